@@ -0,0 +1,256 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+)
+
+type auditCallerKey struct{}
+
+// WithAuditCaller returns a context identifying the caller of the bucket operations in the events of AuditBucket.
+func WithAuditCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, auditCallerKey{}, caller)
+}
+
+// AuditCallerFromContext returns the caller set with WithAuditCaller, or an empty string.
+func AuditCallerFromContext(ctx context.Context) string {
+	caller, _ := ctx.Value(auditCallerKey{}).(string)
+	return caller
+}
+
+// AuditConfig configures AuditBucket.
+type AuditConfig struct {
+	// ReadSampleRatio is the ratio, between 0 and 1, of the successful read operations logged. Failed reads and all
+	// uploads and deletes are always logged.
+	ReadSampleRatio float64
+	// DetectOverwrites checks whether uploaded objects already exist, to log overwrites, at the cost of an Exists call
+	// per upload. If the check fails, the overwrite is logged as unknown and the upload proceeds.
+	DetectOverwrites bool
+	// Caller returns the identity of the caller from the context of the operations. Defaults to
+	// AuditCallerFromContext.
+	Caller func(ctx context.Context) string
+}
+
+// DefaultAuditConfig logs 1% of the successful reads and detects overwrites.
+var DefaultAuditConfig = AuditConfig{ReadSampleRatio: 0.01, DetectOverwrites: true}
+
+// Keys of the audit events. They are distinct from the labels of the bucket metrics, so that events and metrics can be
+// ingested by the same pipelines.
+const (
+	auditOpKey         = "audit_op"
+	auditObjectKey     = "object"
+	auditSizeKey       = "size_bytes"
+	auditDurationKey   = "duration_seconds"
+	auditResultKey     = "result"
+	auditErrorClassKey = "error_class"
+	auditErrorKey      = "err"
+	auditCallerKeyName = "caller_id"
+	auditStoreKey      = "store"
+	auditOffsetKey     = "offset"
+	auditLengthKey     = "length"
+	auditExistsKey     = "exists"
+	auditOverwriteKey  = "overwrite"
+)
+
+// AuditBucket is a Bucket emitting a structured event per operation, with the operation, the object name or listed
+// directory, the size when known, the duration, the result and the class of the error, and the identity of the
+// caller taken from the context. Uploads and deletes are always logged, reads are sampled.
+//
+// Events are written to a go-kit logger, at info level for successful operations and warn level for failures, or to
+// a slog.Handler with the same levels.
+type AuditBucket struct {
+	bkt    Bucket
+	cfg    AuditConfig
+	emit   func(ctx context.Context, failed bool, keyvals []any)
+	sample func() float64
+}
+
+// NewAuditBucket returns an AuditBucket writing the events to logger.
+func NewAuditBucket(bkt Bucket, logger log.Logger, cfg AuditConfig) *AuditBucket {
+	return newAuditBucket(bkt, cfg, func(_ context.Context, failed bool, keyvals []any) {
+		l := level.Info(logger)
+		if failed {
+			l = level.Warn(logger)
+		}
+		_ = l.Log(append([]any{"msg", "bucket operation"}, keyvals...)...)
+	})
+}
+
+// NewSlogAuditBucket returns an AuditBucket writing the events to handler.
+func NewSlogAuditBucket(bkt Bucket, handler slog.Handler, cfg AuditConfig) *AuditBucket {
+	return newAuditBucket(bkt, cfg, func(ctx context.Context, failed bool, keyvals []any) {
+		lvl := slog.LevelInfo
+		if failed {
+			lvl = slog.LevelWarn
+		}
+		if !handler.Enabled(ctx, lvl) {
+			return
+		}
+		record := slog.NewRecord(time.Now(), lvl, "bucket operation", 0)
+		record.Add(keyvals...)
+		_ = handler.Handle(ctx, record)
+	})
+}
+
+func newAuditBucket(bkt Bucket, cfg AuditConfig, emit func(context.Context, bool, []any)) *AuditBucket {
+	if cfg.Caller == nil {
+		cfg.Caller = AuditCallerFromContext
+	}
+	return &AuditBucket{bkt: bkt, cfg: cfg, emit: emit, sample: rand.Float64}
+}
+
+// errorClass returns the class of err, as classified by the bucket.
+func (b *AuditBucket) errorClass(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case b.bkt.IsObjNotFoundErr(err):
+		return "not_found"
+	case b.bkt.IsAccessDeniedErr(err):
+		return "access_denied"
+	case IsRetryableErr(b.bkt, err):
+		return "retryable"
+	}
+	return "other"
+}
+
+// log emits the event of an operation started at start. Successful reads are only logged if sampled. size is omitted
+// when negative.
+func (b *AuditBucket) log(ctx context.Context, op, name string, start time.Time, size int64, err error, extra ...any) {
+	mutation := op == OpUpload || op == OpDelete
+	if err == nil && !mutation && (b.cfg.ReadSampleRatio <= 0 || b.sample() >= b.cfg.ReadSampleRatio) {
+		return
+	}
+
+	keyvals := []any{
+		auditOpKey, op,
+		auditObjectKey, name,
+		auditStoreKey, b.bkt.Name(),
+		auditCallerKeyName, b.cfg.Caller(ctx),
+		auditDurationKey, time.Since(start).Seconds(),
+	}
+	if size >= 0 {
+		keyvals = append(keyvals, auditSizeKey, size)
+	}
+	keyvals = append(keyvals, extra...)
+	if err != nil {
+		keyvals = append(keyvals, auditResultKey, "error", auditErrorClassKey, b.errorClass(err), auditErrorKey, err.Error())
+	} else {
+		keyvals = append(keyvals, auditResultKey, "success")
+	}
+	b.emit(ctx, err != nil, keyvals)
+}
+
+// readerSize returns the size of rc if known, or -1.
+func readerSize(rc io.Reader) int64 {
+	size, err := TryToGetSize(rc)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (b *AuditBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *AuditBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	start := time.Now()
+	err := b.bkt.Iter(ctx, dir, f, options...)
+	b.log(ctx, OpIter, dir, start, -1, err)
+	return err
+}
+
+func (b *AuditBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	start := time.Now()
+	err := b.bkt.IterWithAttributes(ctx, dir, f, options...)
+	b.log(ctx, OpIter, dir, start, -1, err)
+	return err
+}
+
+func (b *AuditBucket) SupportedIterOptions() []IterOptionType { return b.bkt.SupportedIterOptions() }
+
+func (b *AuditBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := b.bkt.Get(ctx, name)
+	size := int64(-1)
+	if err == nil {
+		size = readerSize(rc)
+	}
+	b.log(ctx, OpGet, name, start, size, err)
+	return rc, err
+}
+
+func (b *AuditBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	size := int64(-1)
+	if err == nil {
+		size = readerSize(rc)
+	}
+	b.log(ctx, OpGetRange, name, start, size, err, auditOffsetKey, off, auditLengthKey, length)
+	return rc, err
+}
+
+func (b *AuditBucket) Exists(ctx context.Context, name string) (bool, error) {
+	start := time.Now()
+	exists, err := b.bkt.Exists(ctx, name)
+	b.log(ctx, OpExists, name, start, -1, err, auditExistsKey, exists)
+	return exists, err
+}
+
+func (b *AuditBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	start := time.Now()
+	attrs, err := b.bkt.Attributes(ctx, name)
+	size := int64(-1)
+	if err == nil {
+		size = attrs.Size
+	}
+	b.log(ctx, OpAttributes, name, start, size, err)
+	return attrs, err
+}
+
+// Upload logs the size of the uploaded object when known upfront from r, and whether it was overwritten with
+// cfg.DetectOverwrites: true, false, or "unknown" if the existence check failed.
+func (b *AuditBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	start := time.Now()
+	var extra []any
+	if b.cfg.DetectOverwrites {
+		var overwrite any = "unknown"
+		if exists, err := b.bkt.Exists(ctx, name); err == nil {
+			overwrite = exists
+		}
+		extra = append(extra, auditOverwriteKey, overwrite)
+	}
+	size := readerSize(r)
+	err := b.bkt.Upload(ctx, name, r, opts...)
+	b.log(ctx, OpUpload, name, start, size, err, extra...)
+	return err
+}
+
+func (b *AuditBucket) Delete(ctx context.Context, name string) error {
+	start := time.Now()
+	err := b.bkt.Delete(ctx, name)
+	b.log(ctx, OpDelete, name, start, -1, err)
+	return err
+}
+
+func (b *AuditBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *AuditBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *AuditBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.bkt, err) }
+
+func (b *AuditBucket) Close() error { return b.bkt.Close() }
+
+func (b *AuditBucket) Name() string { return b.bkt.Name() }
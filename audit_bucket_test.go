@@ -0,0 +1,165 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+)
+
+func TestAuditBucket_AcceptanceTest(t *testing.T) {
+	AcceptanceTest(t, NewAuditBucket(NewInMemBucket(), log.NewNopLogger(), AuditConfig{ReadSampleRatio: 1}))
+}
+
+// auditEvents returns an AuditBucket writing JSON events to slog, and a function returning the events logged so far.
+func auditEvents(t *testing.T, bkt Bucket, cfg AuditConfig) (*AuditBucket, func() []map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	b := NewSlogAuditBucket(bkt, slog.NewJSONHandler(&buf, nil), cfg)
+	return b, func() []map[string]any {
+		var events []map[string]any
+		dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+		for dec.More() {
+			var event map[string]any
+			testutil.Ok(t, dec.Decode(&event))
+			events = append(events, event)
+		}
+		buf.Reset()
+		return events
+	}
+}
+
+func TestAuditBucket_Events(t *testing.T) {
+	ctx := WithAuditCaller(context.Background(), "compactor")
+	b, events := auditEvents(t, NewInMemBucket(), AuditConfig{ReadSampleRatio: 1, DetectOverwrites: true})
+
+	testutil.Ok(t, b.Upload(ctx, "dir/obj", strings.NewReader("content")))
+	testutil.Ok(t, b.Upload(context.Background(), "dir/obj", strings.NewReader("new content")))
+	got := events()
+	testutil.Equals(t, 2, len(got))
+	for i, expected := range []map[string]any{
+		{"level": "INFO", "msg": "bucket operation", "audit_op": "upload", "object": "dir/obj", "store": "inmem", "caller_id": "compactor", "size_bytes": 7.0, "overwrite": false, "result": "success"},
+		{"level": "INFO", "msg": "bucket operation", "audit_op": "upload", "object": "dir/obj", "store": "inmem", "caller_id": "", "size_bytes": 11.0, "overwrite": true, "result": "success"},
+	} {
+		testutil.Assert(t, got[i]["duration_seconds"].(float64) >= 0)
+		delete(got[i], "duration_seconds")
+		delete(got[i], "time")
+		testutil.Equals(t, expected, got[i])
+	}
+
+	testutil.Equals(t, "new content", readObject(t, b, "dir/obj"))
+	rc, err := b.GetRange(ctx, "dir/obj", 4, 3)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	_, err = b.Attributes(ctx, "dir/obj")
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Iter(ctx, "dir", func(string) error { return nil }))
+	got = events()
+	testutil.Equals(t, 4, len(got))
+	testutil.Equals(t, []any{"get", 11.0}, []any{got[0]["audit_op"], got[0]["size_bytes"]})
+	testutil.Equals(t, []any{"get_range", 3.0, 4.0, 3.0}, []any{got[1]["audit_op"], got[1]["size_bytes"], got[1]["offset"], got[1]["length"]})
+	testutil.Equals(t, []any{"attributes", 11.0}, []any{got[2]["audit_op"], got[2]["size_bytes"]})
+	testutil.Equals(t, []any{"iter", "dir", nil}, []any{got[3]["audit_op"], got[3]["object"], got[3]["size_bytes"]})
+
+	// Failures are logged at warn level with the class of the error.
+	_, err = b.Get(ctx, "missing")
+	testutil.NotOk(t, err)
+	testutil.NotOk(t, b.Iter(ctx, "", func(string) error { return errors.New("stop") }))
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	testutil.NotOk(t, b.Iter(canceled, "", func(string) error { return canceled.Err() }))
+	got = events()
+	testutil.Equals(t, 3, len(got))
+	for i, class := range []string{"not_found", "other", "canceled"} {
+		testutil.Equals(t, "WARN", got[i]["level"])
+		testutil.Equals(t, "error", got[i]["result"])
+		testutil.Equals(t, class, got[i]["error_class"])
+		testutil.Assert(t, got[i]["err"] != "")
+	}
+}
+
+func TestAuditBucket_Sampling(t *testing.T) {
+	ctx := context.Background()
+	b, events := auditEvents(t, NewInMemBucket(), AuditConfig{ReadSampleRatio: 0.5})
+	samples := []float64{0.7, 0.2}
+	b.sample = func() float64 {
+		s := samples[0]
+		samples = samples[1:]
+		return s
+	}
+
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader("content")))
+	_, err := b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	_, err = b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	_, err = b.Attributes(ctx, "missing")
+	testutil.NotOk(t, err)
+	testutil.Ok(t, b.Delete(ctx, "obj"))
+
+	// Mutations and failures are always logged, successful reads only when sampled.
+	var ops []any
+	for _, event := range events() {
+		ops = append(ops, event["audit_op"])
+	}
+	testutil.Equals(t, []any{"upload", "exists", "attributes", "delete"}, ops)
+	testutil.Equals(t, 0, len(samples))
+
+	// Reads are never logged without a sample ratio.
+	b, events = auditEvents(t, NewInMemBucket(), AuditConfig{})
+	_, err = b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(events()))
+}
+
+func TestAuditBucket_OverwriteUnknown(t *testing.T) {
+	ctx := context.Background()
+	faults := WithFaults(NewInMemBucket(), FaultRule{Ops: []string{OpExists}, Probability: 1, Err: ErrFaultTransient})
+	b, events := auditEvents(t, faults, DefaultAuditConfig)
+
+	// Uploads proceed when the existence check fails.
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader("content")))
+	testutil.Equals(t, "content", readObject(t, faults, "obj"))
+	got := events()
+	testutil.Equals(t, 1, len(got))
+	testutil.Equals(t, []any{"upload", "unknown", "success"}, []any{got[0]["audit_op"], got[0]["overwrite"], got[0]["result"]})
+}
+
+func TestAuditBucket_GoKitLogger(t *testing.T) {
+	var buf bytes.Buffer
+	b := NewAuditBucket(NewInMemBucket(), log.NewLogfmtLogger(&buf), DefaultAuditConfig)
+	testutil.Ok(t, b.Upload(WithAuditCaller(context.Background(), "ruler"), "obj", strings.NewReader("content")))
+	line := buf.String()
+	for _, field := range []string{"level=info", `msg="bucket operation"`, "audit_op=upload", "object=obj", "store=inmem", "caller_id=ruler", "size_bytes=7", "overwrite=false", "result=success"} {
+		testutil.Assert(t, strings.Contains(line, field), "expected %q in %q", field, line)
+	}
+}
+
+func TestAuditBucket_FieldsDoNotCollideWithMetricLabels(t *testing.T) {
+	ctx := context.Background()
+	b, events := auditEvents(t, NewInMemBucket(), AuditConfig{ReadSampleRatio: 1, DetectOverwrites: true})
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader("content")))
+	rc, err := b.GetRange(ctx, "obj", 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	_, err = b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	_, err = b.Get(ctx, "missing")
+	testutil.NotOk(t, err)
+
+	for _, event := range events() {
+		for _, label := range []string{"operation", "bucket", "backend", "position", "secondary"} {
+			_, ok := event[label]
+			testutil.Assert(t, !ok, "audit event field %q collides with a metric label", label)
+		}
+	}
+}
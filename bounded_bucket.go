@@ -0,0 +1,326 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/atomic"
+)
+
+// ErrIdleReadTimeout is returned by the readers of BoundedBucket when no data was received for longer than
+// BoundedConfig.IdleReadTimeout.
+var ErrIdleReadTimeout = errors.New("idle read timeout")
+
+// BoundedConfig configures BoundedBucket.
+type BoundedConfig struct {
+	// Timeouts are the deadlines of the given operations (OpGet, OpUpload...). For Get and GetRange, the deadline
+	// covers reading the object until the reader is closed. For Iter, it covers the callbacks.
+	Timeouts map[string]time.Duration
+	// IdleReadTimeout fails reads of the objects returned by Get and GetRange when no data is received for that long.
+	// 0 means no timeout.
+	IdleReadTimeout time.Duration
+	// UploadMinThroughput, in bytes per second, extends the upload timeout by the time needed to upload the object at
+	// this throughput, when its size is known. It has no effect without an upload timeout. 0 means the upload timeout
+	// does not depend on the size.
+	UploadMinThroughput int64
+	// MaxInFlight caps the number of concurrent calls of the given operations. Extra calls wait for a slot, until
+	// their context is done. Get and GetRange calls hold their slot until the reader is closed.
+	MaxInFlight map[string]int
+}
+
+// BoundedBucket is a Bucket wrapper bounding the duration and the concurrency of the operations, so that callers
+// don't need to set deadlines on every call and a stuck provider can't pile up requests.
+//
+// Timeouts rely on the wrapped bucket honouring the context, which all the providers do.
+type BoundedBucket struct {
+	bkt  Bucket
+	cfg  BoundedConfig
+	sems map[string]chan struct{}
+
+	inFlight      *prometheus.GaugeVec
+	queued        *prometheus.GaugeVec
+	queueDuration *prometheus.HistogramVec
+	timeouts      *prometheus.CounterVec
+}
+
+// NewBoundedBucket returns a BoundedBucket wrapping bkt.
+func NewBoundedBucket(bkt Bucket, cfg BoundedConfig, reg prometheus.Registerer) *BoundedBucket {
+	b := &BoundedBucket{
+		bkt:  bkt,
+		cfg:  cfg,
+		sems: map[string]chan struct{}{},
+
+		inFlight: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "objstore_bucket_operations_in_flight",
+			Help: "Number of bucket operations in flight, including the Get and GetRange readers not closed yet.",
+		}, []string{"operation"}),
+		queued: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "objstore_bucket_operations_queued",
+			Help: "Number of bucket operations waiting for a concurrency slot.",
+		}, []string{"operation"}),
+		queueDuration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "objstore_bucket_operation_queue_duration_seconds",
+			Help:    "Time spent by bucket operations waiting for a concurrency slot.",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60},
+		}, []string{"operation"}),
+		timeouts: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_operation_timeouts_total",
+			Help: "Total number of bucket operations which exceeded their timeout, including idle read timeouts.",
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{OpIter, OpGet, OpGetRange, OpExists, OpUpload, OpDelete, OpAttributes} {
+		if n := cfg.MaxInFlight[op]; n > 0 {
+			b.sems[op] = make(chan struct{}, n)
+		}
+		b.inFlight.WithLabelValues(op)
+		b.queued.WithLabelValues(op)
+		b.queueDuration.WithLabelValues(op)
+		b.timeouts.WithLabelValues(op)
+	}
+	return b
+}
+
+// call is a bounded operation. done must be called once the operation is over.
+type call struct {
+	b      *BoundedBucket
+	op     string
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// start waits for a concurrency slot and returns the call, whose context has the timeout of the operation.
+func (b *BoundedBucket) start(ctx context.Context, op string, timeout time.Duration) (*call, error) {
+	if sem := b.sems[op]; sem != nil {
+		select {
+		case sem <- struct{}{}:
+		default:
+			b.queued.WithLabelValues(op).Inc()
+			start := time.Now()
+			select {
+			case sem <- struct{}{}:
+				b.queued.WithLabelValues(op).Dec()
+				b.queueDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+			case <-ctx.Done():
+				b.queued.WithLabelValues(op).Dec()
+				return nil, errors.Wrapf(ctx.Err(), "wait for %s concurrency slot", op)
+			}
+		}
+	}
+	b.inFlight.WithLabelValues(op).Inc()
+
+	c := &call{b: b, op: op, parent: ctx}
+	if timeout > 0 {
+		c.ctx, c.cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		c.ctx, c.cancel = context.WithCancel(ctx)
+	}
+	return c, nil
+}
+
+// done releases the call, counting err as a timeout if it happened because of the deadline of the call.
+func (c *call) done(err error) {
+	c.once.Do(func() {
+		if err != nil && errors.Is(c.ctx.Err(), context.DeadlineExceeded) && c.parent.Err() == nil {
+			c.b.timeouts.WithLabelValues(c.op).Inc()
+		}
+		c.cancel()
+		c.b.inFlight.WithLabelValues(c.op).Dec()
+		if sem := c.b.sems[c.op]; sem != nil {
+			<-sem
+		}
+	})
+}
+
+// boundedReader releases the call when closed, and fails reads waiting for data for longer than idle.
+type boundedReader struct {
+	io.ReadCloser
+	c *call
+
+	idle    time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+	err     error
+}
+
+func newBoundedReader(rc io.ReadCloser, c *call, idle time.Duration) *boundedReader {
+	r := &boundedReader{ReadCloser: rc, c: c, idle: idle}
+	if idle > 0 {
+		r.timer = time.AfterFunc(idle, func() {
+			r.expired.Store(true)
+			c.cancel()
+		})
+		r.timer.Stop()
+	}
+	return r
+}
+
+func (r *boundedReader) Read(p []byte) (int, error) {
+	if r.timer == nil {
+		n, err := r.ReadCloser.Read(p)
+		if err != nil && err != io.EOF {
+			r.err = err
+		}
+		return n, err
+	}
+	if r.expired.Load() {
+		return 0, errors.Wrapf(ErrIdleReadTimeout, "no data received for %v", r.idle)
+	}
+
+	r.timer.Reset(r.idle)
+	n, err := r.ReadCloser.Read(p)
+	r.timer.Stop()
+	// The context is canceled once the timer fired, even if this read eventually returned data.
+	if r.expired.Load() {
+		r.c.b.timeouts.WithLabelValues(r.c.op).Inc()
+		return n, errors.Wrapf(ErrIdleReadTimeout, "no data received for %v", r.idle)
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *boundedReader) Close() error {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	err := r.ReadCloser.Close()
+	// Idle timeouts were already counted.
+	if r.expired.Load() {
+		r.c.done(nil)
+	} else {
+		r.c.done(r.err)
+	}
+	return err
+}
+
+func (r *boundedReader) ObjectSize() (int64, error) { return TryToGetSize(r.ReadCloser) }
+
+func (b *BoundedBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *BoundedBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	c, err := b.start(ctx, OpIter, b.cfg.Timeouts[OpIter])
+	if err != nil {
+		return err
+	}
+	err = b.bkt.Iter(c.ctx, dir, f, options...)
+	c.done(err)
+	return err
+}
+
+func (b *BoundedBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	c, err := b.start(ctx, OpIter, b.cfg.Timeouts[OpIter])
+	if err != nil {
+		return err
+	}
+	err = b.bkt.IterWithAttributes(c.ctx, dir, f, options...)
+	c.done(err)
+	return err
+}
+
+func (b *BoundedBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *BoundedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	c, err := b.start(ctx, OpGet, b.cfg.Timeouts[OpGet])
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(c.ctx, name)
+	if err != nil {
+		c.done(err)
+		return nil, err
+	}
+	return newBoundedReader(rc, c, b.cfg.IdleReadTimeout), nil
+}
+
+func (b *BoundedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	c, err := b.start(ctx, OpGetRange, b.cfg.Timeouts[OpGetRange])
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(c.ctx, name, off, length)
+	if err != nil {
+		c.done(err)
+		return nil, err
+	}
+	return newBoundedReader(rc, c, b.cfg.IdleReadTimeout), nil
+}
+
+func (b *BoundedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	c, err := b.start(ctx, OpExists, b.cfg.Timeouts[OpExists])
+	if err != nil {
+		return false, err
+	}
+	exists, err := b.bkt.Exists(c.ctx, name)
+	c.done(err)
+	return exists, err
+}
+
+func (b *BoundedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	c, err := b.start(ctx, OpAttributes, b.cfg.Timeouts[OpAttributes])
+	if err != nil {
+		return ObjectAttributes{}, err
+	}
+	attrs, err := b.bkt.Attributes(c.ctx, name)
+	c.done(err)
+	return attrs, err
+}
+
+// uploadTimeout returns the timeout of uploading r, extended according to its size. Uploads without a configured
+// timeout stay unbounded.
+func (b *BoundedBucket) uploadTimeout(r io.Reader) time.Duration {
+	timeout := b.cfg.Timeouts[OpUpload]
+	if timeout <= 0 || b.cfg.UploadMinThroughput <= 0 {
+		return timeout
+	}
+	size, err := TryToGetSize(r)
+	if err != nil || size <= 0 {
+		return timeout
+	}
+	return timeout + time.Duration(float64(size)/float64(b.cfg.UploadMinThroughput)*float64(time.Second))
+}
+
+func (b *BoundedBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	c, err := b.start(ctx, OpUpload, b.uploadTimeout(r))
+	if err != nil {
+		return err
+	}
+	err = b.bkt.Upload(c.ctx, name, r, opts...)
+	c.done(err)
+	return err
+}
+
+func (b *BoundedBucket) Delete(ctx context.Context, name string) error {
+	c, err := b.start(ctx, OpDelete, b.cfg.Timeouts[OpDelete])
+	if err != nil {
+		return err
+	}
+	err = b.bkt.Delete(c.ctx, name)
+	c.done(err)
+	return err
+}
+
+func (b *BoundedBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *BoundedBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+// IsRetryableErr returns true for idle read timeouts, on top of the errors retryable for the wrapped bucket.
+func (b *BoundedBucket) IsRetryableErr(err error) bool {
+	return errors.Is(err, ErrIdleReadTimeout) || IsRetryableErr(b.bkt, err)
+}
+
+func (b *BoundedBucket) Close() error { return b.bkt.Close() }
+
+func (b *BoundedBucket) Name() string { return b.bkt.Name() }
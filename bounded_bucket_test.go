@@ -0,0 +1,134 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBoundedBucket_AcceptanceTest(t *testing.T) {
+	AcceptanceTest(t, NewBoundedBucket(NewInMemBucket(), BoundedConfig{
+		Timeouts:            map[string]time.Duration{OpGet: time.Minute, OpUpload: time.Minute},
+		IdleReadTimeout:     time.Minute,
+		UploadMinThroughput: 1 << 20,
+		MaxInFlight:         map[string]int{OpGet: 2, OpIter: 1},
+	}, nil))
+}
+
+func TestBoundedBucket_Timeouts(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("content")))
+
+	faults := WithFaults(inmem)
+	b := NewBoundedBucket(faults, BoundedConfig{
+		Timeouts:        map[string]time.Duration{OpExists: 20 * time.Millisecond},
+		IdleReadTimeout: 20 * time.Millisecond,
+	}, nil)
+
+	faults.SetRules(FaultRule{Ops: []string{OpExists}, Probability: 1, Latency: FixedLatency(time.Minute)})
+	_, err := b.Exists(ctx, "obj")
+	testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.timeouts.WithLabelValues(OpExists)))
+
+	// Deadlines of the caller are not counted.
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	_, err = b.Exists(cctx, "obj")
+	testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.timeouts.WithLabelValues(OpExists)))
+
+	// Other operations have no timeout.
+	faults.SetRules(FaultRule{Ops: []string{OpAttributes}, Probability: 1, Latency: FixedLatency(50 * time.Millisecond)})
+	_, err = b.Attributes(ctx, "obj")
+	testutil.Ok(t, err)
+
+	// Reads stalling for longer than the idle timeout fail.
+	faults.SetRules(FaultRule{Ops: []string{OpGetRange}, OnCall: 1, ReadDelay: 100 * time.Millisecond})
+	rc, err := b.GetRange(ctx, "obj", 0, 3)
+	testutil.Ok(t, err)
+	_, err = io.ReadAll(rc)
+	testutil.Assert(t, errors.Is(err, ErrIdleReadTimeout), "expected idle read timeout, got %v", err)
+	testutil.Assert(t, b.IsRetryableErr(err), "expected idle read timeout to be retryable")
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.timeouts.WithLabelValues(OpGetRange)))
+
+	// Slow consumers are not.
+	rc, err = b.GetRange(ctx, "obj", 0, 3)
+	testutil.Ok(t, err)
+	buf := make([]byte, 1)
+	var got []byte
+	for {
+		n, err := rc.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		testutil.Ok(t, err)
+		time.Sleep(30 * time.Millisecond)
+	}
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "con", string(got))
+}
+
+func TestBoundedBucket_UploadTimeout(t *testing.T) {
+	b := NewBoundedBucket(NewInMemBucket(), BoundedConfig{
+		Timeouts:            map[string]time.Duration{OpUpload: time.Second},
+		UploadMinThroughput: 1 << 20,
+	}, nil)
+	testutil.Equals(t, 3*time.Second, b.uploadTimeout(bytes.NewReader(make([]byte, 2<<20))))
+	// The size of generic readers is unknown.
+	testutil.Equals(t, time.Second, b.uploadTimeout(io.MultiReader(bytes.NewReader(make([]byte, 2<<20)))))
+
+	// Uploads without a timeout are not bounded by their size.
+	b = NewBoundedBucket(NewInMemBucket(), BoundedConfig{UploadMinThroughput: 1 << 20}, nil)
+	testutil.Equals(t, time.Duration(0), b.uploadTimeout(bytes.NewReader(make([]byte, 2<<20))))
+}
+
+func TestBoundedBucket_MaxInFlight(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("content")))
+	b := NewBoundedBucket(inmem, BoundedConfig{MaxInFlight: map[string]int{OpGet: 1}}, nil)
+
+	// The slot is held until the reader is closed.
+	rc, err := b.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.inFlight.WithLabelValues(OpGet)))
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = b.Get(cctx, "obj")
+	testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+
+	done := make(chan error)
+	go func() {
+		rc, err := b.Get(ctx, "obj")
+		if err == nil {
+			err = rc.Close()
+		}
+		done <- err
+	}()
+	for promtest.ToFloat64(b.queued.WithLabelValues(OpGet)) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Other operations are not limited.
+	_, err = b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, rc.Close())
+	testutil.Ok(t, <-done)
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.inFlight.WithLabelValues(OpGet)))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.queued.WithLabelValues(OpGet)))
+}
@@ -0,0 +1,100 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// Cache is a key value store used as cache backend by CachingBucket.
+// Caches are best effort: failures are logged and reported as misses, never returned to the caller.
+type Cache interface {
+	// Store stores the values. A zero ttl means the items only expire by eviction.
+	Store(ctx context.Context, data map[string][]byte, ttl time.Duration)
+	// Fetch returns the values of the keys found in the cache.
+	Fetch(ctx context.Context, keys []string) map[string][]byte
+	// Delete removes the keys from the cache.
+	Delete(ctx context.Context, keys []string)
+}
+
+// NewInMemoryCache returns a Cache storing up to maxSize bytes in memory, evicting the least recently used items first.
+func NewInMemoryCache(maxSize int64) Cache {
+	return newLRUCache(maxSize)
+}
+
+// CacheProvider is the type of a cache backend.
+type CacheProvider string
+
+const (
+	INMEMORY  CacheProvider = "IN-MEMORY"
+	MEMCACHED CacheProvider = "MEMCACHED"
+	REDIS     CacheProvider = "REDIS"
+)
+
+// CacheConfig is the YAML configuration of a cache backend.
+type CacheConfig struct {
+	Type   CacheProvider `yaml:"type"`
+	Config interface{}   `yaml:"config"`
+}
+
+// InMemoryCacheConfig configures the in-memory cache backend.
+type InMemoryCacheConfig struct {
+	MaxSize int64 `yaml:"max_size"`
+}
+
+// NewCache initializes a cache backend from its YAML configuration.
+func NewCache(logger log.Logger, confContentYaml []byte, reg prometheus.Registerer) (Cache, error) {
+	cacheConf := &CacheConfig{}
+	if err := yaml.UnmarshalStrict(confContentYaml, cacheConf); err != nil {
+		return nil, errors.Wrap(err, "parsing config YAML file")
+	}
+	return NewCacheFromConfig(logger, cacheConf, reg)
+}
+
+// NewCacheFromConfig initializes a cache backend from an existing CacheConfig.
+func NewCacheFromConfig(logger log.Logger, cacheConf *CacheConfig, reg prometheus.Registerer) (Cache, error) {
+	config, err := yaml.Marshal(cacheConf.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal content of cache configuration")
+	}
+
+	var c Cache
+	switch strings.ToUpper(string(cacheConf.Type)) {
+	case string(INMEMORY):
+		var conf InMemoryCacheConfig
+		if err = yaml.UnmarshalStrict(config, &conf); err != nil {
+			break
+		}
+		if conf.MaxSize <= 0 {
+			err = errors.New("cache max size must be positive")
+			break
+		}
+		c = NewInMemoryCache(conf.MaxSize)
+	case string(MEMCACHED):
+		conf := DefaultMemcachedConfig
+		if err = yaml.UnmarshalStrict(config, &conf); err != nil {
+			break
+		}
+		c, err = NewMemcachedCache(logger, conf, reg)
+	case string(REDIS):
+		conf := DefaultRedisConfig
+		if err = yaml.UnmarshalStrict(config, &conf); err != nil {
+			break
+		}
+		c, err = NewRedisCache(logger, conf, reg)
+	default:
+		return nil, errors.Errorf("cache with type %s is not supported", cacheConf.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %s cache", cacheConf.Type)
+	}
+	return c, nil
+}
@@ -0,0 +1,423 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/objstore"
+)
+
+// defaultMaxItemSize is the default maximum size of an item stored in a custom cache.
+const defaultMaxItemSize = 16 << 20
+
+// KeyFunc returns the cache key of an operation on the named object.
+// It allows sharing cache entries between names, e.g. by stripping a tenant prefix, or shortening long names.
+type KeyFunc func(op, name string) string
+
+// DefaultKey is the KeyFunc used when a rule does not set any.
+func DefaultKey(op, name string) string {
+	return op + ":" + name
+}
+
+// Rule selects the operations and objects cached by CachingBucket.
+type Rule struct {
+	// Ops is the list of cached operations, among OpGet, OpGetRange, OpAttributes and OpExists. Empty matches all of them.
+	Ops []string
+	// NamePattern is a path.Match pattern matched against the object name. Empty matches all names.
+	NamePattern string
+	// TTL of the cached entries. 0 means entries only expire by eviction.
+	TTL time.Duration
+	// Key builds the cache key. Defaults to DefaultKey.
+	Key KeyFunc
+}
+
+// Config configures CachingBucket.
+type Config struct {
+	// Cache is the cache backend. Defaults to an in-memory cache of MaxSize bytes.
+	Cache Cache
+	// MaxSize is the maximum size in bytes of the default in-memory cache.
+	MaxSize int64
+	// MaxItemSize is the maximum size in bytes of a single cached item. Bigger objects are not cached by Get.
+	// Defaults to MaxSize with the in-memory cache, and to 16MiB otherwise.
+	MaxItemSize int64
+	// SubrangeSize is the size of the aligned subranges GetRange results are cached as.
+	SubrangeSize int64
+	// Rules select the cached operations and objects, the first matching rule applies.
+	// Operations without a matching rule go straight to the wrapped bucket.
+	Rules []Rule
+}
+
+func (c *Config) validate() error {
+	if c.Cache == nil {
+		if c.MaxSize <= 0 {
+			return errors.New("cache max size must be positive")
+		}
+		if c.MaxItemSize <= 0 || c.MaxItemSize > c.MaxSize {
+			c.MaxItemSize = c.MaxSize
+		}
+	} else if c.MaxItemSize <= 0 {
+		c.MaxItemSize = defaultMaxItemSize
+	}
+	for _, r := range c.Rules {
+		if slices.Contains(r.Ops, objstore.OpGetRange) || len(r.Ops) == 0 {
+			if c.SubrangeSize <= 0 {
+				return errors.New("subrange size must be positive to cache GetRange")
+			}
+		}
+		if _, err := path.Match(r.NamePattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid name pattern %q", r.NamePattern)
+		}
+	}
+	return nil
+}
+
+// CachingBucket is a Bucket wrapper caching the results of Get, GetRange, Attributes and Exists, in memory or in
+// a remote cache.
+// Uploads and deletions made through the wrapper invalidate the cached entries of the object.
+// GetRange results are cached as aligned subranges of the object, keyed by its version: its ETag if known by the
+// provider, and otherwise its last modified time and size, along with a generation bumped by uploads and deletions
+// through the wrapper, as the last modified time of most providers is only precise to the second.
+type CachingBucket struct {
+	objstore.Bucket
+
+	cfg   Config
+	cache Cache
+
+	requests *prometheus.CounterVec
+	hits     *prometheus.CounterVec
+	misses   *prometheus.CounterVec
+}
+
+// NewCachingBucket returns a CachingBucket wrapping bkt.
+func NewCachingBucket(bkt objstore.Bucket, cfg Config, reg prometheus.Registerer) (*CachingBucket, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	cache := cfg.Cache
+	if cache == nil {
+		cache = NewInMemoryCache(cfg.MaxSize)
+	}
+	cb := &CachingBucket{
+		Bucket: bkt,
+		cfg:    cfg,
+		cache:  cache,
+
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_cache_requests_total",
+			Help: "Total number of cache lookups by the caching bucket, per operation. GetRange counts one lookup per subrange.",
+		}, []string{"operation"}),
+		hits: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_cache_hits_total",
+			Help: "Total number of cache lookups served from the cache, per operation.",
+		}, []string{"operation"}),
+		misses: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_cache_misses_total",
+			Help: "Total number of cache lookups forwarded to the bucket, per operation.",
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{objstore.OpGet, objstore.OpGetRange, objstore.OpAttributes, objstore.OpExists} {
+		cb.requests.WithLabelValues(op)
+		cb.hits.WithLabelValues(op)
+		cb.misses.WithLabelValues(op)
+	}
+	return cb, nil
+}
+
+// rule returns the first rule matching the operation on the object.
+func (cb *CachingBucket) rule(op, name string) (Rule, bool) {
+	for _, r := range cb.cfg.Rules {
+		if len(r.Ops) > 0 && !slices.Contains(r.Ops, op) {
+			continue
+		}
+		if r.NamePattern != "" {
+			if ok, _ := path.Match(r.NamePattern, name); !ok {
+				continue
+			}
+		}
+		if r.Key == nil {
+			r.Key = DefaultKey
+		}
+		return r, true
+	}
+	return Rule{}, false
+}
+
+func (cb *CachingBucket) fetch(ctx context.Context, op string, keys []string) map[string][]byte {
+	found := cb.cache.Fetch(ctx, keys)
+	cb.requests.WithLabelValues(op).Add(float64(len(keys)))
+	cb.hits.WithLabelValues(op).Add(float64(len(found)))
+	cb.misses.WithLabelValues(op).Add(float64(len(keys) - len(found)))
+	return found
+}
+
+func (cb *CachingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	r, ok := cb.rule(objstore.OpExists, name)
+	if !ok {
+		return cb.Bucket.Exists(ctx, name)
+	}
+
+	key := r.Key(objstore.OpExists, name)
+	if v, ok := cb.fetch(ctx, objstore.OpExists, []string{key})[key]; ok && len(v) == 1 {
+		return v[0] == 1, nil
+	}
+
+	exists, err := cb.Bucket.Exists(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	v := byte(0)
+	if exists {
+		v = 1
+	}
+	cb.cache.Store(ctx, map[string][]byte{key: {v}}, r.TTL)
+	return exists, nil
+}
+
+func (cb *CachingBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	r, ok := cb.rule(objstore.OpAttributes, name)
+	if !ok {
+		return cb.Bucket.Attributes(ctx, name)
+	}
+
+	key := r.Key(objstore.OpAttributes, name)
+	if v, ok := cb.fetch(ctx, objstore.OpAttributes, []string{key})[key]; ok {
+		var attrs objstore.ObjectAttributes
+		if err := json.Unmarshal(v, &attrs); err == nil {
+			return attrs, nil
+		}
+	}
+
+	attrs, err := cb.Bucket.Attributes(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+	if v, err := json.Marshal(attrs); err == nil {
+		cb.cache.Store(ctx, map[string][]byte{key: v}, r.TTL)
+	}
+	return attrs, nil
+}
+
+func (cb *CachingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, ok := cb.rule(objstore.OpGet, name)
+	if !ok {
+		return cb.Bucket.Get(ctx, name)
+	}
+
+	key := r.Key(objstore.OpGet, name)
+	if v, ok := cb.fetch(ctx, objstore.OpGet, []string{key})[key]; ok {
+		return objstore.NopCloserWithSize(bytes.NewReader(v)), nil
+	}
+
+	rc, err := cb.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if size, err := objstore.TryToGetSize(rc); err == nil && size > cb.cfg.MaxItemSize {
+		return rc, nil
+	}
+	return &storingReader{ReadCloser: rc, limit: cb.cfg.MaxItemSize, store: func(v []byte) {
+		cb.cache.Store(ctx, map[string][]byte{key: v}, r.TTL)
+	}}, nil
+}
+
+// storingReader stores the content of the wrapped reader once it has been fully read.
+type storingReader struct {
+	io.ReadCloser
+
+	limit int64
+	buf   bytes.Buffer
+	skip  bool
+	store func([]byte)
+}
+
+func (r *storingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.skip {
+		if int64(r.buf.Len()+n) > r.limit {
+			r.skip = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !r.skip {
+		r.skip = true
+		r.store(r.buf.Bytes())
+	}
+	return n, err
+}
+
+func (r *storingReader) ObjectSize() (int64, error) {
+	return objstore.TryToGetSize(r.ReadCloser)
+}
+
+func (cb *CachingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	r, ok := cb.rule(objstore.OpGetRange, name)
+	if !ok || off < 0 || (length <= 0 && length != -1) {
+		return cb.Bucket.GetRange(ctx, name, off, length)
+	}
+
+	// Subranges are keyed by the object version, which is resolved through the (cached) attributes.
+	attrs, err := cb.Attributes(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	end := attrs.Size
+	if length != -1 && off+length < end {
+		end = off + length
+	}
+	if off >= end {
+		return objstore.NopCloserWithSize(bytes.NewReader(nil)), nil
+	}
+
+	data, err := cb.fetchSubranges(ctx, r, name, attrs, off, end)
+	if err != nil {
+		return nil, err
+	}
+	return objstore.NopCloserWithSize(bytes.NewReader(data)), nil
+}
+
+// fetchSubranges returns the object bytes in [off, end), reading the subranges missing from the cache from the bucket.
+func (cb *CachingBucket) fetchSubranges(ctx context.Context, r Rule, name string, attrs objstore.ObjectAttributes, off, end int64) ([]byte, error) {
+	sub := cb.cfg.SubrangeSize
+	first := off / sub * sub
+
+	var starts []int64
+	keys := map[int64]string{}
+	var allKeys []string
+	version := cb.version(ctx, r, name, attrs)
+	for start := first; start < end; start += sub {
+		k := fmt.Sprintf("%s:%s:%d", r.Key(objstore.OpGetRange, name), version, start)
+		starts = append(starts, start)
+		keys[start] = k
+		allKeys = append(allKeys, k)
+	}
+	subrangeLen := func(start int64) int64 { return min(sub, attrs.Size-start) }
+
+	found := cb.fetch(ctx, objstore.OpGetRange, allKeys)
+	for start, k := range keys {
+		if v, ok := found[k]; ok && int64(len(v)) != subrangeLen(start) {
+			// Corrupted or stale entry, refetch it.
+			delete(found, k)
+		}
+	}
+
+	// Fetch contiguous missing subranges with a single request.
+	toStore := map[string][]byte{}
+	for i := 0; i < len(starts); {
+		if _, ok := found[keys[starts[i]]]; ok {
+			i++
+			continue
+		}
+		j := i
+		for j+1 < len(starts) {
+			if _, ok := found[keys[starts[j+1]]]; ok {
+				break
+			}
+			j++
+		}
+
+		from, to := starts[i], starts[j]+subrangeLen(starts[j])
+		data, err := cb.readRange(ctx, name, from, to-from)
+		if err != nil {
+			return nil, err
+		}
+		for _, start := range starts[i : j+1] {
+			lo, hi := start-from, start-from+subrangeLen(start)
+			if hi > int64(len(data)) {
+				return nil, errors.Errorf("get range %s: got %d bytes, expected at least %d", name, len(data), hi)
+			}
+			found[keys[start]] = data[lo:hi]
+			toStore[keys[start]] = data[lo:hi]
+		}
+		i = j + 1
+	}
+	if len(toStore) > 0 {
+		cb.cache.Store(ctx, toStore, r.TTL)
+	}
+
+	out := make([]byte, 0, end-first)
+	for _, start := range starts {
+		out = append(out, found[keys[start]]...)
+	}
+	return out[off-first : end-first], nil
+}
+
+// generationKey is the key of the generation of the object, bumped by uploads and deletions through the wrapper.
+func generationKey(r Rule, name string) string {
+	return r.Key(objstore.OpGetRange, name) + ":generation"
+}
+
+// version returns the version of the object the subranges are keyed by.
+func (cb *CachingBucket) version(ctx context.Context, r Rule, name string, attrs objstore.ObjectAttributes) string {
+	version := objstore.ObjectVersion(attrs)
+	if attrs.ETag != "" {
+		return version
+	}
+	key := generationKey(r, name)
+	if gen, ok := cb.cache.Fetch(ctx, []string{key})[key]; ok {
+		version += "-" + string(gen)
+	}
+	return version
+}
+
+func (cb *CachingBucket) readRange(ctx context.Context, name string, off, length int64) (_ []byte, err error) {
+	rc, err := cb.Bucket.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	defer errcapture.Do(&err, rc.Close, "close range reader")
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read range %s", name)
+	}
+	return data, nil
+}
+
+// Upload uploads the object and invalidates its cached entries.
+func (cb *CachingBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...objstore.ObjectUploadOption) error {
+	defer cb.invalidate(ctx, name)
+	return cb.Bucket.Upload(ctx, name, r, opts...)
+}
+
+// Delete deletes the object and invalidates its cached entries.
+func (cb *CachingBucket) Delete(ctx context.Context, name string) error {
+	defer cb.invalidate(ctx, name)
+	return cb.Bucket.Delete(ctx, name)
+}
+
+// invalidate removes the cached entries of the object, and bumps its generation so that its GetRange subranges become
+// unreachable even if the new version has the same last modified time and size.
+func (cb *CachingBucket) invalidate(ctx context.Context, name string) {
+	var keys []string
+	for _, op := range []string{objstore.OpGet, objstore.OpAttributes, objstore.OpExists} {
+		if r, ok := cb.rule(op, name); ok {
+			keys = append(keys, r.Key(op, name))
+		}
+	}
+	if len(keys) > 0 {
+		cb.cache.Delete(ctx, keys)
+	}
+	if r, ok := cb.rule(objstore.OpGetRange, name); ok {
+		gen := strconv.FormatInt(time.Now().UnixNano(), 36)
+		cb.cache.Store(ctx, map[string][]byte{generationKey(r, name): []byte(gen)}, 0)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/objstore"
+)
+
+// newTestBucket returns an in-memory bucket counting the operations reaching it.
+func newTestBucket(t *testing.T) (*objstore.InMemBucket, objstore.Bucket, func(op string) int) {
+	t.Helper()
+	inmem := objstore.NewInMemBucket()
+	reg := prometheus.NewRegistry()
+	bkt := objstore.WrapWithMetrics(inmem, reg, "test")
+	calls := func(op string) int {
+		mfs, err := reg.Gather()
+		testutil.Ok(t, err)
+		for _, mf := range mfs {
+			if mf.GetName() != "objstore_bucket_operations_total" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "operation" && l.GetValue() == op {
+						return int(m.GetCounter().GetValue())
+					}
+				}
+			}
+		}
+		return 0
+	}
+	return inmem, bkt, calls
+}
+
+func readAll(t *testing.T, rc io.ReadCloser, err error) string {
+	t.Helper()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, rc.Close()) }()
+	b, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	return string(b)
+}
+
+func TestCachingBucket_AcceptanceTest(t *testing.T) {
+	cb, err := NewCachingBucket(objstore.NewInMemBucket(), Config{MaxSize: 1 << 20, SubrangeSize: 4, Rules: []Rule{{}}}, nil)
+	testutil.Ok(t, err)
+	objstore.AcceptanceTest(t, cb)
+}
+
+func TestCachingBucket_GetAttributesExists(t *testing.T) {
+	ctx := context.Background()
+	_, bkt, calls := newTestBucket(t)
+	testutil.Ok(t, bkt.Upload(ctx, "dir/index", strings.NewReader("index-content")))
+	testutil.Ok(t, bkt.Upload(ctx, "dir/meta.json", strings.NewReader("{}")))
+
+	reg := prometheus.NewRegistry()
+	cb, err := NewCachingBucket(bkt, Config{
+		MaxSize: 1024,
+		Rules: []Rule{
+			{Ops: []string{objstore.OpGet, objstore.OpAttributes}, NamePattern: "*/index"},
+			{Ops: []string{objstore.OpExists}, TTL: time.Minute},
+		},
+	}, reg)
+	testutil.Ok(t, err)
+
+	for i := 0; i < 3; i++ {
+		rc, err := cb.Get(ctx, "dir/index")
+		testutil.Equals(t, "index-content", readAll(t, rc, err))
+
+		attrs, err := cb.Attributes(ctx, "dir/index")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(13), attrs.Size)
+
+		ok, err := cb.Exists(ctx, "dir/missing")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "expected missing object")
+
+		// Not matched by any Get rule.
+		rc, err = cb.Get(ctx, "dir/meta.json")
+		testutil.Equals(t, "{}", readAll(t, rc, err))
+	}
+	testutil.Equals(t, 1+3, calls(objstore.OpGet))
+	testutil.Equals(t, 1, calls(objstore.OpAttributes))
+	testutil.Equals(t, 1, calls(objstore.OpExists))
+
+	testutil.Equals(t, 3.0, promtest.ToFloat64(cb.requests.WithLabelValues(objstore.OpGet)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(cb.hits.WithLabelValues(objstore.OpGet)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cb.misses.WithLabelValues(objstore.OpGet)))
+
+	// Uploads through the wrapper invalidate the entries.
+	testutil.Ok(t, cb.Upload(ctx, "dir/index", strings.NewReader("new")))
+	testutil.Ok(t, cb.Upload(ctx, "dir/missing", strings.NewReader("now here")))
+
+	rc, err := cb.Get(ctx, "dir/index")
+	testutil.Equals(t, "new", readAll(t, rc, err))
+	attrs, err := cb.Attributes(ctx, "dir/index")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(3), attrs.Size)
+	ok, err := cb.Exists(ctx, "dir/missing")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist")
+
+	// So do deletions.
+	testutil.Ok(t, cb.Delete(ctx, "dir/index"))
+	_, err = cb.Get(ctx, "dir/index")
+	testutil.Assert(t, cb.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+}
+
+func TestCachingBucket_GetSkipsLargeObjects(t *testing.T) {
+	ctx := context.Background()
+	_, bkt, calls := newTestBucket(t)
+	testutil.Ok(t, bkt.Upload(ctx, "large", bytes.NewReader(make([]byte, 100))))
+
+	cb, err := NewCachingBucket(bkt, Config{MaxSize: 1024, MaxItemSize: 10, Rules: []Rule{{Ops: []string{objstore.OpGet}}}}, nil)
+	testutil.Ok(t, err)
+
+	for i := 0; i < 2; i++ {
+		rc, err := cb.Get(ctx, "large")
+		testutil.Equals(t, 100, len(readAll(t, rc, err)))
+	}
+	testutil.Equals(t, 2, calls(objstore.OpGet))
+}
+
+func TestCachingBucket_GetRangeSubranges(t *testing.T) {
+	ctx := context.Background()
+	_, bkt, calls := newTestBucket(t)
+	content := "0123456789abcdefghijklmnopqrstuvwxyz"
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader(content)))
+
+	cb, err := NewCachingBucket(bkt, Config{
+		MaxSize:      1024,
+		SubrangeSize: 10,
+		Rules:        []Rule{{Ops: []string{objstore.OpGetRange, objstore.OpAttributes}}},
+	}, nil)
+	testutil.Ok(t, err)
+
+	// Fetches subranges [0, 10) and [10, 20) in a single request.
+	rc, err := cb.GetRange(ctx, "obj", 5, 10)
+	testutil.Equals(t, content[5:15], readAll(t, rc, err))
+	testutil.Equals(t, 1, calls(objstore.OpGetRange))
+
+	// Served from the cache.
+	rc, err = cb.GetRange(ctx, "obj", 12, 3)
+	testutil.Equals(t, content[12:15], readAll(t, rc, err))
+	testutil.Equals(t, 1, calls(objstore.OpGetRange))
+
+	// Only the last, partial, subranges are fetched.
+	rc, err = cb.GetRange(ctx, "obj", 8, -1)
+	testutil.Equals(t, content[8:], readAll(t, rc, err))
+	testutil.Equals(t, 2, calls(objstore.OpGetRange))
+
+	rc, err = cb.GetRange(ctx, "obj", 30, 100)
+	testutil.Equals(t, content[30:], readAll(t, rc, err))
+	rc, err = cb.GetRange(ctx, "obj", 100, 10)
+	testutil.Equals(t, "", readAll(t, rc, err))
+	testutil.Equals(t, 2, calls(objstore.OpGetRange))
+	testutil.Equals(t, 1, calls(objstore.OpAttributes))
+
+	// A new version of the object is not served from stale subranges.
+	testutil.Ok(t, cb.Upload(ctx, "obj", strings.NewReader(strings.ToUpper(content))))
+	rc, err = cb.GetRange(ctx, "obj", 12, 3)
+	testutil.Equals(t, strings.ToUpper(content[12:15]), readAll(t, rc, err))
+	testutil.Equals(t, 3, calls(objstore.OpGetRange))
+}
+
+func TestCachingBucket_GetRangeSameSecondOverwrite(t *testing.T) {
+	ctx := context.Background()
+	inmem, bkt, _ := newTestBucket(t)
+	cb, err := NewCachingBucket(bkt, Config{MaxSize: 1024, SubrangeSize: 4, Rules: []Rule{{Ops: []string{objstore.OpGetRange}}}}, nil)
+	testutil.Ok(t, err)
+
+	// The provider only reports the last modified time to the second, and no ETag.
+	lastModified := time.Unix(1000, 0)
+	testutil.Ok(t, cb.Upload(ctx, "obj", strings.NewReader("abcdefgh")))
+	testutil.Ok(t, inmem.ChangeLastModified("obj", lastModified))
+	rc, err := cb.GetRange(ctx, "obj", 2, 4)
+	testutil.Equals(t, "cdef", readAll(t, rc, err))
+
+	testutil.Ok(t, cb.Upload(ctx, "obj", strings.NewReader("ABCDEFGH")))
+	testutil.Ok(t, inmem.ChangeLastModified("obj", lastModified))
+	rc, err = cb.GetRange(ctx, "obj", 2, 4)
+	testutil.Equals(t, "CDEF", readAll(t, rc, err))
+}
+
+func TestCachingBucket_InvalidConfig(t *testing.T) {
+	_, err := NewCachingBucket(objstore.NewInMemBucket(), Config{}, nil)
+	testutil.NotOk(t, err)
+	_, err = NewCachingBucket(objstore.NewInMemBucket(), Config{MaxSize: 10, Rules: []Rule{{Ops: []string{objstore.OpGetRange}}}}, nil)
+	testutil.NotOk(t, err)
+	_, err = NewCachingBucket(objstore.NewInMemBucket(), Config{MaxSize: 10, Rules: []Rule{{Ops: []string{objstore.OpGet}, NamePattern: "["}}}, nil)
+	testutil.NotOk(t, err)
+}
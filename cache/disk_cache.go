@@ -0,0 +1,466 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/thanos-io/objstore"
+)
+
+const (
+	// DefaultChunkSize is the chunk size used by DiskCachingBucket when none is configured.
+	DefaultChunkSize = 1 << 20
+
+	diskTmpDir = ".tmp"
+)
+
+// chunkPath matches the chunk files relative to the cache directory: <object hash prefix>/<object hash>/<version hash>-<offset>.
+var chunkPath = regexp.MustCompile(`^[0-9a-f]{2}/([0-9a-f]{64})/([0-9a-f]{16})-([0-9]+)$`)
+
+// DiskConfig configures DiskCachingBucket.
+type DiskConfig struct {
+	// Directory the chunks are stored in. It is created if missing and reindexed on startup.
+	Directory string
+	// MaxSize is the maximum total size in bytes of the cached chunks.
+	MaxSize int64
+	// ChunkSize is the size of the aligned chunks objects are cached as. Defaults to DefaultChunkSize.
+	ChunkSize int64
+}
+
+func (c *DiskConfig) validate() error {
+	if c.Directory == "" {
+		return errors.New("cache directory must be set")
+	}
+	if c.MaxSize <= 0 {
+		return errors.New("cache max size must be positive")
+	}
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = DefaultChunkSize
+	}
+	return nil
+}
+
+// DiskCachingBucket is a Bucket wrapper caching GetRange results as fixed size, aligned chunks in a local directory.
+// It suits repeated range reads on large objects which do not fit in memory.
+//
+// Chunks are stored per object version, identified by its ETag or, when the provider has none, by its last modified
+// time and size. Every GetRange resolves the object attributes to find the current version, so stale chunks are never
+// served; wrapping a CachingBucket caching Attributes trades this guarantee for fewer requests. Least recently used
+// chunks are evicted once the cache exceeds its maximum size, and concurrent misses on the same chunk are coalesced
+// into a single request.
+type DiskCachingBucket struct {
+	objstore.Bucket
+
+	cfg   DiskConfig
+	group singleflight.Group
+
+	mtx     sync.Mutex
+	size    int64
+	order   *list.List // Front is the most recently used chunk.
+	chunks  map[string]*list.Element
+	objects map[string]map[string]*list.Element
+
+	requests  prometheus.Counter
+	hits      prometheus.Counter
+	evictions prometheus.Counter
+	sizeBytes prometheus.Gauge
+}
+
+type diskChunk struct {
+	path    string // Relative to the cache directory.
+	object  string
+	version string
+	size    int64
+}
+
+// NewDiskCachingBucket returns a DiskCachingBucket wrapping bkt. Chunks left in the directory by a previous run are
+// indexed, oldest accessed first, and evicted if they exceed the maximum size.
+func NewDiskCachingBucket(bkt objstore.Bucket, cfg DiskConfig, reg prometheus.Registerer) (*DiskCachingBucket, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	b := &DiskCachingBucket{
+		Bucket:  bkt,
+		cfg:     cfg,
+		order:   list.New(),
+		chunks:  map[string]*list.Element{},
+		objects: map[string]map[string]*list.Element{},
+
+		requests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_disk_cache_requests_total",
+			Help: "Total number of chunk lookups in the disk cache.",
+		}),
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_disk_cache_hits_total",
+			Help: "Total number of chunk lookups served from the disk cache.",
+		}),
+		evictions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_disk_cache_evictions_total",
+			Help: "Total number of chunks evicted from the disk cache.",
+		}),
+		sizeBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "objstore_bucket_disk_cache_size_bytes",
+			Help: "Total size of the chunks stored in the disk cache.",
+		}),
+	}
+	if err := b.reindex(); err != nil {
+		return nil, errors.Wrapf(err, "index cache directory %s", cfg.Directory)
+	}
+	return b, nil
+}
+
+// reindex loads the chunks stored in the cache directory, using their modification time as last access time.
+func (b *DiskCachingBucket) reindex() error {
+	tmp := filepath.Join(b.cfg.Directory, diskTmpDir)
+	// Leftovers of interrupted writes.
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0o750); err != nil {
+		return err
+	}
+
+	type found struct {
+		chunk   *diskChunk
+		modTime time.Time
+	}
+	var chunks []found
+	err := filepath.WalkDir(b.cfg.Directory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.cfg.Directory, p)
+		if err != nil {
+			return err
+		}
+		m := chunkPath.FindStringSubmatch(filepath.ToSlash(rel))
+		if m == nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, found{
+			chunk:   &diskChunk{path: rel, object: m[1], version: m[2], size: info.Size()},
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].modTime.Before(chunks[j].modTime) })
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, c := range chunks {
+		b.add(c.chunk)
+	}
+	for b.size > b.cfg.MaxSize {
+		b.evict()
+	}
+	b.sizeBytes.Set(float64(b.size))
+	return nil
+}
+
+// objectVersion returns the hashes identifying the object and its current version in chunk paths.
+func objectVersion(name string, attrs objstore.ObjectAttributes) (object, version string) {
+	h := sha256.Sum256([]byte(name))
+	object = hex.EncodeToString(h[:])
+
+	v := "etag:" + attrs.ETag
+	if attrs.ETag == "" {
+		v = "mtime:" + strconv.FormatInt(attrs.LastModified.UnixNano(), 10)
+	}
+	h = sha256.Sum256([]byte(v + ":" + strconv.FormatInt(attrs.Size, 10)))
+	return object, hex.EncodeToString(h[:8])
+}
+
+func (b *DiskCachingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if off < 0 || (length <= 0 && length != -1) {
+		return b.Bucket.GetRange(ctx, name, off, length)
+	}
+
+	attrs, err := b.Bucket.Attributes(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	end := attrs.Size
+	if length != -1 && off+length < end {
+		end = off + length
+	}
+	if off >= end {
+		return objstore.NopCloserWithSize(bytes.NewReader(nil)), nil
+	}
+
+	object, version := objectVersion(name, attrs)
+	r := &chunkReader{ctx: ctx, b: b, name: name, object: object, version: version, objSize: attrs.Size, off: off, end: end, size: end - off}
+	// Load the first chunk eagerly, so that failures are reported by GetRange.
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// chunk returns the chunk of the object starting at off, reading it from the bucket on cache miss.
+func (b *DiskCachingBucket) chunk(ctx context.Context, name, object, version string, off, size int64) ([]byte, error) {
+	rel := filepath.Join(object[:2], object, fmt.Sprintf("%s-%d", version, off))
+
+	b.requests.Inc()
+	if data, ok := b.read(rel, size); ok {
+		b.hits.Inc()
+		return data, nil
+	}
+
+	// The fetch is shared by the concurrent misses on the chunk, so it must not be canceled with the caller starting
+	// it. Each caller stops waiting for it when its own context is canceled.
+	fetchCtx := context.WithoutCancel(ctx)
+	ch := b.group.DoChan(rel, func() (interface{}, error) {
+		data, err := b.readRange(fetchCtx, name, off, size)
+		if err != nil {
+			return nil, err
+		}
+		b.write(&diskChunk{path: rel, object: object, version: version, size: size}, data)
+		return data, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// read returns the cached chunk, if present and valid.
+func (b *DiskCachingBucket) read(rel string, size int64) ([]byte, bool) {
+	b.mtx.Lock()
+	e, ok := b.chunks[rel]
+	if ok {
+		b.order.MoveToFront(e)
+	}
+	b.mtx.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	p := filepath.Join(b.cfg.Directory, rel)
+	data, err := os.ReadFile(p)
+	if err != nil || int64(len(data)) != size {
+		// Evicted concurrently, or corrupted.
+		b.mtx.Lock()
+		if e, ok := b.chunks[rel]; ok {
+			b.remove(e)
+			b.sizeBytes.Set(float64(b.size))
+		}
+		b.mtx.Unlock()
+		return nil, false
+	}
+	// Persist the access time, so that the order survives restarts.
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return data, true
+}
+
+// write stores the chunk on disk, evicting least recently used chunks and stale versions of the object.
+// Write failures only mean the chunk is not cached.
+func (b *DiskCachingBucket) write(c *diskChunk, data []byte) {
+	if c.size > b.cfg.MaxSize {
+		return
+	}
+	if err := b.writeFile(c.path, data); err != nil {
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, e := range b.objects[c.object] {
+		if e.Value.(*diskChunk).version != c.version {
+			b.remove(e)
+		}
+	}
+	if e, ok := b.chunks[c.path]; ok {
+		b.remove(e)
+	}
+	for b.size+c.size > b.cfg.MaxSize {
+		b.evict()
+	}
+	b.add(c)
+	b.sizeBytes.Set(float64(b.size))
+}
+
+// writeFile atomically writes the chunk file, so that a crash never leaves a partial chunk behind.
+func (b *DiskCachingBucket) writeFile(rel string, data []byte) (err error) {
+	f, err := os.CreateTemp(filepath.Join(b.cfg.Directory, diskTmpDir), "chunk-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	p := filepath.Join(b.cfg.Directory, rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (b *DiskCachingBucket) readRange(ctx context.Context, name string, off, length int64) (_ []byte, err error) {
+	rc, err := b.Bucket.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	defer errcapture.Do(&err, rc.Close, "close range reader")
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read range %s", name)
+	}
+	if int64(len(data)) != length {
+		return nil, errors.Errorf("read range %s: got %d bytes, expected %d", name, len(data), length)
+	}
+	return data, nil
+}
+
+// add indexes the chunk as the most recently used one. It has to be called with the lock held.
+func (b *DiskCachingBucket) add(c *diskChunk) {
+	e := b.order.PushFront(c)
+	b.chunks[c.path] = e
+	if b.objects[c.object] == nil {
+		b.objects[c.object] = map[string]*list.Element{}
+	}
+	b.objects[c.object][c.path] = e
+	b.size += c.size
+}
+
+// remove deletes the chunk from the index and the disk. It has to be called with the lock held.
+func (b *DiskCachingBucket) remove(e *list.Element) {
+	c := b.order.Remove(e).(*diskChunk)
+	delete(b.chunks, c.path)
+	delete(b.objects[c.object], c.path)
+	if len(b.objects[c.object]) == 0 {
+		delete(b.objects, c.object)
+	}
+	b.size -= c.size
+	_ = os.Remove(filepath.Join(b.cfg.Directory, c.path))
+}
+
+// evict removes the least recently used chunk. It has to be called with the lock held.
+func (b *DiskCachingBucket) evict() {
+	if e := b.order.Back(); e != nil {
+		b.remove(e)
+		b.evictions.Inc()
+	}
+}
+
+// Upload uploads the object and removes its cached chunks.
+func (b *DiskCachingBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...objstore.ObjectUploadOption) error {
+	defer b.invalidate(name)
+	return b.Bucket.Upload(ctx, name, r, opts...)
+}
+
+// Delete deletes the object and removes its cached chunks.
+func (b *DiskCachingBucket) Delete(ctx context.Context, name string) error {
+	defer b.invalidate(name)
+	return b.Bucket.Delete(ctx, name)
+}
+
+func (b *DiskCachingBucket) invalidate(name string) {
+	h := sha256.Sum256([]byte(name))
+	object := hex.EncodeToString(h[:])
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, e := range b.objects[object] {
+		b.remove(e)
+	}
+	b.sizeBytes.Set(float64(b.size))
+}
+
+// chunkReader streams a range of an object, one cached chunk at a time.
+type chunkReader struct {
+	ctx             context.Context
+	b               *DiskCachingBucket
+	name            string
+	object, version string
+	objSize         int64
+
+	off, end int64
+	size     int64
+	buf      []byte
+}
+
+// load loads the chunk holding the current offset.
+func (r *chunkReader) load() error {
+	cs := r.b.cfg.ChunkSize
+	start := r.off / cs * cs
+	data, err := r.b.chunk(r.ctx, r.name, r.object, r.version, start, min(cs, r.objSize-start))
+	if err != nil {
+		return err
+	}
+	r.buf = data[r.off-start : min(int64(len(data)), r.end-start)]
+	return nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.off >= r.end {
+			return 0, io.EOF
+		}
+		if err := r.load(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *chunkReader) Close() error { return nil }
+
+// ObjectSize returns the size of the range.
+func (r *chunkReader) ObjectSize() (int64, error) { return r.size, nil }
@@ -0,0 +1,172 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/objstore"
+)
+
+func TestDiskCachingBucket_AcceptanceTest(t *testing.T) {
+	b, err := NewDiskCachingBucket(objstore.NewInMemBucket(), DiskConfig{Directory: t.TempDir(), MaxSize: 1 << 20, ChunkSize: 4}, nil)
+	testutil.Ok(t, err)
+	objstore.AcceptanceTest(t, b)
+}
+
+func TestDiskCachingBucket_GetRange(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	inmem, bkt, calls := newTestBucket(t)
+	content := "0123456789abcdefghijklmnopqrstuvwxyz"
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader(content)))
+
+	b, err := NewDiskCachingBucket(bkt, DiskConfig{Directory: dir, MaxSize: 1024, ChunkSize: 10}, nil)
+	testutil.Ok(t, err)
+
+	rc, err := b.GetRange(ctx, "obj", 5, 10)
+	testutil.Equals(t, content[5:15], readAll(t, rc, err))
+	testutil.Equals(t, 2, calls(objstore.OpGetRange))
+
+	rc, err = b.GetRange(ctx, "obj", 12, 3)
+	testutil.Equals(t, content[12:15], readAll(t, rc, err))
+	testutil.Equals(t, 2, calls(objstore.OpGetRange))
+
+	rc, err = b.GetRange(ctx, "obj", 8, -1)
+	testutil.Equals(t, content[8:], readAll(t, rc, err))
+	testutil.Equals(t, 4, calls(objstore.OpGetRange))
+
+	rc, err = b.GetRange(ctx, "obj", 100, 10)
+	testutil.Equals(t, "", readAll(t, rc, err))
+	testutil.Equals(t, 36.0, promtest.ToFloat64(b.sizeBytes))
+	testutil.Equals(t, 7.0, promtest.ToFloat64(b.requests))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(b.hits))
+
+	// Chunks survive restarts.
+	b, err = NewDiskCachingBucket(bkt, DiskConfig{Directory: dir, MaxSize: 1024, ChunkSize: 10}, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 36.0, promtest.ToFloat64(b.sizeBytes))
+	rc, err = b.GetRange(ctx, "obj", 0, -1)
+	testutil.Equals(t, content, readAll(t, rc, err))
+	testutil.Equals(t, 4, calls(objstore.OpGetRange))
+
+	// Objects modified behind the cache are detected, and their stale chunks removed.
+	time.Sleep(time.Millisecond)
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader(strings.ToUpper(content))))
+	rc, err = b.GetRange(ctx, "obj", 12, 3)
+	testutil.Equals(t, strings.ToUpper(content[12:15]), readAll(t, rc, err))
+	testutil.Equals(t, 5, calls(objstore.OpGetRange))
+	testutil.Equals(t, 10.0, promtest.ToFloat64(b.sizeBytes))
+
+	// So are uploads and deletions through the wrapper.
+	testutil.Ok(t, b.Delete(ctx, "obj"))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.sizeBytes))
+	_, err = b.GetRange(ctx, "obj", 0, 1)
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+}
+
+func TestDiskCachingBucket_Eviction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	_, bkt, calls := newTestBucket(t)
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader(strings.Repeat("x", 100))))
+
+	b, err := NewDiskCachingBucket(bkt, DiskConfig{Directory: dir, MaxSize: 30, ChunkSize: 10}, nil)
+	testutil.Ok(t, err)
+
+	for _, off := range []int64{0, 10, 20, 0, 30} {
+		rc, err := b.GetRange(ctx, "obj", off, 10)
+		testutil.Equals(t, strings.Repeat("x", 10), readAll(t, rc, err))
+	}
+	testutil.Equals(t, 4, calls(objstore.OpGetRange))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.evictions))
+
+	// Chunk 10 was the least recently used one.
+	rc, err := b.GetRange(ctx, "obj", 0, 10)
+	testutil.Equals(t, strings.Repeat("x", 10), readAll(t, rc, err))
+	testutil.Equals(t, 4, calls(objstore.OpGetRange))
+	rc, err = b.GetRange(ctx, "obj", 10, 10)
+	testutil.Equals(t, strings.Repeat("x", 10), readAll(t, rc, err))
+	testutil.Equals(t, 5, calls(objstore.OpGetRange))
+
+	// A smaller limit evicts chunks on startup, and leftover temporary files are removed.
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, diskTmpDir, "chunk-1"), []byte("partial"), 0o600))
+	b, err = NewDiskCachingBucket(bkt, DiskConfig{Directory: dir, MaxSize: 15, ChunkSize: 10}, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 10.0, promtest.ToFloat64(b.sizeBytes))
+	entries, err := os.ReadDir(filepath.Join(dir, diskTmpDir))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(entries))
+}
+
+func TestDiskCachingBucket_CoalescesMisses(t *testing.T) {
+	ctx := context.Background()
+	_, bkt, calls := newTestBucket(t)
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader(strings.Repeat("x", 10))))
+
+	slow := objstore.WithFaults(bkt, objstore.FaultRule{
+		Ops:         []string{objstore.OpGetRange},
+		Probability: 1,
+		Latency:     objstore.FixedLatency(100 * time.Millisecond),
+	})
+	b, err := NewDiskCachingBucket(slow, DiskConfig{Directory: t.TempDir(), MaxSize: 1024, ChunkSize: 10}, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := b.GetRange(ctx, "obj", 0, 10)
+			testutil.Equals(t, strings.Repeat("x", 10), readAll(t, rc, err))
+		}()
+	}
+	wg.Wait()
+	testutil.Equals(t, 1, calls(objstore.OpGetRange))
+}
+
+func TestDiskCachingBucket_CoalescedMissCanceled(t *testing.T) {
+	ctx := context.Background()
+	_, bkt, calls := newTestBucket(t)
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader(strings.Repeat("x", 10))))
+
+	slow := objstore.WithFaults(bkt, objstore.FaultRule{
+		Ops:         []string{objstore.OpGetRange},
+		Probability: 1,
+		Latency:     objstore.FixedLatency(200 * time.Millisecond),
+	})
+	b, err := NewDiskCachingBucket(slow, DiskConfig{Directory: t.TempDir(), MaxSize: 1024, ChunkSize: 10}, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	// The caller starting the fetch cancels, while another one waits for the same chunk.
+	firstCtx, cancel := context.WithCancel(ctx)
+	firstErr := make(chan error)
+	go func() {
+		_, err := b.GetRange(firstCtx, "obj", 0, 10)
+		firstErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	second := make(chan string)
+	go func() {
+		rc, err := b.GetRange(ctx, "obj", 0, 10)
+		second <- readAll(t, rc, err)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	testutil.Assert(t, errors.Is(<-firstErr, context.Canceled), "expected the canceled caller to fail")
+	testutil.Equals(t, strings.Repeat("x", 10), <-second)
+	testutil.Equals(t, 1, calls(objstore.OpGetRange))
+}
@@ -0,0 +1,239 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+// fakeServer is an in-process cache server storing items in a map.
+type fakeServer struct {
+	ln          net.Listener
+	maxItemSize int
+
+	mtx      sync.Mutex
+	items    map[string][]byte
+	ttls     map[string]string
+	commands map[string]int
+	maxKeys  int
+}
+
+func newFakeServer(t *testing.T, maxItemSize int, handle func(*fakeServer, *bufio.Reader, *bufio.Writer) error) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	s := &fakeServer{ln: ln, maxItemSize: maxItemSize, items: map[string][]byte{}, ttls: map[string]string{}, commands: map[string]int{}}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r, w := bufio.NewReader(c), bufio.NewWriter(c)
+				for handle(s, r, w) == nil {
+					if w.Flush() != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) addr() string { return s.ln.Addr().String() }
+
+func (s *fakeServer) command(name string, keys int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.commands[name]++
+	s.maxKeys = max(s.maxKeys, keys)
+}
+
+func (s *fakeServer) count(name string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.commands[name]
+}
+
+func (s *fakeServer) evictAll(prefix string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for k := range s.items {
+		if strings.HasPrefix(k, prefix) {
+			delete(s.items, k)
+		}
+	}
+}
+
+// newFakeMemcached returns a fake server speaking the memcached text protocol.
+func newFakeMemcached(t *testing.T, maxItemSize int) *fakeServer {
+	return newFakeServer(t, maxItemSize, func(s *fakeServer, r *bufio.Reader, w *bufio.Writer) error {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			_, err = w.WriteString("ERROR\r\n")
+			return err
+		}
+
+		switch fields[0] {
+		case "get":
+			s.command("get", len(fields)-1)
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			for _, k := range fields[1:] {
+				if v, ok := s.items[k]; ok {
+					fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", k, len(v), v)
+				}
+			}
+			_, err = w.WriteString("END\r\n")
+			return err
+		case "set":
+			if len(fields) != 5 {
+				_, err = w.WriteString("ERROR\r\n")
+				return err
+			}
+			s.command("set", 1)
+			n, _ := strconv.Atoi(fields[4])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if n > s.maxItemSize {
+				_, err = w.WriteString("SERVER_ERROR object too large for cache\r\n")
+				return err
+			}
+			s.mtx.Lock()
+			s.items[fields[1]] = data[:n]
+			s.ttls[fields[1]] = fields[3]
+			s.mtx.Unlock()
+			_, err = w.WriteString("STORED\r\n")
+			return err
+		case "delete":
+			s.command("delete", 1)
+			s.mtx.Lock()
+			_, ok := s.items[fields[1]]
+			delete(s.items, fields[1])
+			s.mtx.Unlock()
+			reply := "NOT_FOUND\r\n"
+			if ok {
+				reply = "DELETED\r\n"
+			}
+			_, err = w.WriteString(reply)
+			return err
+		}
+		_, err = w.WriteString("ERROR\r\n")
+		return err
+	})
+}
+
+// newFakeRedis returns a fake server speaking the Redis protocol, requiring the password if set.
+func newFakeRedis(t *testing.T, maxItemSize int, password string) *fakeServer {
+	return newFakeServer(t, maxItemSize, func(s *fakeServer, r *bufio.Reader, w *bufio.Writer) error {
+		args, err := readFakeRESPCommand(r)
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			_, err = w.WriteString("-ERR empty command\r\n")
+			return err
+		}
+
+		s.command(strings.ToUpper(args[0]), len(args)-1)
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[len(args)-1] != password {
+				_, err = w.WriteString("-WRONGPASS invalid password\r\n")
+				return err
+			}
+			_, err = w.WriteString("+OK\r\n")
+			return err
+		case "SELECT":
+			_, err = w.WriteString("+OK\r\n")
+			return err
+		case "MGET":
+			fmt.Fprintf(w, "*%d\r\n", len(args)-1)
+			for _, k := range args[1:] {
+				if v, ok := s.items[k]; ok {
+					fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+				} else {
+					w.WriteString("$-1\r\n")
+				}
+			}
+			return nil
+		case "SET":
+			if len(args[2]) > s.maxItemSize {
+				_, err = w.WriteString("-ERR value too large\r\n")
+				return err
+			}
+			s.items[args[1]] = []byte(args[2])
+			if len(args) == 5 {
+				s.ttls[args[1]] = args[4]
+			}
+			_, err = w.WriteString("+OK\r\n")
+			return err
+		case "DEL":
+			n := 0
+			for _, k := range args[1:] {
+				if _, ok := s.items[k]; ok {
+					n++
+				}
+				delete(s.items, k)
+			}
+			_, err = fmt.Fprintf(w, ":%d\r\n", n)
+			return err
+		}
+		_, err = w.WriteString("-ERR unknown command\r\n")
+		return err
+	})
+}
+
+func readFakeRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// lruCache is a size bounded in-memory cache evicting the least recently used items first.
+type lruCache struct {
+	maxSize int64
+	now     func() time.Time
+
+	mtx   sync.Mutex
+	size  int64
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func newLRUCache(maxSize int64) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		now:     time.Now,
+		order:   list.New(),
+		items:   map[string]*list.Element{},
+	}
+}
+
+// Fetch returns the values of the keys found in the cache.
+func (c *lruCache) Fetch(_ context.Context, keys []string) map[string][]byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	found := make(map[string][]byte, len(keys))
+	now := c.now()
+	for _, k := range keys {
+		e, ok := c.items[k]
+		if !ok {
+			continue
+		}
+		item := e.Value.(*lruItem)
+		if !item.expiresAt.IsZero() && !now.Before(item.expiresAt) {
+			c.removeElement(e)
+			continue
+		}
+		c.order.MoveToFront(e)
+		found[k] = item.value
+	}
+	return found
+}
+
+// Store stores the values in the cache. A zero ttl means the items never expire.
+// Values bigger than the cache size are ignored.
+func (c *lruCache) Store(_ context.Context, data map[string][]byte, ttl time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = c.now().Add(ttl)
+	}
+	for k, v := range data {
+		if int64(len(v)) > c.maxSize {
+			continue
+		}
+		if e, ok := c.items[k]; ok {
+			c.removeElement(e)
+		}
+		for c.size+int64(len(v)) > c.maxSize {
+			c.removeElement(c.order.Back())
+		}
+		c.items[k] = c.order.PushFront(&lruItem{key: k, value: v, expiresAt: expiresAt})
+		c.size += int64(len(v))
+	}
+}
+
+// Delete removes the keys from the cache.
+func (c *lruCache) Delete(_ context.Context, keys []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, k := range keys {
+		if e, ok := c.items[k]; ok {
+			c.removeElement(e)
+		}
+	}
+}
+
+func (c *lruCache) removeElement(e *list.Element) {
+	item := c.order.Remove(e).(*lruItem)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.value))
+}
@@ -0,0 +1,40 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	c := newLRUCache(10)
+	c.now = func() time.Time { return now }
+
+	c.Store(ctx, map[string][]byte{"a": []byte("aaaa"), "b": []byte("bbbb")}, 0)
+	c.Store(ctx, map[string][]byte{"ttl": []byte("t")}, time.Minute)
+	testutil.Equals(t, 3, len(c.Fetch(ctx, []string{"a", "b", "ttl", "missing"})))
+
+	// Touch "a" so that "b" is evicted first.
+	c.Fetch(ctx, []string{"a"})
+	c.Store(ctx, map[string][]byte{"c": []byte("cccc")}, 0)
+	testutil.Equals(t, map[string][]byte{"a": []byte("aaaa"), "c": []byte("cccc")}, c.Fetch(ctx, []string{"a", "b", "c"}))
+
+	// Items bigger than the cache are ignored.
+	c.Store(ctx, map[string][]byte{"big": make([]byte, 11)}, 0)
+	testutil.Equals(t, 0, len(c.Fetch(ctx, []string{"big"})))
+
+	c.Store(ctx, map[string][]byte{"ttl": []byte("t")}, time.Minute)
+	now = now.Add(time.Minute)
+	testutil.Equals(t, 0, len(c.Fetch(ctx, []string{"ttl"})))
+
+	c.Delete(ctx, []string{"a"})
+	testutil.Equals(t, map[string][]byte{"c": []byte("cccc")}, c.Fetch(ctx, []string{"a", "c"}))
+	testutil.Equals(t, int64(4), c.size)
+}
@@ -0,0 +1,262 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// memcachedMaxKeyLen is the maximum key length accepted by memcached.
+	memcachedMaxKeyLen = 250
+	// memcachedMaxRelativeTTL is the longest expiration memcached accepts as a relative time, longer ones are unix timestamps.
+	memcachedMaxRelativeTTL = 30 * 24 * time.Hour
+)
+
+// MemcachedConfig configures the memcached cache backend.
+type MemcachedConfig struct {
+	// Addresses of the memcached servers. Keys are distributed across servers by hash.
+	Addresses []string `yaml:"addresses"`
+	// Timeout of every operation, including dialing.
+	Timeout model.Duration `yaml:"timeout"`
+	// MaxIdleConnections is the maximum number of idle connections kept per server.
+	MaxIdleConnections int `yaml:"max_idle_connections"`
+	// MaxItemSize is the maximum size of an item stored under a single key. Bigger items are split across keys.
+	// It must not exceed the server item size limit (memcached -I flag, 1MiB by default).
+	MaxItemSize int `yaml:"max_item_size"`
+	// MaxGetMultiBatchSize is the maximum number of keys fetched by a single get command.
+	MaxGetMultiBatchSize int `yaml:"max_get_multi_batch_size"`
+	// MaxAsyncConcurrency is the maximum number of concurrent commands sent by a single Fetch or Store.
+	MaxAsyncConcurrency int `yaml:"max_async_concurrency"`
+}
+
+// DefaultMemcachedConfig is the default memcached cache configuration.
+var DefaultMemcachedConfig = MemcachedConfig{
+	Timeout:              model.Duration(500 * time.Millisecond),
+	MaxIdleConnections:   100,
+	MaxItemSize:          1 << 20,
+	MaxGetMultiBatchSize: 100,
+	MaxAsyncConcurrency:  20,
+}
+
+func (c MemcachedConfig) validate() error {
+	if len(c.Addresses) == 0 {
+		return errors.New("no memcached address configured")
+	}
+	if c.MaxItemSize < minMaxItemSize {
+		return errors.Errorf("max item size must be at least %d bytes", minMaxItemSize)
+	}
+	if c.MaxGetMultiBatchSize <= 0 || c.MaxAsyncConcurrency <= 0 {
+		return errors.New("max get multi batch size and max async concurrency must be positive")
+	}
+	return nil
+}
+
+// NewMemcachedCache returns a Cache speaking the memcached text protocol. The returned cache implements io.Closer.
+func NewMemcachedCache(logger log.Logger, cfg MemcachedConfig, reg prometheus.Registerer) (Cache, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	client := &memcachedClient{}
+	for _, addr := range cfg.Addresses {
+		client.pools = append(client.pools, newConnPool(addr, time.Duration(cfg.Timeout), cfg.MaxIdleConnections, nil))
+	}
+	return newRemoteCache(logger, "memcached", client, cfg.MaxItemSize, cfg.MaxGetMultiBatchSize, cfg.MaxAsyncConcurrency, reg), nil
+}
+
+type memcachedClient struct {
+	pools []*connPool
+}
+
+// memcachedKey returns a key valid for memcached: keys too long or holding whitespace or control characters are hashed.
+func memcachedKey(key string) string {
+	valid := len(key) <= memcachedMaxKeyLen && strings.IndexFunc(key, func(r rune) bool { return r <= ' ' || r == 0x7f }) < 0
+	if valid {
+		return key
+	}
+	h := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+func (c *memcachedClient) pool(key string) *connPool {
+	return c.pools[crc32.ChecksumIEEE([]byte(key))%uint32(len(c.pools))]
+}
+
+func (c *memcachedClient) getMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	byServer := map[*connPool][]string{}
+	names := make(map[string]string, len(keys))
+	for _, k := range keys {
+		mk := memcachedKey(k)
+		names[mk] = k
+		p := c.pool(mk)
+		byServer[p] = append(byServer[p], mk)
+	}
+
+	found := make(map[string][]byte, len(keys))
+	for p, mkeys := range byServer {
+		items, err := c.get(ctx, p, mkeys)
+		if err != nil {
+			return found, errors.Wrapf(err, "get from %s", p.addr)
+		}
+		for mk, v := range items {
+			if k, ok := names[mk]; ok {
+				found[k] = v
+			}
+		}
+	}
+	return found, nil
+}
+
+func (c *memcachedClient) get(ctx context.Context, p *connPool, keys []string) (_ map[string][]byte, err error) {
+	cn, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { p.put(cn, err) }()
+
+	if _, err := fmt.Fprintf(cn.w, "get %s\r\n", strings.Join(keys, " ")); err != nil {
+		return nil, err
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	found := map[string][]byte{}
+	for {
+		line, err := readLine(cn)
+		if err != nil {
+			return nil, err
+		}
+		if line == "END" {
+			return found, nil
+		}
+		// VALUE <key> <flags> <bytes> [<cas unique>]
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return nil, memcachedError(line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil || size < 0 {
+			return nil, errors.Errorf("invalid value line %q", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(cn.r, data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n")) {
+			return nil, errors.New("value not terminated by CRLF")
+		}
+		found[fields[1]] = data[:size]
+	}
+}
+
+func (c *memcachedClient) set(ctx context.Context, key string, value []byte, ttl time.Duration) (err error) {
+	key = memcachedKey(key)
+	p := c.pool(key)
+	cn, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { p.put(cn, err) }()
+
+	if _, err := fmt.Fprintf(cn.w, "set %s 0 %d %d\r\n", key, memcachedExpiration(ttl), len(value)); err != nil {
+		return err
+	}
+	if _, err := cn.w.Write(value); err != nil {
+		return err
+	}
+	if _, err := cn.w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	if err := cn.w.Flush(); err != nil {
+		return err
+	}
+
+	line, err := readLine(cn)
+	if err != nil {
+		return err
+	}
+	if line != "STORED" {
+		return memcachedError(line)
+	}
+	return nil
+}
+
+func (c *memcachedClient) delete(ctx context.Context, key string) (err error) {
+	key = memcachedKey(key)
+	p := c.pool(key)
+	cn, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { p.put(cn, err) }()
+
+	if _, err := fmt.Fprintf(cn.w, "delete %s\r\n", key); err != nil {
+		return err
+	}
+	if err := cn.w.Flush(); err != nil {
+		return err
+	}
+
+	line, err := readLine(cn)
+	if err != nil {
+		return err
+	}
+	if line != "DELETED" && line != "NOT_FOUND" {
+		return memcachedError(line)
+	}
+	return nil
+}
+
+func (c *memcachedClient) close() {
+	for _, p := range c.pools {
+		p.close()
+	}
+}
+
+// memcachedExpiration converts the ttl to a memcached expiration time.
+func memcachedExpiration(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > memcachedMaxRelativeTTL {
+		return time.Now().Add(ttl).Unix()
+	}
+	// Round up, as 0 means no expiration.
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// memcachedError converts an unexpected reply to an error. Error replies leave the connection usable.
+func memcachedError(line string) error {
+	if line == "ERROR" || line == "NOT_STORED" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return serverError("memcached: " + line)
+	}
+	return errors.Errorf("memcached: unexpected reply %q", line)
+}
+
+// readLine reads a CRLF terminated line.
+func readLine(cn *conn) (string, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.Errorf("line not terminated by CRLF: %q", line)
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
@@ -0,0 +1,214 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// RedisConfig configures the Redis cache backend.
+type RedisConfig struct {
+	// Address of the Redis server.
+	Address string `yaml:"address"`
+	// Username and Password used to authenticate, if set.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// DB is the database to select.
+	DB int `yaml:"db"`
+	// Timeout of every operation, including dialing.
+	Timeout model.Duration `yaml:"timeout"`
+	// MaxIdleConnections is the maximum number of idle connections kept.
+	MaxIdleConnections int `yaml:"max_idle_connections"`
+	// MaxItemSize is the maximum size of an item stored under a single key. Bigger items are split across keys.
+	MaxItemSize int `yaml:"max_item_size"`
+	// MaxGetMultiBatchSize is the maximum number of keys fetched by a single MGET command.
+	MaxGetMultiBatchSize int `yaml:"max_get_multi_batch_size"`
+	// MaxAsyncConcurrency is the maximum number of concurrent commands sent by a single Fetch or Store.
+	MaxAsyncConcurrency int `yaml:"max_async_concurrency"`
+}
+
+// DefaultRedisConfig is the default Redis cache configuration.
+var DefaultRedisConfig = RedisConfig{
+	Timeout:              model.Duration(500 * time.Millisecond),
+	MaxIdleConnections:   100,
+	MaxItemSize:          16 << 20,
+	MaxGetMultiBatchSize: 100,
+	MaxAsyncConcurrency:  20,
+}
+
+func (c RedisConfig) validate() error {
+	if c.Address == "" {
+		return errors.New("no redis address configured")
+	}
+	if c.MaxItemSize < minMaxItemSize {
+		return errors.Errorf("max item size must be at least %d bytes", minMaxItemSize)
+	}
+	if c.MaxGetMultiBatchSize <= 0 || c.MaxAsyncConcurrency <= 0 {
+		return errors.New("max get multi batch size and max async concurrency must be positive")
+	}
+	return nil
+}
+
+// NewRedisCache returns a Cache speaking the Redis protocol (RESP). The returned cache implements io.Closer.
+func NewRedisCache(logger log.Logger, cfg RedisConfig, reg prometheus.Registerer) (Cache, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	client := &redisClient{}
+	client.pool = newConnPool(cfg.Address, time.Duration(cfg.Timeout), cfg.MaxIdleConnections, func(cn *conn) error {
+		if cfg.Password != "" {
+			args := []string{"AUTH", cfg.Password}
+			if cfg.Username != "" {
+				args = []string{"AUTH", cfg.Username, cfg.Password}
+			}
+			if _, err := redisCommand(cn, args...); err != nil {
+				return errors.Wrap(err, "authenticate")
+			}
+		}
+		if cfg.DB != 0 {
+			if _, err := redisCommand(cn, "SELECT", strconv.Itoa(cfg.DB)); err != nil {
+				return errors.Wrap(err, "select db")
+			}
+		}
+		return nil
+	})
+	return newRemoteCache(logger, "redis", client, cfg.MaxItemSize, cfg.MaxGetMultiBatchSize, cfg.MaxAsyncConcurrency, reg), nil
+}
+
+type redisClient struct {
+	pool *connPool
+}
+
+func (c *redisClient) do(ctx context.Context, args ...string) (_ interface{}, err error) {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { c.pool.put(cn, err) }()
+
+	return redisCommand(cn, args...)
+}
+
+func (c *redisClient) getMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	reply, err := c.do(ctx, append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != len(keys) {
+		return nil, errors.Errorf("redis: unexpected MGET reply %v", reply)
+	}
+
+	found := make(map[string][]byte, len(keys))
+	for i, v := range values {
+		if b, ok := v.([]byte); ok {
+			found[keys[i]] = b
+		}
+	}
+	return found, nil
+}
+
+func (c *redisClient) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := c.do(ctx, args...)
+	return err
+}
+
+func (c *redisClient) delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, "DEL", key)
+	return err
+}
+
+func (c *redisClient) close() {
+	c.pool.close()
+}
+
+// redisCommand sends the command and reads its reply. Error replies are returned as serverError.
+func redisCommand(cn *conn, args ...string) (interface{}, error) {
+	if _, err := cn.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n"); err != nil {
+		return nil, err
+	}
+	for _, a := range args {
+		if _, err := cn.w.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"); err != nil {
+			return nil, err
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readRESP(cn)
+}
+
+// readRESP reads a reply. Simple strings are returned as string, bulk strings as []byte, integers as int64,
+// arrays as []interface{} and null replies as nil.
+func readRESP(cn *conn) (interface{}, error) {
+	line, err := readLine(cn)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, serverError("redis: " + line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "redis: invalid bulk string length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "redis: invalid array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, 0, n)
+		// Read all elements even after an error reply, to leave the connection usable.
+		var serr error
+		for i := 0; i < n; i++ {
+			v, err := readRESP(cn)
+			var e serverError
+			if errors.As(err, &e) {
+				serr = err
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if serr != nil {
+			return nil, serr
+		}
+		return values, nil
+	}
+	return nil, errors.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,339 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// Values are prefixed with a tag telling whether they hold the item or the manifest of an item split across keys.
+	tagItem  byte = 0
+	tagSplit byte = 1
+
+	splitIDLen = 8
+
+	// minMaxItemSize is the minimum item size limit, which leaves room for the manifests of split items.
+	minMaxItemSize = 64
+)
+
+// remoteClient is the protocol specific part of a remote cache.
+type remoteClient interface {
+	getMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+	set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	delete(ctx context.Context, key string) error
+	close()
+}
+
+// serverError is an error reply of a cache server. The connection it was received on is still usable.
+type serverError string
+
+func (e serverError) Error() string { return string(e) }
+
+// remoteCache implements Cache on top of a remoteClient. It batches multi-gets and splits the items bigger than
+// maxItemSize across several keys. Split items are stored as a manifest under their key, listing the parts.
+type remoteCache struct {
+	logger log.Logger
+	client remoteClient
+
+	maxItemSize    int
+	batchSize      int
+	maxConcurrency int
+
+	operations *prometheus.CounterVec
+	failures   *prometheus.CounterVec
+}
+
+func newRemoteCache(logger log.Logger, backend string, client remoteClient, maxItemSize, batchSize, maxConcurrency int, reg prometheus.Registerer) *remoteCache {
+	c := &remoteCache{
+		logger:         log.With(logger, "cache", backend),
+		client:         client,
+		maxItemSize:    maxItemSize,
+		batchSize:      batchSize,
+		maxConcurrency: maxConcurrency,
+
+		operations: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "objstore_cache_operations_total",
+			Help:        "Total number of operations sent to the cache backend.",
+			ConstLabels: prometheus.Labels{"backend": backend},
+		}, []string{"operation"}),
+		failures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "objstore_cache_operation_failures_total",
+			Help:        "Total number of operations sent to the cache backend that failed.",
+			ConstLabels: prometheus.Labels{"backend": backend},
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{"getmulti", "set", "delete"} {
+		c.operations.WithLabelValues(op)
+		c.failures.WithLabelValues(op)
+	}
+	return c
+}
+
+func (c *remoteCache) Store(ctx context.Context, data map[string][]byte, ttl time.Duration) {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(c.maxConcurrency)
+	for k, v := range data {
+		g.Go(func() error {
+			c.store(gctx, k, v, ttl)
+			return nil
+		})
+	}
+	_ = g.Wait()
+}
+
+func (c *remoteCache) store(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if len(value)+1 <= c.maxItemSize {
+		c.set(ctx, key, append([]byte{tagItem}, value...), ttl)
+		return
+	}
+
+	// Parts are keyed by a random id, so that the parts of concurrent or previous stores of the item are never mixed.
+	id := make([]byte, splitIDLen)
+	if _, err := rand.Read(id); err != nil {
+		level.Warn(c.logger).Log("msg", "failed to generate split item id", "key", key, "err", err)
+		return
+	}
+	parts := (len(value) + c.maxItemSize - 1) / c.maxItemSize
+	for i := 0; i < parts; i++ {
+		part := value[i*c.maxItemSize : min((i+1)*c.maxItemSize, len(value))]
+		if !c.set(ctx, partKey(key, id, i), part, ttl) {
+			return
+		}
+	}
+
+	manifest := []byte{tagSplit}
+	manifest = append(manifest, id...)
+	manifest = binary.AppendUvarint(manifest, uint64(parts))
+	manifest = binary.AppendUvarint(manifest, uint64(len(value)))
+	c.set(ctx, key, manifest, ttl)
+}
+
+func partKey(key string, id []byte, i int) string {
+	return fmt.Sprintf("%s:part:%x:%d", key, id, i)
+}
+
+func (c *remoteCache) set(ctx context.Context, key string, value []byte, ttl time.Duration) bool {
+	c.operations.WithLabelValues("set").Inc()
+	if err := c.client.set(ctx, key, value, ttl); err != nil {
+		c.failures.WithLabelValues("set").Inc()
+		level.Warn(c.logger).Log("msg", "failed to store item", "key", key, "size", len(value), "err", err)
+		return false
+	}
+	return true
+}
+
+type splitItem struct {
+	keys []string
+	size int
+}
+
+func (c *remoteCache) Fetch(ctx context.Context, keys []string) map[string][]byte {
+	found := map[string][]byte{}
+	splits := map[string]splitItem{}
+	var partKeys []string
+	for k, v := range c.getMulti(ctx, keys) {
+		if len(v) == 0 {
+			continue
+		}
+		switch v[0] {
+		case tagItem:
+			found[k] = v[1:]
+		case tagSplit:
+			s, ok := decodeManifest(k, v[1:])
+			if !ok {
+				level.Warn(c.logger).Log("msg", "invalid split item manifest", "key", k)
+				continue
+			}
+			splits[k] = s
+			partKeys = append(partKeys, s.keys...)
+		}
+	}
+	if len(splits) == 0 {
+		return found
+	}
+
+	parts := c.getMulti(ctx, partKeys)
+	for k, s := range splits {
+		value := make([]byte, 0, s.size)
+		for _, pk := range s.keys {
+			p, ok := parts[pk]
+			if !ok {
+				value = nil
+				break
+			}
+			value = append(value, p...)
+		}
+		// Parts missing, e.g. evicted, make the whole item a miss.
+		if value != nil && len(value) == s.size {
+			found[k] = value
+		}
+	}
+	return found
+}
+
+func decodeManifest(key string, b []byte) (splitItem, bool) {
+	if len(b) < splitIDLen {
+		return splitItem{}, false
+	}
+	id, b := b[:splitIDLen], b[splitIDLen:]
+	parts, n := binary.Uvarint(b)
+	if n <= 0 {
+		return splitItem{}, false
+	}
+	size, m := binary.Uvarint(b[n:])
+	if m <= 0 || n+m != len(b) || parts == 0 || parts > size {
+		return splitItem{}, false
+	}
+
+	s := splitItem{size: int(size)}
+	for i := 0; i < int(parts); i++ {
+		s.keys = append(s.keys, partKey(key, id, i))
+	}
+	return s, true
+}
+
+// getMulti fetches the keys in concurrent batches of at most batchSize keys.
+func (c *remoteCache) getMulti(ctx context.Context, keys []string) map[string][]byte {
+	var (
+		mtx   sync.Mutex
+		found = make(map[string][]byte, len(keys))
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(c.maxConcurrency)
+	for start := 0; start < len(keys); start += c.batchSize {
+		batch := keys[start:min(start+c.batchSize, len(keys))]
+		g.Go(func() error {
+			c.operations.WithLabelValues("getmulti").Inc()
+			items, err := c.client.getMulti(gctx, batch)
+			if err != nil {
+				c.failures.WithLabelValues("getmulti").Inc()
+				level.Warn(c.logger).Log("msg", "failed to fetch items", "keys", len(batch), "err", err)
+				return nil
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			for k, v := range items {
+				found[k] = v
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return found
+}
+
+// Close closes the connections to the cache servers.
+func (c *remoteCache) Close() error {
+	c.client.close()
+	return nil
+}
+
+// Delete removes the keys. The parts of split items are left to expire.
+func (c *remoteCache) Delete(ctx context.Context, keys []string) {
+	for _, k := range keys {
+		c.operations.WithLabelValues("delete").Inc()
+		if err := c.client.delete(ctx, k); err != nil {
+			c.failures.WithLabelValues("delete").Inc()
+			level.Warn(c.logger).Log("msg", "failed to delete item", "key", k, "err", err)
+		}
+	}
+}
+
+// conn is a buffered connection to a cache server.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// connPool keeps idle connections to a cache server for reuse.
+type connPool struct {
+	addr    string
+	timeout time.Duration
+	// setup is run on new connections, e.g. to authenticate.
+	setup func(*conn) error
+
+	idle chan *conn
+}
+
+func newConnPool(addr string, timeout time.Duration, maxIdle int, setup func(*conn) error) *connPool {
+	return &connPool{addr: addr, timeout: timeout, setup: setup, idle: make(chan *conn, maxIdle)}
+}
+
+// get returns a connection with its deadline set from the context and the pool timeout.
+func (p *connPool) get(ctx context.Context) (*conn, error) {
+	deadline := time.Now().Add(p.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	var c *conn
+	select {
+	case c = <-p.idle:
+	default:
+		d := net.Dialer{Deadline: deadline}
+		nc, err := d.DialContext(ctx, "tcp", p.addr)
+		if err != nil {
+			return nil, err
+		}
+		c = &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+		if err := c.SetDeadline(deadline); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		if p.setup != nil {
+			if err := p.setup(c); err != nil {
+				_ = c.Close()
+				return nil, err
+			}
+		}
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// put returns the connection to the pool. Connections which failed, other than with a server error reply, may be in
+// an unknown protocol state and are closed.
+func (p *connPool) put(c *conn, err error) {
+	var serr serverError
+	if err != nil && !errors.As(err, &serr) {
+		_ = c.Close()
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		_ = c.Close()
+	}
+}
+
+func (p *connPool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			_ = c.Close()
+		default:
+			return
+		}
+	}
+}
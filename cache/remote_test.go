@@ -0,0 +1,200 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/objstore"
+)
+
+func TestRemoteCache(t *testing.T) {
+	const maxItemSize = 64
+
+	for _, tc := range []struct {
+		backend string
+		// newCache returns a cache with batches of 2 keys, backed by a fake server rejecting items bigger than maxItemSize.
+		newCache func(t *testing.T) (*remoteCache, *fakeServer)
+		getCmd   string
+	}{
+		{
+			backend: "memcached",
+			getCmd:  "get",
+			newCache: func(t *testing.T) (*remoteCache, *fakeServer) {
+				srv := newFakeMemcached(t, maxItemSize)
+				cfg := DefaultMemcachedConfig
+				cfg.Addresses = []string{srv.addr()}
+				cfg.MaxItemSize = maxItemSize
+				cfg.MaxGetMultiBatchSize = 2
+				c, err := NewMemcachedCache(log.NewNopLogger(), cfg, prometheus.NewRegistry())
+				testutil.Ok(t, err)
+				return c.(*remoteCache), srv
+			},
+		},
+		{
+			backend: "redis",
+			getCmd:  "MGET",
+			newCache: func(t *testing.T) (*remoteCache, *fakeServer) {
+				srv := newFakeRedis(t, maxItemSize, "secret")
+				cfg := DefaultRedisConfig
+				cfg.Address = srv.addr()
+				cfg.Password = "secret"
+				cfg.DB = 1
+				cfg.MaxItemSize = maxItemSize
+				cfg.MaxGetMultiBatchSize = 2
+				c, err := NewRedisCache(log.NewNopLogger(), cfg, prometheus.NewRegistry())
+				testutil.Ok(t, err)
+				return c.(*remoteCache), srv
+			},
+		},
+	} {
+		t.Run(tc.backend, func(t *testing.T) {
+			ctx := context.Background()
+
+			t.Run("store fetch delete", func(t *testing.T) {
+				c, srv := tc.newCache(t)
+				defer func() { testutil.Ok(t, c.Close()) }()
+
+				long := strings.Repeat("k", 300)
+				data := map[string][]byte{"a": []byte("1"), "b": []byte("22"), "with space": []byte("3"), long: []byte("4"), "empty": {}}
+				c.Store(ctx, data, time.Minute)
+				testutil.Equals(t, data, c.Fetch(ctx, []string{"a", "b", "with space", long, "empty", "missing"}))
+
+				c.Delete(ctx, []string{"a", "missing"})
+				testutil.Equals(t, map[string][]byte{"b": []byte("22")}, c.Fetch(ctx, []string{"a", "b"}))
+				testutil.Equals(t, 0.0, promtest.ToFloat64(c.failures.WithLabelValues("delete")))
+
+				srv.mtx.Lock()
+				defer srv.mtx.Unlock()
+				for _, ttl := range srv.ttls {
+					testutil.Assert(t, ttl == "60" || ttl == "60000", "unexpected ttl %s", ttl)
+				}
+			})
+
+			t.Run("batching", func(t *testing.T) {
+				c, srv := tc.newCache(t)
+				defer func() { testutil.Ok(t, c.Close()) }()
+
+				var keys []string
+				data := map[string][]byte{}
+				for i := 0; i < 5; i++ {
+					keys = append(keys, fmt.Sprintf("key-%d", i))
+					data[keys[i]] = []byte{byte(i)}
+				}
+				c.Store(ctx, data, 0)
+				testutil.Equals(t, data, c.Fetch(ctx, keys))
+				testutil.Equals(t, 3, srv.count(tc.getCmd))
+				srv.mtx.Lock()
+				defer srv.mtx.Unlock()
+				testutil.Equals(t, 2, srv.maxKeys)
+			})
+
+			t.Run("split items", func(t *testing.T) {
+				c, srv := tc.newCache(t)
+				defer func() { testutil.Ok(t, c.Close()) }()
+
+				large := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 5)
+				exact := bytes.Repeat([]byte("x"), maxItemSize-1)
+				c.Store(ctx, map[string][]byte{"large": large, "exact": exact}, 0)
+				testutil.Equals(t, 0.0, promtest.ToFloat64(c.failures.WithLabelValues("set")))
+				// 180 bytes are split in 3 parts, plus the manifest.
+				srv.mtx.Lock()
+				testutil.Equals(t, 5, len(srv.items))
+				srv.mtx.Unlock()
+				testutil.Equals(t, map[string][]byte{"large": large, "exact": exact}, c.Fetch(ctx, []string{"large", "exact"}))
+
+				// Storing a new value never mixes its parts with the previous ones.
+				c.Store(ctx, map[string][]byte{"large": bytes.ToUpper(large)}, 0)
+				testutil.Equals(t, map[string][]byte{"large": bytes.ToUpper(large)}, c.Fetch(ctx, []string{"large"}))
+
+				// Missing parts make the whole item a miss.
+				srv.evictAll("large:part:")
+				testutil.Equals(t, map[string][]byte{}, c.Fetch(ctx, []string{"large"}))
+			})
+		})
+	}
+}
+
+func TestRemoteCache_ServerErrors(t *testing.T) {
+	ctx := context.Background()
+	srv := newFakeRedis(t, 100, "secret")
+
+	cfg := DefaultRedisConfig
+	cfg.Address = srv.addr()
+	cfg.Password = "wrong"
+	c, err := NewRedisCache(log.NewNopLogger(), cfg, nil)
+	testutil.Ok(t, err)
+	rc := c.(*remoteCache)
+
+	// Failures are reported as misses.
+	c.Store(ctx, map[string][]byte{"a": []byte("1")}, 0)
+	testutil.Equals(t, map[string][]byte{}, c.Fetch(ctx, []string{"a"}))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(rc.failures.WithLabelValues("set")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(rc.failures.WithLabelValues("getmulti")))
+
+	_, err = NewMemcachedCache(log.NewNopLogger(), DefaultMemcachedConfig, nil)
+	testutil.NotOk(t, err)
+}
+
+func TestNewCache(t *testing.T) {
+	ctx := context.Background()
+	srv := newFakeMemcached(t, 1<<20)
+
+	c, err := NewCache(log.NewNopLogger(), []byte(fmt.Sprintf(`type: MEMCACHED
+config:
+  addresses: [%q]
+  max_item_size: 100
+`, srv.addr())), nil)
+	testutil.Ok(t, err)
+	c.Store(ctx, map[string][]byte{"a": []byte("1")}, 0)
+	testutil.Equals(t, map[string][]byte{"a": []byte("1")}, c.Fetch(ctx, []string{"a"}))
+
+	c, err = NewCache(log.NewNopLogger(), []byte("type: in-memory\nconfig:\n  max_size: 100\n"), nil)
+	testutil.Ok(t, err)
+	c.Store(ctx, map[string][]byte{"a": []byte("1")}, 0)
+	testutil.Equals(t, map[string][]byte{"a": []byte("1")}, c.Fetch(ctx, []string{"a"}))
+
+	_, err = NewCache(log.NewNopLogger(), []byte("type: REDIS\nconfig:\n  unknown: 1\n"), nil)
+	testutil.NotOk(t, err)
+	_, err = NewCache(log.NewNopLogger(), []byte("type: FOO\n"), nil)
+	testutil.NotOk(t, err)
+}
+
+func TestCachingBucket_RemoteCache(t *testing.T) {
+	ctx := context.Background()
+	srv := newFakeMemcached(t, 64)
+	cfg := DefaultMemcachedConfig
+	cfg.Addresses = []string{srv.addr()}
+	cfg.MaxItemSize = 64
+	c, err := NewMemcachedCache(log.NewNopLogger(), cfg, nil)
+	testutil.Ok(t, err)
+
+	cb, err := NewCachingBucket(objstore.NewInMemBucket(), Config{Cache: c, SubrangeSize: 16, Rules: []Rule{{}}}, nil)
+	testutil.Ok(t, err)
+	objstore.AcceptanceTest(t, cb)
+
+	// Objects bigger than the server item size are split.
+	content := strings.Repeat("0123456789", 20)
+	testutil.Ok(t, cb.Upload(ctx, "large", strings.NewReader(content)))
+	for i := 0; i < 2; i++ {
+		rc, err := cb.Get(ctx, "large")
+		testutil.Ok(t, err)
+		b, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, content, string(b))
+	}
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cb.hits.WithLabelValues(objstore.OpGet)))
+}
@@ -0,0 +1,400 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CircuitState is the state of the circuit breaker of an operation.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through.
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen lets a few probing requests through, to decide whether to close or open the circuit again.
+	CircuitHalfOpen
+	// CircuitOpen fails all requests without calling the bucket.
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitOpenError is returned, without calling the wrapped bucket, by the operations whose circuit is open.
+type CircuitOpenError struct {
+	Op string
+	// RetryAfter is the time left before probing requests are let through. It is 0 when the circuit is half-open
+	// and all the probes are in flight.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s operations, retry after %v", e.Op, e.RetryAfter)
+}
+
+// IsCircuitOpenErr returns true if err was returned because the circuit of the operation is open.
+func IsCircuitOpenErr(err error) bool {
+	var e *CircuitOpenError
+	return errors.As(err, &e)
+}
+
+// CircuitBreakerConfig configures CircuitBreakerBucket.
+type CircuitBreakerConfig struct {
+	// FailureRatio, in (0, 1], of the requests failing within Window which opens the circuit. Defaults to the ratio
+	// of DefaultCircuitBreakerConfig.
+	FailureRatio float64
+	// OpFailureRatio overrides FailureRatio for the given operations (OpGet, OpUpload...).
+	OpFailureRatio map[string]float64
+	// MinRequests is the minimum number of requests within Window before the circuit can open.
+	MinRequests int
+	// Window is the rolling window the failure ratio is computed on, split in 10 slots. Defaults to the window of
+	// DefaultCircuitBreakerConfig.
+	Window time.Duration
+	// OpenDuration is the time the circuit stays open before probing requests are let through.
+	OpenDuration time.Duration
+	// HalfOpenProbes is the number of probing requests which must all succeed to close the circuit.
+	HalfOpenProbes int
+}
+
+// DefaultCircuitBreakerConfig opens the circuit when half of the requests fail.
+var DefaultCircuitBreakerConfig = CircuitBreakerConfig{
+	FailureRatio:   0.5,
+	MinRequests:    20,
+	Window:         10 * time.Second,
+	OpenDuration:   30 * time.Second,
+	HalfOpenProbes: 3,
+}
+
+// CircuitBreakerBucket is a Bucket wrapper failing fast with CircuitOpenError when an operation keeps failing,
+// instead of letting every request wait for its timeout. Each operation has its own circuit.
+//
+// Not found and access denied errors, as classified by the wrapped bucket, as well as requests canceled by the
+// caller and errors returned by Iter callbacks, are not failures. Only the calls are accounted for: errors while
+// reading the object stream returned by Get and GetRange are not.
+type CircuitBreakerBucket struct {
+	bkt      Bucket
+	cfg      CircuitBreakerConfig
+	breakers map[string]*circuitBreaker
+	now      func() time.Time
+
+	state    *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+}
+
+// NewCircuitBreakerBucket returns a CircuitBreakerBucket wrapping bkt.
+func NewCircuitBreakerBucket(bkt Bucket, cfg CircuitBreakerConfig, reg prometheus.Registerer) (*CircuitBreakerBucket, error) {
+	cfg.MinRequests = max(cfg.MinRequests, 1)
+	cfg.HalfOpenProbes = max(cfg.HalfOpenProbes, 1)
+	if cfg.Window == 0 {
+		cfg.Window = DefaultCircuitBreakerConfig.Window
+	}
+	if cfg.Window < circuitBreakerSlots {
+		return nil, errors.Errorf("circuit breaker window %v is too short", cfg.Window)
+	}
+	if cfg.FailureRatio == 0 {
+		cfg.FailureRatio = DefaultCircuitBreakerConfig.FailureRatio
+	}
+	if cfg.FailureRatio < 0 || cfg.FailureRatio > 1 {
+		return nil, errors.Errorf("circuit breaker failure ratio %v is not in (0, 1]", cfg.FailureRatio)
+	}
+	for op, ratio := range cfg.OpFailureRatio {
+		if ratio <= 0 || ratio > 1 {
+			return nil, errors.Errorf("circuit breaker failure ratio %v of %s operations is not in (0, 1]", ratio, op)
+		}
+	}
+
+	b := &CircuitBreakerBucket{
+		bkt:      bkt,
+		cfg:      cfg,
+		breakers: map[string]*circuitBreaker{},
+		now:      time.Now,
+
+		state: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "objstore_bucket_circuit_breaker_state",
+			Help: "State of the circuit breaker of bucket operations: 0 closed, 1 half-open, 2 open.",
+		}, []string{"operation"}),
+		rejected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_circuit_breaker_rejected_requests_total",
+			Help: "Total number of requests failed without calling the bucket because the circuit was open.",
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{OpIter, OpGet, OpGetRange, OpExists, OpUpload, OpDelete, OpAttributes} {
+		ratio, ok := cfg.OpFailureRatio[op]
+		if !ok {
+			ratio = cfg.FailureRatio
+		}
+		b.breakers[op] = &circuitBreaker{ratio: ratio, slotDuration: cfg.Window / circuitBreakerSlots}
+		b.state.WithLabelValues(op).Set(float64(CircuitClosed))
+		b.rejected.WithLabelValues(op)
+	}
+	return b, nil
+}
+
+// circuitBreakerSlots is the number of slots of the rolling window.
+const circuitBreakerSlots = 10
+
+type circuitSlot struct {
+	epoch    int64
+	requests int
+	failures int
+}
+
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	outcomeIgnored
+)
+
+type circuitBreaker struct {
+	mtx          sync.Mutex
+	ratio        float64
+	slotDuration time.Duration
+	slots        [circuitBreakerSlots]circuitSlot
+
+	state    CircuitState
+	openedAt time.Time
+	// probes is the number of probing requests in flight, and successes the number of successful ones.
+	probes    int
+	successes int
+}
+
+// State returns the current state of the circuit of op.
+func (b *CircuitBreakerBucket) State(op string) CircuitState {
+	cb := b.breakers[op]
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.state == CircuitOpen && b.now().Sub(cb.openedAt) >= b.cfg.OpenDuration {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+func (b *CircuitBreakerBucket) setState(op string, cb *circuitBreaker, state CircuitState, now time.Time) {
+	cb.state = state
+	cb.probes, cb.successes = 0, 0
+	switch state {
+	case CircuitOpen:
+		cb.openedAt = now
+	case CircuitClosed:
+		cb.slots = [circuitBreakerSlots]circuitSlot{}
+	}
+	b.state.WithLabelValues(op).Set(float64(state))
+}
+
+// allow returns whether the request can be sent, and whether it is a probing one.
+func (b *CircuitBreakerBucket) allow(op string) (probe bool, err error) {
+	cb := b.breakers[op]
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	now := b.now()
+	if cb.state == CircuitOpen {
+		if wait := b.cfg.OpenDuration - now.Sub(cb.openedAt); wait > 0 {
+			b.rejected.WithLabelValues(op).Inc()
+			return false, &CircuitOpenError{Op: op, RetryAfter: wait}
+		}
+		b.setState(op, cb, CircuitHalfOpen, now)
+	}
+	if cb.state == CircuitHalfOpen {
+		if cb.probes+cb.successes >= b.cfg.HalfOpenProbes {
+			b.rejected.WithLabelValues(op).Inc()
+			return false, &CircuitOpenError{Op: op}
+		}
+		cb.probes++
+		return true, nil
+	}
+	return false, nil
+}
+
+// record accounts for the outcome of a request let through by allow.
+func (b *CircuitBreakerBucket) record(op string, probe bool, o outcome) {
+	cb := b.breakers[op]
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	now := b.now()
+	if probe {
+		if cb.state != CircuitHalfOpen {
+			// Another probe already failed.
+			return
+		}
+		cb.probes--
+		switch o {
+		case outcomeFailure:
+			b.setState(op, cb, CircuitOpen, now)
+		case outcomeSuccess:
+			cb.successes++
+			if cb.successes >= b.cfg.HalfOpenProbes {
+				b.setState(op, cb, CircuitClosed, now)
+			}
+		}
+		return
+	}
+	// Requests sent before the circuit opened don't count anymore.
+	if cb.state != CircuitClosed || o == outcomeIgnored {
+		return
+	}
+
+	epoch := now.UnixNano() / int64(cb.slotDuration)
+	slot := &cb.slots[epoch%circuitBreakerSlots]
+	if slot.epoch != epoch {
+		*slot = circuitSlot{epoch: epoch}
+	}
+	slot.requests++
+	if o == outcomeFailure {
+		slot.failures++
+	}
+
+	requests, failures := 0, 0
+	for _, s := range cb.slots {
+		if s.epoch > epoch-circuitBreakerSlots {
+			requests += s.requests
+			failures += s.failures
+		}
+	}
+	if requests >= b.cfg.MinRequests && failures > 0 && float64(failures) >= cb.ratio*float64(requests) {
+		b.setState(op, cb, CircuitOpen, now)
+	}
+}
+
+func (b *CircuitBreakerBucket) outcome(err error) outcome {
+	switch {
+	case err == nil, b.bkt.IsObjNotFoundErr(err), b.bkt.IsAccessDeniedErr(err):
+		return outcomeSuccess
+	case errors.Is(err, context.Canceled):
+		return outcomeIgnored
+	}
+	return outcomeFailure
+}
+
+// do runs fn if the circuit of op allows it.
+func (b *CircuitBreakerBucket) do(op string, fn func() error) error {
+	probe, err := b.allow(op)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	b.record(op, probe, b.outcome(err))
+	return err
+}
+
+func (b *CircuitBreakerBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *CircuitBreakerBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	probe, err := b.allow(OpIter)
+	if err != nil {
+		return err
+	}
+	var cbErr error
+	err = b.bkt.Iter(ctx, dir, func(name string) error {
+		cbErr = f(name)
+		return cbErr
+	}, options...)
+	if cbErr != nil {
+		b.record(OpIter, probe, outcomeSuccess)
+	} else {
+		b.record(OpIter, probe, b.outcome(err))
+	}
+	return err
+}
+
+func (b *CircuitBreakerBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	probe, err := b.allow(OpIter)
+	if err != nil {
+		return err
+	}
+	var cbErr error
+	err = b.bkt.IterWithAttributes(ctx, dir, func(attrs IterObjectAttributes) error {
+		cbErr = f(attrs)
+		return cbErr
+	}, options...)
+	if cbErr != nil {
+		b.record(OpIter, probe, outcomeSuccess)
+	} else {
+		b.record(OpIter, probe, b.outcome(err))
+	}
+	return err
+}
+
+func (b *CircuitBreakerBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *CircuitBreakerBucket) Get(ctx context.Context, name string) (rc io.ReadCloser, err error) {
+	err = b.do(OpGet, func() error {
+		rc, err = b.bkt.Get(ctx, name)
+		return err
+	})
+	return rc, err
+}
+
+func (b *CircuitBreakerBucket) GetRange(ctx context.Context, name string, off, length int64) (rc io.ReadCloser, err error) {
+	err = b.do(OpGetRange, func() error {
+		rc, err = b.bkt.GetRange(ctx, name, off, length)
+		return err
+	})
+	return rc, err
+}
+
+func (b *CircuitBreakerBucket) Exists(ctx context.Context, name string) (exists bool, err error) {
+	err = b.do(OpExists, func() error {
+		exists, err = b.bkt.Exists(ctx, name)
+		return err
+	})
+	return exists, err
+}
+
+func (b *CircuitBreakerBucket) Attributes(ctx context.Context, name string) (attrs ObjectAttributes, err error) {
+	err = b.do(OpAttributes, func() error {
+		attrs, err = b.bkt.Attributes(ctx, name)
+		return err
+	})
+	return attrs, err
+}
+
+func (b *CircuitBreakerBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	return b.do(OpUpload, func() error {
+		return b.bkt.Upload(ctx, name, r, opts...)
+	})
+}
+
+func (b *CircuitBreakerBucket) Delete(ctx context.Context, name string) error {
+	return b.do(OpDelete, func() error {
+		return b.bkt.Delete(ctx, name)
+	})
+}
+
+func (b *CircuitBreakerBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *CircuitBreakerBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+// IsRetryableErr returns false for CircuitOpenError, as retrying immediately would fail as well.
+func (b *CircuitBreakerBucket) IsRetryableErr(err error) bool {
+	return !IsCircuitOpenErr(err) && IsRetryableErr(b.bkt, err)
+}
+
+func (b *CircuitBreakerBucket) Close() error { return b.bkt.Close() }
+
+func (b *CircuitBreakerBucket) Name() string { return b.bkt.Name() }
@@ -0,0 +1,148 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var testCircuitBreakerConfig = CircuitBreakerConfig{
+	FailureRatio:   0.5,
+	MinRequests:    4,
+	Window:         10 * time.Second,
+	OpenDuration:   time.Minute,
+	HalfOpenProbes: 2,
+}
+
+func TestCircuitBreakerBucket_AcceptanceTest(t *testing.T) {
+	b, err := NewCircuitBreakerBucket(NewInMemBucket(), testCircuitBreakerConfig, nil)
+	testutil.Ok(t, err)
+	AcceptanceTest(t, b)
+}
+
+func TestCircuitBreakerBucket(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("content")))
+
+	faults := WithFaults(inmem)
+	b, err := NewCircuitBreakerBucket(faults, testCircuitBreakerConfig, nil)
+	testutil.Ok(t, err)
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+
+	// Not found errors are not failures.
+	for i := 0; i < 10; i++ {
+		_, err := b.Get(ctx, "missing")
+		testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	}
+	testutil.Equals(t, CircuitClosed, b.State(OpGet))
+
+	// Failures older than the window are forgotten.
+	faults.SetRules(FaultRule{Ops: []string{OpExists}, Probability: 1, Err: ErrFaultTransient})
+	for i := 0; i < 6; i++ {
+		_, err := b.Exists(ctx, "obj")
+		testutil.Assert(t, errors.Is(err, ErrFaultTransient), "expected transient error, got %v", err)
+		if i == 2 {
+			now = now.Add(11 * time.Second)
+		}
+	}
+	testutil.Equals(t, CircuitClosed, b.State(OpExists))
+
+	// The circuit opens once enough requests failed within the window.
+	_, err = b.Exists(ctx, "obj")
+	testutil.Assert(t, errors.Is(err, ErrFaultTransient), "expected transient error, got %v", err)
+	testutil.Equals(t, CircuitOpen, b.State(OpExists))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.state.WithLabelValues(OpExists)))
+
+	faults.SetRules()
+	_, err = b.Exists(ctx, "obj")
+	testutil.Assert(t, IsCircuitOpenErr(err), "expected circuit open error, got %v", err)
+	testutil.Assert(t, !b.IsRetryableErr(err), "expected circuit open error not to be retryable")
+	testutil.Equals(t, time.Minute, err.(*CircuitOpenError).RetryAfter)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.rejected.WithLabelValues(OpExists)))
+
+	// Other operations are not affected.
+	_, err = b.Attributes(ctx, "obj")
+	testutil.Ok(t, err)
+
+	// A failed probe opens the circuit again.
+	now = now.Add(time.Minute)
+	testutil.Equals(t, CircuitHalfOpen, b.State(OpExists))
+	faults.SetRules(FaultRule{Ops: []string{OpExists}, OnCall: 1, Err: ErrFaultTransient})
+	_, err = b.Exists(ctx, "obj")
+	testutil.Assert(t, errors.Is(err, ErrFaultTransient), "expected transient error, got %v", err)
+	testutil.Equals(t, CircuitOpen, b.State(OpExists))
+
+	// Successful probes close it.
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		ok, err := b.Exists(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "expected object to exist")
+	}
+	testutil.Equals(t, CircuitClosed, b.State(OpExists))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.state.WithLabelValues(OpExists)))
+}
+
+func TestCircuitBreakerBucket_HalfOpenProbes(t *testing.T) {
+	ctx := context.Background()
+	faults := WithFaults(NewInMemBucket(), FaultRule{Ops: []string{OpUpload}, Probability: 1, Err: ErrFaultTransient})
+	b, err := NewCircuitBreakerBucket(faults, testCircuitBreakerConfig, nil)
+	testutil.Ok(t, err)
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		testutil.NotOk(t, b.Upload(ctx, "obj", strings.NewReader("content")))
+	}
+	testutil.Equals(t, CircuitOpen, b.State(OpUpload))
+	now = now.Add(time.Minute)
+
+	// Only HalfOpenProbes requests are in flight at once.
+	probe1, err := b.allow(OpUpload)
+	testutil.Ok(t, err)
+	probe2, err := b.allow(OpUpload)
+	testutil.Ok(t, err)
+	testutil.Assert(t, probe1 && probe2, "expected probing requests")
+	_, err = b.allow(OpUpload)
+	testutil.Assert(t, IsCircuitOpenErr(err), "expected circuit open error, got %v", err)
+
+	// Canceled probes let another one through.
+	b.record(OpUpload, true, b.outcome(errors.Wrap(context.Canceled, "upload")))
+	_, err = b.allow(OpUpload)
+	testutil.Ok(t, err)
+	b.record(OpUpload, true, outcomeSuccess)
+	b.record(OpUpload, true, outcomeSuccess)
+	testutil.Equals(t, CircuitClosed, b.State(OpUpload))
+}
+
+func TestCircuitBreakerBucket_Config(t *testing.T) {
+	for _, cfg := range []CircuitBreakerConfig{
+		{FailureRatio: -0.5},
+		{FailureRatio: 1.5},
+		{OpFailureRatio: map[string]float64{OpGet: 0}},
+		{Window: 5 * time.Nanosecond},
+		{Window: -time.Second},
+	} {
+		_, err := NewCircuitBreakerBucket(NewInMemBucket(), cfg, nil)
+		testutil.NotOk(t, err, "config %+v", cfg)
+	}
+
+	// Successful requests never open the circuit with the default ratio.
+	b, err := NewCircuitBreakerBucket(NewInMemBucket(), CircuitBreakerConfig{MinRequests: 1}, nil)
+	testutil.Ok(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := b.Exists(context.Background(), "obj")
+		testutil.Ok(t, err)
+	}
+	testutil.Equals(t, CircuitClosed, b.State(OpExists))
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v2"
 )
 
@@ -31,22 +32,46 @@ type BucketConfig struct {
 	Type   objstore.ObjProvider `yaml:"type"`
 	Config interface{}          `yaml:"config"`
 	Prefix string               `yaml:"prefix" default:""`
+	// Policy, if not empty, wraps the bucket with an objstore.PolicyBucket denying the operations it forbids.
+	Policy objstore.PolicyConfig `yaml:"policy"`
+	// RateLimit, if any limit is set, wraps the bucket with an objstore.RateLimitedBucket, whose limits can be
+	// changed at runtime with SetLimits.
+	RateLimit objstore.RateLimitConfig `yaml:"rate_limit"`
+}
+
+// Option configures the buckets created by NewBucket and NewBucketFromConfig.
+type Option func(*options)
+
+type options struct {
+	reg prometheus.Registerer
+}
+
+// WithRegisterer registers the metrics of the wrappers configured in BucketConfig, e.g. the rate limiter, with reg.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		o.reg = reg
+	}
 }
 
 // NewBucket initializes and returns new object storage clients.
 // NOTE: confContentYaml can contain secrets.
-func NewBucket(logger log.Logger, confContentYaml []byte, component string, wrapRoundtripper func(http.RoundTripper) http.RoundTripper) (objstore.Bucket, error) {
+func NewBucket(logger log.Logger, confContentYaml []byte, component string, wrapRoundtripper func(http.RoundTripper) http.RoundTripper, opts ...Option) (objstore.Bucket, error) {
 	level.Info(logger).Log("msg", "loading bucket configuration")
 	bucketConf := &BucketConfig{}
 	if err := yaml.UnmarshalStrict(confContentYaml, bucketConf); err != nil {
 		return nil, errors.Wrap(err, "parsing config YAML file")
 	}
 
-	return NewBucketFromConfig(logger, bucketConf, component, wrapRoundtripper)
+	return NewBucketFromConfig(logger, bucketConf, component, wrapRoundtripper, opts...)
 }
 
 // NewBucketFromConfig creates an objstore.Bucket from an existing BucketConfig object.
-func NewBucketFromConfig(logger log.Logger, bucketConf *BucketConfig, component string, wrapRoundtripper func(http.RoundTripper) http.RoundTripper) (objstore.Bucket, error) {
+func NewBucketFromConfig(logger log.Logger, bucketConf *BucketConfig, component string, wrapRoundtripper func(http.RoundTripper) http.RoundTripper, opts ...Option) (objstore.Bucket, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	config, err := yaml.Marshal(bucketConf.Config)
 	if err != nil {
 		return nil, errors.Wrap(err, "marshal content of bucket configuration")
@@ -81,5 +106,18 @@ func NewBucketFromConfig(logger log.Logger, bucketConf *BucketConfig, component
 		return nil, errors.Wrap(err, fmt.Sprintf("create %s client", bucketConf.Type))
 	}
 
-	return objstore.NewPrefixedBucket(bucket, bucketConf.Prefix), nil
+	bucket = objstore.NewPrefixedBucket(bucket, bucketConf.Prefix)
+	if !bucketConf.Policy.IsZero() {
+		bucket, err = objstore.NewPolicyBucket(bucket, bucketConf.Policy)
+		if err != nil {
+			return nil, errors.Wrap(err, "create policy bucket")
+		}
+	}
+	if !bucketConf.RateLimit.IsZero() {
+		bucket, err = objstore.NewRateLimitedBucket(bucket, bucketConf.RateLimit, o.reg)
+		if err != nil {
+			return nil, errors.Wrap(err, "create rate limited bucket")
+		}
+	}
+	return bucket, nil
 }
@@ -7,8 +7,15 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
+	"testing"
 
+	"github.com/efficientgo/core/testutil"
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/objstore"
 )
 
 func ExampleBucket() {
@@ -33,3 +40,42 @@ func ExampleBucket() {
 	// Output:
 	// false
 }
+
+func TestNewBucket_RateLimit(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	bkt, err := NewBucket(log.NewNopLogger(), []byte(`type: FILESYSTEM
+config:
+  directory: `+t.TempDir()+`
+rate_limit:
+  requests:
+    get: {rate: 10}
+  download_bytes: {rate: 1048576, burst: 65536}
+`), "test", nil, WithRegisterer(reg))
+	testutil.Ok(t, err)
+	_, ok := bkt.(*objstore.RateLimitedBucket)
+	testutil.Assert(t, ok, "expected a rate limited bucket, got %T", bkt)
+	count, err := promtest.GatherAndCount(reg, "objstore_bucket_rate_limit_wait_seconds_total")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 7, count)
+
+	_, err = NewBucket(log.NewNopLogger(), []byte(`type: FILESYSTEM
+config:
+  directory: `+t.TempDir()+`
+rate_limit:
+  requests:
+    unknown: {rate: 10}
+`), "test", nil)
+	testutil.NotOk(t, err)
+}
+
+func TestNewBucket_Policy(t *testing.T) {
+	bkt, err := NewBucket(log.NewNopLogger(), []byte(`type: FILESYSTEM
+config:
+  directory: `+t.TempDir()+`
+policy:
+  read_only: true
+`), "test", nil)
+	testutil.Ok(t, err)
+	err = bkt.Upload(context.Background(), "obj", strings.NewReader("content"))
+	testutil.Assert(t, bkt.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+}
@@ -0,0 +1,195 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"strconv"
+	"sync"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CoalescingBucket is a Bucket wrapper deduplicating concurrent identical reads: while a Get, GetRange, Exists or
+// Attributes call is in flight, the same call on the same object and range waits for its result instead of
+// reaching the wrapped bucket.
+//
+// Get and GetRange results are read fully in memory and every caller gets an independent reader over them.
+// The shared call is not canceled when one of the callers gives up, only once all of them did; each caller still
+// returns as soon as its own context is done.
+type CoalescingBucket struct {
+	bkt Bucket
+
+	mtx   sync.Mutex
+	calls map[string]*coalescedCall
+
+	requests     *prometheus.CounterVec
+	deduplicated *prometheus.CounterVec
+}
+
+// NewCoalescingBucket returns a CoalescingBucket wrapping bkt.
+func NewCoalescingBucket(bkt Bucket, reg prometheus.Registerer) *CoalescingBucket {
+	b := &CoalescingBucket{
+		bkt:   bkt,
+		calls: map[string]*coalescedCall{},
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_coalescing_requests_total",
+			Help: "Total number of read requests received by the coalescing bucket, per operation.",
+		}, []string{"operation"}),
+		deduplicated: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_coalescing_deduplicated_requests_total",
+			Help: "Total number of read requests served by an identical in-flight request instead of the bucket, per operation.",
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{OpGet, OpGetRange, OpExists, OpAttributes} {
+		b.requests.WithLabelValues(op)
+		b.deduplicated.WithLabelValues(op)
+	}
+	return b
+}
+
+// coalescedCall is a call shared by concurrent callers. It is canceled once all its callers gave up.
+type coalescedCall struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs fn once for all the concurrent calls with the same key.
+func (b *CoalescingBucket) do(ctx context.Context, op, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	b.requests.WithLabelValues(op).Inc()
+	key = op + ":" + key
+
+	b.mtx.Lock()
+	c, joined := b.calls[key]
+	if joined {
+		c.waiters++
+	} else {
+		// The call outlives the caller starting it, but not all its callers.
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &coalescedCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		b.calls[key] = c
+		go func() {
+			c.val, c.err = fn(callCtx)
+			b.mtx.Lock()
+			if b.calls[key] == c {
+				delete(b.calls, key)
+			}
+			b.mtx.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	b.mtx.Unlock()
+
+	select {
+	case <-c.done:
+		if joined {
+			b.deduplicated.WithLabelValues(op).Inc()
+		}
+		return c.val, c.err
+	case <-ctx.Done():
+		b.mtx.Lock()
+		if c.waiters--; c.waiters == 0 {
+			c.cancel()
+			if b.calls[key] == c {
+				delete(b.calls, key)
+			}
+		}
+		b.mtx.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (b *CoalescingBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *CoalescingBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *CoalescingBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return b.bkt.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *CoalescingBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *CoalescingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	v, err := b.do(ctx, OpGet, name, func(ctx context.Context) (interface{}, error) {
+		return readAllAndClose(b.bkt.Get(ctx, name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NopCloserWithSize(bytes.NewReader(v.([]byte))), nil
+}
+
+func (b *CoalescingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	key := name + ":" + strconv.FormatInt(off, 10) + ":" + strconv.FormatInt(length, 10)
+	v, err := b.do(ctx, OpGetRange, key, func(ctx context.Context) (interface{}, error) {
+		return readAllAndClose(b.bkt.GetRange(ctx, name, off, length))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NopCloserWithSize(bytes.NewReader(v.([]byte))), nil
+}
+
+func readAllAndClose(rc io.ReadCloser, err error) (_ []byte, rerr error) {
+	if err != nil {
+		return nil, err
+	}
+	defer errcapture.Do(&rerr, rc.Close, "close reader")
+
+	return io.ReadAll(rc)
+}
+
+func (b *CoalescingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	v, err := b.do(ctx, OpExists, name, func(ctx context.Context) (interface{}, error) {
+		return b.bkt.Exists(ctx, name)
+	})
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+func (b *CoalescingBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	v, err := b.do(ctx, OpAttributes, name, func(ctx context.Context) (interface{}, error) {
+		return b.bkt.Attributes(ctx, name)
+	})
+	if err != nil {
+		return ObjectAttributes{}, err
+	}
+	// Callers may modify the metadata, don't share it.
+	attrs := v.(ObjectAttributes)
+	attrs.UserMetadata = maps.Clone(attrs.UserMetadata)
+	return attrs, nil
+}
+
+func (b *CoalescingBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	return b.bkt.Upload(ctx, name, r, opts...)
+}
+
+func (b *CoalescingBucket) Delete(ctx context.Context, name string) error {
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *CoalescingBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *CoalescingBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *CoalescingBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.bkt, err) }
+
+func (b *CoalescingBucket) Close() error { return b.bkt.Close() }
+
+func (b *CoalescingBucket) Name() string { return b.bkt.Name() }
@@ -0,0 +1,168 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCoalescingBucket_AcceptanceTest(t *testing.T) {
+	AcceptanceTest(t, NewCoalescingBucket(NewInMemBucket(), nil))
+}
+
+func TestCoalescingBucket_Deduplicates(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	inner := WrapWithMetrics(NewInMemBucket(), reg, "test")
+	testutil.Ok(t, inner.Upload(ctx, "index", strings.NewReader("index-content")))
+
+	slow := WithFaults(inner, FaultRule{Probability: 1, Latency: FixedLatency(200 * time.Millisecond)})
+	b := NewCoalescingBucket(slow, nil)
+
+	const callers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			rc, err := b.Get(ctx, "index")
+			testutil.Ok(t, err)
+			// Readers are independent: a partial read does not affect the other callers.
+			if i%2 == 0 {
+				testutil.Ok(t, rc.Close())
+				return
+			}
+			content, err := io.ReadAll(rc)
+			testutil.Ok(t, err)
+			testutil.Equals(t, "index-content", string(content))
+		}()
+		go func() {
+			defer wg.Done()
+			rc, err := b.GetRange(ctx, "index", 6, 3)
+			testutil.Ok(t, err)
+			content, err := io.ReadAll(rc)
+			testutil.Ok(t, err)
+			testutil.Equals(t, "con", string(content))
+		}()
+		go func() {
+			defer wg.Done()
+			ok, err := b.Exists(ctx, "index")
+			testutil.Ok(t, err)
+			testutil.Assert(t, ok, "expected object to exist")
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := b.Attributes(ctx, "missing")
+			testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+		}()
+	}
+	wg.Wait()
+
+	for _, op := range []string{OpGet, OpGetRange, OpExists, OpAttributes} {
+		testutil.Equals(t, 1.0, promtest.ToFloat64(inner.metrics.ops.WithLabelValues(op)), op)
+		testutil.Equals(t, float64(callers), promtest.ToFloat64(b.requests.WithLabelValues(op)), op)
+		testutil.Equals(t, float64(callers-1), promtest.ToFloat64(b.deduplicated.WithLabelValues(op)), op)
+	}
+
+	// Different ranges are not coalesced.
+	rc, err := b.GetRange(ctx, "index", 0, 5)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, 2.0, promtest.ToFloat64(inner.metrics.ops.WithLabelValues(OpGetRange)))
+}
+
+func TestCoalescingBucket_CallerCancellation(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemBucket()
+	testutil.Ok(t, inner.Upload(ctx, "obj", strings.NewReader("content")))
+	b := NewCoalescingBucket(WithFaults(inner, FaultRule{Probability: 1, Latency: FixedLatency(200 * time.Millisecond)}), nil)
+
+	cctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := b.Get(cctx, "obj")
+		testutil.Equals(t, context.Canceled, err)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The canceled caller started the shared call, which still completes for the others.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rc, err := b.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		content, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "content", string(content))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	wg.Wait()
+}
+
+func TestCoalescingBucket_AllCallersCanceled(t *testing.T) {
+	ctx := context.Background()
+	started, canceled := make(chan struct{}), make(chan struct{})
+	b := NewCoalescingBucket(&mockBucket{
+		Bucket: NewInMemBucket(),
+		get: func(ctx context.Context, _ string) (io.ReadCloser, error) {
+			close(started)
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		},
+	}, nil)
+
+	cctx1, cancel1 := context.WithCancel(ctx)
+	cctx2, cancel2 := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, cctx := range []context.Context{cctx1, cctx2} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Get(cctx, "obj")
+			testutil.Equals(t, context.Canceled, err)
+		}()
+	}
+	<-started
+	for waiters := 0; waiters < 2; time.Sleep(time.Millisecond) {
+		b.mtx.Lock()
+		waiters = b.calls[OpGet+":obj"].waiters
+		b.mtx.Unlock()
+	}
+
+	// The shared call keeps running while a caller waits for it.
+	cancel1()
+	select {
+	case <-canceled:
+		t.Fatal("expected the shared call to keep running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once all the callers gave up, it is canceled.
+	cancel2()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the shared call to be canceled")
+	}
+	wg.Wait()
+}
+
+func TestCoalescingBucket_IsRetryableErr(t *testing.T) {
+	b := NewCoalescingBucket(WithFaults(NewInMemBucket(), FaultRule{Ops: []string{OpExists}, Probability: 1, Err: ErrFaultTransient}), nil)
+	_, err := b.Exists(context.Background(), "obj")
+	testutil.Assert(t, b.IsRetryableErr(err), "expected retryable error, got %v", err)
+}
@@ -0,0 +1,607 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"maps"
+	"path"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// CompressionEncoding is the compression algorithm of CompressedBucket.
+type CompressionEncoding string
+
+const (
+	CompressionGzip CompressionEncoding = "gzip"
+	CompressionZstd CompressionEncoding = "zstd"
+)
+
+// CompressionRule compresses the objects matching Pattern with Encoding. Pattern has the syntax of path.Match, and is
+// matched against the object name, then its base name, e.g. "*.json" matches all the JSON objects.
+type CompressionRule struct {
+	Pattern  string
+	Encoding CompressionEncoding
+}
+
+// CompressionConfig configures CompressedBucket.
+type CompressionConfig struct {
+	// Rules select the encoding of uploaded objects. The first matching rule applies, objects matching no rule are
+	// uploaded uncompressed.
+	Rules []CompressionRule
+	// FrameSize is the size of the uncompressed frames compressed independently. Range reads fetch and decompress the
+	// frames covering the range. Defaults to 256KiB, and is at most 64MiB.
+	FrameSize int
+}
+
+const (
+	defaultCompressionFrameSize = 256 << 10
+	// maxCompressionFrameSize bounds the frame size, so that corrupted frame headers cannot cause huge allocations.
+	maxCompressionFrameSize = 64 << 20
+
+	compressionMagic        = "OBJSCMP1"
+	compressionTrailerMagic = "OBJSCMPX"
+	// compressionHeaderSize is the size of the magic, the encoding and the frame size.
+	compressionHeaderSize = len(compressionMagic) + 1 + 4
+	frameHeaderSize       = 8
+	// compressionTrailerSize is the size of the uncompressed size, the number of frames, the frame size, the encoding
+	// and the magic.
+	compressionTrailerSize = 8 + 4 + 4 + 1 + len(compressionTrailerMagic)
+	// compressionTailSize is the size of the end of objects read to get the trailer and the frame index at once.
+	compressionTailSize = 4096
+
+	// Keys of the user metadata recording the encoding of the uploaded objects, for providers supporting it.
+	compressionEncodingMetadataKey = "objstore-content-encoding"
+	compressionSizeMetadataKey     = "objstore-uncompressed-size"
+	// compressionIdentity is the encoding recorded for objects uploaded uncompressed.
+	compressionIdentity = "identity"
+)
+
+var compressionEncodingIDs = map[CompressionEncoding]byte{CompressionGzip: 1, CompressionZstd: 2}
+
+// CompressedBucket is a Bucket transparently compressing objects, with the encoding selected by their name.
+//
+// Compressed objects are split in frames compressed independently, followed by an index of the frames, so that
+// GetRange only fetches and decompresses the frames covering the range. Objects uploaded without compression, directly
+// or matching no rule, are read as is.
+//
+// All reads first get the attributes of the object, to tell whether it is compressed. The encoding of the objects
+// uploaded through the bucket, compressed or not, is recorded in their user metadata. For providers not supporting
+// user metadata, or objects uploaded directly, compressed objects are recognized by their trailer, which costs an
+// additional request.
+type CompressedBucket struct {
+	bkt       Bucket
+	cfg       CompressionConfig
+	zstdEnc   *zstd.Encoder
+	zstdDec   *zstd.Decoder
+	frameSize int
+}
+
+// NewCompressedBucket returns a CompressedBucket compressing the objects of bkt according to cfg.
+func NewCompressedBucket(bkt Bucket, cfg CompressionConfig) (*CompressedBucket, error) {
+	for _, rule := range cfg.Rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", rule.Pattern)
+		}
+		if _, ok := compressionEncodingIDs[rule.Encoding]; !ok {
+			return nil, errors.Errorf("unsupported encoding %q", rule.Encoding)
+		}
+	}
+	if cfg.FrameSize < 0 || cfg.FrameSize > maxCompressionFrameSize {
+		return nil, errors.Errorf("invalid frame size %d", cfg.FrameSize)
+	}
+	frameSize := cfg.FrameSize
+	if frameSize == 0 {
+		frameSize = defaultCompressionFrameSize
+	}
+	zstdEnc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd encoder")
+	}
+	zstdDec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd decoder")
+	}
+	return &CompressedBucket{bkt: bkt, cfg: cfg, zstdEnc: zstdEnc, zstdDec: zstdDec, frameSize: frameSize}, nil
+}
+
+// encoding returns the encoding of the object, and false if it is not compressed.
+func (b *CompressedBucket) encoding(name string) (CompressionEncoding, bool) {
+	for _, rule := range b.cfg.Rules {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.Encoding, true
+		}
+		if ok, _ := path.Match(rule.Pattern, path.Base(name)); ok {
+			return rule.Encoding, true
+		}
+	}
+	return "", false
+}
+
+func (b *CompressedBucket) compress(encoding byte, dst *bytes.Buffer, frame []byte) error {
+	switch encoding {
+	case compressionEncodingIDs[CompressionZstd]:
+		dst.Write(b.zstdEnc.EncodeAll(frame, nil))
+		return nil
+	case compressionEncodingIDs[CompressionGzip]:
+		w := gzip.NewWriter(dst)
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	return errors.Errorf("unknown encoding %d", encoding)
+}
+
+func (b *CompressedBucket) decompress(encoding byte, frame []byte, size int) ([]byte, error) {
+	switch encoding {
+	case compressionEncodingIDs[CompressionZstd]:
+		return b.zstdDec.DecodeAll(frame, make([]byte, 0, size))
+	case compressionEncodingIDs[CompressionGzip]:
+		r, err := gzip.NewReader(bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		out := bytes.NewBuffer(make([]byte, 0, size))
+		// Frames decompressing to more than expected are reported by the caller.
+		if _, err := io.Copy(out, io.LimitReader(r, int64(size)+1)); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), r.Close()
+	}
+	return nil, errors.Errorf("unknown encoding %d", encoding)
+}
+
+// compressionIndex is read from the end of compressed objects:
+//
+//	compressed frame sizes (uint32 each) | uncompressed size (uint64) | number of frames (uint32) | frame size (uint32) | encoding | magic
+//
+// Frames are stored after the header, each prefixed by its compressed and uncompressed sizes (uint32 each), and
+// followed by an empty frame header marking the end of the frames. All integers are big endian.
+type compressionIndex struct {
+	size      int64
+	frameSize int64
+	encoding  byte
+	// offsets are the offsets of the frames in the object, followed by the offset of the end of the frames.
+	offsets []int64
+}
+
+// index reads the frame index of the object of the given size, and returns false if it is not compressed.
+func (b *CompressedBucket) index(ctx context.Context, name string, size int64) (*compressionIndex, bool, error) {
+	if size < int64(compressionHeaderSize+frameHeaderSize+compressionTrailerSize) {
+		return nil, false, nil
+	}
+	tailSize := min(size, compressionTailSize)
+	tail, err := readAllAndClose(b.bkt.GetRange(ctx, name, size-tailSize, tailSize))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(tail)) != tailSize {
+		return nil, false, errors.Errorf("read end of %s: expected %d bytes, got %d", name, tailSize, len(tail))
+	}
+	trailer := tail[len(tail)-compressionTrailerSize:]
+	if string(trailer[17:]) != compressionTrailerMagic {
+		return nil, false, nil
+	}
+
+	idx := &compressionIndex{
+		size:      int64(binary.BigEndian.Uint64(trailer)),
+		frameSize: int64(binary.BigEndian.Uint32(trailer[12:])),
+		encoding:  trailer[16],
+	}
+	frames := int64(binary.BigEndian.Uint32(trailer[8:]))
+	indexSize := frames * 4
+	if idx.frameSize <= 0 || idx.frameSize > maxCompressionFrameSize || indexSize+int64(compressionTrailerSize) > size {
+		return nil, false, errors.Errorf("invalid frame index of %s", name)
+	}
+	entries := tail[:len(tail)-compressionTrailerSize]
+	if int64(len(entries)) >= indexSize {
+		entries = entries[int64(len(entries))-indexSize:]
+	} else {
+		entries, err = readAllAndClose(b.bkt.GetRange(ctx, name, size-int64(compressionTrailerSize)-indexSize, indexSize))
+		if err != nil {
+			return nil, false, err
+		}
+		if int64(len(entries)) != indexSize {
+			return nil, false, errors.Errorf("read frame index of %s: expected %d bytes, got %d", name, indexSize, len(entries))
+		}
+	}
+
+	offset := int64(compressionHeaderSize)
+	idx.offsets = make([]int64, 0, frames+1)
+	for i := int64(0); i < frames; i++ {
+		idx.offsets = append(idx.offsets, offset)
+		offset += int64(binary.BigEndian.Uint32(entries[i*4:]))
+	}
+	idx.offsets = append(idx.offsets, offset)
+	return idx, true, nil
+}
+
+// detect returns the attributes of the object and whether it is compressed, from the encoding recorded in its user
+// metadata, or from its trailer otherwise. The frame index is returned if it was read to find the trailer.
+func (b *CompressedBucket) detect(ctx context.Context, name string) (ObjectAttributes, bool, *compressionIndex, error) {
+	attrs, err := b.bkt.Attributes(ctx, name)
+	if err != nil {
+		return attrs, false, nil, err
+	}
+	if encoding, ok := attrs.UserMetadata[compressionEncodingMetadataKey]; ok {
+		return attrs, encoding != compressionIdentity, nil, nil
+	}
+	idx, ok, err := b.index(ctx, name, attrs.Size)
+	if err != nil {
+		return attrs, false, nil, err
+	}
+	return attrs, ok, idx, nil
+}
+
+// uncompressedSize returns the uncompressed size recorded in the user metadata of the compressed object, or read
+// from its trailer.
+func (b *CompressedBucket) uncompressedSize(ctx context.Context, name string, attrs ObjectAttributes, idx *compressionIndex) (int64, error) {
+	if idx != nil {
+		return idx.size, nil
+	}
+	if size, err := strconv.ParseInt(attrs.UserMetadata[compressionSizeMetadataKey], 10, 64); err == nil {
+		return size, nil
+	}
+	idx, ok, err := b.index(ctx, name, attrs.Size)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.Errorf("missing frame index of compressed object %s", name)
+	}
+	return idx.size, nil
+}
+
+func (b *CompressedBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *CompressedBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *CompressedBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return b.bkt.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *CompressedBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+// Get returns the object, decompressed if it is compressed.
+func (b *CompressedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if name == "" {
+		// Let the bucket report the invalid name.
+		return b.bkt.Get(ctx, name)
+	}
+	attrs, compressed, idx, err := b.detect(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return b.bkt.Get(ctx, name)
+	}
+	size, err := b.uncompressedSize(ctx, name, attrs, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(rc)
+	header := make([]byte, compressionHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		_ = rc.Close()
+		return nil, errors.Wrapf(err, "read header of %s", name)
+	}
+	frameSize := int64(binary.BigEndian.Uint32(header[len(compressionMagic)+1:]))
+	if string(header[:len(compressionMagic)]) != compressionMagic || frameSize <= 0 || frameSize > maxCompressionFrameSize {
+		_ = rc.Close()
+		return nil, errors.Errorf("invalid header of compressed object %s", name)
+	}
+
+	return &decompressingReader{
+		b:         b,
+		name:      name,
+		rc:        rc,
+		r:         r,
+		encoding:  header[len(compressionMagic)],
+		frameSize: frameSize,
+		frames:    -1,
+		remaining: -1,
+		size:      size,
+	}, nil
+}
+
+// GetRange reads the frame index of the object, then the frames covering the range.
+func (b *CompressedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, errors.Errorf("invalid range offset %d", off)
+	}
+	if length <= 0 && length != -1 {
+		return nil, errors.Errorf("invalid range length %d", length)
+	}
+	attrs, compressed, idx, err := b.detect(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return b.bkt.GetRange(ctx, name, off, length)
+	}
+	if idx == nil {
+		var ok bool
+		if idx, ok, err = b.index(ctx, name, attrs.Size); err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.Errorf("missing frame index of compressed object %s", name)
+		}
+	}
+
+	end := idx.size
+	if length != -1 {
+		end = min(off+length, idx.size)
+	}
+	if off >= end {
+		return ObjectSizerReadCloser{
+			ReadCloser: io.NopCloser(bytes.NewReader(nil)),
+			Size:       func() (int64, error) { return 0, nil },
+		}, nil
+	}
+
+	first, last := off/idx.frameSize, (end-1)/idx.frameSize
+	if last >= int64(len(idx.offsets)-1) {
+		return nil, errors.Errorf("invalid frame index of %s", name)
+	}
+	start := idx.offsets[first]
+	rc, err := b.bkt.GetRange(ctx, name, start, idx.offsets[last+1]-start)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressingReader{
+		b:         b,
+		name:      name,
+		rc:        rc,
+		r:         bufio.NewReader(rc),
+		encoding:  idx.encoding,
+		frameSize: idx.frameSize,
+		frames:    last - first + 1,
+		skip:      int(off - first*idx.frameSize),
+		remaining: end - off,
+		size:      end - off,
+	}, nil
+}
+
+func (b *CompressedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.bkt.Exists(ctx, name)
+}
+
+// Attributes returns the attributes of the object, with its uncompressed size. The checksum of compressed objects, of
+// the compressed content, is omitted.
+func (b *CompressedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	attrs, compressed, idx, err := b.detect(ctx, name)
+	if err != nil {
+		return ObjectAttributes{}, err
+	}
+	if compressed {
+		if attrs.Size, err = b.uncompressedSize(ctx, name, attrs, idx); err != nil {
+			return ObjectAttributes{}, err
+		}
+		attrs.Checksum = ""
+	}
+	if _, ok := attrs.UserMetadata[compressionEncodingMetadataKey]; ok {
+		attrs.UserMetadata = maps.Clone(attrs.UserMetadata)
+		delete(attrs.UserMetadata, compressionEncodingMetadataKey)
+		delete(attrs.UserMetadata, compressionSizeMetadataKey)
+	}
+	return attrs, nil
+}
+
+// Upload compresses the object while uploading it, if its name matches a rule.
+func (b *CompressedBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	encoding, ok := b.encoding(name)
+	if !ok {
+		metadata := map[string]string{compressionEncodingMetadataKey: compressionIdentity}
+		maps.Copy(metadata, ApplyObjectUploadOptions(opts...).UserMetadata)
+		return b.bkt.Upload(ctx, name, r, append(opts, WithUserMetadata(metadata))...)
+	}
+
+	metadata := map[string]string{compressionEncodingMetadataKey: string(encoding)}
+	if size, err := TryToGetSize(r); err == nil {
+		metadata[compressionSizeMetadataKey] = strconv.FormatInt(size, 10)
+	}
+	maps.Copy(metadata, ApplyObjectUploadOptions(opts...).UserMetadata)
+	opts = append(opts, WithUserMetadata(metadata))
+
+	header := make([]byte, 0, compressionHeaderSize)
+	header = append(header, compressionMagic...)
+	header = append(header, compressionEncodingIDs[encoding])
+	header = binary.BigEndian.AppendUint32(header, uint32(b.frameSize))
+	return b.bkt.Upload(ctx, name, &compressingReader{
+		b:        b,
+		r:        r,
+		encoding: compressionEncodingIDs[encoding],
+		buf:      make([]byte, b.frameSize),
+		out:      bytes.NewBuffer(header),
+	}, opts...)
+}
+
+func (b *CompressedBucket) Delete(ctx context.Context, name string) error {
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *CompressedBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *CompressedBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *CompressedBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.bkt, err) }
+
+func (b *CompressedBucket) Close() error {
+	_ = b.zstdEnc.Close()
+	b.zstdDec.Close()
+	return b.bkt.Close()
+}
+
+func (b *CompressedBucket) Name() string { return b.bkt.Name() }
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// compressingReader reads the header, the compressed frames, then the frame index of the content of r.
+type compressingReader struct {
+	b        *CompressedBucket
+	r        io.Reader
+	encoding byte
+	buf      []byte
+	out      *bytes.Buffer
+	done     bool
+
+	size       int64
+	frameSizes []uint32
+}
+
+func (r *compressingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+func (r *compressingReader) nextFrame() error {
+	n, err := io.ReadFull(r.r, r.buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n > 0 {
+		r.out.Write(make([]byte, frameHeaderSize))
+		if err := r.b.compress(r.encoding, r.out, r.buf[:n]); err != nil {
+			return errors.Wrap(err, "compress frame")
+		}
+		frame := r.out.Bytes()
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-frameHeaderSize))
+		binary.BigEndian.PutUint32(frame[4:], uint32(n))
+		r.frameSizes = append(r.frameSizes, uint32(len(frame)))
+		r.size += int64(n)
+	}
+	if n == len(r.buf) {
+		return nil
+	}
+
+	// End of the content: end of frames marker, index and trailer.
+	r.out.Write(make([]byte, frameHeaderSize))
+	trailer := make([]byte, 0, len(r.frameSizes)*4+compressionTrailerSize)
+	for _, size := range r.frameSizes {
+		trailer = binary.BigEndian.AppendUint32(trailer, size)
+	}
+	trailer = binary.BigEndian.AppendUint64(trailer, uint64(r.size))
+	trailer = binary.BigEndian.AppendUint32(trailer, uint32(len(r.frameSizes)))
+	trailer = binary.BigEndian.AppendUint32(trailer, uint32(len(r.buf)))
+	trailer = append(trailer, r.encoding)
+	trailer = append(trailer, compressionTrailerMagic...)
+	r.out.Write(trailer)
+	r.done = true
+	return nil
+}
+
+// decompressingReader reads and decompresses frames.
+type decompressingReader struct {
+	b        *CompressedBucket
+	name     string
+	rc       io.ReadCloser
+	r        *bufio.Reader
+	encoding byte
+	size     int64
+	// frameSize bounds the uncompressed size of the frames.
+	frameSize int64
+
+	// frames is the number of frames left to read, -1 when reading until the end of the frames.
+	frames int64
+	// skip is the number of bytes to skip at the beginning of the first frame.
+	skip int
+	// remaining is the number of bytes left to return, -1 when reading until the end of the frames.
+	remaining int64
+
+	buf   []byte
+	plain []byte
+	done  bool
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	for len(r.plain) == 0 {
+		if r.frames == 0 || r.done {
+			return 0, io.EOF
+		}
+		if err := r.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	if r.remaining != -1 {
+		n = int(min(int64(n), r.remaining))
+		r.remaining -= int64(n)
+	}
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *decompressingReader) nextFrame() error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return errors.Wrapf(err, "read frame header of %s", r.name)
+	}
+	compressedSize := int64(binary.BigEndian.Uint32(header[:]))
+	size := int64(binary.BigEndian.Uint32(header[4:]))
+	if compressedSize == 0 {
+		r.done = true
+		return nil
+	}
+	// Compressed frames are at most slightly bigger than uncompressed ones.
+	if size > r.frameSize || compressedSize > 2*r.frameSize+1024 {
+		return errors.Errorf("invalid frame header of %s", r.name)
+	}
+	if int64(cap(r.buf)) < compressedSize {
+		r.buf = make([]byte, compressedSize)
+	}
+	r.buf = r.buf[:compressedSize]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return errors.Wrapf(err, "read frame of %s", r.name)
+	}
+	plain, err := r.b.decompress(r.encoding, r.buf, int(size))
+	if err != nil {
+		return errors.Wrapf(err, "decompress frame of %s", r.name)
+	}
+	if int64(len(plain)) != size {
+		return errors.Errorf("decompress frame of %s: expected %d bytes, got %d", r.name, size, len(plain))
+	}
+	if r.frames > 0 {
+		r.frames--
+	}
+	skip := min(r.skip, len(plain))
+	r.skip -= skip
+	r.plain = plain[skip:]
+	return nil
+}
+
+func (r *decompressingReader) ObjectSize() (int64, error) { return r.size, nil }
+
+func (r *decompressingReader) Close() error { return r.rc.Close() }
@@ -0,0 +1,222 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestCompressedBucket_AcceptanceTest(t *testing.T) {
+	for _, encoding := range []CompressionEncoding{CompressionGzip, CompressionZstd} {
+		t.Run(string(encoding), func(t *testing.T) {
+			b, err := NewCompressedBucket(NewInMemBucket(), CompressionConfig{Rules: []CompressionRule{{Pattern: "*.some", Encoding: encoding}}})
+			testutil.Ok(t, err)
+			AcceptanceTest(t, b)
+		})
+	}
+}
+
+func TestCompressedBucket_Ranges(t *testing.T) {
+	ctx := context.Background()
+	for _, encoding := range []CompressionEncoding{CompressionGzip, CompressionZstd} {
+		t.Run(string(encoding), func(t *testing.T) {
+			inmem := NewInMemBucket()
+			b, err := NewCompressedBucket(inmem, CompressionConfig{Rules: []CompressionRule{{Pattern: "*", Encoding: encoding}}, FrameSize: 5})
+			testutil.Ok(t, err)
+
+			for _, size := range []int{0, 1, 5, 12, 15} {
+				content := []byte("abcdefghijklmnopqrstuvwxyz"[:size])
+				name := fmt.Sprintf("obj-%d", size)
+				testutil.Ok(t, b.Upload(ctx, name, strings.NewReader(string(content))))
+
+				attrs, err := b.Attributes(ctx, name)
+				testutil.Ok(t, err)
+				testutil.Equals(t, int64(size), attrs.Size)
+
+				rc, err := b.Get(ctx, name)
+				testutil.Ok(t, err)
+				testutil.Equals(t, content, readDecompressed(t, rc, int64(size)))
+
+				for off := 0; off <= size+1; off++ {
+					for _, length := range []int{-1, 1, 3, 5, 6, 11, 20} {
+						rc, err := b.GetRange(ctx, name, int64(off), int64(length))
+						testutil.Ok(t, err)
+						end := size
+						if length != -1 {
+							end = min(off+length, size)
+						}
+						expected := []byte{}
+						if off < end {
+							expected = content[off:end]
+						}
+						testutil.Equals(t, expected, readDecompressed(t, rc, int64(len(expected))), "off %d, length %d", off, length)
+					}
+				}
+			}
+		})
+	}
+}
+
+func readDecompressed(t *testing.T, rc io.ReadCloser, expectedSize int64) []byte {
+	t.Helper()
+	size, err := TryToGetSize(rc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expectedSize, size)
+	content, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	if content == nil {
+		content = []byte{}
+	}
+	return content
+}
+
+func TestCompressedBucket_Upload(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	rec := NewRecordingBucket(inmem)
+	b, err := NewCompressedBucket(rec, CompressionConfig{Rules: []CompressionRule{
+		{Pattern: "logs/*", Encoding: CompressionGzip},
+		{Pattern: "*.json", Encoding: CompressionZstd},
+	}, FrameSize: 1024})
+	testutil.Ok(t, err)
+
+	content := strings.Repeat(`{"key": "value"}`, 10000)
+	testutil.Ok(t, b.Upload(ctx, "blocks/meta.json", strings.NewReader(content), WithUserMetadata(map[string]string{"owner": "me"})))
+	testutil.Ok(t, b.Upload(ctx, "logs/app", strings.NewReader(content)))
+	testutil.Ok(t, b.Upload(ctx, "blocks/chunks", strings.NewReader(content)))
+
+	testutil.Assert(t, len(inmem.Objects()["blocks/meta.json"]) < len(content)/10, "expected object to be compressed")
+	testutil.Assert(t, len(inmem.Objects()["logs/app"]) < len(content)/10, "expected object to be compressed")
+	testutil.Equals(t, content, string(inmem.Objects()["blocks/chunks"]))
+	for _, name := range []string{"blocks/meta.json", "logs/app", "blocks/chunks"} {
+		testutil.Equals(t, content, readObject(t, b, name))
+	}
+
+	// The encoding is recorded in the user metadata.
+	uploads := rec.Recording().Interactions
+	testutil.Equals(t, map[string]string{
+		"owner":                        "me",
+		compressionEncodingMetadataKey: "zstd",
+		compressionSizeMetadataKey:     fmt.Sprint(len(content)),
+	}, uploads[0].Request.UserMetadata)
+	testutil.Equals(t, "gzip", uploads[1].Request.UserMetadata[compressionEncodingMetadataKey])
+	testutil.Equals(t, map[string]string{compressionEncodingMetadataKey: "identity"}, uploads[2].Request.UserMetadata)
+
+	// Range reads only fetch the frames covering the range.
+	rc, err := b.GetRange(ctx, "logs/app", 5000, 10)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []byte(content[5000:5010]), readDecompressed(t, rc, 10))
+	interactions := rec.Recording().Interactions
+	last := interactions[len(interactions)-1].Request
+	testutil.Equals(t, OpGetRange, last.Op)
+	testutil.Assert(t, last.Length < 1024, "expected a single compressed frame to be fetched, got %d bytes", last.Length)
+
+	_, err = NewCompressedBucket(inmem, CompressionConfig{Rules: []CompressionRule{{Pattern: "*", Encoding: "lz4"}}})
+	testutil.NotOk(t, err)
+	_, err = NewCompressedBucket(inmem, CompressionConfig{Rules: []CompressionRule{{Pattern: "[", Encoding: CompressionGzip}}})
+	testutil.NotOk(t, err)
+}
+
+func TestCompressedBucket_UncompressedObjects(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	b, err := NewCompressedBucket(inmem, CompressionConfig{Rules: []CompressionRule{{Pattern: "*", Encoding: CompressionZstd}}})
+	testutil.Ok(t, err)
+
+	// Objects uploaded before compression was enabled are read as is.
+	content := strings.Repeat("raw content ", 100)
+	testutil.Ok(t, inmem.Upload(ctx, "raw", strings.NewReader(content)))
+	testutil.Ok(t, inmem.Upload(ctx, "short", strings.NewReader("x")))
+
+	testutil.Equals(t, content, readObject(t, b, "raw"))
+	testutil.Equals(t, "x", readObject(t, b, "short"))
+	attrs, err := b.Attributes(ctx, "raw")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(len(content)), attrs.Size)
+	rc, err := b.GetRange(ctx, "raw", 4, 7)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []byte("content"), readDecompressed(t, rc, 7))
+}
+
+func TestCompressedBucket_Detection(t *testing.T) {
+	ctx := context.Background()
+	inmem := &metadataBucket{InMemBucket: NewInMemBucket(), metadata: map[string]map[string]string{}}
+	rec := NewRecordingBucket(inmem)
+	b, err := NewCompressedBucket(rec, CompressionConfig{Rules: []CompressionRule{{Pattern: "*.json", Encoding: CompressionZstd}}})
+	testutil.Ok(t, err)
+
+	// Raw objects uploaded through the bucket are read without looking for a trailer.
+	content := strings.Repeat("raw content ", 1000)
+	testutil.Ok(t, b.Upload(ctx, "raw", strings.NewReader(content)))
+	before := len(rec.Recording().Interactions)
+	rc, err := b.GetRange(ctx, "raw", 4, 7)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []byte("content"), readDecompressed(t, rc, 7))
+	var ops []string
+	for _, i := range rec.Recording().Interactions[before:] {
+		ops = append(ops, i.Request.Op)
+	}
+	testutil.Equals(t, []string{OpAttributes, OpGetRange}, ops)
+
+	// Get and GetRange agree on objects looking like compressed ones.
+	fake := compressionMagic + "\x02\x00\x00\x00\x10 not compressed"
+	testutil.Ok(t, inmem.Upload(ctx, "fake.json", strings.NewReader(fake)))
+	testutil.Equals(t, fake, readObject(t, b, "fake.json"))
+	rc, err = b.GetRange(ctx, "fake.json", 0, int64(len(fake)))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []byte(fake), readDecompressed(t, rc, int64(len(fake))))
+
+	// Corrupted frame headers are reported, rather than allocating their size.
+	testutil.Ok(t, b.Upload(ctx, "obj.json", strings.NewReader(content)))
+	compressed := inmem.Objects()["obj.json"]
+	attrs, err := inmem.Attributes(ctx, "obj.json")
+	testutil.Ok(t, err)
+	corrupted := bytes.Clone(compressed)
+	binary.BigEndian.PutUint32(corrupted[compressionHeaderSize+4:], 0xffffffff)
+	testutil.Ok(t, inmem.Upload(ctx, "obj.json", bytes.NewReader(corrupted), WithUserMetadata(attrs.UserMetadata)))
+	rc, err = b.Get(ctx, "obj.json")
+	testutil.Ok(t, err)
+	_, err = io.ReadAll(rc)
+	testutil.NotOk(t, err)
+	testutil.Ok(t, rc.Close())
+}
+
+// metadataBucket is an InMemBucket keeping the user metadata of the objects, like most providers.
+type metadataBucket struct {
+	*InMemBucket
+
+	mtx      sync.Mutex
+	metadata map[string]map[string]string
+}
+
+func (b *metadataBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	if err := b.InMemBucket.Upload(ctx, name, r, opts...); err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.metadata[name] = ApplyObjectUploadOptions(opts...).UserMetadata
+	return nil
+}
+
+func (b *metadataBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	attrs, err := b.InMemBucket.Attributes(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	attrs.UserMetadata = b.metadata[name]
+	return attrs, nil
+}
@@ -0,0 +1,521 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/bits"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ChunkingMode is the way DedupBucket splits objects in chunks stored under their hash.
+type ChunkingMode string
+
+const (
+	// ChunkingNone stores whole objects as a single chunk. Objects are buffered in memory while uploaded.
+	ChunkingNone ChunkingMode = ""
+	// ChunkingFixed splits objects in chunks of a fixed size.
+	ChunkingFixed ChunkingMode = "fixed"
+	// ChunkingContentDefined splits objects at positions defined by their content, so that inserting or removing data
+	// only changes the chunks around the change.
+	ChunkingContentDefined ChunkingMode = "content-defined"
+)
+
+// DedupConfig configures DedupBucket.
+type DedupConfig struct {
+	Chunking ChunkingMode
+	// ChunkSize is the size of the chunks with fixed size chunking, and their average size with content defined
+	// chunking, where chunks are between a quarter and four times that size.
+	ChunkSize int
+	// GCGracePeriod is the minimum age of the unreferenced chunks deleted by GC, so that the chunks of concurrent
+	// uploads, not referenced yet, are kept. Uploads reusing chunks older than half of it upload them again, so that
+	// GC running concurrently keeps them as long as the uploads take less than half of it. With no grace period, GC
+	// must not run while objects are uploaded.
+	GCGracePeriod time.Duration
+}
+
+// DefaultDedupConfig splits objects in content defined chunks of 1MiB on average.
+var DefaultDedupConfig = DedupConfig{
+	Chunking:      ChunkingContentDefined,
+	ChunkSize:     1 << 20,
+	GCGracePeriod: 24 * time.Hour,
+}
+
+const (
+	dedupRefsDir   = "refs"
+	dedupChunksDir = "chunks"
+)
+
+// DedupBucket is a Bucket storing the content of objects in chunks named after the SHA-256 of their content, so that
+// content uploaded several times, under any name, is stored once. Each object is a reference object listing its
+// chunks, stored under the refs/ directory of the underlying bucket, while chunks are stored under chunks/.
+//
+// Deletes only remove the reference objects. GC deletes the chunks not referenced anymore and older than the grace
+// period, which uploads reusing chunks refresh.
+type DedupBucket struct {
+	logger log.Logger
+	bkt    Bucket
+	refs   Bucket
+	chunks Bucket
+	cfg    DedupConfig
+	now    func() time.Time
+
+	chunksUploaded  prometheus.Counter
+	chunksReused    prometheus.Counter
+	chunksRefreshed prometheus.Counter
+	bytesUploaded   prometheus.Counter
+	bytesReused     prometheus.Counter
+}
+
+// NewDedupBucket returns a DedupBucket storing objects in bkt.
+func NewDedupBucket(logger log.Logger, bkt Bucket, cfg DedupConfig, reg prometheus.Registerer) (*DedupBucket, error) {
+	switch cfg.Chunking {
+	case ChunkingNone:
+	case ChunkingFixed, ChunkingContentDefined:
+		if cfg.ChunkSize < 64 {
+			return nil, errors.Errorf("chunk size %d is too small", cfg.ChunkSize)
+		}
+	default:
+		return nil, errors.Errorf("unsupported chunking mode %q", cfg.Chunking)
+	}
+	return &DedupBucket{
+		logger: logger,
+		bkt:    bkt,
+		refs:   NewPrefixedBucket(bkt, dedupRefsDir),
+		chunks: NewPrefixedBucket(bkt, dedupChunksDir),
+		cfg:    cfg,
+		now:    time.Now,
+
+		chunksUploaded: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_dedup_chunks_uploaded_total",
+			Help: "Total number of chunks uploaded, as their content was not stored yet.",
+		}),
+		chunksReused: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_dedup_chunks_reused_total",
+			Help: "Total number of chunks not uploaded, as their content was already stored.",
+		}),
+		chunksRefreshed: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_dedup_chunks_refreshed_total",
+			Help: "Total number of reused chunks uploaded again, as they were old enough to be deleted by a concurrent GC.",
+		}),
+		bytesUploaded: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_dedup_uploaded_bytes_total",
+			Help: "Total number of bytes of the uploaded chunks.",
+		}),
+		bytesReused: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_dedup_reused_bytes_total",
+			Help: "Total number of bytes of the chunks not uploaded, as their content was already stored.",
+		}),
+	}, nil
+}
+
+// dedupManifest is the content of reference objects.
+type dedupManifest struct {
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type,omitempty"`
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+	Chunks       []dedupChunk      `json:"chunks"`
+}
+
+type dedupChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// chunkName returns the name of the chunk with the given hash, under a directory per hash prefix to keep listings
+// short.
+func chunkName(hash string) string {
+	return path.Join(hash[:2], hash)
+}
+
+func (b *DedupBucket) manifest(ctx context.Context, name string) (*dedupManifest, error) {
+	content, err := readAllAndClose(b.refs.Get(ctx, name))
+	if err != nil {
+		return nil, err
+	}
+	var m dedupManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, errors.Wrapf(err, "decode reference object %s", name)
+	}
+	return &m, nil
+}
+
+func (b *DedupBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *DedupBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return b.refs.Iter(ctx, dir, f, options...)
+}
+
+func (b *DedupBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return b.refs.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *DedupBucket) SupportedIterOptions() []IterOptionType { return b.refs.SupportedIterOptions() }
+
+func (b *DedupBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.GetRange(ctx, name, 0, -1)
+}
+
+// GetRange reads the reference object, then the chunks covering the range.
+func (b *DedupBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, errors.Errorf("invalid range offset %d", off)
+	}
+	if length <= 0 && length != -1 {
+		return nil, errors.Errorf("invalid range length %d", length)
+	}
+	m, err := b.manifest(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	end := m.Size
+	if length != -1 {
+		end = min(off+length, m.Size)
+	}
+
+	r := &chunksReader{ctx: ctx, chunks: b.chunks, name: name, size: max(end-off, 0)}
+	var chunkOff int64
+	for _, c := range m.Chunks {
+		chunkEnd := chunkOff + c.Size
+		if chunkEnd > off && chunkOff < end {
+			start := max(off, chunkOff) - chunkOff
+			r.parts = append(r.parts, chunkPart{hash: c.Hash, off: start, length: min(end, chunkEnd) - chunkOff - start, size: c.Size})
+		}
+		chunkOff = chunkEnd
+	}
+	return r, nil
+}
+
+func (b *DedupBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.refs.Exists(ctx, name)
+}
+
+// Attributes returns the size, content type and user metadata of the object, and the last modification time of its
+// reference object.
+func (b *DedupBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	attrs, err := b.refs.Attributes(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+	m, err := b.manifest(ctx, name)
+	if err != nil {
+		return ObjectAttributes{}, err
+	}
+	return ObjectAttributes{
+		Size:         m.Size,
+		LastModified: attrs.LastModified,
+		ContentType:  m.ContentType,
+		UserMetadata: m.UserMetadata,
+		ETag:         attrs.ETag,
+	}, nil
+}
+
+// Upload uploads the chunks of the content not stored yet, then the reference object.
+func (b *DedupBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	params := ApplyObjectUploadOptions(opts...)
+	m := dedupManifest{ContentType: params.ContentType, UserMetadata: params.UserMetadata, Chunks: []dedupChunk{}}
+
+	c := newChunker(r, b.cfg)
+	stored := map[string]struct{}{}
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read content")
+		}
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		m.Chunks = append(m.Chunks, dedupChunk{Hash: hash, Size: int64(len(chunk))})
+		m.Size += int64(len(chunk))
+
+		if _, ok := stored[hash]; ok {
+			b.chunksReused.Inc()
+			b.bytesReused.Add(float64(len(chunk)))
+			continue
+		}
+		if err := b.storeChunk(ctx, hash, chunk); err != nil {
+			return err
+		}
+		stored[hash] = struct{}{}
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "encode reference object")
+	}
+	return b.refs.Upload(ctx, name, bytes.NewReader(content), WithContentType("application/json"))
+}
+
+// storeChunk uploads the chunk unless already stored. Stored chunks older than half of the grace period are uploaded
+// again, as they might be unreferenced and deleted by a concurrent GC before the reference object is uploaded.
+func (b *DedupBucket) storeChunk(ctx context.Context, hash string, chunk []byte) error {
+	attrs, err := b.chunks.Attributes(ctx, chunkName(hash))
+	if err != nil && !b.chunks.IsObjNotFoundErr(err) {
+		return errors.Wrapf(err, "check chunk %s", hash)
+	}
+	if err == nil {
+		b.chunksReused.Inc()
+		b.bytesReused.Add(float64(len(chunk)))
+		if b.cfg.GCGracePeriod <= 0 || attrs.LastModified.After(b.now().Add(-b.cfg.GCGracePeriod/2)) {
+			return nil
+		}
+		if err := b.chunks.Upload(ctx, chunkName(hash), bytes.NewReader(chunk)); err != nil {
+			return errors.Wrapf(err, "refresh chunk %s", hash)
+		}
+		b.chunksRefreshed.Inc()
+		return nil
+	}
+	if err := b.chunks.Upload(ctx, chunkName(hash), bytes.NewReader(chunk)); err != nil {
+		return errors.Wrapf(err, "upload chunk %s", hash)
+	}
+	b.chunksUploaded.Inc()
+	b.bytesUploaded.Add(float64(len(chunk)))
+	return nil
+}
+
+// Delete deletes the reference object. Its chunks are deleted by GC once not referenced anymore.
+func (b *DedupBucket) Delete(ctx context.Context, name string) error {
+	return b.refs.Delete(ctx, name)
+}
+
+func (b *DedupBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *DedupBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *DedupBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.bkt, err) }
+
+func (b *DedupBucket) Close() error { return b.bkt.Close() }
+
+func (b *DedupBucket) Name() string { return b.bkt.Name() }
+
+// DedupGCStats are the results of a DedupBucket.GC pass.
+type DedupGCStats struct {
+	// References is the number of reference objects.
+	References int
+	// Chunks is the number of chunks before the deletions.
+	Chunks int
+	// DeletedChunks is the number of chunks deleted, as no reference object referenced them.
+	DeletedChunks int
+	// DeletedBytes is the size of the chunks deleted.
+	DeletedBytes int64
+}
+
+// GC counts the references to each chunk from all the reference objects, then deletes the chunks without references
+// older than cfg.GCGracePeriod. The age of each chunk is checked right before its deletion, so that chunks refreshed by
+// concurrent uploads are kept.
+func (b *DedupBucket) GC(ctx context.Context) (DedupGCStats, error) {
+	var stats DedupGCStats
+	refCounts := map[string]int{}
+	if err := b.refs.Iter(ctx, "", func(name string) error {
+		m, err := b.manifest(ctx, name)
+		if err != nil {
+			if b.bkt.IsObjNotFoundErr(err) {
+				// Deleted since listed.
+				return nil
+			}
+			return err
+		}
+		stats.References++
+		for _, c := range m.Chunks {
+			refCounts[c.Hash]++
+		}
+		return nil
+	}, WithRecursiveIter()); err != nil {
+		return stats, errors.Wrap(err, "count chunk references")
+	}
+
+	var options []IterOption
+	if slices.Contains(b.chunks.SupportedIterOptions(), UpdatedAt) {
+		options = append(options, WithUpdatedAt())
+	}
+	threshold := b.now().Add(-b.cfg.GCGracePeriod)
+	var unreferenced []IterObjectAttributes
+	if err := b.chunks.IterWithAttributes(ctx, "", func(attrs IterObjectAttributes) error {
+		stats.Chunks++
+		if refCounts[path.Base(attrs.Name)] == 0 {
+			unreferenced = append(unreferenced, attrs)
+		}
+		return nil
+	}, append(options, WithRecursiveIter())...); err != nil {
+		return stats, errors.Wrap(err, "list chunks")
+	}
+
+	for _, iterAttrs := range unreferenced {
+		attrs, err := b.chunks.Attributes(ctx, iterAttrs.Name)
+		if err != nil {
+			if b.bkt.IsObjNotFoundErr(err) {
+				continue
+			}
+			return stats, errors.Wrapf(err, "get attributes of chunk %s", iterAttrs.Name)
+		}
+		if attrs.LastModified.After(threshold) {
+			continue
+		}
+		if err := b.chunks.Delete(ctx, iterAttrs.Name); err != nil && !b.bkt.IsObjNotFoundErr(err) {
+			return stats, errors.Wrapf(err, "delete chunk %s", iterAttrs.Name)
+		}
+		stats.DeletedChunks++
+		stats.DeletedBytes += attrs.Size
+	}
+	level.Info(b.logger).Log("msg", "deleted unreferenced chunks", "references", stats.References, "chunks", stats.Chunks, "deleted", stats.DeletedChunks)
+	return stats, nil
+}
+
+// chunkPart is the part of a chunk read by chunksReader.
+type chunkPart struct {
+	hash        string
+	off, length int64
+	size        int64
+}
+
+// chunksReader reads the parts of the chunks of an object in order, opening one chunk at a time.
+type chunksReader struct {
+	ctx    context.Context
+	chunks Bucket
+	name   string
+	parts  []chunkPart
+	size   int64
+	cur    io.ReadCloser
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			part := r.parts[0]
+			r.parts = r.parts[1:]
+			var err error
+			if part.off == 0 && part.length == part.size {
+				r.cur, err = r.chunks.Get(r.ctx, chunkName(part.hash))
+			} else {
+				r.cur, err = r.chunks.GetRange(r.ctx, chunkName(part.hash), part.off, part.length)
+			}
+			if err != nil {
+				return 0, errors.Wrapf(err, "read chunk %s of %s", part.hash, r.name)
+			}
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			err = r.cur.Close()
+			r.cur = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunksReader) ObjectSize() (int64, error) { return r.size, nil }
+
+func (r *chunksReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	return r.cur.Close()
+}
+
+// chunker splits content in chunks according to the chunking mode.
+type chunker struct {
+	r   io.Reader
+	cfg DedupConfig
+	buf []byte
+	// n is the number of bytes of buf read but not returned yet.
+	n   int
+	eof bool
+	// cut is the size of the previous chunk, to drop from buf on the next call.
+	cut int
+}
+
+func newChunker(r io.Reader, cfg DedupConfig) *chunker {
+	c := &chunker{r: r, cfg: cfg}
+	switch cfg.Chunking {
+	case ChunkingFixed:
+		c.buf = make([]byte, cfg.ChunkSize)
+	case ChunkingContentDefined:
+		c.buf = make([]byte, cfg.ChunkSize*4)
+	}
+	return c
+}
+
+// next returns the next chunk, valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	if c.cfg.Chunking == ChunkingNone {
+		if c.eof {
+			return nil, io.EOF
+		}
+		c.eof = true
+		return io.ReadAll(c.r)
+	}
+
+	copy(c.buf, c.buf[c.cut:c.n])
+	c.n -= c.cut
+	c.cut = 0
+	if !c.eof {
+		read, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	c.cut = c.n
+	if c.cfg.Chunking == ChunkingContentDefined {
+		c.cut = contentDefinedCut(c.buf[:c.n], c.cfg.ChunkSize)
+	}
+	return c.buf[:c.cut], nil
+}
+
+// gearTable holds the random values of the gear rolling hash.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		table[i] = mix64(x)
+	}
+	return table
+}()
+
+// contentDefinedCut returns the size of the first chunk of data, between a quarter and four times the average size. It
+// is cut where the top bits of the gear rolling hash of the last 64 bytes are zero, as many as the bits of the average
+// size, so that cuts happen on average every average size bytes and only depend on the surrounding content.
+func contentDefinedCut(data []byte, avgSize int) int {
+	minSize, maxSize := avgSize/4, avgSize*4
+	if len(data) <= minSize {
+		return len(data)
+	}
+	shift := 64 - (bits.Len(uint(avgSize)) - 1)
+	var hash uint64
+	for i := minSize; i < min(len(data), maxSize); i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash>>shift == 0 {
+			return i + 1
+		}
+	}
+	return min(len(data), maxSize)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDedupBucket_AcceptanceTest(t *testing.T) {
+	for _, cfg := range []DedupConfig{
+		DefaultDedupConfig,
+		{Chunking: ChunkingFixed, ChunkSize: 1 << 20},
+		{Chunking: ChunkingNone},
+	} {
+		t.Run(string(cfg.Chunking), func(t *testing.T) {
+			b, err := NewDedupBucket(log.NewNopLogger(), NewInMemBucket(), cfg, nil)
+			testutil.Ok(t, err)
+			AcceptanceTest(t, b)
+		})
+	}
+}
+
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	testutil.Ok(t, err)
+	return content
+}
+
+func TestDedupBucket_Dedup(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	b, err := NewDedupBucket(log.NewNopLogger(), inmem, DedupConfig{Chunking: ChunkingFixed, ChunkSize: 64}, nil)
+	testutil.Ok(t, err)
+
+	content := randomContent(t, 300)
+	testutil.Ok(t, b.Upload(ctx, "backup-1/file", bytes.NewReader(content), WithContentType("application/octet-stream")))
+	testutil.Ok(t, b.Upload(ctx, "backup-2/file", bytes.NewReader(content)))
+	testutil.Equals(t, 5.0, promtest.ToFloat64(b.chunksUploaded))
+	testutil.Equals(t, 5.0, promtest.ToFloat64(b.chunksReused))
+	// Two reference objects and five chunks.
+	testutil.Equals(t, 7, len(inmem.Objects()))
+
+	for _, name := range []string{"backup-1/file", "backup-2/file"} {
+		testutil.Equals(t, string(content), readObject(t, b, name))
+	}
+	attrs, err := b.Attributes(ctx, "backup-1/file")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(300), attrs.Size)
+	testutil.Equals(t, "application/octet-stream", attrs.ContentType)
+
+	for _, off := range []int64{0, 10, 64, 100, 299, 300} {
+		for _, length := range []int64{-1, 1, 54, 64, 200} {
+			rc, err := b.GetRange(ctx, "backup-1/file", off, length)
+			testutil.Ok(t, err)
+			end := int64(len(content))
+			if length != -1 {
+				end = min(off+length, end)
+			}
+			size, err := TryToGetSize(rc)
+			testutil.Ok(t, err)
+			testutil.Equals(t, end-off, size)
+			got, err := io.ReadAll(rc)
+			testutil.Ok(t, err)
+			testutil.Ok(t, rc.Close())
+			testutil.Equals(t, string(content[off:end]), string(got), "off %d, length %d", off, length)
+		}
+	}
+}
+
+func TestDedupBucket_ContentDefinedChunking(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewDedupBucket(log.NewNopLogger(), NewInMemBucket(), DedupConfig{Chunking: ChunkingContentDefined, ChunkSize: 1024}, nil)
+	testutil.Ok(t, err)
+
+	content := randomContent(t, 64<<10)
+	testutil.Ok(t, b.Upload(ctx, "v1", bytes.NewReader(content)))
+	uploaded := promtest.ToFloat64(b.chunksUploaded)
+	testutil.Assert(t, uploaded > 16 && uploaded < 256, "expected chunks of 1KiB on average, got %v chunks", uploaded)
+
+	// Inserting data only changes the chunks around the insertion.
+	shifted := append(append(bytes.Clone(content[:30000]), "inserted"...), content[30000:]...)
+	testutil.Ok(t, b.Upload(ctx, "v2", bytes.NewReader(shifted)))
+	testutil.Assert(t, promtest.ToFloat64(b.chunksUploaded)-uploaded <= 3, "expected at most 3 new chunks, got %v", promtest.ToFloat64(b.chunksUploaded)-uploaded)
+	testutil.Equals(t, string(shifted), readObject(t, b, "v2"))
+}
+
+func TestDedupBucket_GC(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	b, err := NewDedupBucket(log.NewNopLogger(), inmem, DedupConfig{Chunking: ChunkingFixed, ChunkSize: 64, GCGracePeriod: time.Hour}, nil)
+	testutil.Ok(t, err)
+
+	shared := strings.Repeat("s", 64)
+	testutil.Ok(t, b.Upload(ctx, "a", strings.NewReader(shared+strings.Repeat("a", 64))))
+	testutil.Ok(t, b.Upload(ctx, "b", strings.NewReader(shared)))
+	testutil.Ok(t, b.Upload(ctx, "c", strings.NewReader(strings.Repeat("c", 10))))
+	testutil.Ok(t, b.Delete(ctx, "a"))
+	testutil.Ok(t, b.Delete(ctx, "c"))
+
+	// Unreferenced chunks are kept during the grace period.
+	stats, err := b.GC(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, DedupGCStats{References: 1, Chunks: 3}, stats)
+
+	b.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	stats, err = b.GC(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, DedupGCStats{References: 1, Chunks: 3, DeletedChunks: 2, DeletedBytes: 74}, stats)
+	testutil.Equals(t, shared, readObject(t, b, "b"))
+	testutil.Equals(t, 2, len(inmem.Objects()))
+
+	var names []string
+	testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"b"}, names)
+}
+
+func TestDedupBucket_GCDuringUpload(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	var (
+		b       *DedupBucket
+		gcStats DedupGCStats
+	)
+	// GC runs after the chunks of "b" are stored, before its reference object is uploaded.
+	bkt := &mockBucket{Bucket: inmem, upload: func(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+		if name == "refs/b" {
+			var err error
+			gcStats, err = b.GC(ctx)
+			testutil.Ok(t, err)
+		}
+		return inmem.Upload(ctx, name, r, opts...)
+	}, get: inmem.Get, getRange: inmem.GetRange}
+	b, err := NewDedupBucket(log.NewNopLogger(), bkt, DedupConfig{Chunking: ChunkingFixed, ChunkSize: 64, GCGracePeriod: time.Hour}, nil)
+	testutil.Ok(t, err)
+
+	content := strings.Repeat("a", 64) + strings.Repeat("b", 64)
+	testutil.Ok(t, b.Upload(ctx, "a", strings.NewReader(content)))
+	testutil.Ok(t, b.Delete(ctx, "a"))
+	// The chunks of "a" are unreferenced and older than the grace period.
+	for name := range inmem.Objects() {
+		testutil.Ok(t, inmem.ChangeLastModified(name, time.Now().Add(-2*time.Hour)))
+	}
+
+	testutil.Ok(t, b.Upload(ctx, "b", strings.NewReader(content)))
+	testutil.Equals(t, DedupGCStats{Chunks: 2}, gcStats)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.chunksRefreshed))
+	testutil.Equals(t, content, readObject(t, b, "b"))
+
+	// Recently stored chunks are reused without being uploaded again.
+	testutil.Ok(t, b.Upload(ctx, "c", strings.NewReader(content)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.chunksRefreshed))
+	testutil.Equals(t, 4.0, promtest.ToFloat64(b.chunksReused))
+}
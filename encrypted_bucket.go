@@ -0,0 +1,525 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// KMS wraps the per-object data keys of EncryptedBucket with key encryption keys it manages. Implementations calling
+// a remote service should cache the unwrapped keys, as every read unwraps the key of the object.
+type KMS interface {
+	// WrapKey encrypts dataKey with the current key encryption key, and returns the ID of that key with the
+	// encrypted data key.
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key encrypted with the key encryption key of the given ID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// EncryptionConfig configures EncryptedBucket.
+type EncryptionConfig struct {
+	// SegmentSize is the size of the plaintext segments encrypted separately, at most 64MiB. Range reads fetch and
+	// decrypt the segments covering the range. It is stored in each object, so that it can be changed for new objects
+	// only.
+	SegmentSize int
+}
+
+// DefaultEncryptionConfig encrypts objects in 64KiB segments.
+var DefaultEncryptionConfig = EncryptionConfig{SegmentSize: 64 << 10}
+
+const (
+	encryptionMagic = "OBJSENC1"
+	// encryptionPrefixSize is the size of the magic followed by the header size.
+	encryptionPrefixSize = len(encryptionMagic) + 4
+	maxKeyIDSize         = 255
+	maxWrappedKeySize    = 1024
+	maxHeaderSize        = encryptionPrefixSize + 4 + 2 + maxKeyIDSize + 2 + maxWrappedKeySize
+	dataKeySize          = 32
+
+	// maxSegmentSize bounds the segment size, so that corrupted headers cannot cause huge allocations before any
+	// segment is authenticated.
+	maxSegmentSize = 64 << 20
+)
+
+// EncryptedBucket is a Bucket encrypting objects on the client side, so that the provider only stores ciphertext.
+//
+// Each object is encrypted with its own random data key, wrapped by a KMS and stored in the object header. The
+// content is split in fixed size segments, each encrypted with AES-256-GCM and authenticated along with the header,
+// its position and whether it is the last one, so that segments can't be altered, reordered or truncated without
+// failing the reads. GetRange only fetches the header and the segments covering the range.
+//
+// Object sizes reported by Attributes and the readers are the plaintext ones. Attributes fetches the object header
+// in addition to the attributes, to compute it.
+type EncryptedBucket struct {
+	bkt Bucket
+	kms KMS
+	cfg EncryptionConfig
+}
+
+// NewEncryptedBucket returns an EncryptedBucket encrypting the objects of bkt with data keys wrapped by kms.
+func NewEncryptedBucket(bkt Bucket, kms KMS, cfg EncryptionConfig) (*EncryptedBucket, error) {
+	if cfg.SegmentSize <= 0 || cfg.SegmentSize > maxSegmentSize {
+		return nil, errors.Errorf("invalid segment size %d", cfg.SegmentSize)
+	}
+	return &EncryptedBucket{bkt: bkt, kms: kms, cfg: cfg}, nil
+}
+
+// encryptionHeader is the header of encrypted objects:
+//
+//	magic | header size (uint32) | segment size (uint32) | key ID size (uint16) | key ID | wrapped key size (uint16) | wrapped key
+//
+// All integers are big endian. The whole header is the additional authenticated data of all the segments.
+type encryptionHeader struct {
+	raw         []byte
+	segmentSize int
+	keyID       string
+	wrappedKey  []byte
+}
+
+func newEncryptionHeader(segmentSize int, keyID string, wrappedKey []byte) (*encryptionHeader, error) {
+	if len(keyID) > maxKeyIDSize {
+		return nil, errors.Errorf("key ID longer than %d bytes", maxKeyIDSize)
+	}
+	if len(wrappedKey) > maxWrappedKeySize {
+		return nil, errors.Errorf("wrapped key longer than %d bytes", maxWrappedKeySize)
+	}
+	raw := make([]byte, 0, maxHeaderSize)
+	raw = append(raw, encryptionMagic...)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(encryptionPrefixSize+4+2+len(keyID)+2+len(wrappedKey)))
+	raw = binary.BigEndian.AppendUint32(raw, uint32(segmentSize))
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(keyID)))
+	raw = append(raw, keyID...)
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(wrappedKey)))
+	raw = append(raw, wrappedKey...)
+	return &encryptionHeader{raw: raw, segmentSize: segmentSize, keyID: keyID, wrappedKey: wrappedKey}, nil
+}
+
+// readEncryptionHeader reads the header from the beginning of an encrypted object.
+func readEncryptionHeader(r io.Reader) (*encryptionHeader, error) {
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, errors.Wrap(err, "read encryption header")
+	}
+	if string(prefix[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("object is not encrypted")
+	}
+	size := int(binary.BigEndian.Uint32(prefix[len(encryptionMagic):]))
+	if size < encryptionPrefixSize+4+2+2 || size > maxHeaderSize {
+		return nil, errors.Errorf("invalid encryption header size %d", size)
+	}
+	raw := make([]byte, size)
+	copy(raw, prefix)
+	if _, err := io.ReadFull(r, raw[encryptionPrefixSize:]); err != nil {
+		return nil, errors.Wrap(err, "read encryption header")
+	}
+
+	h := &encryptionHeader{raw: raw}
+	rest := raw[encryptionPrefixSize:]
+	h.segmentSize = int(binary.BigEndian.Uint32(rest))
+	rest = rest[4:]
+	keyIDSize := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < keyIDSize+2 {
+		return nil, errors.New("truncated encryption header")
+	}
+	h.keyID = string(rest[:keyIDSize])
+	rest = rest[keyIDSize:]
+	wrappedKeySize := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) != wrappedKeySize {
+		return nil, errors.New("invalid wrapped key size in encryption header")
+	}
+	h.wrappedKey = rest
+	if h.segmentSize <= 0 || h.segmentSize > maxSegmentSize {
+		return nil, errors.Errorf("invalid segment size %d in encryption header", h.segmentSize)
+	}
+	return h, nil
+}
+
+// encryptedSegmentSize returns the size of an encrypted full segment.
+func (h *encryptionHeader) encryptedSegmentSize() int64 {
+	return int64(h.segmentSize) + 16
+}
+
+// plaintextSize returns the size of the plaintext of size bytes of encrypted segments.
+func (h *encryptionHeader) plaintextSize(size int64) int64 {
+	segments := (size + h.encryptedSegmentSize() - 1) / h.encryptedSegmentSize()
+	return max(size-segments*16, 0)
+}
+
+// encryptedSize returns the size of an object of size bytes of plaintext.
+func (h *encryptionHeader) encryptedSize(size int64) int64 {
+	segments := max((size+int64(h.segmentSize)-1)/int64(h.segmentSize), 1)
+	return int64(len(h.raw)) + size + segments*16
+}
+
+// segmentNonce returns the nonce of the segment at index, which also authenticates whether it is the last one.
+func segmentNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aead returns the cipher of the object with the header h, unwrapping its data key.
+func (b *EncryptedBucket) aead(ctx context.Context, h *encryptionHeader) (cipher.AEAD, error) {
+	key, err := b.kms.UnwrapKey(ctx, h.keyID, h.wrappedKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unwrap data key with key %s", h.keyID)
+	}
+	return newAEAD(key)
+}
+
+func (b *EncryptedBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *EncryptedBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *EncryptedBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return b.bkt.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *EncryptedBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *EncryptedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// Some readers only report the size of the unread data, so it must be read before the header.
+	encryptedSize, sizeErr := TryToGetSize(rc)
+
+	r := bufio.NewReader(rc)
+	h, err := readEncryptionHeader(r)
+	if err != nil {
+		_ = rc.Close()
+		return nil, errors.Wrapf(err, "get %s", name)
+	}
+	aead, err := b.aead(ctx, h)
+	if err != nil {
+		_ = rc.Close()
+		return nil, errors.Wrapf(err, "get %s", name)
+	}
+	return &decryptingReader{
+		name:      name,
+		rc:        rc,
+		r:         r,
+		aead:      aead,
+		h:         h,
+		segments:  -1,
+		remaining: -1,
+		size: func() (int64, error) {
+			if sizeErr != nil {
+				return 0, sizeErr
+			}
+			return h.plaintextSize(encryptedSize - int64(len(h.raw))), nil
+		},
+	}, nil
+}
+
+// GetRange fetches the header of the object, then the segments covering the range.
+func (b *EncryptedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, errors.Errorf("invalid range offset %d", off)
+	}
+	if length <= 0 && length != -1 {
+		return nil, errors.Errorf("invalid range length %d", length)
+	}
+	h, err := b.header(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := b.aead(ctx, h)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get range of %s", name)
+	}
+
+	segmentSize := int64(h.segmentSize)
+	first := off / segmentSize
+	start := int64(len(h.raw)) + first*h.encryptedSegmentSize()
+	segments, encryptedLength := int64(-1), int64(-1)
+	if length != -1 {
+		segments = (off+length-1)/segmentSize - first + 1
+		// One more byte tells whether the last segment is the last one of the object.
+		encryptedLength = segments*h.encryptedSegmentSize() + 1
+	}
+	rc, err := b.bkt.GetRange(ctx, name, start, encryptedLength)
+	if err != nil {
+		return nil, err
+	}
+	encryptedSize, sizeErr := TryToGetSize(rc)
+
+	return &decryptingReader{
+		name:      name,
+		rc:        rc,
+		r:         bufio.NewReader(rc),
+		aead:      aead,
+		h:         h,
+		index:     uint64(first),
+		segments:  segments,
+		skip:      int(off - first*segmentSize),
+		remaining: length,
+		size: func() (int64, error) {
+			if sizeErr != nil {
+				return 0, sizeErr
+			}
+			if encryptedLength != -1 && encryptedSize == encryptedLength {
+				// The object continues after the range.
+				return length, nil
+			}
+			size := max(h.plaintextSize(encryptedSize)-(off-first*segmentSize), 0)
+			if length != -1 {
+				size = min(size, length)
+			}
+			return size, nil
+		},
+	}, nil
+}
+
+// header reads the encryption header of the object.
+func (b *EncryptedBucket) header(ctx context.Context, name string) (_ *encryptionHeader, err error) {
+	rc, err := b.bkt.GetRange(ctx, name, 0, int64(maxHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := rc.Close(); cerr != nil && err == nil {
+			err = errors.Wrap(cerr, "close header reader")
+		}
+	}()
+	h, err := readEncryptionHeader(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read header of %s", name)
+	}
+	return h, nil
+}
+
+func (b *EncryptedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.bkt.Exists(ctx, name)
+}
+
+// Attributes returns the attributes of the object, with its plaintext size. The checksum, of the encrypted content,
+// is omitted.
+func (b *EncryptedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	attrs, err := b.bkt.Attributes(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+	h, err := b.header(ctx, name)
+	if err != nil {
+		return ObjectAttributes{}, err
+	}
+	attrs.Size = h.plaintextSize(attrs.Size - int64(len(h.raw)))
+	attrs.Checksum = ""
+	return attrs, nil
+}
+
+// Upload encrypts the content of r with a new data key while uploading it.
+func (b *EncryptedBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return errors.Wrap(err, "generate data key")
+	}
+	keyID, wrapped, err := b.kms.WrapKey(ctx, dataKey)
+	if err != nil {
+		return errors.Wrap(err, "wrap data key")
+	}
+	h, err := newEncryptionHeader(b.cfg.SegmentSize, keyID, wrapped)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	er := &encryptingReader{
+		r:     bufio.NewReader(r),
+		aead:  aead,
+		h:     h,
+		buf:   make([]byte, h.segmentSize),
+		out:   bytes.NewReader(h.raw),
+		plain: r,
+	}
+	return b.bkt.Upload(ctx, name, er, opts...)
+}
+
+func (b *EncryptedBucket) Delete(ctx context.Context, name string) error {
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *EncryptedBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *EncryptedBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *EncryptedBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.bkt, err) }
+
+func (b *EncryptedBucket) Close() error { return b.bkt.Close() }
+
+func (b *EncryptedBucket) Name() string { return b.bkt.Name() }
+
+// encryptingReader reads the header, then the encrypted segments of the plaintext.
+type encryptingReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	h      *encryptionHeader
+	buf    []byte
+	sealed []byte
+	out    *bytes.Reader
+	index  uint64
+	done   bool
+	// plain is the plaintext reader, to get its size.
+	plain io.Reader
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.nextSegment(); err != nil {
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+func (r *encryptingReader) nextSegment() error {
+	n, err := io.ReadFull(r.r, r.buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := n < len(r.buf)
+	if !final {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	r.sealed = r.aead.Seal(r.sealed[:0], segmentNonce(r.index, final), r.buf[:n], r.h.raw)
+	r.out.Reset(r.sealed)
+	r.index++
+	r.done = final
+	return nil
+}
+
+// ObjectSize returns the encrypted size, if the plaintext size is known.
+func (r *encryptingReader) ObjectSize() (int64, error) {
+	size, err := TryToGetSize(r.plain)
+	if err != nil {
+		return 0, err
+	}
+	return r.h.encryptedSize(size), nil
+}
+
+// decryptingReader reads and decrypts segments, starting at the one at index.
+type decryptingReader struct {
+	name string
+	rc   io.ReadCloser
+	r    *bufio.Reader
+	aead cipher.AEAD
+	h    *encryptionHeader
+	size func() (int64, error)
+
+	index uint64
+	// segments is the number of segments left to read, -1 when reading until the end of the object.
+	segments int64
+	// skip is the number of bytes to skip at the beginning of the first segment.
+	skip int
+	// remaining is the number of bytes left to return, -1 when reading until the end of the object.
+	remaining int64
+
+	buf     []byte
+	plain   []byte
+	started bool
+	final   bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	for len(r.plain) == 0 {
+		if r.segments == 0 || r.final {
+			return 0, io.EOF
+		}
+		if err := r.nextSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	if r.remaining != -1 {
+		n = int(min(int64(n), r.remaining))
+		r.remaining -= int64(n)
+	}
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) nextSegment() error {
+	if r.buf == nil {
+		r.buf = make([]byte, r.h.encryptedSegmentSize())
+	}
+	n, err := io.ReadFull(r.r, r.buf)
+	switch {
+	case err == io.EOF:
+		if r.started || r.index == 0 {
+			return errors.Errorf("decrypt %s: object is truncated", r.name)
+		}
+		// The range starts after the end of the object.
+		r.final = true
+		return nil
+	case err == io.ErrUnexpectedEOF:
+		r.final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.r.Peek(1); err == io.EOF {
+			r.final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := r.aead.Open(r.buf[:0], segmentNonce(r.index, r.final), r.buf[:n], r.h.raw)
+	if err != nil {
+		return errors.Wrapf(err, "decrypt segment %d of %s", r.index, r.name)
+	}
+	r.started = true
+	r.index++
+	if r.segments > 0 {
+		r.segments--
+	}
+	skip := min(r.skip, len(plain))
+	r.skip -= skip
+	r.plain = plain[skip:]
+	return nil
+}
+
+func (r *decryptingReader) ObjectSize() (int64, error) { return r.size() }
+
+func (r *decryptingReader) Close() error { return r.rc.Close() }
@@ -0,0 +1,157 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func newTestKMS(t *testing.T, ids ...string) *KeyfileKMS {
+	t.Helper()
+	var cfg KeyfileConfig
+	for _, id := range ids {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		testutil.Ok(t, err)
+		cfg.Keys = append(cfg.Keys, KeyfileKey{ID: id, Key: base64.StdEncoding.EncodeToString(key)})
+	}
+	kms, err := NewKeyfileKMSFromConfig(cfg)
+	testutil.Ok(t, err)
+	return kms
+}
+
+func TestEncryptedBucket_AcceptanceTest(t *testing.T) {
+	b, err := NewEncryptedBucket(NewInMemBucket(), newTestKMS(t, "key"), DefaultEncryptionConfig)
+	testutil.Ok(t, err)
+	AcceptanceTest(t, b)
+}
+
+func TestEncryptedBucket_Ranges(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	b, err := NewEncryptedBucket(inmem, newTestKMS(t, "key"), EncryptionConfig{SegmentSize: 5})
+	testutil.Ok(t, err)
+
+	for _, size := range []int{0, 1, 5, 12, 15} {
+		content := make([]byte, size)
+		_, err := rand.Read(content)
+		testutil.Ok(t, err)
+		name := fmt.Sprintf("obj-%d", size)
+		testutil.Ok(t, b.Upload(ctx, name, bytes.NewReader(content)))
+		testutil.Assert(t, !bytes.Contains(inmem.Objects()[name], content) || size < 5, "expected content to be encrypted")
+
+		attrs, err := b.Attributes(ctx, name)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(size), attrs.Size)
+
+		// Uploads report the encrypted size when the plaintext size is known.
+		h, err := b.header(ctx, name)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(len(inmem.Objects()[name])), h.encryptedSize(int64(size)))
+
+		rc, err := b.Get(ctx, name)
+		testutil.Ok(t, err)
+		testutil.Equals(t, content, readDecrypted(t, rc, int64(size)))
+
+		for off := 0; off <= size+1; off++ {
+			for _, length := range []int{-1, 1, 3, 5, 6, 11, 20} {
+				rc, err := b.GetRange(ctx, name, int64(off), int64(length))
+				testutil.Ok(t, err)
+				end := size
+				if length != -1 {
+					end = min(off+length, size)
+				}
+				expected := []byte{}
+				if off < end {
+					expected = content[off:end]
+				}
+				testutil.Equals(t, expected, readDecrypted(t, rc, int64(len(expected))), "off %d, length %d", off, length)
+			}
+		}
+	}
+}
+
+func readDecrypted(t *testing.T, rc io.ReadCloser, expectedSize int64) []byte {
+	t.Helper()
+	size, err := TryToGetSize(rc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expectedSize, size)
+	content, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	if content == nil {
+		content = []byte{}
+	}
+	return content
+}
+
+func TestEncryptedBucket_Tampering(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	b, err := NewEncryptedBucket(inmem, newTestKMS(t, "key"), EncryptionConfig{SegmentSize: 4})
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader("0123456789ab")))
+	encrypted := inmem.Objects()["obj"]
+	headerSize := len(encrypted) - 3*20
+
+	for _, tcase := range []struct {
+		name    string
+		content []byte
+	}{
+		{name: "flipped bit", content: func() []byte {
+			c := bytes.Clone(encrypted)
+			c[headerSize+25] ^= 1
+			return c
+		}()},
+		{name: "truncated at segment boundary", content: encrypted[:headerSize+2*20]},
+		{name: "header only", content: encrypted[:headerSize]},
+		{name: "swapped segments", content: func() []byte {
+			c := bytes.Clone(encrypted[:headerSize])
+			c = append(c, encrypted[headerSize+20:headerSize+40]...)
+			c = append(c, encrypted[headerSize:headerSize+20]...)
+			return append(c, encrypted[headerSize+40:]...)
+		}()},
+		{name: "not encrypted", content: []byte("plaintext content")},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Ok(t, inmem.Upload(ctx, "obj", bytes.NewReader(tcase.content)))
+			rc, err := b.Get(ctx, "obj")
+			if err == nil {
+				_, err = io.ReadAll(rc)
+				testutil.Ok(t, rc.Close())
+			}
+			testutil.NotOk(t, err)
+		})
+	}
+
+	// Huge segment sizes are rejected before allocating the segments.
+	c := bytes.Clone(encrypted)
+	binary.BigEndian.PutUint32(c[encryptionPrefixSize:], 0xfffffff0)
+	testutil.Ok(t, inmem.Upload(ctx, "obj", bytes.NewReader(c)))
+	rc, err := b.Get(ctx, "obj")
+	if err == nil {
+		_, err = io.ReadAll(rc)
+		testutil.Ok(t, rc.Close())
+	}
+	testutil.Assert(t, err != nil && strings.Contains(err.Error(), "invalid segment size"), "expected invalid segment size error, got %v", err)
+	_, err = NewEncryptedBucket(inmem, newTestKMS(t, "key"), EncryptionConfig{SegmentSize: maxSegmentSize + 1})
+	testutil.NotOk(t, err)
+
+	// Objects encrypted with another key can't be read.
+	other, err := NewEncryptedBucket(inmem, newTestKMS(t, "key"), DefaultEncryptionConfig)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader("content")))
+	_, err = other.Get(ctx, "obj")
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,355 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/errgroup"
+)
+
+// FallbackConfig configures FallbackBucket.
+type FallbackConfig struct {
+	// CopyOnRead copies the objects read from a fallback bucket with Get or GetRange into the first bucket, in the
+	// background, so that the data is lazily migrated.
+	CopyOnRead bool
+}
+
+// FallbackBucket is a Bucket reading from a chain of buckets: reads go to the first bucket and, if the object is not
+// found or the bucket fails, to the next ones in order. Listings merge the entries of all the buckets, which are
+// buffered in memory until all the buckets are listed.
+//
+// Uploads go to the first bucket only. Deletes go to all the buckets, so that deleted objects are not read from the
+// fallback buckets anymore.
+type FallbackBucket struct {
+	logger  log.Logger
+	buckets []Bucket
+	cfg     FallbackConfig
+
+	copiesMtx    sync.Mutex
+	copying      map[string]struct{}
+	copies       sync.WaitGroup
+	copiesCtx    context.Context
+	cancelCopies context.CancelFunc
+
+	reads          *prometheus.CounterVec
+	copied         prometheus.Counter
+	copiesFailures prometheus.Counter
+}
+
+// NewFallbackBucket returns a FallbackBucket over buckets, in order of preference.
+func NewFallbackBucket(logger log.Logger, buckets []Bucket, cfg FallbackConfig, reg prometheus.Registerer) (*FallbackBucket, error) {
+	if len(buckets) == 0 {
+		return nil, errors.New("at least one bucket is required")
+	}
+	copiesCtx, cancelCopies := context.WithCancel(context.Background())
+	b := &FallbackBucket{
+		logger:       logger,
+		buckets:      buckets,
+		cfg:          cfg,
+		copying:      map[string]struct{}{},
+		copiesCtx:    copiesCtx,
+		cancelCopies: cancelCopies,
+
+		reads: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_fallback_reads_total",
+			Help: "Total number of reads served by each bucket of the chain, by position. Reads served by positions other than 0 fell back.",
+		}, []string{"position", "operation"}),
+		copied: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_fallback_copies_total",
+			Help: "Total number of objects copied from a fallback bucket into the first bucket.",
+		}),
+		copiesFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_fallback_copy_failures_total",
+			Help: "Total number of failed copies of objects from a fallback bucket into the first bucket.",
+		}),
+	}
+	for i := range buckets {
+		for _, op := range []string{OpGet, OpGetRange, OpExists, OpAttributes} {
+			b.reads.WithLabelValues(strconv.Itoa(i), op)
+		}
+	}
+	return b, nil
+}
+
+// read calls fn on each bucket until it succeeds, and returns the position of the bucket which succeeded. If all
+// fail, the first error which is not a not found error is returned, or the not found error of the first bucket.
+func (b *FallbackBucket) read(op string, fn func(Bucket) error) (int, error) {
+	var notFoundErr, firstErr error
+	for i, bkt := range b.buckets {
+		err := fn(bkt)
+		if err == nil {
+			b.reads.WithLabelValues(strconv.Itoa(i), op).Inc()
+			return i, nil
+		}
+		if bkt.IsObjNotFoundErr(err) {
+			if notFoundErr == nil {
+				notFoundErr = err
+			}
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return -1, firstErr
+	}
+	return -1, notFoundErr
+}
+
+// copyToFirst copies the object from the bucket at position i into the first bucket, in the background, until the
+// bucket is closed. The copy is skipped if the object was uploaded to the first bucket in the meantime; an upload
+// racing with the final check may still be overwritten, as buckets don't support conditional writes.
+func (b *FallbackBucket) copyToFirst(i int, name string) {
+	if i <= 0 || !b.cfg.CopyOnRead {
+		return
+	}
+	b.copiesMtx.Lock()
+	defer b.copiesMtx.Unlock()
+	if b.copiesCtx.Err() != nil {
+		return
+	}
+	if _, ok := b.copying[name]; ok {
+		return
+	}
+	b.copying[name] = struct{}{}
+
+	b.copies.Add(1)
+	go func() {
+		defer b.copies.Done()
+		defer func() {
+			b.copiesMtx.Lock()
+			delete(b.copying, name)
+			b.copiesMtx.Unlock()
+		}()
+
+		copied, err := copyObjectUnless(b.copiesCtx, b.buckets[i], b.buckets[0], name, func(ctx context.Context) (bool, error) {
+			return b.buckets[0].Exists(ctx, name)
+		})
+		if err != nil {
+			b.copiesFailures.Inc()
+			level.Warn(b.logger).Log("msg", "failed to copy object from fallback bucket", "position", i, "name", name, "err", err)
+			return
+		}
+		if copied {
+			b.copied.Inc()
+		}
+	}()
+}
+
+func (b *FallbackBucket) Provider() ObjProvider { return b.buckets[0].Provider() }
+
+// Iter calls f with the entries of all the buckets, deduplicated and sorted. It fails if any bucket fails. The entries
+// are buffered in memory, f is only called once all the buckets are listed.
+func (b *FallbackBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return mergedIter(ctx, b.buckets, dir, f, options...)
+}
+
+// IterWithAttributes calls f with the entries of all the buckets, deduplicated and sorted. The attributes are the ones
+// of the first bucket having the entry. It fails if any bucket fails.
+func (b *FallbackBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return mergedIterWithAttributes(ctx, b.buckets, dir, f, options...)
+}
+
+// SupportedIterOptions returns the options supported by all the buckets.
+func (b *FallbackBucket) SupportedIterOptions() []IterOptionType {
+	return commonIterOptions(b.buckets)
+}
+
+func (b *FallbackBucket) Get(ctx context.Context, name string) (rc io.ReadCloser, err error) {
+	i, err := b.read(OpGet, func(bkt Bucket) (err error) {
+		rc, err = bkt.Get(ctx, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.copyToFirst(i, name)
+	return rc, nil
+}
+
+// GetRange reads the range from the first bucket having the object. With CopyOnRead, the whole object is copied.
+func (b *FallbackBucket) GetRange(ctx context.Context, name string, off, length int64) (rc io.ReadCloser, err error) {
+	i, err := b.read(OpGetRange, func(bkt Bucket) (err error) {
+		rc, err = bkt.GetRange(ctx, name, off, length)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.copyToFirst(i, name)
+	return rc, nil
+}
+
+// Exists returns true if any bucket has the object. Errors are returned only if no bucket has it.
+func (b *FallbackBucket) Exists(ctx context.Context, name string) (bool, error) {
+	var firstErr error
+	for i, bkt := range b.buckets {
+		exists, err := bkt.Exists(ctx, name)
+		if err == nil && exists {
+			b.reads.WithLabelValues(strconv.Itoa(i), OpExists).Inc()
+			return true, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return false, firstErr
+}
+
+func (b *FallbackBucket) Attributes(ctx context.Context, name string) (attrs ObjectAttributes, err error) {
+	_, err = b.read(OpAttributes, func(bkt Bucket) (err error) {
+		attrs, err = bkt.Attributes(ctx, name)
+		return err
+	})
+	return attrs, err
+}
+
+func (b *FallbackBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	return b.buckets[0].Upload(ctx, name, r, opts...)
+}
+
+// Delete deletes the object from all the buckets. It returns a not found error only if no bucket had the object.
+func (b *FallbackBucket) Delete(ctx context.Context, name string) error {
+	var notFoundErr error
+	deleted := false
+	for _, bkt := range b.buckets {
+		err := bkt.Delete(ctx, name)
+		switch {
+		case err == nil:
+			deleted = true
+		case bkt.IsObjNotFoundErr(err):
+			if notFoundErr == nil {
+				notFoundErr = err
+			}
+		default:
+			return err
+		}
+	}
+	if deleted {
+		return nil
+	}
+	return notFoundErr
+}
+
+// IsObjNotFoundErr returns true if any bucket of the chain classifies err as not found.
+func (b *FallbackBucket) IsObjNotFoundErr(err error) bool {
+	return slices.ContainsFunc(b.buckets, func(bkt Bucket) bool { return bkt.IsObjNotFoundErr(err) })
+}
+
+// IsAccessDeniedErr returns true if any bucket of the chain classifies err as access denied.
+func (b *FallbackBucket) IsAccessDeniedErr(err error) bool {
+	return slices.ContainsFunc(b.buckets, func(bkt Bucket) bool { return bkt.IsAccessDeniedErr(err) })
+}
+
+// IsRetryableErr returns true if any bucket of the chain classifies err as retryable.
+func (b *FallbackBucket) IsRetryableErr(err error) bool {
+	return slices.ContainsFunc(b.buckets, func(bkt Bucket) bool { return IsRetryableErr(bkt, err) })
+}
+
+// Close cancels the copies in progress, waits for them to return and closes all the buckets.
+func (b *FallbackBucket) Close() error {
+	// Copies are only started under the lock, so none can start once canceled.
+	b.copiesMtx.Lock()
+	b.cancelCopies()
+	b.copiesMtx.Unlock()
+	b.copies.Wait()
+	return closeAll(b.buckets)
+}
+
+func (b *FallbackBucket) Name() string { return b.buckets[0].Name() }
+
+// mergedIter lists dir in all the buckets concurrently, and calls f with the entries deduplicated and sorted.
+func mergedIter(ctx context.Context, buckets []Bucket, dir string, f func(string) error, options ...IterOption) error {
+	return mergeListings(ctx, buckets, func(ctx context.Context, bkt Bucket, add func(IterObjectAttributes)) error {
+		return bkt.Iter(ctx, dir, func(name string) error {
+			add(IterObjectAttributes{Name: name})
+			return nil
+		}, options...)
+	}, func(attrs IterObjectAttributes) error { return f(attrs.Name) })
+}
+
+// mergedIterWithAttributes lists dir in all the buckets concurrently, and calls f with the entries deduplicated and
+// sorted. The attributes are the ones of the first bucket having the entry.
+func mergedIterWithAttributes(ctx context.Context, buckets []Bucket, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return mergeListings(ctx, buckets, func(ctx context.Context, bkt Bucket, add func(IterObjectAttributes)) error {
+		return bkt.IterWithAttributes(ctx, dir, func(attrs IterObjectAttributes) error {
+			add(attrs)
+			return nil
+		}, options...)
+	}, f)
+}
+
+// mergeListings lists all the buckets concurrently with list, and calls f with the entries deduplicated and sorted.
+// Listings are not guaranteed to be sorted, so the entries of all the buckets are buffered in memory before calling f:
+// memory grows with the number of entries listed, and f is not called before the slowest bucket is listed.
+func mergeListings(
+	ctx context.Context,
+	buckets []Bucket,
+	list func(context.Context, Bucket, func(IterObjectAttributes)) error,
+	f func(IterObjectAttributes) error,
+) error {
+	entries := make([][]IterObjectAttributes, len(buckets))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, bkt := range buckets {
+		g.Go(func() error {
+			return list(gctx, bkt, func(attrs IterObjectAttributes) { entries[i] = append(entries[i], attrs) })
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	seen := map[string]IterObjectAttributes{}
+	for _, bucketEntries := range entries {
+		for _, attrs := range bucketEntries {
+			if _, ok := seen[attrs.Name]; !ok {
+				seen[attrs.Name] = attrs
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := f(seen[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commonIterOptions returns the iter options supported by all the buckets.
+func commonIterOptions(buckets []Bucket) []IterOptionType {
+	opts := buckets[0].SupportedIterOptions()
+	for _, bkt := range buckets[1:] {
+		other := bkt.SupportedIterOptions()
+		opts = slices.DeleteFunc(slices.Clone(opts), func(o IterOptionType) bool { return !slices.Contains(other, o) })
+	}
+	return opts
+}
+
+// closeAll closes all the buckets and returns the first error.
+func closeAll(buckets []Bucket) error {
+	var firstErr error
+	for _, bkt := range buckets {
+		if err := bkt.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "close bucket %s", bkt.Name())
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,172 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFallbackBucket_AcceptanceTest(t *testing.T) {
+	b, err := NewFallbackBucket(log.NewNopLogger(), []Bucket{NewInMemBucket(), NewInMemBucket()}, FallbackConfig{CopyOnRead: true}, nil)
+	testutil.Ok(t, err)
+	AcceptanceTest(t, b)
+}
+
+// newFallbackBuckets returns two buckets having old/ and new/ objects respectively, and both a shared object.
+func newFallbackBuckets(t *testing.T) (*InMemBucket, *InMemBucket) {
+	ctx := context.Background()
+	first, second := NewInMemBucket(), NewInMemBucket()
+	testutil.Ok(t, first.Upload(ctx, "new/obj", strings.NewReader("new")))
+	testutil.Ok(t, first.Upload(ctx, "shared", strings.NewReader("first")))
+	testutil.Ok(t, second.Upload(ctx, "old/obj", strings.NewReader("old")))
+	testutil.Ok(t, second.Upload(ctx, "shared", strings.NewReader("second")))
+	return first, second
+}
+
+func TestFallbackBucket_Reads(t *testing.T) {
+	ctx := context.Background()
+	first, second := newFallbackBuckets(t)
+	faults := WithFaults(first)
+	b, err := NewFallbackBucket(log.NewNopLogger(), []Bucket{faults, second}, FallbackConfig{}, nil)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, "new", readObject(t, b, "new/obj"))
+	testutil.Equals(t, "first", readObject(t, b, "shared"))
+	testutil.Equals(t, "old", readObject(t, b, "old/obj"))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.reads.WithLabelValues("1", OpGet)))
+
+	rc, err := b.GetRange(ctx, "old/obj", 1, 1)
+	testutil.Ok(t, err)
+	content, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "l", string(content))
+	attrs, err := b.Attributes(ctx, "old/obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(3), attrs.Size)
+	ok, err := b.Exists(ctx, "old/obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist")
+
+	_, err = b.Get(ctx, "missing")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	ok, err = b.Exists(ctx, "missing")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected object not to exist")
+
+	// Unavailable buckets are skipped, but their error is returned rather than not found if no bucket has the object.
+	faults.SetRules(FaultRule{Probability: 1, Err: ErrFaultTransient})
+	testutil.Equals(t, "second", readObject(t, b, "shared"))
+	_, err = b.Get(ctx, "new/obj")
+	testutil.Assert(t, errors.Is(err, ErrFaultTransient), "expected transient error, got %v", err)
+	testutil.Assert(t, !b.IsObjNotFoundErr(err), "expected error not to be a not found error")
+}
+
+func TestFallbackBucket_CopyOnRead(t *testing.T) {
+	first, second := newFallbackBuckets(t)
+	b, err := NewFallbackBucket(log.NewNopLogger(), []Bucket{first, second}, FallbackConfig{CopyOnRead: true}, nil)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, "old", readObject(t, b, "old/obj"))
+	testutil.Equals(t, "first", readObject(t, b, "shared"))
+	b.copies.Wait()
+	testutil.Equals(t, "old", readObject(t, first, "old/obj"))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.copied))
+
+	// Copied objects are read from the first bucket.
+	testutil.Equals(t, "old", readObject(t, b, "old/obj"))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.reads.WithLabelValues("1", OpGet)))
+	testutil.Ok(t, b.Close())
+}
+
+func TestFallbackBucket_CopyOnReadRacingUpload(t *testing.T) {
+	first, second := newFallbackBuckets(t)
+	var gets atomic.Int32
+	racing := &mockBucket{
+		Bucket: second,
+		get: func(ctx context.Context, name string) (io.ReadCloser, error) {
+			// The object is uploaded to the first bucket while the copy reads the fallback one.
+			if gets.Add(1) == 2 {
+				testutil.Ok(t, first.Upload(ctx, name, strings.NewReader("uploaded")))
+			}
+			return second.Get(ctx, name)
+		},
+	}
+	b, err := NewFallbackBucket(log.NewNopLogger(), []Bucket{first, racing}, FallbackConfig{CopyOnRead: true}, nil)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, "old", readObject(t, b, "old/obj"))
+	testutil.Ok(t, b.Close())
+	testutil.Equals(t, "uploaded", readObject(t, first, "old/obj"))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.copied))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.copiesFailures))
+}
+
+func TestFallbackBucket_CloseCancelsCopies(t *testing.T) {
+	first, second := newFallbackBuckets(t)
+	uploading := make(chan struct{})
+	blocked := &mockBucket{
+		Bucket: first,
+		get:    first.Get,
+		upload: func(ctx context.Context, _ string, _ io.Reader, _ ...ObjectUploadOption) error {
+			close(uploading)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	b, err := NewFallbackBucket(log.NewNopLogger(), []Bucket{blocked, second}, FallbackConfig{CopyOnRead: true}, nil)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, "old", readObject(t, b, "old/obj"))
+	<-uploading
+	testutil.Ok(t, b.Close())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.copiesFailures))
+
+	// No copies are started once closed.
+	testutil.Equals(t, "old", readObject(t, b, "old/obj"))
+	b.copies.Wait()
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.copiesFailures))
+}
+
+func TestFallbackBucket_Writes(t *testing.T) {
+	ctx := context.Background()
+	first, second := newFallbackBuckets(t)
+	b, err := NewFallbackBucket(log.NewNopLogger(), []Bucket{first, second}, FallbackConfig{}, nil)
+	testutil.Ok(t, err)
+
+	var names []string
+	testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"new/", "old/", "shared"}, names)
+
+	names = nil
+	testutil.Ok(t, b.IterWithAttributes(ctx, "", func(attrs IterObjectAttributes) error {
+		names = append(names, attrs.Name)
+		return nil
+	}, WithRecursiveIter()))
+	testutil.Equals(t, []string{"new/obj", "old/obj", "shared"}, names)
+
+	testutil.Ok(t, b.Upload(ctx, "upload", strings.NewReader("content")))
+	_, err = second.Attributes(ctx, "upload")
+	testutil.Assert(t, second.IsObjNotFoundErr(err), "expected upload to go to the first bucket only, got %v", err)
+
+	// Deletes remove the object from all the buckets.
+	testutil.Ok(t, b.Delete(ctx, "shared"))
+	_, err = b.Get(ctx, "shared")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	testutil.Ok(t, b.Delete(ctx, "old/obj"))
+	err = b.Delete(ctx, "old/obj")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+}
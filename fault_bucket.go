@@ -0,0 +1,326 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrFaultNotFound is an injected error recognized by FaultBucket.IsObjNotFoundErr.
+	ErrFaultNotFound = errors.New("injected fault: object not found")
+	// ErrFaultAccessDenied is an injected error recognized by FaultBucket.IsAccessDeniedErr.
+	ErrFaultAccessDenied = errors.New("injected fault: access denied")
+	// ErrFaultTransient is an injected error simulating a temporary provider failure, e.g. throttling or a reset connection.
+	ErrFaultTransient = errors.New("injected fault: transient error")
+)
+
+// ReaderFaultKind is the kind of fault injected into a reader stream.
+type ReaderFaultKind int
+
+const (
+	// ReaderTruncate ends the stream with io.ErrUnexpectedEOF.
+	ReaderTruncate ReaderFaultKind = iota
+	// ReaderCorrupt flips the bits of every byte past the fault offset.
+	ReaderCorrupt
+)
+
+// ReaderFault describes a fault injected into the stream returned by Get and GetRange or passed to Upload.
+type ReaderFault struct {
+	Kind ReaderFaultKind
+	// After is the number of bytes passed through untouched before the fault kicks in.
+	After int64
+}
+
+// FaultRule describes when and which fault is injected by FaultBucket.
+type FaultRule struct {
+	// Ops is the list of operations (OpGet, OpUpload...) the rule applies to. Empty matches all operations.
+	Ops []string
+	// NamePattern is a path.Match pattern matched against the object name, or the directory for OpIter.
+	// Empty matches all names.
+	NamePattern string
+
+	// OnCall injects the fault only on the Nth (1-based) matching call. When 0, Probability is used instead.
+	OnCall int
+	// Probability in [0, 1] of injecting the fault on a matching call.
+	Probability float64
+
+	// Err is returned instead of calling the wrapped bucket. ErrFaultNotFound, ErrFaultAccessDenied and
+	// ErrFaultTransient are recognized by the FaultBucket classifiers. Errors obtained from the wrapped
+	// provider can be used to exercise its own classifiers.
+	Err error
+	// Latency returns the delay added before the operation is executed.
+	Latency func() time.Duration
+	// Reader injects a fault into the object stream.
+	Reader *ReaderFault
+	// ReadDelay is the delay added to every Read call on the object stream, simulating a slow reader.
+	ReadDelay time.Duration
+}
+
+// FixedLatency returns a latency distribution always returning d.
+func FixedLatency(d time.Duration) func() time.Duration {
+	return func() time.Duration { return d }
+}
+
+// UniformLatency returns a latency distribution uniformly distributed in [minimum, maximum).
+func UniformLatency(minimum, maximum time.Duration) func() time.Duration {
+	return func() time.Duration {
+		if maximum <= minimum {
+			return minimum
+		}
+		return minimum + time.Duration(rand.Int63n(int64(maximum-minimum)))
+	}
+}
+
+// ExponentialLatency returns an exponentially distributed latency with the given mean, which models
+// the long tail of remote object storage requests.
+func ExponentialLatency(mean time.Duration) func() time.Duration {
+	return func() time.Duration {
+		return time.Duration(rand.ExpFloat64() * float64(mean))
+	}
+}
+
+// FaultBucket is a Bucket wrapper injecting errors, latency and broken streams according to a set of rules.
+// It is meant for testing the resilience of bucket clients. Methods are thread-safe.
+type FaultBucket struct {
+	bkt Bucket
+
+	mtx   sync.Mutex
+	rnd   *rand.Rand
+	rules []FaultRule
+	calls []int
+}
+
+// WithFaults returns a FaultBucket wrapping bkt and injecting faults according to the rules.
+// The first matching rule that triggers wins.
+func WithFaults(bkt Bucket, rules ...FaultRule) *FaultBucket {
+	b := &FaultBucket{bkt: bkt, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	b.SetRules(rules...)
+	return b
+}
+
+// SetRules replaces the rules and resets the call counters.
+func (b *FaultBucket) SetRules(rules ...FaultRule) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.rules = rules
+	b.calls = make([]int, len(rules))
+}
+
+// Seed seeds the random source used for probabilistic rules, making them deterministic.
+func (b *FaultBucket) Seed(seed int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.rnd = rand.New(rand.NewSource(seed))
+}
+
+// fault returns the rule triggered by the given call, if any.
+func (b *FaultBucket) fault(op, name string) (FaultRule, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var (
+		triggered FaultRule
+		found     bool
+	)
+	for i, r := range b.rules {
+		if len(r.Ops) > 0 && !slices.Contains(r.Ops, op) {
+			continue
+		}
+		if r.NamePattern != "" {
+			if ok, _ := path.Match(r.NamePattern, name); !ok {
+				continue
+			}
+		}
+		// Count every matching call, so OnCall stays stable whatever the other rules do.
+		b.calls[i]++
+		if found {
+			continue
+		}
+		if r.OnCall > 0 {
+			found = b.calls[i] == r.OnCall
+		} else {
+			found = r.Probability > 0 && b.rnd.Float64() < r.Probability
+		}
+		if found {
+			triggered = r
+		}
+	}
+	return triggered, found
+}
+
+// before applies the latency and error of the rule triggered by the call.
+func (b *FaultBucket) before(ctx context.Context, op, name string) (FaultRule, error) {
+	r, ok := b.fault(op, name)
+	if !ok {
+		return r, nil
+	}
+	if r.Latency != nil {
+		select {
+		case <-time.After(r.Latency()):
+		case <-ctx.Done():
+			return r, ctx.Err()
+		}
+	}
+	if r.Err != nil {
+		return r, errors.Wrapf(r.Err, "%s %s", op, name)
+	}
+	return r, nil
+}
+
+func (b *FaultBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *FaultBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	if _, err := b.before(ctx, OpIter, dir); err != nil {
+		return err
+	}
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *FaultBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	if _, err := b.before(ctx, OpIter, dir); err != nil {
+		return err
+	}
+	return b.bkt.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *FaultBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *FaultBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := b.before(ctx, OpGet, name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return newFaultReader(rc, r), nil
+}
+
+func (b *FaultBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	r, err := b.before(ctx, OpGetRange, name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	return newFaultReader(rc, r), nil
+}
+
+func (b *FaultBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if _, err := b.before(ctx, OpExists, name); err != nil {
+		return false, err
+	}
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *FaultBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if _, err := b.before(ctx, OpAttributes, name); err != nil {
+		return ObjectAttributes{}, err
+	}
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *FaultBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	rule, err := b.before(ctx, OpUpload, name)
+	if err != nil {
+		return err
+	}
+	if rule.Reader != nil || rule.ReadDelay > 0 {
+		r = newFaultReader(NopCloserWithSize(r), rule)
+	}
+	return b.bkt.Upload(ctx, name, r, opts...)
+}
+
+func (b *FaultBucket) Delete(ctx context.Context, name string) error {
+	if _, err := b.before(ctx, OpDelete, name); err != nil {
+		return err
+	}
+	return b.bkt.Delete(ctx, name)
+}
+
+// IsObjNotFoundErr returns true if error means that object is not found, either injected or returned by the wrapped bucket.
+func (b *FaultBucket) IsObjNotFoundErr(err error) bool {
+	return errors.Is(err, ErrFaultNotFound) || b.bkt.IsObjNotFoundErr(err)
+}
+
+// IsAccessDeniedErr returns true if access to object is denied, either injected or returned by the wrapped bucket.
+func (b *FaultBucket) IsAccessDeniedErr(err error) bool {
+	return errors.Is(err, ErrFaultAccessDenied) || b.bkt.IsAccessDeniedErr(err)
+}
+
+// IsRetryableErr returns true if the error is transient, either injected with ErrFaultTransient or according to the
+// wrapped bucket.
+func (b *FaultBucket) IsRetryableErr(err error) bool {
+	return errors.Is(err, ErrFaultTransient) || IsRetryableErr(b.bkt, err)
+}
+
+func (b *FaultBucket) Close() error { return b.bkt.Close() }
+
+func (b *FaultBucket) Name() string { return b.bkt.Name() }
+
+type faultReader struct {
+	io.ReadCloser
+
+	fault *ReaderFault
+	delay time.Duration
+	read  int64
+}
+
+func newFaultReader(rc io.ReadCloser, r FaultRule) io.ReadCloser {
+	if r.Reader == nil && r.ReadDelay == 0 {
+		return rc
+	}
+	return &faultReader{ReadCloser: rc, fault: r.Reader, delay: r.ReadDelay}
+}
+
+func (r *faultReader) Read(p []byte) (int, error) {
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+	}
+	if r.fault == nil {
+		return r.ReadCloser.Read(p)
+	}
+
+	if r.fault.Kind == ReaderTruncate {
+		left := r.fault.After - r.read
+		if left <= 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if r.fault.Kind == ReaderCorrupt {
+		for i := 0; i < n; i++ {
+			if r.read+int64(i) >= r.fault.After {
+				p[i] = ^p[i]
+			}
+		}
+	}
+	r.read += int64(n)
+	return n, err
+}
+
+// ObjectSize returns the size of the wrapped stream, as announced by the provider.
+func (r *faultReader) ObjectSize() (int64, error) {
+	return TryToGetSize(r.ReadCloser)
+}
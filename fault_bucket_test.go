@@ -0,0 +1,154 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestFaultBucket_AcceptanceTest(t *testing.T) {
+	AcceptanceTest(t, WithFaults(NewInMemBucket()))
+}
+
+func TestFaultBucket_Errors(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "a/index", strings.NewReader("index")))
+	testutil.Ok(t, inmem.Upload(ctx, "a/chunks", strings.NewReader("chunks")))
+
+	b := WithFaults(inmem,
+		FaultRule{Ops: []string{OpGet}, NamePattern: "*/index", OnCall: 2, Err: ErrFaultTransient},
+		FaultRule{Ops: []string{OpAttributes}, Probability: 1, Err: ErrFaultAccessDenied},
+		FaultRule{Ops: []string{OpExists}, NamePattern: "a/chunks", Probability: 1, Err: ErrFaultNotFound},
+	)
+
+	// Only the second matching call fails.
+	for i := 1; i <= 3; i++ {
+		rc, err := b.Get(ctx, "a/index")
+		if i == 2 {
+			testutil.NotOk(t, err)
+			testutil.Assert(t, errors.Is(err, ErrFaultTransient), "expected transient error, got %v", err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+	}
+	// Other names are not matched.
+	rc, err := b.Get(ctx, "a/chunks")
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+
+	_, err = b.Attributes(ctx, "a/index")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+	testutil.Assert(t, !b.IsObjNotFoundErr(err), "expected access denied error, got %v", err)
+
+	_, err = b.Exists(ctx, "a/chunks")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+
+	// Errors from the wrapped bucket are still classified.
+	_, err = b.Get(ctx, "missing")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+
+	// Resetting the rules removes the faults.
+	b.SetRules()
+	_, err = b.Attributes(ctx, "a/index")
+	testutil.Ok(t, err)
+}
+
+func TestFaultBucket_Probability(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("data")))
+
+	b := WithFaults(inmem, FaultRule{Probability: 0.5, Err: ErrFaultTransient})
+	b.Seed(42)
+
+	var failed int
+	for i := 0; i < 1000; i++ {
+		if _, err := b.Exists(ctx, "obj"); err != nil {
+			failed++
+		}
+	}
+	testutil.Assert(t, failed > 400 && failed < 600, "expected about half of the calls to fail, got %d", failed)
+}
+
+func TestFaultBucket_Readers(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("0123456789")))
+
+	t.Run("truncate", func(t *testing.T) {
+		b := WithFaults(inmem, FaultRule{Ops: []string{OpGet}, Probability: 1, Reader: &ReaderFault{Kind: ReaderTruncate, After: 4}})
+
+		rc, err := b.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, rc.Close()) }()
+
+		sz, err := TryToGetSize(rc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(10), sz)
+
+		content, err := io.ReadAll(rc)
+		testutil.Equals(t, io.ErrUnexpectedEOF, err)
+		testutil.Equals(t, "0123", string(content))
+	})
+	t.Run("corrupt", func(t *testing.T) {
+		b := WithFaults(inmem, FaultRule{Ops: []string{OpGetRange}, Probability: 1, Reader: &ReaderFault{Kind: ReaderCorrupt, After: 2}})
+
+		rc, err := b.GetRange(ctx, "obj", 1, 4)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, rc.Close()) }()
+
+		content, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []byte{'1', '2', ^byte('3'), ^byte('4')}, content)
+	})
+	t.Run("upload", func(t *testing.T) {
+		b := WithFaults(inmem, FaultRule{Ops: []string{OpUpload}, Probability: 1, Reader: &ReaderFault{Kind: ReaderTruncate, After: 2}})
+
+		err := b.Upload(ctx, "new", bytes.NewReader([]byte("data")))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, io.ErrUnexpectedEOF, errors.Cause(err))
+	})
+	t.Run("slow reader", func(t *testing.T) {
+		b := WithFaults(inmem, FaultRule{Ops: []string{OpGet}, Probability: 1, ReadDelay: 10 * time.Millisecond})
+
+		rc, err := b.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, rc.Close()) }()
+
+		start := time.Now()
+		content, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "0123456789", string(content))
+		testutil.Assert(t, time.Since(start) >= 10*time.Millisecond, "expected reads to be delayed")
+	})
+}
+
+func TestFaultBucket_Latency(t *testing.T) {
+	inmem := NewInMemBucket()
+	b := WithFaults(inmem, FaultRule{Ops: []string{OpIter}, Probability: 1, Latency: FixedLatency(time.Hour)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := b.Iter(ctx, "", func(string) error { return nil })
+	testutil.Equals(t, context.DeadlineExceeded, err)
+
+	for _, d := range []func() time.Duration{UniformLatency(time.Millisecond, 2*time.Millisecond), ExponentialLatency(time.Millisecond)} {
+		for i := 0; i < 100; i++ {
+			testutil.Assert(t, d() >= 0, "expected positive latency")
+		}
+	}
+}
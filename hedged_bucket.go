@@ -0,0 +1,315 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// HedgingConfig configures HedgedBucket.
+type HedgingConfig struct {
+	// Percentile, in (0, 1), of the observed response latencies after which a hedged request is sent.
+	Percentile float64
+	// MinDelay and MaxDelay bound the delay before sending a hedged request. MaxDelay is used until enough latencies
+	// are observed.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// WindowSize is the number of most recent latencies the percentile is computed on, per operation.
+	WindowSize int
+	// MaxHedgeRatio caps the hedged requests to this fraction of all requests, e.g. 0.05 for 5%.
+	MaxHedgeRatio float64
+	// MaxHedgeBurst is the number of hedged requests which can be sent in a row, when the ratio allows it.
+	MaxHedgeBurst int
+}
+
+// DefaultHedgingConfig hedges the 5% slowest requests.
+var DefaultHedgingConfig = HedgingConfig{
+	Percentile:    0.95,
+	MinDelay:      20 * time.Millisecond,
+	MaxDelay:      2 * time.Second,
+	WindowSize:    1000,
+	MaxHedgeRatio: 0.05,
+	MaxHedgeBurst: 10,
+}
+
+// HedgedBucket is a Bucket wrapper cutting the tail latency of Get and GetRange. When a request does not return
+// within the configured percentile of the recent latencies, an identical hedged request is sent; whichever returns
+// first is used and the other is canceled. Latency is measured until the call returns, i.e. until the response
+// headers are received for most providers, not until the object is read.
+type HedgedBucket struct {
+	bkt Bucket
+	cfg HedgingConfig
+
+	mtx       sync.Mutex
+	latencies map[string]*latencyWindow
+	tokens    float64
+
+	hedged    *prometheus.CounterVec
+	won       *prometheus.CounterVec
+	throttled *prometheus.CounterVec
+}
+
+// NewHedgedBucket returns a HedgedBucket wrapping bkt.
+func NewHedgedBucket(bkt Bucket, cfg HedgingConfig, reg prometheus.Registerer) *HedgedBucket {
+	if cfg.MaxDelay < cfg.MinDelay {
+		cfg.MaxDelay = cfg.MinDelay
+	}
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = DefaultHedgingConfig.WindowSize
+	}
+	cfg.MaxHedgeBurst = max(cfg.MaxHedgeBurst, 1)
+
+	b := &HedgedBucket{
+		bkt: bkt,
+		cfg: cfg,
+		latencies: map[string]*latencyWindow{
+			OpGet:      newLatencyWindow(cfg.WindowSize),
+			OpGetRange: newLatencyWindow(cfg.WindowSize),
+		},
+		tokens: float64(cfg.MaxHedgeBurst),
+
+		hedged: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_hedged_requests_total",
+			Help: "Total number of hedged requests sent because the original one was slow, per operation.",
+		}, []string{"operation"}),
+		won: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_hedged_requests_won_total",
+			Help: "Total number of hedged requests which returned before the original one, per operation.",
+		}, []string{"operation"}),
+		throttled: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_hedged_requests_throttled_total",
+			Help: "Total number of hedged requests not sent because of the hedging rate limit, per operation.",
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{OpGet, OpGetRange} {
+		b.hedged.WithLabelValues(op)
+		b.won.WithLabelValues(op)
+		b.throttled.WithLabelValues(op)
+	}
+	return b
+}
+
+// latencyWindow keeps the most recent latencies and caches their percentile.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+
+	// added counts the samples added since the percentile was last computed.
+	added      int
+	percentile time.Duration
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, size), added: -1}
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+	w.full = w.full || w.next == 0
+	w.added++
+}
+
+// quantile returns the q-quantile of the window, or false if there are not enough samples.
+// It is recomputed every tenth of the window size, as sorting on every request would be expensive.
+func (w *latencyWindow) quantile(q float64) (time.Duration, bool) {
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	minSamples := max(len(w.samples)/10, 1)
+	if n < minSamples {
+		return 0, false
+	}
+	if w.added < 0 || w.added >= minSamples {
+		sorted := slices.Clone(w.samples[:n])
+		slices.Sort(sorted)
+		w.percentile = sorted[min(int(math.Ceil(q*float64(n)))-1, n-1)]
+		w.added = 0
+	}
+	return w.percentile, true
+}
+
+// delay returns the delay before hedging a request, and counts the request for the hedging rate limit.
+func (b *HedgedBucket) delay(op string) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.tokens = min(b.tokens+b.cfg.MaxHedgeRatio, float64(b.cfg.MaxHedgeBurst))
+	d, ok := b.latencies[op].quantile(b.cfg.Percentile)
+	if !ok {
+		return b.cfg.MaxDelay
+	}
+	return min(max(d, b.cfg.MinDelay), b.cfg.MaxDelay)
+}
+
+// allowHedge returns true if the hedging rate limit allows another hedged request.
+func (b *HedgedBucket) allowHedge() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *HedgedBucket) observe(op string, d time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.latencies[op].add(d)
+}
+
+type hedgeResult struct {
+	rc     io.ReadCloser
+	err    error
+	hedge  bool
+	cancel context.CancelFunc
+}
+
+// do runs fn, hedging it if it does not return in time.
+func (b *HedgedBucket) do(ctx context.Context, op string, fn func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	results := make(chan hedgeResult, 2)
+	start := func(hedge bool) {
+		rctx, cancel := context.WithCancel(ctx)
+		go func() {
+			rc, err := fn(rctx)
+			results <- hedgeResult{rc: rc, err: err, hedge: hedge, cancel: cancel}
+		}()
+	}
+
+	begin := time.Now()
+	start(false)
+	timer := time.NewTimer(b.delay(op))
+	defer timer.Stop()
+
+	pending := 1
+	var first *hedgeResult
+	for {
+		select {
+		case <-timer.C:
+			if !b.allowHedge() {
+				b.throttled.WithLabelValues(op).Inc()
+				continue
+			}
+			b.hedged.WithLabelValues(op).Inc()
+			start(true)
+			pending++
+			continue
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				res.cancel()
+				// Wait for the other request, if any, which may still succeed.
+				if pending > 0 {
+					if first == nil {
+						first = &res
+					}
+					continue
+				}
+				if first != nil {
+					return nil, first.err
+				}
+				return nil, res.err
+			}
+
+			// The latency of the original request is at least the time elapsed since it started, even if the hedged
+			// one won, otherwise the percentile would drift down with every won hedge.
+			b.observe(op, time.Since(begin))
+			if res.hedge {
+				b.won.WithLabelValues(op).Inc()
+			}
+			if pending > 0 {
+				go drainHedge(results)
+			}
+			return &hedgedReader{ReadCloser: res.rc, cancel: res.cancel}, nil
+		}
+	}
+}
+
+// drainHedge cancels and releases the losing request.
+func drainHedge(results <-chan hedgeResult) {
+	res := <-results
+	res.cancel()
+	if res.err == nil {
+		_ = res.rc.Close()
+	}
+}
+
+// hedgedReader releases the context of the request when closed.
+type hedgedReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *hedgedReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// ObjectSize returns the size of the object, as announced by the provider.
+func (r *hedgedReader) ObjectSize() (int64, error) { return TryToGetSize(r.ReadCloser) }
+
+func (b *HedgedBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *HedgedBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *HedgedBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return b.bkt.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *HedgedBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *HedgedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.do(ctx, OpGet, func(ctx context.Context) (io.ReadCloser, error) {
+		return b.bkt.Get(ctx, name)
+	})
+}
+
+func (b *HedgedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.do(ctx, OpGetRange, func(ctx context.Context) (io.ReadCloser, error) {
+		return b.bkt.GetRange(ctx, name, off, length)
+	})
+}
+
+func (b *HedgedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *HedgedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *HedgedBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	return b.bkt.Upload(ctx, name, r, opts...)
+}
+
+func (b *HedgedBucket) Delete(ctx context.Context, name string) error {
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *HedgedBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *HedgedBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *HedgedBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.bkt, err) }
+
+func (b *HedgedBucket) Close() error { return b.bkt.Close() }
+
+func (b *HedgedBucket) Name() string { return b.bkt.Name() }
@@ -0,0 +1,121 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testHedgingConfig hedges requests slower than 20ms, until latencies are observed.
+var testHedgingConfig = HedgingConfig{
+	Percentile:    0.9,
+	MinDelay:      10 * time.Millisecond,
+	MaxDelay:      20 * time.Millisecond,
+	WindowSize:    10,
+	MaxHedgeRatio: 1,
+	MaxHedgeBurst: 1,
+}
+
+func TestHedgedBucket_AcceptanceTest(t *testing.T) {
+	AcceptanceTest(t, NewHedgedBucket(NewInMemBucket(), testHedgingConfig, nil))
+}
+
+func TestHedgedBucket_Hedging(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("content")))
+
+	faults := WithFaults(inmem)
+	b := NewHedgedBucket(faults, testHedgingConfig, nil)
+
+	read := func(rc io.ReadCloser, err error) string {
+		testutil.Ok(t, err)
+		got, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		return string(got)
+	}
+
+	// Fast requests are not hedged.
+	testutil.Equals(t, "content", read(b.Get(ctx, "obj")))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.hedged.WithLabelValues(OpGet)))
+
+	// A slow request is hedged, and the hedged request wins.
+	faults.SetRules(FaultRule{Ops: []string{OpGetRange}, OnCall: 1, Latency: FixedLatency(time.Minute)})
+	start := time.Now()
+	testutil.Equals(t, "nte", read(b.GetRange(ctx, "obj", 2, 3)))
+	testutil.Assert(t, time.Since(start) < 10*time.Second, "expected the hedged request to return first")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.hedged.WithLabelValues(OpGetRange)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.won.WithLabelValues(OpGetRange)))
+	// The latency observed is the one of the original request, at least the hedging delay, not the hedged one.
+	testutil.Assert(t, b.latencies[OpGetRange].samples[0] >= testHedgingConfig.MaxDelay, "expected the original latency to be observed, got %v", b.latencies[OpGetRange].samples[0])
+
+	// The original request wins when the hedged one is slower.
+	faults.SetRules(
+		FaultRule{Ops: []string{OpGetRange}, OnCall: 1, Latency: FixedLatency(50 * time.Millisecond)},
+		FaultRule{Ops: []string{OpGetRange}, OnCall: 2, Latency: FixedLatency(time.Minute)},
+	)
+	testutil.Equals(t, "content", read(b.GetRange(ctx, "obj", 0, -1)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.hedged.WithLabelValues(OpGetRange)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.won.WithLabelValues(OpGetRange)))
+
+	// A failed request waits for the other one.
+	faults.SetRules(
+		FaultRule{Ops: []string{OpGet}, OnCall: 1, Latency: FixedLatency(50 * time.Millisecond), Err: ErrFaultTransient},
+		FaultRule{Ops: []string{OpGet}, OnCall: 2, Latency: FixedLatency(100 * time.Millisecond)},
+	)
+	testutil.Equals(t, "content", read(b.Get(ctx, "obj")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.won.WithLabelValues(OpGet)))
+
+	// Errors are returned once all requests failed.
+	_, err := b.Get(ctx, "missing")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+}
+
+func TestHedgedBucket_RateLimit(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("content")))
+
+	cfg := testHedgingConfig
+	cfg.MaxHedgeRatio = 0.5
+	faults := WithFaults(inmem, FaultRule{Ops: []string{OpGet}, Probability: 1, Latency: FixedLatency(30 * time.Millisecond)})
+	b := NewHedgedBucket(faults, cfg, nil)
+
+	// Only every other request can be hedged, after the initial burst.
+	for i := 0; i < 5; i++ {
+		rc, err := b.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+	}
+	testutil.Equals(t, 3.0, promtest.ToFloat64(b.hedged.WithLabelValues(OpGet)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.throttled.WithLabelValues(OpGet)))
+}
+
+func TestLatencyWindow(t *testing.T) {
+	w := newLatencyWindow(20)
+	_, ok := w.quantile(0.5)
+	testutil.Assert(t, !ok, "expected no quantile without samples")
+
+	for i := 1; i <= 10; i++ {
+		w.add(time.Duration(i))
+	}
+	d, ok := w.quantile(0.9)
+	testutil.Assert(t, ok, "expected a quantile")
+	testutil.Equals(t, time.Duration(9), d)
+
+	// Older samples are replaced.
+	for i := 0; i < 20; i++ {
+		w.add(100)
+	}
+	d, _ = w.quantile(0.5)
+	testutil.Equals(t, time.Duration(100), d)
+}
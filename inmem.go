@@ -4,9 +4,15 @@
 package objstore
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -23,14 +29,32 @@ type InMemBucket struct {
 	mtx     sync.RWMutex
 	objects map[string][]byte
 	attrs   map[string]ObjectAttributes
+	// keys holds the sorted object names, so listing cost scales with the result size.
+	keys []string
+	// size is the total size of the stored objects.
+	size int64
+
+	opts    inMemOptions
+	metrics *inMemMetrics
+
+	lruMtx sync.Mutex
+	lru    *lruList
 }
 
 // NewInMemBucket returns a new in memory Bucket.
 // NOTE: Returned bucket is just a naive in memory bucket implementation. For test use cases only.
-func NewInMemBucket() *InMemBucket {
+// By default its capacity is unlimited, see InMemOption to bound it.
+func NewInMemBucket(opts ...InMemOption) *InMemBucket {
+	o := inMemOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	return &InMemBucket{
 		objects: map[string][]byte{},
 		attrs:   map[string]ObjectAttributes{},
+		opts:    o,
+		metrics: newInMemMetrics(o.reg),
+		lru:     newLRUList(),
 	}
 }
 
@@ -54,6 +78,197 @@ func (b *InMemBucket) ChangeLastModified(path string, lastModified time.Time) er
 
 func (b *InMemBucket) Provider() ObjProvider { return MEMORY }
 
+// InMemSnapshot is a point-in-time copy of the content of an InMemBucket, including object attributes.
+// Object contents are shared between the snapshot and buckets, so taking and restoring snapshots is cheap.
+type InMemSnapshot struct {
+	objects map[string][]byte
+	attrs   map[string]ObjectAttributes
+	keys    []string
+}
+
+// Snapshot returns a copy of the current bucket content. It is not affected by further changes to the bucket.
+func (b *InMemBucket) Snapshot() *InMemSnapshot {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return &InMemSnapshot{objects: maps.Clone(b.objects), attrs: maps.Clone(b.attrs), keys: slices.Clone(b.keys)}
+}
+
+// Restore replaces the bucket content with the given snapshot. The same snapshot can be restored multiple times,
+// in multiple buckets. Snapshots exceeding the capacity of the bucket are rejected with a CapacityExceededError,
+// leaving the bucket unchanged, whatever the eviction policy.
+func (b *InMemBucket) Restore(s *InMemSnapshot) error {
+	var size int64
+	for _, body := range s.objects {
+		size += int64(len(body))
+	}
+	if !b.opts.fits(size, len(s.objects)) {
+		return &CapacityExceededError{
+			Size:       size,
+			Objects:    len(s.objects),
+			MaxSize:    b.opts.maxSize,
+			MaxObjects: b.opts.maxObjects,
+		}
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.objects = maps.Clone(s.objects)
+	b.attrs = maps.Clone(s.attrs)
+	b.keys = slices.Clone(s.keys)
+	b.size = size
+	b.updateUsageMetrics()
+
+	b.lruMtx.Lock()
+	defer b.lruMtx.Unlock()
+	b.lru = newLRUList()
+	if b.opts.eviction == EvictLRU {
+		for _, name := range b.keys {
+			b.lru.touch(name)
+		}
+	}
+	return nil
+}
+
+// SaveDir writes every object as a file under dir, using the object last modified time as the file modification time.
+// Objects with ".." path segments, which would be written outside of dir, are rejected before writing anything.
+func (b *InMemBucket) SaveDir(dir string) error {
+	s := b.Snapshot()
+	for _, name := range s.keys {
+		if slices.Contains(strings.Split(name, DirDelim), "..") {
+			return errors.Errorf("object name %s escapes the directory", name)
+		}
+	}
+	for _, name := range s.keys {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+			return errors.Wrapf(err, "create dir for %s", name)
+		}
+		if err := os.WriteFile(file, s.objects[name], 0600); err != nil {
+			return errors.Wrapf(err, "write %s", name)
+		}
+		lastModified := s.attrs[name].LastModified
+		if err := os.Chtimes(file, lastModified, lastModified); err != nil {
+			return errors.Wrapf(err, "set modification time of %s", name)
+		}
+	}
+	return nil
+}
+
+// LoadDir uploads every regular file found under dir, keeping the file modification time as the object last
+// modified time. Existing objects with the same name are overwritten.
+func (b *InMemBucket) LoadDir(dir string) error {
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return errors.Wrap(err, "getting relative path")
+		}
+		info, err := d.Info()
+		if err != nil {
+			return errors.Wrapf(err, "stat %s", file)
+		}
+		body, err := os.ReadFile(filepath.Clean(file))
+		if err != nil {
+			return errors.Wrapf(err, "read %s", file)
+		}
+		return b.put(filepath.ToSlash(rel), body, info.ModTime())
+	})
+}
+
+// SaveTar writes every object as a file entry of a tar archive, using the object last modified time as the entry
+// modification time.
+func (b *InMemBucket) SaveTar(w io.Writer) error {
+	s := b.Snapshot()
+	tw := tar.NewWriter(w)
+	for _, name := range s.keys {
+		body := s.objects[name]
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     int64(len(body)),
+			Mode:     0600,
+			ModTime:  s.attrs[name].LastModified,
+			// PAX keeps sub-second modification times.
+			Format: tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write tar header for %s", name)
+		}
+		if _, err := tw.Write(body); err != nil {
+			return errors.Wrapf(err, "write tar entry %s", name)
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar")
+}
+
+// LoadTar uploads every regular file entry of the tar archive, keeping the entry modification time as the object
+// last modified time. Existing objects with the same name are overwritten.
+func (b *InMemBucket) LoadTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read tar header")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "read tar entry %s", hdr.Name)
+		}
+		if err := b.put(strings.TrimPrefix(hdr.Name, "./"), body, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+// put stores the object, evicting other objects if needed and allowed by the eviction policy.
+func (b *InMemBucket) put(name string, body []byte, lastModified time.Time) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if err := b.makeRoom(name, int64(len(body))); err != nil {
+		return err
+	}
+
+	b.insertKey(name)
+	b.size += int64(len(body)) - int64(len(b.objects[name]))
+	b.objects[name] = body
+	b.attrs[name] = ObjectAttributes{
+		Size:         int64(len(body)),
+		LastModified: lastModified,
+	}
+	b.updateUsageMetrics()
+	b.touch(name)
+	return nil
+}
+
+// remove deletes the object. It has to be called with the write lock held.
+func (b *InMemBucket) remove(name string) {
+	b.size -= int64(len(b.objects[name]))
+	delete(b.objects, name)
+	delete(b.attrs, name)
+	if i, ok := slices.BinarySearch(b.keys, name); ok {
+		b.keys = slices.Delete(b.keys, i, i+1)
+	}
+	b.updateUsageMetrics()
+
+	b.lruMtx.Lock()
+	defer b.lruMtx.Unlock()
+	b.lru.remove(name)
+}
+
 // Objects returns a copy of the internally stored objects.
 // NOTE: For assert purposes.
 func (b *InMemBucket) Objects() map[string][]byte {
@@ -69,8 +284,6 @@ func (b *InMemBucket) Objects() map[string][]byte {
 }
 
 func (b *InMemBucket) genericIter(_ context.Context, dir string, f func(string, time.Time) error, options ...IterOption) error {
-	unique := map[string]struct{}{}
-	lastModified := map[string]time.Time{}
 	params := ApplyIterOptions(options...)
 
 	var dirPartsCount int
@@ -82,60 +295,64 @@ func (b *InMemBucket) genericIter(_ context.Context, dir string, f func(string,
 		dirPartsCount++
 	}
 
+	type entry struct {
+		name         string
+		lastModified time.Time
+	}
+	// Files are passed to f before directories, both in lexicographical order.
+	var files, dirs []entry
+
 	b.mtx.RLock()
-	for filename := range b.objects {
-		if !strings.HasPrefix(filename, dir) || dir == filename {
-			continue
+	i, _ := slices.BinarySearch(b.keys, dir)
+	for i < len(b.keys) {
+		filename := b.keys[i]
+		if !strings.HasPrefix(filename, dir) {
+			break
 		}
-
-		if params.Recursive {
-			// Any object matching the prefix should be included.
-			unique[filename] = struct{}{}
-			lastModified[filename] = b.attrs[filename].LastModified
+		if dir == filename {
+			i++
 			continue
 		}
 
-		parts := strings.SplitAfter(filename, DirDelim)
-
-		name := strings.Join(parts[:dirPartsCount+1], "")
-		unique[name] = struct{}{}
-
-		if params.LastModified {
-			lastModified[name] = b.attrs[filename].LastModified
+		name := filename
+		if !params.Recursive {
+			parts := strings.SplitAfter(filename, DirDelim)
+			name = strings.Join(parts[:dirPartsCount+1], "")
 		}
-	}
-	b.mtx.RUnlock()
 
-	var keys []string
-	for n := range unique {
-		keys = append(keys, n)
-	}
-	sort.Slice(keys, func(i, j int) bool {
-		if strings.HasSuffix(keys[i], DirDelim) && strings.HasSuffix(keys[j], DirDelim) {
-			return strings.Compare(keys[i], keys[j]) < 0
+		e := entry{name: name}
+		if params.LastModified {
+			e.lastModified = b.attrs[filename].LastModified
 		}
-		if strings.HasSuffix(keys[i], DirDelim) {
-			return false
+		if !strings.HasSuffix(name, DirDelim) {
+			files = append(files, e)
+			i++
+			continue
 		}
-		if strings.HasSuffix(keys[j], DirDelim) {
-			return true
+		dirs = append(dirs, e)
+		if params.Recursive {
+			i++
+			continue
 		}
+		// All keys under this directory are contiguous, jump past them.
+		i += sort.SearchStrings(b.keys[i:], prefixEnd(name))
+	}
+	b.mtx.RUnlock()
 
-		return strings.Compare(keys[i], keys[j]) < 0
-	})
-
-	for _, k := range keys {
-		var modifiedTS time.Time
-		if params.LastModified {
-			modifiedTS = lastModified[k]
-		}
-		if err := f(k, modifiedTS); err != nil {
+	for _, e := range append(files, dirs...) {
+		if err := f(e.name, e.lastModified); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// prefixEnd returns the smallest string greater than every string having the given prefix.
+// The prefix has to end with DirDelim.
+func prefixEnd(prefix string) string {
+	return prefix[:len(prefix)-1] + string(DirDelim[0]+1)
+}
+
 // Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
 func (b *InMemBucket) Iter(_ context.Context, dir string, f func(string) error, options ...IterOption) error {
@@ -169,6 +386,9 @@ func (b *InMemBucket) Get(_ context.Context, name string) (io.ReadCloser, error)
 
 	b.mtx.RLock()
 	file, ok := b.objects[name]
+	if ok {
+		b.touch(name)
+	}
 	b.mtx.RUnlock()
 	if !ok {
 		return nil, errNotFound
@@ -190,6 +410,9 @@ func (b *InMemBucket) GetRange(_ context.Context, name string, off, length int64
 
 	b.mtx.RLock()
 	file, ok := b.objects[name]
+	if ok {
+		b.touch(name)
+	}
 	b.mtx.RUnlock()
 	if !ok {
 		return nil, errNotFound
@@ -252,19 +475,13 @@ func (b *InMemBucket) Attributes(_ context.Context, name string) (ObjectAttribut
 }
 
 // Upload writes the file specified in src to into the memory.
+// If the bucket capacity is exceeded and cannot be freed by eviction, a CapacityExceededError is returned.
 func (b *InMemBucket) Upload(_ context.Context, name string, r io.Reader, _ ...ObjectUploadOption) error {
-	b.mtx.Lock()
-	defer b.mtx.Unlock()
 	body, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	b.objects[name] = body
-	b.attrs[name] = ObjectAttributes{
-		Size:         int64(len(body)),
-		LastModified: time.Now(),
-	}
-	return nil
+	return b.put(name, body, time.Now())
 }
 
 // Delete removes all data prefixed with the dir.
@@ -274,11 +491,17 @@ func (b *InMemBucket) Delete(_ context.Context, name string) error {
 	if _, ok := b.objects[name]; !ok {
 		return errNotFound
 	}
-	delete(b.objects, name)
-	delete(b.attrs, name)
+	b.remove(name)
 	return nil
 }
 
+// insertKey adds the name to the sorted keys if not present. It has to be called with the write lock held.
+func (b *InMemBucket) insertKey(name string) {
+	if i, ok := slices.BinarySearch(b.keys, name); !ok {
+		b.keys = slices.Insert(b.keys, i, name)
+	}
+}
+
 // IsObjNotFoundErr returns true if error means that object is not found. Relevant to Get operations.
 func (b *InMemBucket) IsObjNotFoundErr(err error) bool {
 	return errors.Is(err, errNotFound)
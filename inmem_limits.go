@@ -0,0 +1,223 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"container/list"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// EvictionPolicy selects what InMemBucket does when an upload would exceed its capacity.
+type EvictionPolicy int
+
+const (
+	// EvictNone rejects uploads exceeding the capacity with a CapacityExceededError.
+	EvictNone EvictionPolicy = iota
+	// EvictLRU evicts the least recently uploaded or read objects first.
+	EvictLRU
+	// EvictOldest evicts the objects with the oldest LastModified first.
+	EvictOldest
+)
+
+// CapacityExceededError is returned by InMemBucket uploads and restores that do not fit in the configured capacity.
+type CapacityExceededError struct {
+	// Name is the uploaded object, empty for restores.
+	Name string
+	// Size and Objects are the usage the bucket would have reached with the upload.
+	Size    int64
+	Objects int
+
+	MaxSize    int64
+	MaxObjects int
+}
+
+func (e *CapacityExceededError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("inmem: restoring snapshot exceeds capacity: %d bytes (max %d), %d objects (max %d)", e.Size, e.MaxSize, e.Objects, e.MaxObjects)
+	}
+	return fmt.Sprintf("inmem: uploading %s exceeds capacity: %d bytes (max %d), %d objects (max %d)", e.Name, e.Size, e.MaxSize, e.Objects, e.MaxObjects)
+}
+
+// InMemOption configures an InMemBucket.
+type InMemOption func(*inMemOptions)
+
+type inMemOptions struct {
+	maxSize    int64
+	maxObjects int
+	eviction   EvictionPolicy
+	reg        prometheus.Registerer
+}
+
+// WithMaxSize limits the total size in bytes of the objects stored in the bucket. 0 means unlimited.
+func WithMaxSize(bytes int64) InMemOption {
+	return func(o *inMemOptions) {
+		o.maxSize = bytes
+	}
+}
+
+// WithMaxObjects limits the number of objects stored in the bucket. 0 means unlimited.
+func WithMaxObjects(n int) InMemOption {
+	return func(o *inMemOptions) {
+		o.maxObjects = n
+	}
+}
+
+// WithEvictionPolicy selects what happens when an upload exceeds the capacity. Defaults to EvictNone.
+func WithEvictionPolicy(p EvictionPolicy) InMemOption {
+	return func(o *inMemOptions) {
+		o.eviction = p
+	}
+}
+
+// WithInMemRegisterer registers the bucket usage metrics with the given registerer.
+func WithInMemRegisterer(reg prometheus.Registerer) InMemOption {
+	return func(o *inMemOptions) {
+		o.reg = reg
+	}
+}
+
+type inMemMetrics struct {
+	size      prometheus.Gauge
+	objects   prometheus.Gauge
+	evictions prometheus.Counter
+}
+
+func newInMemMetrics(reg prometheus.Registerer) *inMemMetrics {
+	return &inMemMetrics{
+		size: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "objstore_inmem_bucket_size_bytes",
+			Help: "Total size of the objects stored in the in-memory bucket.",
+		}),
+		objects: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "objstore_inmem_bucket_objects",
+			Help: "Number of objects stored in the in-memory bucket.",
+		}),
+		evictions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_inmem_bucket_evictions_total",
+			Help: "Total number of objects evicted from the in-memory bucket to make room for uploads.",
+		}),
+	}
+}
+
+// lruList tracks object usage order for EvictLRU. Front is the most recently used.
+type lruList struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{order: list.New(), elems: map[string]*list.Element{}}
+}
+
+func (l *lruList) touch(name string) {
+	if e, ok := l.elems[name]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elems[name] = l.order.PushFront(name)
+}
+
+func (l *lruList) remove(name string) {
+	if e, ok := l.elems[name]; ok {
+		l.order.Remove(e)
+		delete(l.elems, name)
+	}
+}
+
+// fits returns true if the bucket can hold the given usage.
+func (o inMemOptions) fits(size int64, objects int) bool {
+	return (o.maxSize <= 0 || size <= o.maxSize) && (o.maxObjects <= 0 || objects <= o.maxObjects)
+}
+
+// makeRoom evicts objects, except the one being uploaded, until the upload fits. It has to be called with the
+// write lock held.
+func (b *InMemBucket) makeRoom(name string, size int64) error {
+	prevSize := int64(-1)
+	if body, ok := b.objects[name]; ok {
+		prevSize = int64(len(body))
+	}
+	usage := func() (int64, int) {
+		if prevSize < 0 {
+			return b.size + size, len(b.objects) + 1
+		}
+		return b.size - prevSize + size, len(b.objects)
+	}
+
+	exceeded := func(newSize int64, newObjects int) error {
+		return &CapacityExceededError{
+			Name:       name,
+			Size:       newSize,
+			Objects:    newObjects,
+			MaxSize:    b.opts.maxSize,
+			MaxObjects: b.opts.maxObjects,
+		}
+	}
+	// Do not evict anything for an upload that would not fit even in an otherwise empty bucket.
+	if !b.opts.fits(size, 1) {
+		return exceeded(usage())
+	}
+
+	for {
+		newSize, newObjects := usage()
+		if b.opts.fits(newSize, newObjects) {
+			return nil
+		}
+		victim, ok := b.evictionCandidate(name)
+		if !ok {
+			return exceeded(newSize, newObjects)
+		}
+		b.remove(victim)
+		b.metrics.evictions.Inc()
+	}
+}
+
+// evictionCandidate returns the next object to evict according to the policy, other than the one being uploaded.
+func (b *InMemBucket) evictionCandidate(uploading string) (string, bool) {
+	switch b.opts.eviction {
+	case EvictLRU:
+		b.lruMtx.Lock()
+		defer b.lruMtx.Unlock()
+
+		for e := b.lru.order.Back(); e != nil; e = e.Prev() {
+			if name := e.Value.(string); name != uploading {
+				return name, true
+			}
+		}
+	case EvictOldest:
+		var (
+			oldest string
+			found  bool
+		)
+		for name, attrs := range b.attrs {
+			if name == uploading {
+				continue
+			}
+			if !found || attrs.LastModified.Before(b.attrs[oldest].LastModified) ||
+				(attrs.LastModified.Equal(b.attrs[oldest].LastModified) && name < oldest) {
+				oldest, found = name, true
+			}
+		}
+		return oldest, found
+	}
+	return "", false
+}
+
+// touch marks the object as recently used.
+func (b *InMemBucket) touch(name string) {
+	if b.opts.eviction != EvictLRU {
+		return
+	}
+	b.lruMtx.Lock()
+	defer b.lruMtx.Unlock()
+
+	b.lru.touch(name)
+}
+
+func (b *InMemBucket) updateUsageMetrics() {
+	b.metrics.size.Set(float64(b.size))
+	b.metrics.objects.Set(float64(len(b.objects)))
+}
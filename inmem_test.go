@@ -4,11 +4,20 @@
 package objstore
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestInMem_ReturnsModifiedInIterAttributes(t *testing.T) {
@@ -41,3 +50,230 @@ func TestInMem_ReturnsModifiedInIterAttributes(t *testing.T) {
 
 	testutil.Equals(t, 2, itemsIterated)
 }
+
+func TestInMem_SnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	b := NewInMemBucket()
+	testutil.Ok(t, b.Upload(ctx, "a/obj1", strings.NewReader("data1")))
+	testutil.Ok(t, b.Upload(ctx, "obj2", strings.NewReader("data2")))
+	lastModified := time.Unix(1700000000, 0)
+	testutil.Ok(t, b.ChangeLastModified("a/obj1", lastModified))
+
+	s := b.Snapshot()
+
+	testutil.Ok(t, b.Delete(ctx, "obj2"))
+	testutil.Ok(t, b.Upload(ctx, "a/obj1", strings.NewReader("changed")))
+	testutil.Ok(t, b.Upload(ctx, "obj3", strings.NewReader("data3")))
+
+	testutil.Ok(t, b.Restore(s))
+	testutil.Equals(t, map[string][]byte{"a/obj1": []byte("data1"), "obj2": []byte("data2")}, b.Objects())
+	attrs, err := b.Attributes(ctx, "a/obj1")
+	testutil.Ok(t, err)
+	testutil.Equals(t, ObjectAttributes{Size: 5, LastModified: lastModified}, attrs)
+
+	// Snapshots can be restored into other buckets and are not affected by them.
+	other := NewInMemBucket()
+	testutil.Ok(t, other.Restore(s))
+	testutil.Ok(t, other.Delete(ctx, "obj2"))
+	testutil.Ok(t, b.Restore(s))
+	testutil.Equals(t, 2, len(b.Objects()))
+	// Snapshots exceeding the capacity are rejected.
+	limited := NewInMemBucket(WithMaxObjects(1), WithEvictionPolicy(EvictLRU))
+	testutil.Ok(t, limited.Upload(ctx, "kept", strings.NewReader("data")))
+	err = limited.Restore(s)
+	var capErr *CapacityExceededError
+	testutil.Assert(t, errors.As(err, &capErr), "expected capacity exceeded error, got %v", err)
+	testutil.Equals(t, map[string][]byte{"kept": []byte("data")}, limited.Objects())
+}
+
+func TestInMem_SaveLoad(t *testing.T) {
+	ctx := context.Background()
+	b := NewInMemBucket()
+	testutil.Ok(t, b.Upload(ctx, "a/b/obj1", strings.NewReader("data1")))
+	testutil.Ok(t, b.Upload(ctx, "obj2", strings.NewReader("data2")))
+	testutil.Ok(t, b.ChangeLastModified("a/b/obj1", time.Unix(1700000000, 123456789)))
+	testutil.Ok(t, b.ChangeLastModified("obj2", time.Unix(1600000000, 0)))
+
+	expectAttrs := func(t *testing.T, loaded *InMemBucket) {
+		t.Helper()
+		testutil.Equals(t, b.Objects(), loaded.Objects())
+		for _, name := range []string{"a/b/obj1", "obj2"} {
+			want, err := b.Attributes(ctx, name)
+			testutil.Ok(t, err)
+			got, err := loaded.Attributes(ctx, name)
+			testutil.Ok(t, err)
+			testutil.Equals(t, want.Size, got.Size)
+			testutil.Assert(t, want.LastModified.Equal(got.LastModified), "expected %v, got %v", want.LastModified, got.LastModified)
+		}
+	}
+
+	t.Run("dir", func(t *testing.T) {
+		dir := t.TempDir()
+		testutil.Ok(t, b.SaveDir(dir))
+
+		loaded := NewInMemBucket()
+		testutil.Ok(t, loaded.LoadDir(dir))
+		expectAttrs(t, loaded)
+	})
+	t.Run("dir escape", func(t *testing.T) {
+		escaping := NewInMemBucket()
+		testutil.Ok(t, escaping.Upload(ctx, "a/obj", strings.NewReader("data")))
+		testutil.Ok(t, escaping.Upload(ctx, "a/../../obj", strings.NewReader("data")))
+		dir := t.TempDir()
+		testutil.NotOk(t, escaping.SaveDir(filepath.Join(dir, "saved")))
+		entries, err := os.ReadDir(dir)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(entries))
+	})
+	t.Run("tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		testutil.Ok(t, b.SaveTar(&buf))
+
+		loaded := NewInMemBucket()
+		testutil.Ok(t, loaded.LoadTar(&buf))
+		expectAttrs(t, loaded)
+	})
+}
+
+func BenchmarkInMem_Iter(b *testing.B) {
+	ctx := context.Background()
+	bkt := NewInMemBucket()
+	// 1000 blocks with 100 chunk files each, plus an index and meta file per block.
+	for i := 0; i < 1000; i++ {
+		block := fmt.Sprintf("block-%04d/", i)
+		testutil.Ok(b, bkt.Upload(ctx, block+"index", strings.NewReader("index")))
+		testutil.Ok(b, bkt.Upload(ctx, block+"meta.json", strings.NewReader("meta")))
+		for j := 0; j < 100; j++ {
+			testutil.Ok(b, bkt.Upload(ctx, fmt.Sprintf("%schunks/%06d", block, j), strings.NewReader("chunk")))
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		dir  string
+		opts []IterOption
+	}{
+		{name: "root", dir: ""},
+		{name: "block", dir: "block-0500/"},
+		{name: "block chunks recursive", dir: "block-0500/chunks/", opts: []IterOption{WithRecursiveIter()}},
+		{name: "missing dir", dir: "missing/"},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				testutil.Ok(b, bkt.Iter(ctx, tc.dir, func(string) error { return nil }, tc.opts...))
+			}
+		})
+	}
+}
+
+func TestInMem_IterOrder(t *testing.T) {
+	ctx := context.Background()
+	b := NewInMemBucket()
+	for _, name := range []string{"b/2", "a", "b/1", "a/x/1", "c", "a/y", "ab/1", "a0", "dir/"} {
+		testutil.Ok(t, b.Upload(ctx, name, strings.NewReader(name)))
+	}
+
+	iter := func(dir string, opts ...IterOption) []string {
+		var seen []string
+		testutil.Ok(t, b.Iter(ctx, dir, func(name string) error {
+			seen = append(seen, name)
+			return nil
+		}, opts...))
+		return seen
+	}
+
+	testutil.Equals(t, []string{"a", "a0", "c", "a/", "ab/", "b/", "dir/"}, iter(""))
+	testutil.Equals(t, []string{"a/y", "a/x/"}, iter("a/"))
+	testutil.Equals(t, []string{"a", "a/x/1", "a/y", "a0", "ab/1", "b/1", "b/2", "c", "dir/"}, iter("", WithRecursiveIter()))
+	testutil.Equals(t, []string{"a/x/1", "a/y"}, iter("a/", WithRecursiveIter()))
+
+	testutil.Ok(t, b.Delete(ctx, "a/x/1"))
+	testutil.Equals(t, []string{"a/y"}, iter("a/"))
+	testutil.Equals(t, []string(nil), iter("a/x/"))
+}
+
+func TestInMem_Capacity(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("reject", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		b := NewInMemBucket(WithMaxSize(10), WithMaxObjects(2), WithInMemRegisterer(reg))
+
+		testutil.Ok(t, b.Upload(ctx, "a", strings.NewReader("12345")))
+		testutil.Ok(t, b.Upload(ctx, "b", strings.NewReader("12345")))
+
+		err := b.Upload(ctx, "c", strings.NewReader("1"))
+		testutil.NotOk(t, err)
+		var capErr *CapacityExceededError
+		testutil.Assert(t, errors.As(err, &capErr), "expected capacity error, got %v", err)
+		testutil.Equals(t, 3, capErr.Objects)
+
+		// Overwriting an object only accounts for the size difference.
+		testutil.Ok(t, b.Upload(ctx, "a", strings.NewReader("1")))
+		err = b.Upload(ctx, "a", strings.NewReader("1234567"))
+		testutil.Assert(t, errors.As(err, &capErr), "expected capacity error, got %v", err)
+		testutil.Equals(t, int64(12), capErr.Size)
+
+		testutil.Ok(t, b.Delete(ctx, "b"))
+		testutil.Ok(t, b.Upload(ctx, "c", strings.NewReader("123456789")))
+
+		testutil.Equals(t, 10.0, promtest.ToFloat64(b.metrics.size))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(b.metrics.objects))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(b.metrics.evictions))
+	})
+	t.Run("lru", func(t *testing.T) {
+		b := NewInMemBucket(WithMaxSize(3), WithEvictionPolicy(EvictLRU))
+
+		for _, name := range []string{"a", "b", "c"} {
+			testutil.Ok(t, b.Upload(ctx, name, strings.NewReader(name)))
+		}
+		// Reading "a" makes "b" the least recently used one.
+		rc, err := b.Get(ctx, "a")
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+
+		testutil.Ok(t, b.Upload(ctx, "d", strings.NewReader("d")))
+		testutil.Equals(t, []string{"a", "c", "d"}, objectNames(b))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(b.metrics.evictions))
+
+		// Objects bigger than the capacity are rejected whatever the policy, without evicting anything.
+		err = b.Upload(ctx, "e", strings.NewReader("1234"))
+		var capErr *CapacityExceededError
+		testutil.Assert(t, errors.As(err, &capErr), "expected capacity error, got %v", err)
+		testutil.Equals(t, []string{"a", "c", "d"}, objectNames(b))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(b.metrics.evictions))
+	})
+	t.Run("oldest", func(t *testing.T) {
+		b := NewInMemBucket(WithMaxObjects(2), WithEvictionPolicy(EvictOldest))
+
+		testutil.Ok(t, b.Upload(ctx, "a", strings.NewReader("a")))
+		testutil.Ok(t, b.Upload(ctx, "b", strings.NewReader("b")))
+		testutil.Ok(t, b.ChangeLastModified("a", time.Now().Add(time.Hour)))
+		testutil.Ok(t, b.ChangeLastModified("b", time.Now().Add(-time.Hour)))
+
+		testutil.Ok(t, b.Upload(ctx, "c", strings.NewReader("c")))
+		testutil.Equals(t, []string{"a", "c"}, objectNames(b))
+	})
+	t.Run("too large", func(t *testing.T) {
+		b := NewInMemBucket(WithMaxSize(4), WithEvictionPolicy(EvictOldest))
+
+		testutil.Ok(t, b.Upload(ctx, "a", strings.NewReader("a")))
+		testutil.Ok(t, b.Upload(ctx, "b", strings.NewReader("b")))
+
+		err := b.Upload(ctx, "c", strings.NewReader("12345"))
+		var capErr *CapacityExceededError
+		testutil.Assert(t, errors.As(err, &capErr), "expected capacity error, got %v", err)
+		testutil.Equals(t, []string{"a", "b"}, objectNames(b))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(b.metrics.evictions))
+	})
+}
+
+func objectNames(b *InMemBucket) []string {
+	var names []string
+	for name := range b.Objects() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
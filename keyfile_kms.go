@@ -0,0 +1,112 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// KeyfileConfig is the content of a keyfile: a list of base64 encoded AES-256 keys, identified by their ID. The first
+// key wraps the new data keys, the other ones only unwrap the data keys of existing objects, so that keys can be
+// rotated by adding a new one first.
+//
+//	keys:
+//	  - id: "2024-06"
+//	    key: "<base64 encoded 32 bytes>"
+//	  - id: "2023-12"
+//	    key: "<base64 encoded 32 bytes>"
+type KeyfileConfig struct {
+	Keys []KeyfileKey `yaml:"keys"`
+}
+
+// KeyfileKey is a key of a keyfile.
+type KeyfileKey struct {
+	ID  string `yaml:"id"`
+	Key string `yaml:"key"`
+}
+
+// KeyfileKMS is a KMS wrapping the data keys with AES-256-GCM, with local keys read from a keyfile.
+type KeyfileKMS struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// NewKeyfileKMS returns a KeyfileKMS with the keys of the keyfile at path.
+func NewKeyfileKMS(path string) (*KeyfileKMS, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read keyfile")
+	}
+	var cfg KeyfileConfig
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return nil, errors.Wrap(err, "parse keyfile")
+	}
+	return NewKeyfileKMSFromConfig(cfg)
+}
+
+// NewKeyfileKMSFromConfig returns a KeyfileKMS with the keys of cfg.
+func NewKeyfileKMSFromConfig(cfg KeyfileConfig) (*KeyfileKMS, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("no key in keyfile")
+	}
+	k := &KeyfileKMS{currentID: cfg.Keys[0].ID, keys: map[string][]byte{}}
+	for _, key := range cfg.Keys {
+		if key.ID == "" || len(key.ID) > maxKeyIDSize {
+			return nil, errors.Errorf("invalid key ID %q", key.ID)
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, errors.Errorf("duplicate key ID %q", key.ID)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode key %s", key.ID)
+		}
+		if len(decoded) != 32 {
+			return nil, errors.Errorf("key %s is %d bytes long, expected 32", key.ID, len(decoded))
+		}
+		k.keys[key.ID] = decoded
+	}
+	return k, nil
+}
+
+// WrapKey encrypts dataKey with the first key of the keyfile. The wrapped key is the random nonce followed by the
+// ciphertext.
+func (k *KeyfileKMS) WrapKey(_ context.Context, dataKey []byte) (string, []byte, error) {
+	aead, err := newAEAD(k.keys[k.currentID])
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, errors.Wrap(err, "generate nonce")
+	}
+	return k.currentID, aead.Seal(nonce, nonce, dataKey, []byte(k.currentID)), nil
+}
+
+// UnwrapKey decrypts a data key wrapped with the key of the given ID.
+func (k *KeyfileKMS) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, errors.Errorf("unknown key %s", keyID)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt data key")
+	}
+	return dataKey, nil
+}
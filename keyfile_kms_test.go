@@ -0,0 +1,70 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestKeyfileKMS_Rotation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	oldKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("o", 32)))
+	newKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("n", 32)))
+
+	path := filepath.Join(dir, "keyfile.yaml")
+	testutil.Ok(t, os.WriteFile(path, []byte("keys:\n  - id: old\n    key: "+oldKey+"\n"), 0o600))
+	kms, err := NewKeyfileKMS(path)
+	testutil.Ok(t, err)
+
+	inmem := NewInMemBucket()
+	b, err := NewEncryptedBucket(inmem, kms, DefaultEncryptionConfig)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Upload(ctx, "before", strings.NewReader("before rotation")))
+
+	// New keys are added first, the previous ones are kept to read the existing objects.
+	testutil.Ok(t, os.WriteFile(path, []byte("keys:\n  - id: new\n    key: "+newKey+"\n  - id: old\n    key: "+oldKey+"\n"), 0o600))
+	kms, err = NewKeyfileKMS(path)
+	testutil.Ok(t, err)
+	b, err = NewEncryptedBucket(inmem, kms, DefaultEncryptionConfig)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Upload(ctx, "after", strings.NewReader("after rotation")))
+
+	testutil.Equals(t, "before rotation", readObject(t, b, "before"))
+	testutil.Equals(t, "after rotation", readObject(t, b, "after"))
+	h, err := b.header(ctx, "after")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "new", h.keyID)
+
+	_, err = kms.UnwrapKey(ctx, "unknown", h.wrappedKey)
+	testutil.NotOk(t, err)
+	_, err = kms.UnwrapKey(ctx, "old", h.wrappedKey)
+	testutil.NotOk(t, err)
+}
+
+func TestNewKeyfileKMSFromConfig(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	for _, tcase := range []struct {
+		name string
+		cfg  KeyfileConfig
+	}{
+		{name: "no key"},
+		{name: "no ID", cfg: KeyfileConfig{Keys: []KeyfileKey{{Key: key}}}},
+		{name: "duplicate ID", cfg: KeyfileConfig{Keys: []KeyfileKey{{ID: "a", Key: key}, {ID: "a", Key: key}}}},
+		{name: "invalid encoding", cfg: KeyfileConfig{Keys: []KeyfileKey{{ID: "a", Key: "!"}}}},
+		{name: "short key", cfg: KeyfileConfig{Keys: []KeyfileKey{{ID: "a", Key: base64.StdEncoding.EncodeToString(make([]byte, 16))}}}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := NewKeyfileKMSFromConfig(tcase.cfg)
+			testutil.NotOk(t, err)
+		})
+	}
+}
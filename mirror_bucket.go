@@ -0,0 +1,636 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MirrorMode is the way MirrorBucket writes to the secondary buckets.
+type MirrorMode string
+
+const (
+	// MirrorSync writes to the secondary buckets before returning. Failed writes are queued for retry.
+	MirrorSync MirrorMode = "sync"
+	// MirrorAsync queues the writes to the secondary buckets, which are done in the background.
+	MirrorAsync MirrorMode = "async"
+)
+
+// MirrorConfig configures MirrorBucket.
+type MirrorConfig struct {
+	Mode MirrorMode
+	// QueueDir is the directory persisting the queue of pending secondary writes, so that they survive restarts.
+	// When empty, the queue is kept in memory only.
+	QueueDir string
+	// RetryInterval is the interval between retries of the failed secondary writes.
+	RetryInterval time.Duration
+	// ReadFallback reads from the secondary buckets, in order, when a read from the primary one fails or doesn't find
+	// the object.
+	ReadFallback bool
+}
+
+// DefaultMirrorConfig writes synchronously to the secondary buckets.
+var DefaultMirrorConfig = MirrorConfig{
+	Mode:          MirrorSync,
+	RetryInterval: 30 * time.Second,
+}
+
+// MirrorBucket is a Bucket writing to a primary bucket and mirroring the writes to secondary buckets, e.g. while
+// migrating from one provider to another. Reads go to the primary bucket, with an optional fallback to the
+// secondary ones.
+//
+// Upload and Delete fail only if the primary bucket fails. Failed secondary writes are queued and retried until they
+// succeed. The queue only records the operation and the object name: uploads are retried by copying the object from
+// the primary bucket, as it is at that time. Secondary buckets are identified by their position, which must be kept
+// across restarts when the queue is persisted.
+type MirrorBucket struct {
+	logger      log.Logger
+	primary     Bucket
+	secondaries []Bucket
+	cfg         MirrorConfig
+	queue       *mirrorQueue
+	// processMtx serializes the passes over the queue.
+	processMtx sync.Mutex
+
+	notify chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	writeFailures *prometheus.CounterVec
+	pending       *prometheus.GaugeVec
+	oldestPending *prometheus.GaugeVec
+	readFallbacks *prometheus.CounterVec
+}
+
+// NewMirrorBucket returns a MirrorBucket writing to primary and secondaries. Pending writes persisted in
+// cfg.QueueDir are resumed.
+func NewMirrorBucket(logger log.Logger, primary Bucket, secondaries []Bucket, cfg MirrorConfig, reg prometheus.Registerer) (*MirrorBucket, error) {
+	if cfg.Mode == "" {
+		cfg.Mode = MirrorSync
+	}
+	if cfg.Mode != MirrorSync && cfg.Mode != MirrorAsync {
+		return nil, errors.Errorf("unknown mirror mode %q", cfg.Mode)
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultMirrorConfig.RetryInterval
+	}
+	queue, err := newMirrorQueue(cfg.QueueDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "load mirror queue")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &MirrorBucket{
+		logger:      logger,
+		primary:     primary,
+		secondaries: secondaries,
+		cfg:         cfg,
+		queue:       queue,
+		notify:      make(chan struct{}, 1),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+
+		writeFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_mirror_write_failures_total",
+			Help: "Total number of failed writes to secondary buckets, per secondary bucket and operation.",
+		}, []string{"secondary", "operation"}),
+		pending: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "objstore_bucket_mirror_pending_writes",
+			Help: "Number of writes not yet done on secondary buckets, per secondary bucket.",
+		}, []string{"secondary"}),
+		oldestPending: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "objstore_bucket_mirror_oldest_pending_write_age_seconds",
+			Help: "Age of the oldest write not yet done on secondary buckets, per secondary bucket. 0 when all secondary writes are done.",
+		}, []string{"secondary"}),
+		readFallbacks: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_mirror_read_fallbacks_total",
+			Help: "Total number of reads served by secondary buckets because the primary bucket failed, per operation.",
+		}, []string{"operation"}),
+	}
+	for i := range secondaries {
+		for _, op := range []string{OpUpload, OpDelete} {
+			b.writeFailures.WithLabelValues(strconv.Itoa(i), op)
+		}
+	}
+	for _, op := range []string{OpIter, OpGet, OpGetRange, OpExists, OpAttributes} {
+		b.readFallbacks.WithLabelValues(op)
+	}
+	b.updateDrift()
+
+	go b.run(ctx)
+	return b, nil
+}
+
+// mirrorEntry is a pending write on a secondary bucket.
+type mirrorEntry struct {
+	Seq       int64     `json:"seq"`
+	Secondary int       `json:"secondary"`
+	Op        string    `json:"op"`
+	Name      string    `json:"name"`
+	Enqueued  time.Time `json:"enqueued"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// mirrorQueue is a FIFO queue of pending writes, persisted as one JSON file per entry if dir is set.
+type mirrorQueue struct {
+	dir string
+
+	mtx     sync.Mutex
+	entries []mirrorEntry
+	next    int64
+}
+
+func newMirrorQueue(dir string) (*mirrorQueue, error) {
+	q := &mirrorQueue{dir: dir}
+	if dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			// Leftovers of interrupted writes.
+			if strings.HasSuffix(f.Name(), ".tmp") {
+				_ = os.Remove(filepath.Join(dir, f.Name()))
+			}
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var e mirrorEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, errors.Wrapf(err, "decode %s", f.Name())
+		}
+		q.entries = append(q.entries, e)
+		q.next = max(q.next, e.Seq+1)
+	}
+	slices.SortFunc(q.entries, func(a, b mirrorEntry) int { return cmp.Compare(a.Seq, b.Seq) })
+	return q, nil
+}
+
+func (q *mirrorQueue) path(e mirrorEntry) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", e.Seq))
+}
+
+func (q *mirrorQueue) persist(e mirrorEntry) error {
+	if q.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(e) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(e))
+}
+
+func (q *mirrorQueue) push(secondary int, op, name string) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	e := mirrorEntry{Seq: q.next, Secondary: secondary, Op: op, Name: name, Enqueued: time.Now()}
+	if err := q.persist(e); err != nil {
+		return err
+	}
+	q.next++
+	q.entries = append(q.entries, e)
+	return nil
+}
+
+// update replaces the entry with the same sequence number, if still queued.
+func (q *mirrorQueue) update(e mirrorEntry) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	i := slices.IndexFunc(q.entries, func(o mirrorEntry) bool { return o.Seq == e.Seq })
+	if i < 0 {
+		return nil
+	}
+	q.entries[i] = e
+	return q.persist(e)
+}
+
+func (q *mirrorQueue) remove(e mirrorEntry) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.entries = slices.DeleteFunc(q.entries, func(o mirrorEntry) bool { return o.Seq == e.Seq })
+	if q.dir == "" {
+		return nil
+	}
+	if err := os.Remove(q.path(e)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pending returns true if writes on the object are queued for the secondary bucket.
+func (q *mirrorQueue) pending(secondary int, name string) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return slices.ContainsFunc(q.entries, func(e mirrorEntry) bool { return e.Secondary == secondary && e.Name == name })
+}
+
+// pendingUnder returns true if the secondary bucket has pending writes of objects under dir.
+func (q *mirrorQueue) pendingUnder(secondary int, dir string) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return slices.ContainsFunc(q.entries, func(e mirrorEntry) bool {
+		return e.Secondary == secondary && strings.HasPrefix(e.Name, dir)
+	})
+}
+
+func (q *mirrorQueue) snapshot() []mirrorEntry {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return slices.Clone(q.entries)
+}
+
+// updateDrift updates the metrics of the pending writes.
+func (b *MirrorBucket) updateDrift() {
+	entries := b.queue.snapshot()
+	now := time.Now()
+	for i := range b.secondaries {
+		count, oldest := 0, time.Time{}
+		for _, e := range entries {
+			if e.Secondary != i {
+				continue
+			}
+			if count == 0 {
+				oldest = e.Enqueued
+			}
+			count++
+		}
+		secondary := strconv.Itoa(i)
+		b.pending.WithLabelValues(secondary).Set(float64(count))
+		if count == 0 {
+			b.oldestPending.WithLabelValues(secondary).Set(0)
+		} else {
+			b.oldestPending.WithLabelValues(secondary).Set(now.Sub(oldest).Seconds())
+		}
+	}
+}
+
+func (b *MirrorBucket) run(ctx context.Context) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.cfg.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.notify:
+		}
+		b.processQueue(ctx)
+	}
+}
+
+func (b *MirrorBucket) wakeUp() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// processQueue tries all the pending writes once, in order. Once a write on an object fails, the next writes on the
+// same object and secondary bucket are not tried, so that they are never applied out of order.
+func (b *MirrorBucket) processQueue(ctx context.Context) {
+	b.processMtx.Lock()
+	defer b.processMtx.Unlock()
+	defer b.updateDrift()
+
+	type key struct {
+		secondary int
+		name      string
+	}
+	blocked := map[key]struct{}{}
+	for _, e := range b.queue.snapshot() {
+		if ctx.Err() != nil {
+			return
+		}
+		k := key{secondary: e.Secondary, name: e.Name}
+		if _, ok := blocked[k]; ok {
+			continue
+		}
+		if e.Secondary >= len(b.secondaries) {
+			level.Warn(b.logger).Log("msg", "dropping pending write of unknown secondary bucket", "secondary", e.Secondary, "op", e.Op, "name", e.Name)
+			b.removeEntry(e)
+			continue
+		}
+
+		var err error
+		switch e.Op {
+		case OpUpload:
+			err = b.copyFromPrimary(ctx, b.secondaries[e.Secondary], e.Name)
+		case OpDelete:
+			err = b.deleteSecondary(ctx, b.secondaries[e.Secondary], e.Name)
+		default:
+			err = errors.Errorf("unknown operation %q", e.Op)
+		}
+		if err == nil {
+			b.removeEntry(e)
+			continue
+		}
+
+		blocked[k] = struct{}{}
+		b.writeFailures.WithLabelValues(strconv.Itoa(e.Secondary), e.Op).Inc()
+		level.Warn(b.logger).Log("msg", "failed to mirror write to secondary bucket", "secondary", e.Secondary, "op", e.Op, "name", e.Name, "attempts", e.Attempts+1, "err", err)
+		e.Attempts++
+		e.LastError = err.Error()
+		if err := b.queue.update(e); err != nil {
+			level.Error(b.logger).Log("msg", "failed to persist pending write", "name", e.Name, "err", err)
+		}
+	}
+}
+
+func (b *MirrorBucket) removeEntry(e mirrorEntry) {
+	if err := b.queue.remove(e); err != nil {
+		level.Error(b.logger).Log("msg", "failed to remove pending write from the queue", "name", e.Name, "err", err)
+	}
+}
+
+// enqueue queues a write on a secondary bucket. If the queue can't be persisted, the write is lost and the error logged.
+func (b *MirrorBucket) enqueue(secondary int, op, name string) {
+	if err := b.queue.push(secondary, op, name); err != nil {
+		level.Error(b.logger).Log("msg", "failed to queue write to secondary bucket, the buckets will drift", "secondary", secondary, "op", op, "name", name, "err", err)
+	}
+}
+
+// copyFromPrimary copies the object from the primary bucket to s. Objects deleted from the primary bucket since are
+// not copied.
+func (b *MirrorBucket) copyFromPrimary(ctx context.Context, s Bucket, name string) error {
+	if err := copyObject(ctx, b.primary, s, name); err != nil && !b.primary.IsObjNotFoundErr(err) {
+		return err
+	}
+	return nil
+}
+
+// copyObject copies the object, with its content type and user metadata, from src to dst.
+func copyObject(ctx context.Context, src, dst Bucket, name string) error {
+	_, err := copyObjectUnless(ctx, src, dst, name, nil)
+	return err
+}
+
+// copyObjectUnless is like copyObject, but does not upload the object if skip, called right before the upload, returns
+// true. It returns whether the object was uploaded.
+func copyObjectUnless(ctx context.Context, src, dst Bucket, name string, skip func(context.Context) (bool, error)) (_ bool, err error) {
+	attrs, err := src.Attributes(ctx, name)
+	if err != nil {
+		return false, errors.Wrapf(err, "get attributes of %s", name)
+	}
+	rc, err := src.Get(ctx, name)
+	if err != nil {
+		return false, errors.Wrapf(err, "get %s", name)
+	}
+	defer errcapture.Do(&err, rc.Close, "close source reader")
+
+	var opts []ObjectUploadOption
+	if attrs.ContentType != "" {
+		opts = append(opts, WithContentType(attrs.ContentType))
+	}
+	if len(attrs.UserMetadata) > 0 {
+		opts = append(opts, WithUserMetadata(attrs.UserMetadata))
+	}
+	if skip != nil {
+		if ok, err := skip(ctx); err != nil || ok {
+			return false, err
+		}
+	}
+	return true, dst.Upload(ctx, name, rc, opts...)
+}
+
+func (b *MirrorBucket) deleteSecondary(ctx context.Context, s Bucket, name string) error {
+	if err := s.Delete(ctx, name); err != nil && !s.IsObjNotFoundErr(err) {
+		return err
+	}
+	return nil
+}
+
+// uploadSecondary uploads r to s, if it can be rewound to start, the offset it was at before the primary upload, or
+// copies the object from the primary bucket otherwise. start is negative if r cannot be rewound.
+func (b *MirrorBucket) uploadSecondary(ctx context.Context, s Bucket, name string, r io.Reader, start int64, opts []ObjectUploadOption) error {
+	if rs, ok := r.(io.ReadSeeker); ok && start >= 0 {
+		if _, err := rs.Seek(start, io.SeekStart); err == nil {
+			return s.Upload(ctx, name, rs, opts...)
+		}
+	}
+	return b.copyFromPrimary(ctx, s, name)
+}
+
+// ProcessQueue tries the pending secondary writes now, instead of waiting for the next retry.
+func (b *MirrorBucket) ProcessQueue(ctx context.Context) {
+	b.processQueue(ctx)
+}
+
+func (b *MirrorBucket) Provider() ObjProvider { return b.primary.Provider() }
+
+func (b *MirrorBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	start := int64(-1)
+	if rs, ok := r.(io.Seeker); ok && b.cfg.Mode != MirrorAsync {
+		if off, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			start = off
+		}
+	}
+	if err := b.primary.Upload(ctx, name, r, opts...); err != nil {
+		return err
+	}
+	defer b.updateDrift()
+
+	if b.cfg.Mode == MirrorAsync {
+		for i := range b.secondaries {
+			b.enqueue(i, OpUpload, name)
+		}
+		b.wakeUp()
+		return nil
+	}
+	for i, s := range b.secondaries {
+		// Writes must not overtake the queued ones on the same object.
+		if b.queue.pending(i, name) {
+			b.enqueue(i, OpUpload, name)
+			continue
+		}
+		if err := b.uploadSecondary(ctx, s, name, r, start, opts); err != nil {
+			b.writeFailures.WithLabelValues(strconv.Itoa(i), OpUpload).Inc()
+			level.Warn(b.logger).Log("msg", "failed to mirror upload to secondary bucket, queuing it for retry", "secondary", i, "name", name, "err", err)
+			b.enqueue(i, OpUpload, name)
+		}
+	}
+	return nil
+}
+
+func (b *MirrorBucket) Delete(ctx context.Context, name string) error {
+	if err := b.primary.Delete(ctx, name); err != nil {
+		return err
+	}
+	defer b.updateDrift()
+
+	if b.cfg.Mode == MirrorAsync {
+		for i := range b.secondaries {
+			b.enqueue(i, OpDelete, name)
+		}
+		b.wakeUp()
+		return nil
+	}
+	for i, s := range b.secondaries {
+		if b.queue.pending(i, name) {
+			b.enqueue(i, OpDelete, name)
+			continue
+		}
+		if err := b.deleteSecondary(ctx, s, name); err != nil {
+			b.writeFailures.WithLabelValues(strconv.Itoa(i), OpDelete).Inc()
+			level.Warn(b.logger).Log("msg", "failed to mirror delete to secondary bucket, queuing it for retry", "secondary", i, "name", name, "err", err)
+			b.enqueue(i, OpDelete, name)
+		}
+	}
+	return nil
+}
+
+// read calls fn on the primary bucket, then on the secondary ones if enabled, until it succeeds. Secondary buckets
+// with pending writes of the object are skipped, as they may serve a deleted or overwritten version. The error of the
+// primary bucket is returned if all fail.
+func (b *MirrorBucket) read(op, name string, fn func(Bucket) error) error {
+	return b.readIf(op, fn, func(i int) bool { return !b.queue.pending(i, name) })
+}
+
+// readIf is like read, but only falls back to the secondary buckets for which canFallback returns true after the
+// primary bucket failed.
+func (b *MirrorBucket) readIf(op string, fn func(Bucket) error, canFallback func(i int) bool) error {
+	err := fn(b.primary)
+	if err == nil || !b.cfg.ReadFallback {
+		return err
+	}
+	for i, s := range b.secondaries {
+		if !canFallback(i) {
+			continue
+		}
+		if fn(s) == nil {
+			b.readFallbacks.WithLabelValues(op).Inc()
+			return nil
+		}
+	}
+	return err
+}
+
+// Iter falls back to the secondary buckets only if the primary one failed before passing any entry to f, so that f
+// never gets the same entry twice, and only to the secondary buckets without pending writes under dir.
+func (b *MirrorBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	called := false
+	return b.readIf(OpIter, func(bkt Bucket) error {
+		return bkt.Iter(ctx, dir, func(name string) error {
+			called = true
+			return f(name)
+		}, options...)
+	}, func(i int) bool { return !called && !b.queue.pendingUnder(i, dir) })
+}
+
+func (b *MirrorBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	called := false
+	return b.readIf(OpIter, func(bkt Bucket) error {
+		return bkt.IterWithAttributes(ctx, dir, func(attrs IterObjectAttributes) error {
+			called = true
+			return f(attrs)
+		}, options...)
+	}, func(i int) bool { return !called && !b.queue.pendingUnder(i, dir) })
+}
+
+func (b *MirrorBucket) SupportedIterOptions() []IterOptionType {
+	return b.primary.SupportedIterOptions()
+}
+
+func (b *MirrorBucket) Get(ctx context.Context, name string) (rc io.ReadCloser, err error) {
+	err = b.read(OpGet, name, func(bkt Bucket) (err error) {
+		rc, err = bkt.Get(ctx, name)
+		return err
+	})
+	return rc, err
+}
+
+func (b *MirrorBucket) GetRange(ctx context.Context, name string, off, length int64) (rc io.ReadCloser, err error) {
+	err = b.read(OpGetRange, name, func(bkt Bucket) (err error) {
+		rc, err = bkt.GetRange(ctx, name, off, length)
+		return err
+	})
+	return rc, err
+}
+
+func (b *MirrorBucket) Exists(ctx context.Context, name string) (bool, error) {
+	exists, err := b.primary.Exists(ctx, name)
+	if (err == nil && exists) || !b.cfg.ReadFallback {
+		return exists, err
+	}
+	for i, s := range b.secondaries {
+		if b.queue.pending(i, name) {
+			continue
+		}
+		if ok, serr := s.Exists(ctx, name); serr == nil && ok {
+			b.readFallbacks.WithLabelValues(OpExists).Inc()
+			return true, nil
+		}
+	}
+	return exists, err
+}
+
+func (b *MirrorBucket) Attributes(ctx context.Context, name string) (attrs ObjectAttributes, err error) {
+	err = b.read(OpAttributes, name, func(bkt Bucket) (err error) {
+		attrs, err = bkt.Attributes(ctx, name)
+		return err
+	})
+	return attrs, err
+}
+
+func (b *MirrorBucket) IsObjNotFoundErr(err error) bool { return b.primary.IsObjNotFoundErr(err) }
+
+func (b *MirrorBucket) IsAccessDeniedErr(err error) bool { return b.primary.IsAccessDeniedErr(err) }
+
+func (b *MirrorBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.primary, err) }
+
+// Close stops retrying the pending writes, which are kept in the persisted queue if any, and closes all the buckets.
+func (b *MirrorBucket) Close() error {
+	b.cancel()
+	<-b.done
+
+	var firstErr error
+	for _, bkt := range append([]Bucket{b.primary}, b.secondaries...) {
+		if err := bkt.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "close bucket %s", bkt.Name())
+		}
+	}
+	return firstErr
+}
+
+func (b *MirrorBucket) Name() string { return b.primary.Name() }
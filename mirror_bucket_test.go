@@ -0,0 +1,202 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMirrorBucket_AcceptanceTest(t *testing.T) {
+	primary, secondary := NewInMemBucket(), NewInMemBucket()
+	b, err := NewMirrorBucket(log.NewNopLogger(), primary, []Bucket{secondary}, DefaultMirrorConfig, nil)
+	testutil.Ok(t, err)
+	AcceptanceTest(t, b)
+	testutil.Equals(t, primary.Objects(), secondary.Objects())
+}
+
+func readObject(t *testing.T, bkt Bucket, name string) string {
+	t.Helper()
+	rc, err := bkt.Get(context.Background(), name)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, rc.Close()) }()
+	b, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	return string(b)
+}
+
+func TestMirrorBucket_RetriesFailedWrites(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewInMemBucket(), NewInMemBucket()
+	faults := WithFaults(secondary)
+	b, err := NewMirrorBucket(log.NewNopLogger(), primary, []Bucket{faults}, MirrorConfig{RetryInterval: time.Hour}, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	// Secondary failures don't fail the upload, the write is queued.
+	faults.SetRules(FaultRule{Ops: []string{OpUpload}, OnCall: 1, Err: ErrFaultTransient})
+	testutil.Ok(t, b.Upload(ctx, "obj", io.MultiReader(strings.NewReader("v1"))))
+	testutil.Equals(t, "v1", readObject(t, primary, "obj"))
+	testutil.Equals(t, 0, len(secondary.Objects()))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.pending.WithLabelValues("0")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.writeFailures.WithLabelValues("0", OpUpload)))
+
+	b.ProcessQueue(ctx)
+	testutil.Equals(t, "v1", readObject(t, secondary, "obj"))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.pending.WithLabelValues("0")))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.oldestPending.WithLabelValues("0")))
+
+	// Writes on an object with queued writes are queued behind them, so that they are applied in order.
+	faults.SetRules(FaultRule{Ops: []string{OpDelete}, OnCall: 1, Err: ErrFaultTransient})
+	testutil.Ok(t, b.Delete(ctx, "obj"))
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader("v2")))
+	testutil.Equals(t, "v1", readObject(t, secondary, "obj"))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.pending.WithLabelValues("0")))
+
+	// Once a write fails, the next ones on the same object wait.
+	faults.SetRules(FaultRule{Ops: []string{OpDelete}, OnCall: 1, Err: ErrFaultTransient})
+	b.ProcessQueue(ctx)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.pending.WithLabelValues("0")))
+
+	b.ProcessQueue(ctx)
+	testutil.Equals(t, "v2", readObject(t, secondary, "obj"))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.pending.WithLabelValues("0")))
+}
+
+func TestMirrorBucket_PersistedQueue(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	primary, secondary := NewInMemBucket(), NewInMemBucket()
+	cfg := MirrorConfig{Mode: MirrorAsync, QueueDir: dir, RetryInterval: time.Hour}
+
+	faults := WithFaults(secondary, FaultRule{Probability: 1, Err: ErrFaultTransient})
+	b, err := NewMirrorBucket(log.NewNopLogger(), primary, []Bucket{faults}, cfg, nil)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Upload(ctx, "a", strings.NewReader("a")))
+	testutil.Ok(t, b.Upload(ctx, "b", strings.NewReader("b")))
+	testutil.Ok(t, b.Delete(ctx, "b"))
+	b.ProcessQueue(ctx)
+	testutil.Ok(t, b.Close())
+	testutil.Equals(t, 0, len(secondary.Objects()))
+
+	// Pending writes are resumed after a restart. The upload of b was dropped, as b is not in the primary bucket anymore.
+	b, err = NewMirrorBucket(log.NewNopLogger(), primary, []Bucket{secondary}, cfg, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.pending.WithLabelValues("0")))
+
+	b.ProcessQueue(ctx)
+	testutil.Equals(t, map[string][]byte{"a": []byte("a")}, secondary.Objects())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.pending.WithLabelValues("0")))
+
+	// Async writes are done in the background.
+	testutil.Ok(t, b.Upload(ctx, "c", strings.NewReader("c")))
+	for promtest.ToFloat64(b.pending.WithLabelValues("0")) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	testutil.Equals(t, "c", readObject(t, secondary, "c"))
+}
+
+func TestMirrorBucket_ReadFallback(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewInMemBucket(), NewInMemBucket()
+	testutil.Ok(t, secondary.Upload(ctx, "old", strings.NewReader("content")))
+
+	b, err := NewMirrorBucket(log.NewNopLogger(), primary, []Bucket{secondary}, MirrorConfig{}, nil)
+	testutil.Ok(t, err)
+	_, err = b.Get(ctx, "old")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	testutil.Ok(t, b.Close())
+
+	b, err = NewMirrorBucket(log.NewNopLogger(), primary, []Bucket{secondary}, MirrorConfig{ReadFallback: true}, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+	testutil.Equals(t, "content", readObject(t, b, "old"))
+	ok, err := b.Exists(ctx, "old")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist in the secondary bucket")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.readFallbacks.WithLabelValues(OpGet)))
+
+	_, err = b.Get(ctx, "missing")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+}
+
+func TestMirrorBucket_ReadFallbackPendingWrites(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewInMemBucket(), NewInMemBucket()
+	for _, bkt := range []Bucket{primary, secondary} {
+		testutil.Ok(t, bkt.Upload(ctx, "dir/obj", strings.NewReader("content")))
+	}
+	faults := WithFaults(secondary, FaultRule{Ops: []string{OpDelete}, Probability: 1, Err: ErrFaultTransient})
+	b, err := NewMirrorBucket(log.NewNopLogger(), primary, []Bucket{faults}, MirrorConfig{Mode: MirrorAsync, ReadFallback: true, RetryInterval: time.Hour}, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	// The deleted object is not served by the secondary bucket while the delete is pending.
+	testutil.Ok(t, b.Delete(ctx, "dir/obj"))
+	_, err = b.Get(ctx, "dir/obj")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	ok, err := b.Exists(ctx, "dir/obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected deleted object not to exist")
+	_, err = b.Attributes(ctx, "dir/obj")
+	testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.readFallbacks.WithLabelValues(OpGet)))
+	testutil.Equals(t, "content", readObject(t, secondary, "dir/obj"))
+}
+
+func TestMirrorBucket_IterFallback(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewInMemBucket(), NewInMemBucket()
+	for _, bkt := range []Bucket{primary, secondary} {
+		testutil.Ok(t, bkt.Upload(ctx, "a", strings.NewReader("a")))
+		testutil.Ok(t, bkt.Upload(ctx, "b", strings.NewReader("b")))
+	}
+	faults := WithFaults(primary, FaultRule{Ops: []string{OpIter}, OnCall: 1, Err: ErrFaultTransient})
+	b, err := NewMirrorBucket(log.NewNopLogger(), faults, []Bucket{secondary}, MirrorConfig{ReadFallback: true}, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	// Listings failing before passing any entry fall back to the secondary bucket.
+	var names []string
+	testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"a", "b"}, names)
+
+	// Listings failing midway do not, so that entries are not passed twice.
+	names = nil
+	stop := errors.New("stop")
+	err = b.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return stop
+	})
+	testutil.Assert(t, errors.Is(err, stop), "expected callback error, got %v", err)
+	testutil.Equals(t, []string{"a"}, names)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.readFallbacks.WithLabelValues(OpIter)))
+}
+
+func TestMirrorBucket_UploadFromOffset(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := NewInMemBucket(), NewInMemBucket()
+	b, err := NewMirrorBucket(log.NewNopLogger(), primary, []Bucket{secondary}, MirrorConfig{}, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	r := strings.NewReader("headercontent")
+	_, err = r.Seek(6, io.SeekStart)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Upload(ctx, "obj", r))
+	testutil.Equals(t, "content", readObject(t, primary, "obj"))
+	testutil.Equals(t, "content", readObject(t, secondary, "obj"))
+}
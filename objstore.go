@@ -197,7 +197,8 @@ func ApplyIterOptions(options ...IterOption) IterParams {
 }
 
 type UploadObjectParams struct {
-	ContentType string
+	ContentType  string
+	UserMetadata map[string]string
 }
 
 type ObjectUploadOption func(f *UploadObjectParams)
@@ -208,6 +209,14 @@ func WithContentType(contentType string) ObjectUploadOption {
 	}
 }
 
+// WithUserMetadata is an option to attach user defined key-value metadata to the uploaded object.
+// Providers that do not support user metadata ignore it.
+func WithUserMetadata(metadata map[string]string) ObjectUploadOption {
+	return func(f *UploadObjectParams) {
+		f.UserMetadata = metadata
+	}
+}
+
 func ApplyObjectUploadOptions(opts ...ObjectUploadOption) UploadObjectParams {
 	out := UploadObjectParams{}
 	for _, opt := range opts {
@@ -280,6 +289,27 @@ type ObjectAttributes struct {
 
 	// LastModified is the timestamp the object was last modified.
 	LastModified time.Time `json:"last_modified"`
+
+	// ContentType is the content type the object was uploaded with, if known by the provider.
+	ContentType string `json:"content_type,omitempty"`
+
+	// UserMetadata is the user defined metadata the object was uploaded with, if known by the provider.
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+
+	// Checksum is the hex encoded SHA-256 digest of the object content, if known by the provider.
+	Checksum string `json:"checksum,omitempty"`
+
+	// ETag is the entity tag of the object, if known by the provider. It changes whenever the content changes.
+	ETag string `json:"etag,omitempty"`
+}
+
+// ObjectVersion returns a string identifying the version of the object with the given attributes: its ETag if known by
+// the provider, and its last modification time and size otherwise.
+func ObjectVersion(attrs ObjectAttributes) string {
+	if attrs.ETag != "" {
+		return attrs.ETag
+	}
+	return fmt.Sprintf("%d-%d", attrs.LastModified.UnixNano(), attrs.Size)
 }
 
 type IterObjectAttributes struct {
@@ -821,6 +851,10 @@ func (b *metricBucket) IsAccessDeniedErr(err error) bool {
 	return b.bkt.IsAccessDeniedErr(err)
 }
 
+func (b *metricBucket) IsRetryableErr(err error) bool {
+	return IsRetryableErr(b.bkt, err)
+}
+
 func (b *metricBucket) Close() error {
 	return b.bkt.Close()
 }
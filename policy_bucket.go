@@ -0,0 +1,205 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrOperationDenied is returned by PolicyBucket for the operations its policy denies. It is classified as an access
+// denied error.
+var ErrOperationDenied = errors.New("operation denied by bucket policy")
+
+// PolicyRule matches operations on objects under some prefixes.
+type PolicyRule struct {
+	// Operations (OpGet, OpUpload...) the rule applies to. Empty matches all operations.
+	Operations []string `yaml:"operations"`
+	// Prefixes of the object names the rule applies to. Empty matches all names.
+	Prefixes []string `yaml:"prefixes"`
+}
+
+func (r PolicyRule) matchesOp(op string) bool {
+	return len(r.Operations) == 0 || slices.Contains(r.Operations, op)
+}
+
+func (r PolicyRule) matchesName(name string) bool {
+	return len(r.Prefixes) == 0 || slices.ContainsFunc(r.Prefixes, func(p string) bool { return strings.HasPrefix(name, p) })
+}
+
+// PolicyConfig configures PolicyBucket.
+type PolicyConfig struct {
+	// ReadOnly denies all Upload and Delete calls.
+	ReadOnly bool `yaml:"read_only"`
+	// Allow rules restrict the operations they match to their prefixes: an operation matched by at least one allow
+	// rule is denied on the names not matched by any of them.
+	Allow []PolicyRule `yaml:"allow"`
+	// Deny rules deny the operations on the names they match, whatever the allow rules.
+	Deny []PolicyRule `yaml:"deny"`
+}
+
+// IsZero returns true if the policy allows everything.
+func (cfg PolicyConfig) IsZero() bool {
+	return !cfg.ReadOnly && len(cfg.Allow) == 0 && len(cfg.Deny) == 0
+}
+
+func (cfg PolicyConfig) validate() error {
+	for _, r := range slices.Concat(cfg.Allow, cfg.Deny) {
+		for _, op := range r.Operations {
+			if !slices.Contains(bucketOps, op) {
+				return errors.Errorf("unknown operation %q", op)
+			}
+		}
+	}
+	return nil
+}
+
+// PolicyBucket is a Bucket wrapper denying operations according to a prefix-based policy, with ErrOperationDenied.
+// Names are matched against the prefixes as seen by the caller. Names which providers may normalize to another one,
+// having "." or ".." segments, or leading or duplicate slashes, are denied, so that they can't escape the prefixes. Iter is matched with the listed directory, with a
+// trailing slash, and its entries are not filtered.
+type PolicyBucket struct {
+	bkt Bucket
+	cfg PolicyConfig
+}
+
+// NewPolicyBucket returns a PolicyBucket wrapping bkt.
+func NewPolicyBucket(bkt Bucket, cfg PolicyConfig) (*PolicyBucket, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid bucket policy")
+	}
+	return &PolicyBucket{bkt: bkt, cfg: cfg}, nil
+}
+
+// ReadOnly returns a PolicyBucket wrapping bkt which denies Upload and Delete calls.
+func ReadOnly(bkt Bucket) *PolicyBucket {
+	return &PolicyBucket{bkt: bkt, cfg: PolicyConfig{ReadOnly: true}}
+}
+
+// canonical returns false if name has "." or ".." segments, or empty segments other than a trailing slash.
+func canonical(name string) bool {
+	if name == "" {
+		return true
+	}
+	segments := strings.Split(strings.TrimSuffix(name, DirDelim), DirDelim)
+	return !slices.ContainsFunc(segments, func(s string) bool { return s == "" || s == "." || s == ".." })
+}
+
+// check returns ErrOperationDenied if the policy denies op on name.
+func (b *PolicyBucket) check(op, name string) error {
+	if !canonical(name) {
+		return errors.Wrapf(ErrOperationDenied, "%s %s: name is not canonical", op, name)
+	}
+	if b.cfg.ReadOnly && (op == OpUpload || op == OpDelete) {
+		return errors.Wrapf(ErrOperationDenied, "%s %s: bucket is read-only", op, name)
+	}
+	for _, r := range b.cfg.Deny {
+		if r.matchesOp(op) && r.matchesName(name) {
+			return errors.Wrapf(ErrOperationDenied, "%s %s", op, name)
+		}
+	}
+	restricted := false
+	for _, r := range b.cfg.Allow {
+		if !r.matchesOp(op) {
+			continue
+		}
+		if r.matchesName(name) {
+			return nil
+		}
+		restricted = true
+	}
+	if restricted {
+		return errors.Wrapf(ErrOperationDenied, "%s %s", op, name)
+	}
+	return nil
+}
+
+func (b *PolicyBucket) checkDir(dir string) error {
+	if dir != "" && !strings.HasSuffix(dir, DirDelim) {
+		dir += DirDelim
+	}
+	return b.check(OpIter, dir)
+}
+
+func (b *PolicyBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *PolicyBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	if err := b.checkDir(dir); err != nil {
+		return err
+	}
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *PolicyBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	if err := b.checkDir(dir); err != nil {
+		return err
+	}
+	return b.bkt.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *PolicyBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *PolicyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.check(OpGet, name); err != nil {
+		return nil, err
+	}
+	return b.bkt.Get(ctx, name)
+}
+
+func (b *PolicyBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.check(OpGetRange, name); err != nil {
+		return nil, err
+	}
+	return b.bkt.GetRange(ctx, name, off, length)
+}
+
+func (b *PolicyBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.check(OpExists, name); err != nil {
+		return false, err
+	}
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *PolicyBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if err := b.check(OpAttributes, name); err != nil {
+		return ObjectAttributes{}, err
+	}
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *PolicyBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	if err := b.check(OpUpload, name); err != nil {
+		return err
+	}
+	return b.bkt.Upload(ctx, name, r, opts...)
+}
+
+func (b *PolicyBucket) Delete(ctx context.Context, name string) error {
+	if err := b.check(OpDelete, name); err != nil {
+		return err
+	}
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *PolicyBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+// IsAccessDeniedErr returns true for ErrOperationDenied, on top of the access denied errors of the wrapped bucket.
+func (b *PolicyBucket) IsAccessDeniedErr(err error) bool {
+	return errors.Is(err, ErrOperationDenied) || b.bkt.IsAccessDeniedErr(err)
+}
+
+// IsRetryableErr returns false for ErrOperationDenied, as the policy won't change.
+func (b *PolicyBucket) IsRetryableErr(err error) bool {
+	return !errors.Is(err, ErrOperationDenied) && IsRetryableErr(b.bkt, err)
+}
+
+func (b *PolicyBucket) Close() error { return b.bkt.Close() }
+
+func (b *PolicyBucket) Name() string { return b.bkt.Name() }
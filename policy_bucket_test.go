@@ -0,0 +1,86 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestPolicyBucket_AcceptanceTest(t *testing.T) {
+	b, err := NewPolicyBucket(NewInMemBucket(), PolicyConfig{
+		Deny: []PolicyRule{{Operations: []string{OpDelete}, Prefixes: []string{"archive/"}}},
+	})
+	testutil.Ok(t, err)
+	AcceptanceTest(t, b)
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("content")))
+	b := ReadOnly(inmem)
+
+	err := b.Upload(ctx, "new", strings.NewReader("content"))
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+	testutil.Assert(t, !b.IsRetryableErr(err), "expected denied operation not to be retryable")
+	err = b.Delete(ctx, "obj")
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+
+	ok, err := b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist")
+	testutil.Equals(t, 1, len(inmem.Objects()))
+}
+
+func TestPolicyBucket(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	for _, name := range []string{"tenant-a/obj", "tenant-b/obj", "archive/obj", "tenant-a/archive/obj"} {
+		testutil.Ok(t, inmem.Upload(ctx, name, strings.NewReader("content")))
+	}
+
+	b, err := NewPolicyBucket(inmem, PolicyConfig{
+		Allow: []PolicyRule{
+			{Operations: []string{OpUpload, OpDelete}, Prefixes: []string{"tenant-a/"}},
+			{Operations: []string{OpIter}, Prefixes: []string{"tenant-a/", "tenant-b/"}},
+		},
+		Deny: []PolicyRule{{Operations: []string{OpDelete}, Prefixes: []string{"tenant-a/archive/"}}},
+	})
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		name    string
+		call    func() error
+		allowed bool
+	}{
+		{name: "upload under allowed prefix", call: func() error { return b.Upload(ctx, "tenant-a/new", strings.NewReader("x")) }, allowed: true},
+		{name: "upload elsewhere", call: func() error { return b.Upload(ctx, "tenant-b/new", strings.NewReader("x")) }},
+		{name: "delete under allowed prefix", call: func() error { return b.Delete(ctx, "tenant-a/obj") }, allowed: true},
+		{name: "delete under denied prefix", call: func() error { return b.Delete(ctx, "tenant-a/archive/obj") }},
+		{name: "unrestricted read", call: func() error { _, err := b.Attributes(ctx, "archive/obj"); return err }, allowed: true},
+		{name: "iter allowed dir", call: func() error { return b.Iter(ctx, "tenant-b", func(string) error { return nil }) }, allowed: true},
+		{name: "iter root", call: func() error { return b.Iter(ctx, "", func(string) error { return nil }) }},
+		{name: "upload escaping allowed prefix", call: func() error { return b.Upload(ctx, "tenant-a/../tenant-b/x", strings.NewReader("x")) }},
+		{name: "delete escaping to denied prefix", call: func() error { return b.Delete(ctx, "tenant-a/x/../archive/obj") }},
+		{name: "delete with dot segment", call: func() error { return b.Delete(ctx, "tenant-a/./archive/obj") }},
+		{name: "delete with duplicate slash", call: func() error { return b.Delete(ctx, "tenant-a//archive/obj") }},
+		{name: "upload with leading slash", call: func() error { return b.Upload(ctx, "/tenant-a/new", strings.NewReader("x")) }},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			err := tcase.call()
+			if tcase.allowed {
+				testutil.Ok(t, err)
+				return
+			}
+			testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+		})
+	}
+
+	_, err = NewPolicyBucket(inmem, PolicyConfig{Deny: []PolicyRule{{Operations: []string{"write"}}}})
+	testutil.NotOk(t, err)
+}
@@ -94,6 +94,11 @@ func (p *PrefixedBucket) IsAccessDeniedErr(err error) bool {
 	return p.bkt.IsAccessDeniedErr(err)
 }
 
+// IsRetryableErr returns true if the error is transient according to the wrapped bucket.
+func (p *PrefixedBucket) IsRetryableErr(err error) bool {
+	return IsRetryableErr(p.bkt, err)
+}
+
 // Attributes returns information about the specified object.
 func (p *PrefixedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
 	return p.bkt.Attributes(ctx, conditionalPrefix(p.prefix, name))
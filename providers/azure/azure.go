@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
@@ -304,6 +305,15 @@ func (b *Bucket) IsAccessDeniedErr(err error) bool {
 	return bloberror.HasCode(err, bloberror.AuthorizationPermissionMismatch) || bloberror.HasCode(err, bloberror.InsufficientAccountPermissions)
 }
 
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) && objstore.IsRetryableStatusCode(respErr.StatusCode) {
+		return true
+	}
+	return bloberror.HasCode(err, bloberror.ServerBusy, bloberror.OperationTimedOut, bloberror.InternalError) || objstore.IsTransientNetworkErr(err)
+}
+
 func (b *Bucket) getBlobReader(ctx context.Context, name string, httpRange blob.HTTPRange) (io.ReadCloser, error) {
 	level.Debug(b.logger).Log("msg", "getting blob", "blob", name, "offset", httpRange.Offset, "length", httpRange.Count)
 	if name == "" {
@@ -345,10 +355,14 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	if err != nil {
 		return objstore.ObjectAttributes{}, err
 	}
-	return objstore.ObjectAttributes{
+	attrs := objstore.ObjectAttributes{
 		Size:         *resp.ContentLength,
 		LastModified: *resp.LastModified,
-	}, nil
+	}
+	if resp.ETag != nil {
+		attrs.ETag = string(*resp.ETag)
+	}
+	return attrs, nil
 }
 
 // Exists checks if the given object exists.
@@ -332,6 +332,14 @@ func (b *Bucket) IsAccessDeniedErr(_ error) bool {
 	return false
 }
 
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	if bosErr, ok := errors.Cause(err).(*bce.BceServiceError); ok && objstore.IsRetryableStatusCode(bosErr.StatusCode) {
+		return true
+	}
+	return objstore.IsTransientNetworkErr(err)
+}
+
 func (b *Bucket) getRange(_ context.Context, bucketName, objectKey string, off, length int64) (io.ReadCloser, error) {
 	if len(objectKey) == 0 {
 		return nil, errors.Errorf("given object name should not empty")
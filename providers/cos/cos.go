@@ -405,6 +405,16 @@ func (b *Bucket) IsAccessDeniedErr(_ error) bool {
 	return false
 }
 
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	if cosErr, ok := errors.Cause(err).(*cos.ErrorResponse); ok {
+		if cosErr.Code == "SlowDown" || (cosErr.Response != nil && objstore.IsRetryableStatusCode(cosErr.Response.StatusCode)) {
+			return true
+		}
+	}
+	return objstore.IsTransientNetworkErr(err)
+}
+
 func (b *Bucket) Close() error { return nil }
 
 type objectInfo struct {
@@ -5,10 +5,13 @@ package filesystem
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/efficientgo/core/errcapture"
 	"github.com/pkg/errors"
@@ -20,13 +23,22 @@ import (
 // Config stores the configuration for storing and accessing blobs in filesystem.
 type Config struct {
 	Directory string `yaml:"directory"`
+	// MetadataMode selects how content type, user metadata and checksums are persisted.
+	// One of "auto" (default), "xattr", "sidecar" or "none".
+	MetadataMode MetadataMode `yaml:"metadata_mode"`
+	// ReadOnly opens the directory read-only and rejects Upload and Delete with an access denied error.
+	ReadOnly bool `yaml:"read_only"`
 }
 
+var errReadOnly = errors.Wrap(os.ErrPermission, "filesystem bucket is read-only")
+
 // Bucket implements the objstore.Bucket interfaces against filesystem that binary runs on.
 // Methods from Bucket interface are thread-safe. Objects are assumed to be immutable.
 // NOTE: It does not follow symbolic links.
 type Bucket struct {
-	rootDir string
+	rootDir      string
+	metadataMode MetadataMode
+	readOnly     bool
 }
 
 // NewBucketFromConfig returns a new filesystem.Bucket from config.
@@ -35,19 +47,54 @@ func NewBucketFromConfig(conf []byte) (*Bucket, error) {
 	if err := yaml.Unmarshal(conf, &c); err != nil {
 		return nil, err
 	}
-	if c.Directory == "" {
-		return nil, errors.New("missing directory for filesystem bucket")
-	}
-	return NewBucket(c.Directory)
+	return NewBucketWithConfig(c)
 }
 
 // NewBucket returns a new filesystem.Bucket.
 func NewBucket(rootDir string) (*Bucket, error) {
-	absDir, err := filepath.Abs(rootDir)
+	return NewBucketWithConfig(Config{Directory: rootDir})
+}
+
+// NewBucketWithConfig returns a new filesystem.Bucket using the provided config.
+func NewBucketWithConfig(c Config) (*Bucket, error) {
+	if c.Directory == "" {
+		return nil, errors.New("missing directory for filesystem bucket")
+	}
+	if c.MetadataMode == "" {
+		c.MetadataMode = MetadataModeAuto
+	}
+	if err := c.MetadataMode.validate(); err != nil {
+		return nil, err
+	}
+
+	absDir, err := filepath.Abs(c.Directory)
 	if err != nil {
 		return nil, err
 	}
-	return &Bucket{rootDir: absDir}, nil
+	if c.ReadOnly {
+		// A read-only bucket never creates its root, so it has to exist and be readable upfront.
+		if err := checkReadableDir(absDir); err != nil {
+			return nil, err
+		}
+	}
+	return &Bucket{rootDir: absDir, metadataMode: c.MetadataMode, readOnly: c.ReadOnly}, nil
+}
+
+func checkReadableDir(dir string) (err error) {
+	f, err := os.OpenFile(filepath.Clean(dir), os.O_RDONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", dir)
+	}
+	defer errcapture.Do(&err, f.Close, "close dir")
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", dir)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s is not a directory", dir)
+	}
+	return nil
 }
 
 func (b *Bucket) Provider() objstore.ObjProvider { return objstore.FILESYSTEM }
@@ -83,6 +130,10 @@ func (b *Bucket) IterWithAttributes(ctx context.Context, dir string, f func(attr
 		return err
 	}
 	for _, file := range files {
+		if isSidecar(file.Name()) {
+			// Metadata sidecars are not objects.
+			continue
+		}
 		name := filepath.Join(dir, file.Name())
 
 		if file.IsDir() {
@@ -171,9 +222,17 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 		return objstore.ObjectAttributes{}, errors.Wrapf(err, "stat %s", file)
 	}
 
+	md, err := b.readMetadata(file)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+
 	return objstore.ObjectAttributes{
 		Size:         stat.Size(),
 		LastModified: stat.ModTime(),
+		ContentType:  md.ContentType,
+		UserMetadata: md.UserMetadata,
+		Checksum:     md.Checksum,
 	}, nil
 }
 
@@ -247,10 +306,13 @@ func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
 }
 
 // Upload writes the file specified in src to into the memory.
-func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader, _ ...objstore.ObjectUploadOption) (err error) {
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader, opts ...objstore.ObjectUploadOption) (err error) {
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
+	if b.readOnly {
+		return errors.Wrapf(errReadOnly, "upload %s", name)
+	}
 
 	file := filepath.Join(b.rootDir, name)
 	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
@@ -263,10 +325,17 @@ func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader, _ ...objs
 	}
 	defer errcapture.Do(&err, f.Close, "close")
 
-	if _, err := io.Copy(f, r); err != nil {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
 		return errors.Wrapf(err, "copy to %s", file)
 	}
-	return nil
+
+	uploadOpts := objstore.ApplyObjectUploadOptions(opts...)
+	return b.writeMetadata(file, objectMetadata{
+		ContentType:  uploadOpts.ContentType,
+		UserMetadata: uploadOpts.UserMetadata,
+		Checksum:     hex.EncodeToString(h.Sum(nil)),
+	})
 }
 
 func isDirEmpty(name string) (ok bool, err error) {
@@ -291,8 +360,14 @@ func (b *Bucket) Delete(ctx context.Context, name string) error {
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
+	if b.readOnly {
+		return errors.Wrapf(errReadOnly, "delete %s", name)
+	}
 
 	file := filepath.Join(b.rootDir, name)
+	if err := b.removeMetadata(file); err != nil {
+		return err
+	}
 	for file != b.rootDir {
 		if err := os.RemoveAll(file); err != nil {
 			return errors.Wrapf(err, "rm %s", file)
@@ -315,8 +390,14 @@ func (b *Bucket) IsObjNotFoundErr(err error) bool {
 }
 
 // IsAccessDeniedErr returns true if access to object is denied.
-func (b *Bucket) IsAccessDeniedErr(_ error) bool {
-	return false
+// Both EACCES and EPERM returned by the operating system, as well as writes to a read-only bucket, are considered access denied.
+func (b *Bucket) IsAccessDeniedErr(err error) bool {
+	return errors.Is(err, os.ErrPermission)
+}
+
+// IsRetryableErr returns true if the system call was interrupted or the resource temporarily unavailable.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
 }
 
 func (b *Bucket) Close() error { return nil }
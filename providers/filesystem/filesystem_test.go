@@ -6,13 +6,17 @@ package filesystem
 import (
 	"bytes"
 	"context"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
 
 	"github.com/thanos-io/objstore"
 )
@@ -190,3 +194,181 @@ func TestDelete_CancelledContext(t *testing.T) {
 	testutil.NotOk(t, err)
 	testutil.Equals(t, context.Canceled, err)
 }
+
+func TestUpload_PersistsMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	for _, mode := range []MetadataMode{MetadataModeAuto, MetadataModeXattr, MetadataModeSidecar} {
+		t.Run(string(mode), func(t *testing.T) {
+			dir := t.TempDir()
+			if mode == MetadataModeXattr {
+				if err := setXattr(dir, xattrName, []byte("{}")); err != nil {
+					t.Skipf("extended attributes not supported: %v", err)
+				}
+			}
+
+			b, err := NewBucketWithConfig(Config{Directory: dir, MetadataMode: mode})
+			testutil.Ok(t, err)
+
+			testutil.Ok(t, b.Upload(ctx, "dir/obj", strings.NewReader("content"),
+				objstore.WithContentType("text/plain"),
+				objstore.WithUserMetadata(map[string]string{"owner": "team-a"}),
+			))
+
+			attrs, err := b.Attributes(ctx, "dir/obj")
+			testutil.Ok(t, err)
+			testutil.Equals(t, int64(7), attrs.Size)
+			testutil.Equals(t, "text/plain", attrs.ContentType)
+			testutil.Equals(t, map[string]string{"owner": "team-a"}, attrs.UserMetadata)
+			testutil.Equals(t, "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73", attrs.Checksum)
+
+			// Overwriting without options must not keep stale metadata.
+			testutil.Ok(t, b.Upload(ctx, "dir/obj", strings.NewReader("content")))
+			attrs, err = b.Attributes(ctx, "dir/obj")
+			testutil.Ok(t, err)
+			testutil.Equals(t, "", attrs.ContentType)
+			testutil.Equals(t, 0, len(attrs.UserMetadata))
+
+			var seen []string
+			testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+				seen = append(seen, name)
+				return nil
+			}, objstore.WithRecursiveIter()))
+			testutil.Equals(t, []string{"dir/obj"}, seen)
+
+			testutil.Ok(t, b.Delete(ctx, "dir/obj"))
+			entries, err := os.ReadDir(dir)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 0, len(entries))
+		})
+	}
+}
+
+func TestUpload_SidecarHiddenFromIter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	b, err := NewBucketWithConfig(Config{Directory: dir, MetadataMode: MetadataModeSidecar})
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader("content"), objstore.WithContentType("text/plain")))
+	_, err = os.Stat(sidecarPath(filepath.Join(dir, "obj")))
+	testutil.Ok(t, err)
+
+	var seen []string
+	testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+		seen = append(seen, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"obj"}, seen)
+}
+
+func TestUpload_MetadataModeNone(t *testing.T) {
+	ctx := context.Background()
+
+	b, err := NewBucketWithConfig(Config{Directory: t.TempDir(), MetadataMode: MetadataModeNone})
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader("content"), objstore.WithContentType("text/plain")))
+	attrs, err := b.Attributes(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", attrs.ContentType)
+	testutil.Equals(t, "", attrs.Checksum)
+}
+
+func TestNewBucketFromConfig_InvalidMetadataMode(t *testing.T) {
+	_, err := NewBucketFromConfig([]byte("directory: /tmp\nmetadata_mode: foo"))
+	testutil.NotOk(t, err)
+}
+
+func skipIfRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks are bypassed when running as root")
+	}
+}
+
+func TestIsAccessDeniedErr(t *testing.T) {
+	b, err := NewBucket(t.TempDir())
+	testutil.Ok(t, err)
+
+	testutil.Assert(t, b.IsAccessDeniedErr(errors.Wrap(&os.PathError{Op: "open", Path: "a", Err: syscall.EACCES}, "wrapped")))
+	testutil.Assert(t, b.IsAccessDeniedErr(&os.PathError{Op: "open", Path: "a", Err: syscall.EPERM}))
+	testutil.Assert(t, !b.IsAccessDeniedErr(&os.PathError{Op: "open", Path: "a", Err: syscall.ENOENT}))
+	testutil.Assert(t, !b.IsAccessDeniedErr(nil))
+}
+
+func TestIsAccessDeniedErr_ChmodDir(t *testing.T) {
+	skipIfRoot(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	b, err := NewBucket(dir)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Upload(ctx, "locked/obj", strings.NewReader("content")))
+
+	locked := filepath.Join(dir, "locked")
+	testutil.Ok(t, os.Chmod(locked, 0))
+	t.Cleanup(func() { testutil.Ok(t, os.Chmod(locked, 0700)) })
+
+	_, err = b.Get(ctx, "locked/obj")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+	testutil.Assert(t, !b.IsObjNotFoundErr(err), "expected access denied error, got %v", err)
+
+	err = b.Upload(ctx, "locked/other", strings.NewReader("content"))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+
+	_, err = b.Attributes(ctx, "locked/obj")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	rw, err := NewBucket(dir)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rw.Upload(ctx, "obj", strings.NewReader("content")))
+
+	b, err := NewBucketFromConfig([]byte("directory: " + dir + "\nread_only: true"))
+	testutil.Ok(t, err)
+
+	rc, err := b.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	content, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "content", string(content))
+
+	err = b.Upload(ctx, "new", strings.NewReader("content"))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+
+	err = b.Delete(ctx, "obj")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+
+	ok, err := b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to be kept")
+	ok, err = b.Exists(ctx, "new")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected object to not be created")
+}
+
+func TestReadOnly_MissingOrUnreadableDir(t *testing.T) {
+	_, err := NewBucketWithConfig(Config{Directory: filepath.Join(t.TempDir(), "missing"), ReadOnly: true})
+	testutil.NotOk(t, err)
+
+	skipIfRoot(t)
+	dir := filepath.Join(t.TempDir(), "unreadable")
+	testutil.Ok(t, os.Mkdir(dir, 0))
+	t.Cleanup(func() { testutil.Ok(t, os.Chmod(dir, 0700)) })
+
+	_, err = NewBucketWithConfig(Config{Directory: dir, ReadOnly: true})
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, os.ErrPermission), "expected permission error, got %v", err)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package filesystem
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MetadataMode selects how per-object metadata (content type, user metadata and checksum) is persisted.
+type MetadataMode string
+
+const (
+	// MetadataModeAuto stores metadata in extended attributes and falls back to a sidecar file
+	// when the underlying filesystem does not support them.
+	MetadataModeAuto MetadataMode = "auto"
+	// MetadataModeXattr stores metadata in extended attributes only.
+	MetadataModeXattr MetadataMode = "xattr"
+	// MetadataModeSidecar stores metadata in a hidden sidecar file next to the object.
+	MetadataModeSidecar MetadataMode = "sidecar"
+	// MetadataModeNone does not persist any metadata.
+	MetadataModeNone MetadataMode = "none"
+)
+
+const (
+	// xattrName is the extended attribute holding the encoded object metadata.
+	xattrName = "user.objstore.metadata"
+	// sidecarPrefix is the file name prefix of sidecar metadata files. Files starting with it are never
+	// reported as objects.
+	sidecarPrefix = ".objstore-meta."
+)
+
+var errXattrNotSupported = errors.New("extended attributes are not supported")
+
+func (m MetadataMode) validate() error {
+	switch m {
+	case MetadataModeAuto, MetadataModeXattr, MetadataModeSidecar, MetadataModeNone:
+		return nil
+	}
+	return errors.Errorf("unsupported metadata mode %q", m)
+}
+
+// objectMetadata is the persisted per-object metadata.
+type objectMetadata struct {
+	ContentType  string            `json:"content_type,omitempty"`
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+	Checksum     string            `json:"checksum,omitempty"`
+}
+
+func isSidecar(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), sidecarPrefix)
+}
+
+func sidecarPath(file string) string {
+	return filepath.Join(filepath.Dir(file), sidecarPrefix+filepath.Base(file))
+}
+
+// writeMetadata persists the metadata of the object stored in file according to the bucket mode.
+func (b *Bucket) writeMetadata(file string, md objectMetadata) error {
+	if b.metadataMode == MetadataModeNone {
+		return nil
+	}
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		return errors.Wrap(err, "encode metadata")
+	}
+
+	if b.metadataMode != MetadataModeSidecar {
+		err := setXattr(file, xattrName, data)
+		if err == nil {
+			// Remove a sidecar that may have been written by a previous upload in sidecar mode.
+			if err := os.Remove(sidecarPath(file)); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "remove stale sidecar for %s", file)
+			}
+			return nil
+		}
+		if b.metadataMode == MetadataModeXattr || !errors.Is(err, errXattrNotSupported) {
+			return errors.Wrapf(err, "set xattr on %s", file)
+		}
+	}
+
+	if err := os.WriteFile(sidecarPath(file), data, 0600); err != nil {
+		return errors.Wrapf(err, "write sidecar for %s", file)
+	}
+	return nil
+}
+
+// readMetadata returns the persisted metadata of the object stored in file. Missing metadata is not an error.
+func (b *Bucket) readMetadata(file string) (objectMetadata, error) {
+	var md objectMetadata
+	if b.metadataMode == MetadataModeNone {
+		return md, nil
+	}
+
+	var data []byte
+	if b.metadataMode != MetadataModeSidecar {
+		var err error
+		data, err = getXattr(file, xattrName)
+		if err != nil && (b.metadataMode == MetadataModeXattr || !errors.Is(err, errXattrNotSupported)) {
+			return md, errors.Wrapf(err, "get xattr on %s", file)
+		}
+	}
+	if len(data) == 0 && b.metadataMode != MetadataModeXattr {
+		var err error
+		data, err = os.ReadFile(sidecarPath(file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return md, nil
+			}
+			return md, errors.Wrapf(err, "read sidecar for %s", file)
+		}
+	}
+	if len(data) == 0 {
+		return md, nil
+	}
+
+	if err := json.Unmarshal(data, &md); err != nil {
+		return md, errors.Wrapf(err, "decode metadata of %s", file)
+	}
+	return md, nil
+}
+
+// removeMetadata removes the sidecar of the object stored in file, if any. Extended attributes are
+// removed together with the file itself.
+func (b *Bucket) removeMetadata(file string) error {
+	if err := os.Remove(sidecarPath(file)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "rm sidecar for %s", file)
+	}
+	return nil
+}
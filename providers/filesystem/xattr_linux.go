@@ -0,0 +1,51 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build linux
+
+package filesystem
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func setXattr(path, name string, data []byte) error {
+	if err := unix.Setxattr(path, name, data, 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return errXattrNotSupported
+		}
+		return err
+	}
+	return nil
+}
+
+// getXattr returns the value of the extended attribute or nil if it is not set.
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		sz, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, xattrErr(err)
+		}
+		buf := make([]byte, sz)
+		n, err := unix.Getxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// Attribute grew between both calls, retry.
+			continue
+		}
+		if err != nil {
+			return nil, xattrErr(err)
+		}
+		return buf[:n], nil
+	}
+}
+
+func xattrErr(err error) error {
+	switch {
+	case errors.Is(err, unix.ENODATA):
+		return nil
+	case errors.Is(err, unix.ENOTSUP):
+		return errXattrNotSupported
+	}
+	return err
+}
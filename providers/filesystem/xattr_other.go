@@ -0,0 +1,14 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build !linux
+
+package filesystem
+
+func setXattr(_, _ string, _ []byte) error {
+	return errXattrNotSupported
+}
+
+func getXattr(_, _ string) ([]byte, error) {
+	return nil, errXattrNotSupported
+}
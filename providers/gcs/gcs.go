@@ -312,6 +312,7 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	return objstore.ObjectAttributes{
 		Size:         attrs.Size,
 		LastModified: attrs.Updated,
+		ETag:         attrs.Etag,
 	}, nil
 }
 
@@ -367,6 +368,11 @@ func (b *Bucket) IsAccessDeniedErr(err error) bool {
 	return false
 }
 
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	return storage.ShouldRetry(errors.Cause(err)) || objstore.IsTransientNetworkErr(err)
+}
+
 func (b *Bucket) Close() error {
 	return b.closer.Close()
 }
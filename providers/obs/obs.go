@@ -364,6 +364,14 @@ func (b *Bucket) IsAccessDeniedErr(_ error) bool {
 	return false
 }
 
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	if obsErr, ok := errors.Cause(err).(obs.ObsError); ok && objstore.IsRetryableStatusCode(obsErr.StatusCode) {
+		return true
+	}
+	return objstore.IsTransientNetworkErr(err)
+}
+
 // Attributes returns information about the specified object.
 func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
 	output, err := b.client.GetObjectMetadata(&obs.GetObjectMetadataInput{
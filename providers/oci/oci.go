@@ -269,6 +269,14 @@ func (b *Bucket) IsAccessDeniedErr(err error) bool {
 	return false
 }
 
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	if failure, ok := common.IsServiceError(err); ok && objstore.IsRetryableStatusCode(failure.GetHTTPStatusCode()) {
+		return true
+	}
+	return objstore.IsTransientNetworkErr(err)
+}
+
 // ObjectSize returns the size of the specified object.
 func (b *Bucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
 	response, err := getObject(ctx, *b, name, "")
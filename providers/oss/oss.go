@@ -428,3 +428,11 @@ func (b *Bucket) IsAccessDeniedErr(err error) bool {
 	}
 	return false
 }
+
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	if aliErr, ok := errors.Cause(err).(alioss.ServiceError); ok && objstore.IsRetryableStatusCode(aliErr.StatusCode) {
+		return true
+	}
+	return objstore.IsTransientNetworkErr(err)
+}
@@ -601,6 +601,7 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	return objstore.ObjectAttributes{
 		Size:         objInfo.Size,
 		LastModified: objInfo.LastModified,
+		ETag:         objInfo.ETag,
 	}, nil
 }
 
@@ -619,6 +620,16 @@ func (b *Bucket) IsAccessDeniedErr(err error) bool {
 	return minio.ToErrorResponse(errors.Cause(err)).Code == "AccessDenied"
 }
 
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (b *Bucket) IsRetryableErr(err error) bool {
+	resp := minio.ToErrorResponse(errors.Cause(err))
+	switch resp.Code {
+	case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable", "RequestLimitExceeded", "ThrottlingException":
+		return true
+	}
+	return objstore.IsRetryableStatusCode(resp.StatusCode) || objstore.IsTransientNetworkErr(err)
+}
+
 func (b *Bucket) Close() error { return nil }
 
 // getServerSideEncryption returns the SSE to use.
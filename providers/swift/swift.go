@@ -337,6 +337,15 @@ func (c *Container) IsAccessDeniedErr(err error) bool {
 	return errors.Is(err, swift.Forbidden)
 }
 
+// IsRetryableErr returns true if the request was throttled or failed with a transient server or network error.
+func (c *Container) IsRetryableErr(err error) bool {
+	var swiftErr *swift.Error
+	if errors.As(err, &swiftErr) && (objstore.IsRetryableStatusCode(swiftErr.StatusCode) || swiftErr.StatusCode == swift.RateLimit.StatusCode) {
+		return true
+	}
+	return objstore.IsTransientNetworkErr(err)
+}
+
 // Upload writes the contents of the reader as an object into the container.
 func (c *Container) Upload(_ context.Context, name string, r io.Reader, opts ...objstore.ObjectUploadOption) (err error) {
 	size, err := objstore.TryToGetSize(r)
@@ -0,0 +1,286 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket limit.
+type RateLimit struct {
+	// Rate is the number of tokens, requests or bytes, added per second. 0 means unlimited.
+	Rate float64 `yaml:"rate"`
+	// Burst is the maximum number of tokens which can be consumed at once. Defaults to one second worth of tokens.
+	Burst int `yaml:"burst"`
+}
+
+func (l RateLimit) limits() (rate.Limit, int) {
+	if l.Rate <= 0 {
+		return rate.Inf, 0
+	}
+	if l.Burst > 0 {
+		return rate.Limit(l.Rate), l.Burst
+	}
+	return rate.Limit(l.Rate), max(int(math.Ceil(l.Rate)), 1)
+}
+
+func (l RateLimit) newLimiter() *rate.Limiter {
+	return rate.NewLimiter(l.limits())
+}
+
+// apply changes the limits of lim. The burst is only changed along with a finite limit, before it, so that concurrent
+// waits never see a finite limit with a zero burst.
+func (l RateLimit) apply(lim *rate.Limiter) {
+	limit, burst := l.limits()
+	if limit != rate.Inf {
+		lim.SetBurst(burst)
+	}
+	lim.SetLimit(limit)
+}
+
+// RateLimitConfig configures RateLimitedBucket.
+type RateLimitConfig struct {
+	// Requests limits the requests per second of the given operations (OpGet, OpUpload...).
+	Requests map[string]RateLimit `yaml:"requests"`
+	// UploadBytes and DownloadBytes limit the bytes per second read from uploaded readers, and from the readers
+	// returned by Get and GetRange.
+	UploadBytes   RateLimit `yaml:"upload_bytes"`
+	DownloadBytes RateLimit `yaml:"download_bytes"`
+}
+
+// IsZero returns true if no limit is configured.
+func (cfg RateLimitConfig) IsZero() bool {
+	return len(cfg.Requests) == 0 && cfg.UploadBytes == RateLimit{} && cfg.DownloadBytes == RateLimit{}
+}
+
+// bucketOps lists all the bucket operations.
+var bucketOps = []string{OpIter, OpGet, OpGetRange, OpExists, OpUpload, OpDelete, OpAttributes}
+
+func (cfg RateLimitConfig) validate() error {
+	for op, l := range cfg.Requests {
+		if !slices.Contains(bucketOps, op) {
+			return errors.Errorf("unknown operation %q", op)
+		}
+		if l.Rate < 0 || l.Burst < 0 {
+			return errors.Errorf("negative rate limit for operation %s", op)
+		}
+	}
+	if cfg.UploadBytes.Rate < 0 || cfg.UploadBytes.Burst < 0 || cfg.DownloadBytes.Rate < 0 || cfg.DownloadBytes.Burst < 0 {
+		return errors.New("negative bandwidth limit")
+	}
+	return nil
+}
+
+// RateLimitedBucket is a Bucket wrapper limiting the rate of requests per operation, and the upload and download
+// bandwidth. Requests wait for the limits, until their context is done. Bandwidth is enforced while reading: the
+// readers returned by Get and GetRange, and the readers passed to Upload, are slowed down.
+//
+// Limits can be changed at runtime with SetLimits.
+type RateLimitedBucket struct {
+	bkt Bucket
+
+	requests map[string]*rate.Limiter
+	upload   *rate.Limiter
+	download *rate.Limiter
+
+	waitSeconds *prometheus.CounterVec
+}
+
+// NewRateLimitedBucket returns a RateLimitedBucket wrapping bkt.
+func NewRateLimitedBucket(bkt Bucket, cfg RateLimitConfig, reg prometheus.Registerer) (*RateLimitedBucket, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid rate limit configuration")
+	}
+
+	b := &RateLimitedBucket{
+		bkt:      bkt,
+		requests: map[string]*rate.Limiter{},
+		upload:   cfg.UploadBytes.newLimiter(),
+		download: cfg.DownloadBytes.newLimiter(),
+
+		waitSeconds: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_rate_limit_wait_seconds_total",
+			Help: "Total time spent waiting for request or bandwidth rate limits, per operation.",
+		}, []string{"operation"}),
+	}
+	for _, op := range bucketOps {
+		b.requests[op] = cfg.Requests[op].newLimiter()
+		b.waitSeconds.WithLabelValues(op)
+	}
+	return b, nil
+}
+
+// SetLimits replaces the limits. Requests already waiting are subject to the new limits.
+func (b *RateLimitedBucket) SetLimits(cfg RateLimitConfig) error {
+	if err := cfg.validate(); err != nil {
+		return errors.Wrap(err, "invalid rate limit configuration")
+	}
+	for op, lim := range b.requests {
+		cfg.Requests[op].apply(lim)
+	}
+	cfg.UploadBytes.apply(b.upload)
+	cfg.DownloadBytes.apply(b.download)
+	return nil
+}
+
+// wait waits for n tokens, in chunks of at most the burst of lim.
+func (b *RateLimitedBucket) wait(ctx context.Context, op string, lim *rate.Limiter, n int) error {
+	start := time.Now()
+	defer func() { b.waitSeconds.WithLabelValues(op).Add(time.Since(start).Seconds()) }()
+
+	for n > 0 {
+		chunk := n
+		if burst := lim.Burst(); lim.Limit() != rate.Inf && burst > 0 && chunk > burst {
+			chunk = burst
+		}
+		if err := lim.WaitN(ctx, chunk); err != nil {
+			// SetLimits may have lowered the burst after it was read, retry with a smaller chunk.
+			if burst := lim.Burst(); ctx.Err() == nil && lim.Limit() != rate.Inf && burst > 0 && chunk > burst {
+				continue
+			}
+			return errors.Wrapf(err, "wait for %s rate limit", op)
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (b *RateLimitedBucket) waitRequest(ctx context.Context, op string) error {
+	return b.wait(ctx, op, b.requests[op], 1)
+}
+
+// rateLimitedReader consumes tokens for the bytes read. Reads are capped to the burst of the limiter, to avoid reading
+// more than can be consumed at once.
+type rateLimitedReader struct {
+	io.Reader
+	ctx context.Context
+	b   *RateLimitedBucket
+	op  string
+	lim *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if burst := r.lim.Burst(); r.lim.Limit() != rate.Inf && len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if werr := r.b.wait(r.ctx, r.op, r.lim, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (r *rateLimitedReader) ObjectSize() (int64, error) { return TryToGetSize(r.Reader) }
+
+// rateLimitedReadCloser is a rateLimitedReader returned by Get and GetRange.
+type rateLimitedReadCloser struct {
+	rateLimitedReader
+	closer io.Closer
+}
+
+func (r *rateLimitedReadCloser) Close() error { return r.closer.Close() }
+
+// rateLimitedReadSeeker keeps uploaded readers seekable, e.g. for providers retrying uploads.
+type rateLimitedReadSeeker struct {
+	rateLimitedReader
+}
+
+func (r *rateLimitedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.Reader.(io.Seeker).Seek(offset, whence)
+}
+
+func (b *RateLimitedBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *RateLimitedBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	if err := b.waitRequest(ctx, OpIter); err != nil {
+		return err
+	}
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *RateLimitedBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	if err := b.waitRequest(ctx, OpIter); err != nil {
+		return err
+	}
+	return b.bkt.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *RateLimitedBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *RateLimitedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.waitRequest(ctx, OpGet); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitedReadCloser{rateLimitedReader: rateLimitedReader{Reader: rc, ctx: ctx, b: b, op: OpGet, lim: b.download}, closer: rc}, nil
+}
+
+func (b *RateLimitedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.waitRequest(ctx, OpGetRange); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitedReadCloser{rateLimitedReader: rateLimitedReader{Reader: rc, ctx: ctx, b: b, op: OpGetRange, lim: b.download}, closer: rc}, nil
+}
+
+func (b *RateLimitedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.waitRequest(ctx, OpExists); err != nil {
+		return false, err
+	}
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *RateLimitedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if err := b.waitRequest(ctx, OpAttributes); err != nil {
+		return ObjectAttributes{}, err
+	}
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *RateLimitedBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	if err := b.waitRequest(ctx, OpUpload); err != nil {
+		return err
+	}
+	lr := rateLimitedReader{Reader: r, ctx: ctx, b: b, op: OpUpload, lim: b.upload}
+	if _, ok := r.(io.Seeker); ok {
+		return b.bkt.Upload(ctx, name, &rateLimitedReadSeeker{rateLimitedReader: lr}, opts...)
+	}
+	return b.bkt.Upload(ctx, name, &lr, opts...)
+}
+
+func (b *RateLimitedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.waitRequest(ctx, OpDelete); err != nil {
+		return err
+	}
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *RateLimitedBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *RateLimitedBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *RateLimitedBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.bkt, err) }
+
+func (b *RateLimitedBucket) Close() error { return b.bkt.Close() }
+
+func (b *RateLimitedBucket) Name() string { return b.bkt.Name() }
@@ -0,0 +1,124 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestRateLimitedBucket_AcceptanceTest(t *testing.T) {
+	b, err := NewRateLimitedBucket(NewInMemBucket(), RateLimitConfig{
+		Requests:      map[string]RateLimit{OpUpload: {Rate: 10000}},
+		DownloadBytes: RateLimit{Rate: 1 << 20},
+	}, nil)
+	testutil.Ok(t, err)
+	AcceptanceTest(t, b)
+}
+
+func TestRateLimitedBucket_Requests(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewRateLimitedBucket(NewInMemBucket(), RateLimitConfig{
+		Requests: map[string]RateLimit{OpExists: {Rate: 20, Burst: 1}},
+	}, nil)
+	testutil.Ok(t, err)
+
+	// The first request uses the burst, the next ones wait 50ms each.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := b.Exists(ctx, "obj")
+		testutil.Ok(t, err)
+	}
+	testutil.Assert(t, time.Since(start) >= 90*time.Millisecond, "expected requests to be rate limited, took %v", time.Since(start))
+
+	// Other operations are not limited.
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := b.Attributes(ctx, "obj")
+		testutil.Assert(t, b.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	}
+	testutil.Assert(t, time.Since(start) < 50*time.Millisecond, "expected attributes not to be rate limited")
+
+	// Requests give up when their context is done.
+	tctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	_, err = b.Exists(tctx, "obj")
+	testutil.NotOk(t, err)
+
+	// Limits are changed at runtime.
+	testutil.Ok(t, b.SetLimits(RateLimitConfig{}))
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := b.Exists(ctx, "obj")
+		testutil.Ok(t, err)
+	}
+	testutil.Assert(t, time.Since(start) < 50*time.Millisecond, "expected requests not to be rate limited anymore")
+
+	testutil.NotOk(t, b.SetLimits(RateLimitConfig{Requests: map[string]RateLimit{"unknown": {Rate: 1}}}))
+	testutil.NotOk(t, b.SetLimits(RateLimitConfig{UploadBytes: RateLimit{Rate: -1}}))
+}
+
+func TestRateLimitedBucket_Bandwidth(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewRateLimitedBucket(NewInMemBucket(), RateLimitConfig{
+		UploadBytes:   RateLimit{Rate: 1000, Burst: 100},
+		DownloadBytes: RateLimit{Rate: 1000, Burst: 100},
+	}, nil)
+	testutil.Ok(t, err)
+
+	content := strings.Repeat("x", 300)
+
+	// 300 bytes at 1000 B/s, after a burst of 100 bytes.
+	start := time.Now()
+	testutil.Ok(t, b.Upload(ctx, "obj", strings.NewReader(content)))
+	testutil.Assert(t, time.Since(start) >= 150*time.Millisecond, "expected upload to be rate limited, took %v", time.Since(start))
+
+	start = time.Now()
+	rc, err := b.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	size, err := TryToGetSize(rc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(300), size)
+	got, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, content, string(got))
+	testutil.Assert(t, time.Since(start) >= 150*time.Millisecond, "expected download to be rate limited, took %v", time.Since(start))
+
+	// Reads fail once the context is done.
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	rc, err = b.GetRange(tctx, "obj", 0, 300)
+	testutil.Ok(t, err)
+	_, err = io.ReadAll(rc)
+	testutil.Assert(t, err != nil && !errors.Is(err, io.EOF), "expected rate limit error, got %v", err)
+	testutil.Ok(t, rc.Close())
+}
+
+func TestRateLimitedBucket_SetLimitsWhileReading(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader(strings.Repeat("x", 300))))
+	b, err := NewRateLimitedBucket(inmem, RateLimitConfig{}, nil)
+	testutil.Ok(t, err)
+
+	// Limits set after the reader was created apply to it.
+	rc, err := b.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.SetLimits(RateLimitConfig{DownloadBytes: RateLimit{Rate: 1e9, Burst: 100}}))
+	got, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, 300, len(got))
+
+	// Waits larger than a burst lowered concurrently are split in smaller chunks.
+	testutil.Ok(t, b.SetLimits(RateLimitConfig{DownloadBytes: RateLimit{Rate: 1e9, Burst: 10}}))
+	testutil.Ok(t, b.wait(ctx, OpGet, b.download, 100))
+}
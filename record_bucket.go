@@ -0,0 +1,665 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Recording is a set of interactions recorded against a bucket, which can be served offline by a ReplayBucket.
+type Recording struct {
+	Provider     ObjProvider   `json:"provider"`
+	Bucket       string        `json:"bucket"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a single recorded bucket operation.
+type Interaction struct {
+	Request  InteractionRequest  `json:"request"`
+	Response InteractionResponse `json:"response"`
+}
+
+// InteractionRequest holds the operation and the arguments an interaction was called with.
+type InteractionRequest struct {
+	Op   string `json:"op"`
+	Name string `json:"name"`
+
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+
+	Recursive bool `json:"recursive,omitempty"`
+	UpdatedAt bool `json:"updated_at,omitempty"`
+
+	ContentType    string            `json:"content_type,omitempty"`
+	UserMetadata   map[string]string `json:"user_metadata,omitempty"`
+	UploadSize     int64             `json:"upload_size,omitempty"`
+	UploadChecksum string            `json:"upload_checksum,omitempty"`
+}
+
+func (r InteractionRequest) String() string {
+	var sb strings.Builder
+	sb.WriteString(r.Op)
+	for _, f := range r.fields() {
+		fmt.Fprintf(&sb, " %s=%v", f.name, f.value)
+	}
+	return sb.String()
+}
+
+type requestField struct {
+	name  string
+	value interface{}
+}
+
+func (r InteractionRequest) fields() []requestField {
+	fields := []requestField{{"name", r.Name}}
+	switch r.Op {
+	case OpGetRange:
+		fields = append(fields, requestField{"offset", r.Offset}, requestField{"length", r.Length})
+	case OpIter:
+		fields = append(fields, requestField{"recursive", r.Recursive}, requestField{"updated_at", r.UpdatedAt})
+	case OpUpload:
+		fields = append(fields,
+			requestField{"content_type", r.ContentType},
+			requestField{"user_metadata", r.UserMetadata},
+			requestField{"upload_size", r.UploadSize},
+			requestField{"upload_checksum", r.UploadChecksum},
+		)
+	}
+	return fields
+}
+
+// key returns a stable identity of the request.
+func (r InteractionRequest) key() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// InteractionResponse holds the outcome of an interaction.
+type InteractionResponse struct {
+	Err *RecordedError `json:"err,omitempty"`
+
+	Exists     bool              `json:"exists,omitempty"`
+	Attributes *ObjectAttributes `json:"attributes,omitempty"`
+	Entries    []RecordedEntry   `json:"entries,omitempty"`
+
+	// Body holds the bytes read by the caller from the object stream.
+	Body []byte `json:"body,omitempty"`
+	// BodySize is the stream size reported by the provider, or -1 if unknown.
+	BodySize int64 `json:"body_size,omitempty"`
+	// BodyComplete is true if the caller read the stream until io.EOF.
+	BodyComplete bool `json:"body_complete,omitempty"`
+	// ReadErr is the error returned while reading the stream, if any.
+	ReadErr *RecordedError `json:"read_err,omitempty"`
+}
+
+// RecordedEntry is an entry returned by an iteration.
+type RecordedEntry struct {
+	Name         string    `json:"name"`
+	LastModified time.Time `json:"last_modified,omitempty"`
+}
+
+// RecordedError is an error returned by the recorded bucket, together with its classification.
+type RecordedError struct {
+	Message      string `json:"message"`
+	NotFound     bool   `json:"not_found,omitempty"`
+	AccessDenied bool   `json:"access_denied,omitempty"`
+	Retryable    bool   `json:"retryable,omitempty"`
+}
+
+func (e *RecordedError) Error() string { return e.Message }
+
+// RecordingBucket is a Bucket wrapper recording every operation, with its arguments and results, against the wrapped bucket.
+// Object streams are recorded when closed. Methods are thread-safe.
+type RecordingBucket struct {
+	bkt Bucket
+
+	mtx          sync.Mutex
+	interactions []Interaction
+}
+
+// NewRecordingBucket returns a RecordingBucket wrapping bkt.
+func NewRecordingBucket(bkt Bucket) *RecordingBucket {
+	return &RecordingBucket{bkt: bkt}
+}
+
+// Recording returns the interactions recorded so far, in call order.
+func (b *RecordingBucket) Recording() Recording {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return Recording{
+		Provider:     b.bkt.Provider(),
+		Bucket:       b.bkt.Name(),
+		Interactions: append([]Interaction(nil), b.interactions...),
+	}
+}
+
+// WriteFile writes the interactions recorded so far as JSON to the given file.
+func (b *RecordingBucket) WriteFile(file string) error {
+	data, err := json.MarshalIndent(b.Recording(), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode recording")
+	}
+	return errors.Wrapf(os.WriteFile(file, data, 0600), "write recording %s", file)
+}
+
+// begin reserves a slot for the interaction, so the recording keeps call order for concurrent operations.
+func (b *RecordingBucket) begin(req InteractionRequest) int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.interactions = append(b.interactions, Interaction{Request: req})
+	return len(b.interactions) - 1
+}
+
+func (b *RecordingBucket) finish(i int, resp InteractionResponse) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.interactions[i].Response = resp
+}
+
+func (b *RecordingBucket) recordErr(err error) *RecordedError {
+	if err == nil {
+		return nil
+	}
+	return &RecordedError{
+		Message:      err.Error(),
+		NotFound:     b.bkt.IsObjNotFoundErr(err),
+		AccessDenied: b.bkt.IsAccessDeniedErr(err),
+		Retryable:    IsRetryableErr(b.bkt, err),
+	}
+}
+
+func iterRequest(dir string, options []IterOption) InteractionRequest {
+	params := ApplyIterOptions(options...)
+	return InteractionRequest{Op: OpIter, Name: dir, Recursive: params.Recursive, UpdatedAt: params.LastModified}
+}
+
+func (b *RecordingBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *RecordingBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	i := b.begin(iterRequest(dir, options))
+
+	var (
+		entries []RecordedEntry
+		cbErr   error
+	)
+	err := b.bkt.Iter(ctx, dir, func(name string) error {
+		entries = append(entries, RecordedEntry{Name: name})
+		cbErr = f(name)
+		return cbErr
+	}, options...)
+
+	b.finish(i, b.iterResponse(entries, err, cbErr))
+	return err
+}
+
+func (b *RecordingBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	i := b.begin(iterRequest(dir, options))
+
+	var (
+		entries []RecordedEntry
+		cbErr   error
+	)
+	err := b.bkt.IterWithAttributes(ctx, dir, func(attrs IterObjectAttributes) error {
+		lastModified, _ := attrs.LastModified()
+		entries = append(entries, RecordedEntry{Name: attrs.Name, LastModified: lastModified})
+		cbErr = f(attrs)
+		return cbErr
+	}, options...)
+
+	b.finish(i, b.iterResponse(entries, err, cbErr))
+	return err
+}
+
+func (b *RecordingBucket) iterResponse(entries []RecordedEntry, err, cbErr error) InteractionResponse {
+	resp := InteractionResponse{Entries: entries}
+	// Errors returned by the callback are the caller's, they will be returned again on replay.
+	if err != nil && (cbErr == nil || !errors.Is(err, cbErr)) {
+		resp.Err = b.recordErr(err)
+	}
+	return resp
+}
+
+func (b *RecordingBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *RecordingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	i := b.begin(InteractionRequest{Op: OpGet, Name: name})
+
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		b.finish(i, InteractionResponse{Err: b.recordErr(err)})
+		return nil, err
+	}
+	return b.newRecordingReader(i, rc), nil
+}
+
+func (b *RecordingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	i := b.begin(InteractionRequest{Op: OpGetRange, Name: name, Offset: off, Length: length})
+
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		b.finish(i, InteractionResponse{Err: b.recordErr(err)})
+		return nil, err
+	}
+	return b.newRecordingReader(i, rc), nil
+}
+
+func (b *RecordingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	i := b.begin(InteractionRequest{Op: OpExists, Name: name})
+
+	ok, err := b.bkt.Exists(ctx, name)
+	b.finish(i, InteractionResponse{Exists: ok, Err: b.recordErr(err)})
+	return ok, err
+}
+
+func (b *RecordingBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	i := b.begin(InteractionRequest{Op: OpAttributes, Name: name})
+
+	attrs, err := b.bkt.Attributes(ctx, name)
+	resp := InteractionResponse{Err: b.recordErr(err)}
+	if err == nil {
+		resp.Attributes = &attrs
+	}
+	b.finish(i, resp)
+	return attrs, err
+}
+
+func (b *RecordingBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	// The content has to be known upfront to identify the request.
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "read upload content")
+	}
+	i := b.begin(uploadRequest(name, body, opts))
+
+	err = b.bkt.Upload(ctx, name, bytes.NewReader(body), opts...)
+	b.finish(i, InteractionResponse{Err: b.recordErr(err)})
+	return err
+}
+
+func uploadRequest(name string, body []byte, opts []ObjectUploadOption) InteractionRequest {
+	params := ApplyObjectUploadOptions(opts...)
+	sum := sha256.Sum256(body)
+	return InteractionRequest{
+		Op:             OpUpload,
+		Name:           name,
+		ContentType:    params.ContentType,
+		UserMetadata:   params.UserMetadata,
+		UploadSize:     int64(len(body)),
+		UploadChecksum: hex.EncodeToString(sum[:]),
+	}
+}
+
+func (b *RecordingBucket) Delete(ctx context.Context, name string) error {
+	i := b.begin(InteractionRequest{Op: OpDelete, Name: name})
+
+	err := b.bkt.Delete(ctx, name)
+	b.finish(i, InteractionResponse{Err: b.recordErr(err)})
+	return err
+}
+
+func (b *RecordingBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *RecordingBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *RecordingBucket) IsRetryableErr(err error) bool { return IsRetryableErr(b.bkt, err) }
+
+func (b *RecordingBucket) Close() error { return b.bkt.Close() }
+
+func (b *RecordingBucket) Name() string { return b.bkt.Name() }
+
+type recordingReader struct {
+	io.ReadCloser
+
+	b        *RecordingBucket
+	i        int
+	body     bytes.Buffer
+	size     int64
+	complete bool
+	readErr  error
+	closed   bool
+}
+
+func (b *RecordingBucket) newRecordingReader(i int, rc io.ReadCloser) *recordingReader {
+	size, err := TryToGetSize(rc)
+	if err != nil {
+		size = -1
+	}
+	return &recordingReader{ReadCloser: rc, b: b, i: i, size: size}
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.body.Write(p[:n])
+	if err == io.EOF {
+		r.complete = true
+	} else if err != nil && r.readErr == nil {
+		r.readErr = err
+	}
+	return n, err
+}
+
+func (r *recordingReader) ObjectSize() (int64, error) {
+	if r.size < 0 {
+		return 0, errors.New("unknown size")
+	}
+	return r.size, nil
+}
+
+func (r *recordingReader) Close() error {
+	err := r.ReadCloser.Close()
+	if !r.closed {
+		r.closed = true
+		r.b.finish(r.i, InteractionResponse{
+			Body:         r.body.Bytes(),
+			BodySize:     r.size,
+			BodyComplete: r.complete,
+			ReadErr:      r.b.recordErr(r.readErr),
+		})
+	}
+	return err
+}
+
+// ReplayBucket is a Bucket serving interactions recorded by a RecordingBucket, without any provider.
+// Identical requests are served in recorded order, independently of other requests, so concurrent callers
+// can be replayed. Requests without a matching recorded interaction fail with an error describing the
+// difference with the closest recorded ones. Methods are thread-safe.
+type ReplayBucket struct {
+	provider ObjProvider
+	name     string
+
+	mtx          sync.Mutex
+	interactions []Interaction
+	used         []bool
+	pending      map[string][]int
+}
+
+// NewReplayBucket returns a ReplayBucket serving the given recording.
+func NewReplayBucket(rec Recording) *ReplayBucket {
+	b := &ReplayBucket{
+		provider:     rec.Provider,
+		name:         rec.Bucket,
+		interactions: rec.Interactions,
+		used:         make([]bool, len(rec.Interactions)),
+		pending:      map[string][]int{},
+	}
+	for i, in := range rec.Interactions {
+		k := in.Request.key()
+		b.pending[k] = append(b.pending[k], i)
+	}
+	return b
+}
+
+// NewReplayBucketFromFile returns a ReplayBucket serving the recording stored in the given file.
+func NewReplayBucketFromFile(file string) (*ReplayBucket, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read recording %s", file)
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, errors.Wrapf(err, "decode recording %s", file)
+	}
+	return NewReplayBucket(rec), nil
+}
+
+// Unused returns the recorded interactions that were not replayed, useful to assert a test replayed the full recording.
+func (b *ReplayBucket) Unused() []Interaction {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var unused []Interaction
+	for i, in := range b.interactions {
+		if !b.used[i] {
+			unused = append(unused, in)
+		}
+	}
+	return unused
+}
+
+// next returns the response of the next recorded interaction matching the request.
+func (b *ReplayBucket) next(req InteractionRequest) (InteractionResponse, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	k := req.key()
+	if idx := b.pending[k]; len(idx) > 0 {
+		b.pending[k] = idx[1:]
+		b.used[idx[0]] = true
+		return b.interactions[idx[0]].Response, nil
+	}
+	return InteractionResponse{}, b.mismatch(req)
+}
+
+// mismatch returns an error describing how the request differs from the closest unused recorded requests.
+func (b *ReplayBucket) mismatch(req InteractionRequest) error {
+	var sameName, sameOp []InteractionRequest
+	for i, in := range b.interactions {
+		if b.used[i] || in.Request.Op != req.Op {
+			continue
+		}
+		if in.Request.Name == req.Name {
+			sameName = append(sameName, in.Request)
+		} else {
+			sameOp = append(sameOp, in.Request)
+		}
+	}
+
+	candidates := sameName
+	if len(candidates) == 0 {
+		candidates = sameOp
+	}
+	if len(candidates) == 0 {
+		return &ReplayMismatchError{Request: req}
+	}
+	// Report the candidate with the least differing fields first.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(diffRequests(candidates[i], req)) < len(diffRequests(candidates[j], req))
+	})
+	if len(candidates) > 3 {
+		candidates = candidates[:3]
+	}
+	return &ReplayMismatchError{Request: req, Candidates: candidates}
+}
+
+// ReplayMismatchError is returned by ReplayBucket when no recorded interaction matches a request.
+type ReplayMismatchError struct {
+	Request    InteractionRequest
+	Candidates []InteractionRequest
+}
+
+func (e *ReplayMismatchError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "replay: no recorded interaction for %s", e.Request)
+	if len(e.Candidates) == 0 {
+		sb.WriteString("; no unused recorded interaction for this operation")
+		return sb.String()
+	}
+	for _, c := range e.Candidates {
+		fmt.Fprintf(&sb, "\n  closest recorded: %s", c)
+		for _, d := range diffRequests(c, e.Request) {
+			fmt.Fprintf(&sb, "\n    - %s", d)
+		}
+	}
+	return sb.String()
+}
+
+// diffRequests returns a human readable difference between the recorded and the actual request.
+func diffRequests(recorded, actual InteractionRequest) []string {
+	rf, af := recorded.fields(), actual.fields()
+	var diffs []string
+	for i := range af {
+		if !reflect.DeepEqual(rf[i].value, af[i].value) {
+			diffs = append(diffs, fmt.Sprintf("%s: recorded %v, got %v", af[i].name, rf[i].value, af[i].value))
+		}
+	}
+	return diffs
+}
+
+func (b *ReplayBucket) replayErr(e *RecordedError) error {
+	if e == nil {
+		return nil
+	}
+	return e
+}
+
+func (b *ReplayBucket) Provider() ObjProvider { return b.provider }
+
+func (b *ReplayBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return b.IterWithAttributes(ctx, dir, func(attrs IterObjectAttributes) error {
+		return f(attrs.Name)
+	}, options...)
+}
+
+func (b *ReplayBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	resp, err := b.next(iterRequest(dir, options))
+	if err != nil {
+		return err
+	}
+	for _, e := range resp.Entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		attrs := IterObjectAttributes{Name: e.Name}
+		attrs.SetLastModified(e.LastModified)
+		if err := f(attrs); err != nil {
+			return err
+		}
+	}
+	return b.replayErr(resp.Err)
+}
+
+func (b *ReplayBucket) SupportedIterOptions() []IterOptionType {
+	return []IterOptionType{Recursive, UpdatedAt}
+}
+
+func (b *ReplayBucket) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	return b.replayReader(InteractionRequest{Op: OpGet, Name: name})
+}
+
+func (b *ReplayBucket) GetRange(_ context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.replayReader(InteractionRequest{Op: OpGetRange, Name: name, Offset: off, Length: length})
+}
+
+func (b *ReplayBucket) replayReader(req InteractionRequest) (io.ReadCloser, error) {
+	resp, err := b.next(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+
+	// Past the recorded bytes, the stream ends the way it did when recorded.
+	end := io.Reader(eofReader{})
+	switch {
+	case resp.ReadErr != nil:
+		end = errReader{err: resp.ReadErr}
+	case !resp.BodyComplete:
+		end = errReader{err: errors.Errorf("replay: %s read beyond the %d recorded bytes", req, len(resp.Body))}
+	}
+	return ObjectSizerReadCloser{
+		ReadCloser: io.NopCloser(io.MultiReader(bytes.NewReader(resp.Body), end)),
+		Size: func() (int64, error) {
+			if resp.BodySize < 0 {
+				return 0, errors.New("unknown size")
+			}
+			return resp.BodySize, nil
+		},
+	}, nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func (b *ReplayBucket) Exists(_ context.Context, name string) (bool, error) {
+	resp, err := b.next(InteractionRequest{Op: OpExists, Name: name})
+	if err != nil {
+		return false, err
+	}
+	return resp.Exists, b.replayErr(resp.Err)
+}
+
+func (b *ReplayBucket) Attributes(_ context.Context, name string) (ObjectAttributes, error) {
+	resp, err := b.next(InteractionRequest{Op: OpAttributes, Name: name})
+	if err != nil {
+		return ObjectAttributes{}, err
+	}
+	if resp.Err != nil {
+		return ObjectAttributes{}, resp.Err
+	}
+	if resp.Attributes == nil {
+		return ObjectAttributes{}, nil
+	}
+	return *resp.Attributes, nil
+}
+
+func (b *ReplayBucket) Upload(_ context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "read upload content")
+	}
+	resp, err := b.next(uploadRequest(name, body, opts))
+	if err != nil {
+		return err
+	}
+	return b.replayErr(resp.Err)
+}
+
+func (b *ReplayBucket) Delete(_ context.Context, name string) error {
+	resp, err := b.next(InteractionRequest{Op: OpDelete, Name: name})
+	if err != nil {
+		return err
+	}
+	return b.replayErr(resp.Err)
+}
+
+// IsObjNotFoundErr returns true if the replayed error was classified as not found when recorded.
+func (b *ReplayBucket) IsObjNotFoundErr(err error) bool {
+	var rerr *RecordedError
+	return errors.As(err, &rerr) && rerr.NotFound
+}
+
+// IsAccessDeniedErr returns true if the replayed error was classified as access denied when recorded.
+func (b *ReplayBucket) IsAccessDeniedErr(err error) bool {
+	var rerr *RecordedError
+	return errors.As(err, &rerr) && rerr.AccessDenied
+}
+
+// IsRetryableErr returns true if the replayed error was classified as retryable when recorded. Other errors are
+// classified with IsTransientNetworkErr.
+func (b *ReplayBucket) IsRetryableErr(err error) bool {
+	var rerr *RecordedError
+	if errors.As(err, &rerr) {
+		return rerr.Retryable
+	}
+	return IsTransientNetworkErr(err)
+}
+
+func (b *ReplayBucket) Close() error { return nil }
+
+func (b *ReplayBucket) Name() string { return b.name }
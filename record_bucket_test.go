@@ -0,0 +1,142 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestRecordReplay_AcceptanceTest(t *testing.T) {
+	rec := NewRecordingBucket(NewInMemBucket())
+	AcceptanceTest(t, rec)
+
+	file := filepath.Join(t.TempDir(), "recording.json")
+	testutil.Ok(t, rec.WriteFile(file))
+
+	replay, err := NewReplayBucketFromFile(file)
+	testutil.Ok(t, err)
+	testutil.Equals(t, MEMORY, replay.Provider())
+	testutil.Equals(t, "inmem", replay.Name())
+
+	AcceptanceTest(t, replay)
+	testutil.Equals(t, 0, len(replay.Unused()))
+}
+
+func TestRecordReplay_Responses(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "dir/obj", strings.NewReader("0123456789")))
+	lastModified := time.Unix(1700000000, 0).UTC()
+	testutil.Ok(t, inmem.ChangeLastModified("dir/obj", lastModified))
+
+	rec := NewRecordingBucket(inmem)
+	_, err := rec.Attributes(ctx, "missing")
+	testutil.Assert(t, rec.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+
+	rc, err := rec.GetRange(ctx, "dir/obj", 2, 5)
+	testutil.Ok(t, err)
+	// Only read part of the stream.
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(rc, buf)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+
+	testutil.Ok(t, rec.IterWithAttributes(ctx, "dir/", func(attrs IterObjectAttributes) error { return nil }, WithUpdatedAt()))
+
+	stop := errors.New("stop")
+	testutil.Equals(t, stop, rec.Iter(ctx, "", func(string) error { return stop }))
+
+	replay := NewReplayBucket(rec.Recording())
+
+	_, err = replay.Attributes(ctx, "missing")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, replay.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	testutil.Assert(t, !replay.IsAccessDeniedErr(err), "expected not found error, got %v", err)
+
+	rc, err = replay.GetRange(ctx, "dir/obj", 2, 5)
+	testutil.Ok(t, err)
+	sz, err := TryToGetSize(rc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(5), sz)
+	content, err := io.ReadAll(rc)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "read beyond the 3 recorded bytes"), "unexpected error %v", err)
+	testutil.Equals(t, "234", string(content))
+	testutil.Ok(t, rc.Close())
+
+	testutil.Ok(t, replay.IterWithAttributes(ctx, "dir/", func(attrs IterObjectAttributes) error {
+		testutil.Equals(t, "dir/obj", attrs.Name)
+		ts, ok := attrs.LastModified()
+		testutil.Assert(t, ok, "expected last modified")
+		testutil.Equals(t, lastModified, ts.UTC())
+		return nil
+	}, WithUpdatedAt()))
+
+	var seen []string
+	testutil.Equals(t, stop, replay.Iter(ctx, "", func(name string) error {
+		seen = append(seen, name)
+		return stop
+	}))
+	testutil.Equals(t, []string{"dir/"}, seen)
+	testutil.Equals(t, 0, len(replay.Unused()))
+
+	// Recorded interactions are consumed.
+	_, err = replay.Attributes(ctx, "missing")
+	testutil.NotOk(t, err)
+	var mismatch *ReplayMismatchError
+	testutil.Assert(t, errors.As(err, &mismatch), "expected mismatch error, got %v", err)
+}
+
+func TestRecordReplay_RetryableErr(t *testing.T) {
+	ctx := context.Background()
+	rec := NewRecordingBucket(WithFaults(NewInMemBucket(), FaultRule{Ops: []string{OpExists}, Probability: 1, Err: ErrFaultTransient}))
+	_, err := rec.Exists(ctx, "obj")
+	testutil.Assert(t, rec.IsRetryableErr(err), "expected retryable error, got %v", err)
+	_, err = rec.Attributes(ctx, "missing")
+	testutil.Assert(t, !rec.IsRetryableErr(err), "expected not found error not to be retryable")
+
+	replay := NewReplayBucket(rec.Recording())
+	_, err = replay.Exists(ctx, "obj")
+	testutil.Assert(t, replay.IsRetryableErr(err), "expected retryable error, got %v", err)
+	_, err = replay.Attributes(ctx, "missing")
+	testutil.Assert(t, !replay.IsRetryableErr(err), "expected not found error not to be retryable")
+}
+
+func TestRecordReplay_Mismatch(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("0123456789")))
+
+	rec := NewRecordingBucket(inmem)
+	rc, err := rec.GetRange(ctx, "obj", 0, 4)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Ok(t, rec.Upload(ctx, "new", strings.NewReader("data"), WithContentType("text/plain")))
+
+	replay := NewReplayBucket(rec.Recording())
+
+	_, err = replay.GetRange(ctx, "obj", 2, 4)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, `replay: no recorded interaction for get_range name=obj offset=2 length=4
+  closest recorded: get_range name=obj offset=0 length=4
+    - offset: recorded 0, got 2`, err.Error())
+
+	err = replay.Upload(ctx, "new", strings.NewReader("other"), WithContentType("text/plain"))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "upload_size: recorded 4, got 5"), "unexpected error %v", err)
+
+	err = replay.Delete(ctx, "obj")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "replay: no recorded interaction for delete name=obj; no unused recorded interaction for this operation", err.Error())
+
+	testutil.Equals(t, 2, len(replay.Unused()))
+}
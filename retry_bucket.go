@@ -0,0 +1,449 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RetryableErrClassifier is implemented by buckets telling which errors are transient, so that the failed operation
+// may succeed if retried.
+type RetryableErrClassifier interface {
+	// IsRetryableErr returns true if the error is transient, e.g. throttling or a reset connection.
+	IsRetryableErr(err error) bool
+}
+
+// IsRetryableStatusCode returns true if the HTTP status code signals throttling or a temporary server failure.
+func IsRetryableStatusCode(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsTransientNetworkErr returns true if the error is a network error which usually goes away when retried:
+// timeouts, reset, aborted or refused connections, and streams ending unexpectedly.
+func IsTransientNetworkErr(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ETIMEDOUT) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsRetryableErr classifies the error with the classifier of the bucket if it implements RetryableErrClassifier, and
+// with IsTransientNetworkErr otherwise. Bucket wrappers use it to forward the classification.
+func IsRetryableErr(bkt Bucket, err error) bool {
+	if c, ok := bkt.(RetryableErrClassifier); ok {
+		return c.IsRetryableErr(err)
+	}
+	return IsTransientNetworkErr(err)
+}
+
+// RetryConfig configures RetryBucket.
+type RetryConfig struct {
+	// MaxRetries is the maximum number of retries of an operation, after the first attempt.
+	MaxRetries int
+	// OpMaxRetries overrides MaxRetries for the given operations (OpGet, OpUpload...).
+	OpMaxRetries map[string]int
+	// MinBackoff is the delay before the first retry. It doubles on every retry, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction, in [0, 1], of every backoff which is randomized, to spread the retries of concurrent clients.
+	Jitter float64
+	// MaxElapsed bounds the time spent on an operation, retries included. 0 means no bound.
+	MaxElapsed time.Duration
+	// IsRetryableErr classifies errors. Defaults to the IsRetryableErr method of the wrapped bucket if it implements
+	// RetryableErrClassifier, and to IsTransientNetworkErr otherwise.
+	IsRetryableErr func(error) bool
+	// OnRetry, if set, is called before waiting for each retry, e.g. with the TraceRetry functions of the
+	// tracing/opentracing and tracing/opentelemetry packages to log retries in the trace span of the context.
+	OnRetry func(ctx context.Context, e RetryEvent)
+}
+
+// RetryEvent describes a retry of an operation of RetryBucket.
+type RetryEvent struct {
+	Op   string
+	Name string
+	// Retry is the number of the retry, starting at 1.
+	Retry   int
+	Backoff time.Duration
+	// Err is the error of the failed attempt.
+	Err error
+}
+
+// DefaultRetryConfig is a sensible retry configuration, meant to be used as a base.
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries: 3,
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+	Jitter:     0.5,
+}
+
+// RetryBucket is a Bucket wrapper retrying the operations failing with retryable errors, with exponential backoff.
+//
+// Reads failing midway are resumed from the last byte read with GetRange, rather than restarted. To avoid joining bytes
+// of different versions of an object, Attributes is called before resuming: reads fail rather than resume if the
+// object was modified after the stream was opened, within the precision of the provider timestamps, or if its version
+// changed since the first resume. Successful reads don't make any extra call. Uploads are retried only if the reader can be rewound, i.e. it
+// implements io.Seeker, or if it was not read yet. Iterations are retried only if no entry was passed to the callback
+// yet.
+//
+// Retries are counted in metrics and passed to RetryConfig.OnRetry. Note that retries configured in the provider
+// client, e.g. S3 max_retries, multiply with these ones.
+type RetryBucket struct {
+	bkt Bucket
+	cfg RetryConfig
+
+	mtx sync.Mutex
+	rnd *rand.Rand
+
+	retries   *prometheus.CounterVec
+	exhausted *prometheus.CounterVec
+}
+
+// NewRetryBucket returns a RetryBucket wrapping bkt.
+func NewRetryBucket(bkt Bucket, cfg RetryConfig, reg prometheus.Registerer) *RetryBucket {
+	if cfg.IsRetryableErr == nil {
+		cfg.IsRetryableErr = func(err error) bool { return IsRetryableErr(bkt, err) }
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+
+	b := &RetryBucket{
+		bkt: bkt,
+		cfg: cfg,
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		retries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_operation_retries_total",
+			Help: "Total number of retries of bucket operations, including resumed reads.",
+		}, []string{"operation"}),
+		exhausted: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "objstore_bucket_operation_retries_exhausted_total",
+			Help: "Total number of bucket operations which failed with a retryable error after exhausting their retry budget.",
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{OpIter, OpGet, OpGetRange, OpExists, OpUpload, OpDelete, OpAttributes} {
+		b.retries.WithLabelValues(op)
+		b.exhausted.WithLabelValues(op)
+	}
+	return b
+}
+
+// retryState tracks the retry budget of a single operation.
+type retryState struct {
+	b       *RetryBucket
+	op      string
+	name    string
+	start   time.Time
+	retries int
+}
+
+func (b *RetryBucket) newRetryState(op, name string) *retryState {
+	return &retryState{b: b, op: op, name: name, start: time.Now()}
+}
+
+// wait waits before retrying the operation which failed with err. It returns false if the operation must not be
+// retried, because the error is not retryable or the retry budget is exhausted.
+func (s *retryState) wait(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || !s.b.cfg.IsRetryableErr(err) {
+		return false
+	}
+
+	backoff := s.b.backoff(s.retries)
+	if s.retries >= s.b.maxRetries(s.op) || (s.b.cfg.MaxElapsed > 0 && time.Since(s.start)+backoff > s.b.cfg.MaxElapsed) {
+		s.b.exhausted.WithLabelValues(s.op).Inc()
+		return false
+	}
+
+	s.retries++
+	s.b.retries.WithLabelValues(s.op).Inc()
+	if s.b.cfg.OnRetry != nil {
+		s.b.cfg.OnRetry(ctx, RetryEvent{Op: s.op, Name: s.name, Retry: s.retries, Backoff: backoff, Err: err})
+	}
+
+	select {
+	case <-time.After(backoff):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// backoff returns the delay before the given retry.
+func (b *RetryBucket) backoff(retry int) time.Duration {
+	d := b.cfg.MinBackoff
+	for i := 0; i < retry && d < b.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, b.cfg.MaxBackoff)
+	if b.cfg.Jitter <= 0 || d <= 0 {
+		return d
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return d - time.Duration(b.cfg.Jitter*b.rnd.Float64()*float64(d))
+}
+
+// maxRetries returns the retry budget of op.
+func (b *RetryBucket) maxRetries(op string) int {
+	if n, ok := b.cfg.OpMaxRetries[op]; ok {
+		return n
+	}
+	return b.cfg.MaxRetries
+}
+
+func (b *RetryBucket) do(ctx context.Context, op, name string, fn func() error) error {
+	return b.doIf(ctx, op, name, fn, func() bool { return true })
+}
+
+// doIf runs fn, retrying it on retryable errors as long as canRetry returns true.
+func (b *RetryBucket) doIf(ctx context.Context, op, name string, fn func() error, canRetry func() bool) error {
+	s := b.newRetryState(op, name)
+	for {
+		err := fn()
+		if err == nil || !canRetry() || !s.wait(ctx, err) {
+			return err
+		}
+	}
+}
+
+func (b *RetryBucket) Provider() ObjProvider { return b.bkt.Provider() }
+
+func (b *RetryBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	called := false
+	return b.doIf(ctx, OpIter, dir, func() error {
+		return b.bkt.Iter(ctx, dir, func(name string) error {
+			called = true
+			return f(name)
+		}, options...)
+	}, func() bool { return !called })
+}
+
+func (b *RetryBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	called := false
+	return b.doIf(ctx, OpIter, dir, func() error {
+		return b.bkt.IterWithAttributes(ctx, dir, func(attrs IterObjectAttributes) error {
+			called = true
+			return f(attrs)
+		}, options...)
+	}, func() bool { return !called })
+}
+
+func (b *RetryBucket) SupportedIterOptions() []IterOptionType {
+	return b.bkt.SupportedIterOptions()
+}
+
+func (b *RetryBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.getRange(ctx, OpGet, name, 0, -1)
+}
+
+func (b *RetryBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.getRange(ctx, OpGetRange, name, off, length)
+}
+
+func (b *RetryBucket) getRange(ctx context.Context, op, name string, off, length int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	// Providers may truncate modification times to the second.
+	opened := time.Now().Truncate(time.Second)
+	err := b.do(ctx, op, name, func() (err error) {
+		if op == OpGet {
+			rc, err = b.bkt.Get(ctx, name)
+		} else {
+			rc, err = b.bkt.GetRange(ctx, name, off, length)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	size, sizeErr := TryToGetSize(rc)
+	return &retryReader{ctx: ctx, b: b, state: b.newRetryState(op, name), op: op, name: name, off: off, length: length, rc: rc, opened: opened, size: size, sizeErr: sizeErr}, nil
+}
+
+// retryReader resumes reads failing with a retryable error from the last byte read.
+type retryReader struct {
+	ctx   context.Context
+	b     *RetryBucket
+	state *retryState
+
+	op          string
+	name        string
+	off, length int64
+	read        int64
+	rc          io.ReadCloser
+	// opened is the time the stream was opened, truncated to the second.
+	opened time.Time
+	// version is the version of the object on the first resume, empty before.
+	version string
+
+	size    int64
+	sizeErr error
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.rc.Read(p)
+		r.read += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if !r.state.wait(r.ctx, err) {
+			return n, err
+		}
+		if rerr := r.resume(); rerr != nil {
+			return n, rerr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume reopens the stream from the last byte read, unless the object changed since the stream was opened.
+func (r *retryReader) resume() error {
+	_ = r.rc.Close()
+
+	length := int64(-1)
+	if r.length != -1 {
+		length = r.length - r.read
+		if length == 0 {
+			r.rc = NopCloserWithSize(io.LimitReader(nil, 0))
+			return nil
+		}
+	}
+	for {
+		rc, err := r.open(length)
+		if err == nil {
+			r.rc = rc
+			return nil
+		}
+		if errors.Is(err, errObjectChanged) || !r.state.wait(r.ctx, err) {
+			r.rc = NopCloserWithSize(io.LimitReader(nil, 0))
+			return errors.Wrapf(err, "resume reading %s at offset %d", r.name, r.off+r.read)
+		}
+	}
+}
+
+var errObjectChanged = errors.New("object changed")
+
+// open checks that the object did not change, then opens the stream from the last byte read.
+func (r *retryReader) open(length int64) (io.ReadCloser, error) {
+	attrs, err := r.b.bkt.Attributes(r.ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+	if r.version == "" {
+		// The object must not have been written since the stream was opened, and must have the announced size.
+		if !attrs.LastModified.Before(r.opened) || (r.op == OpGet && r.sizeErr == nil && attrs.Size != r.size) {
+			return nil, errObjectChanged
+		}
+		r.version = ObjectVersion(attrs)
+	} else if ObjectVersion(attrs) != r.version {
+		return nil, errObjectChanged
+	}
+	return r.b.bkt.GetRange(r.ctx, r.name, r.off+r.read, length)
+}
+
+func (r *retryReader) Close() error { return r.rc.Close() }
+
+// ObjectSize returns the size of the stream, as announced by the provider when it was opened.
+func (r *retryReader) ObjectSize() (int64, error) { return r.size, r.sizeErr }
+
+func (b *RetryBucket) Exists(ctx context.Context, name string) (exists bool, err error) {
+	err = b.do(ctx, OpExists, name, func() (err error) {
+		exists, err = b.bkt.Exists(ctx, name)
+		return err
+	})
+	return exists, err
+}
+
+func (b *RetryBucket) Attributes(ctx context.Context, name string) (attrs ObjectAttributes, err error) {
+	err = b.do(ctx, OpAttributes, name, func() (err error) {
+		attrs, err = b.bkt.Attributes(ctx, name)
+		return err
+	})
+	return attrs, err
+}
+
+func (b *RetryBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	seeker, seekable := r.(io.Seeker)
+	var start int64
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+
+	if seekable {
+		first := true
+		return b.do(ctx, OpUpload, name, func() error {
+			if !first {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return errors.Wrap(err, "rewind upload reader")
+				}
+			}
+			first = false
+			return b.bkt.Upload(ctx, name, r, opts...)
+		})
+	}
+
+	// Readers which cannot be rewound can only be retried if they were not read at all.
+	cr := &countingReader{Reader: r}
+	return b.doIf(ctx, OpUpload, name, func() error {
+		return b.bkt.Upload(ctx, name, cr, opts...)
+	}, func() bool { return cr.n == 0 })
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// ObjectSize returns the size of the wrapped reader, if known.
+func (r *countingReader) ObjectSize() (int64, error) { return TryToGetSize(r.Reader) }
+
+func (b *RetryBucket) Delete(ctx context.Context, name string) error {
+	return b.do(ctx, OpDelete, name, func() error {
+		return b.bkt.Delete(ctx, name)
+	})
+}
+
+func (b *RetryBucket) IsObjNotFoundErr(err error) bool { return b.bkt.IsObjNotFoundErr(err) }
+
+func (b *RetryBucket) IsAccessDeniedErr(err error) bool { return b.bkt.IsAccessDeniedErr(err) }
+
+func (b *RetryBucket) IsRetryableErr(err error) bool { return b.cfg.IsRetryableErr(err) }
+
+func (b *RetryBucket) Close() error { return b.bkt.Close() }
+
+func (b *RetryBucket) Name() string { return b.bkt.Name() }
@@ -0,0 +1,240 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testRetryConfig retries quickly, without jitter.
+var testRetryConfig = RetryConfig{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+
+func TestRetryBucket_AcceptanceTest(t *testing.T) {
+	AcceptanceTest(t, NewRetryBucket(NewInMemBucket(), testRetryConfig, nil))
+}
+
+func TestRetryBucket_Retries(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "a/obj", strings.NewReader("content")))
+
+	faults := WithFaults(inmem)
+	cfg := testRetryConfig
+	cfg.OpMaxRetries = map[string]int{OpAttributes: 1}
+	b := NewRetryBucket(faults, cfg, nil)
+
+	// Transient errors are retried.
+	faults.SetRules(
+		FaultRule{Ops: []string{OpExists}, OnCall: 1, Err: ErrFaultTransient},
+		FaultRule{Ops: []string{OpExists}, OnCall: 2, Err: ErrFaultTransient},
+	)
+	ok, err := b.Exists(ctx, "a/obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist")
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.retries.WithLabelValues(OpExists)))
+
+	// Other errors are not.
+	faults.SetRules(FaultRule{Ops: []string{OpDelete}, OnCall: 1, Err: ErrFaultAccessDenied})
+	err = b.Delete(ctx, "a/obj")
+	testutil.Assert(t, b.IsAccessDeniedErr(err), "expected access denied error, got %v", err)
+	testutil.Equals(t, 0.0, promtest.ToFloat64(b.retries.WithLabelValues(OpDelete)))
+
+	// The retry budget is per operation.
+	faults.SetRules(FaultRule{Ops: []string{OpAttributes}, Probability: 1, Err: ErrFaultTransient})
+	_, err = b.Attributes(ctx, "a/obj")
+	testutil.Assert(t, errors.Is(err, ErrFaultTransient), "expected transient error, got %v", err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.retries.WithLabelValues(OpAttributes)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.exhausted.WithLabelValues(OpAttributes)))
+
+	// Iterations are retried until the callback is called.
+	faults.SetRules(FaultRule{Ops: []string{OpIter}, OnCall: 1, Err: ErrFaultTransient})
+	var names []string
+	testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"a/"}, names)
+
+	cbErr := errors.Wrap(ErrFaultTransient, "callback")
+	calls := 0
+	err = b.Iter(ctx, "", func(string) error {
+		calls++
+		return cbErr
+	})
+	testutil.Assert(t, errors.Is(err, cbErr), "expected callback error, got %v", err)
+	testutil.Equals(t, 1, calls)
+}
+
+func TestRetryBucket_MaxElapsed(t *testing.T) {
+	ctx := context.Background()
+	faults := WithFaults(NewInMemBucket(), FaultRule{Probability: 1, Err: ErrFaultTransient})
+	b := NewRetryBucket(faults, RetryConfig{MaxRetries: 100, MinBackoff: 20 * time.Millisecond, MaxElapsed: 50 * time.Millisecond}, nil)
+
+	start := time.Now()
+	_, err := b.Exists(ctx, "obj")
+	testutil.Assert(t, errors.Is(err, ErrFaultTransient), "expected transient error, got %v", err)
+	testutil.Assert(t, time.Since(start) < 100*time.Millisecond, "expected retries to stop within the budget")
+	// A third retry would have ended after 60ms.
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.retries.WithLabelValues(OpExists)))
+}
+
+func TestRetryBucket_ResumesReads(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	content := "0123456789abcdefghijklmnopqrstuvwxyz"
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader(content)))
+	// Objects written in the second the stream is opened are not resumed.
+	testutil.Ok(t, inmem.ChangeLastModified("obj", time.Now().Add(-time.Minute)))
+
+	metrics := WrapWithMetrics(inmem, prometheus.NewRegistry(), "test")
+	faults := WithFaults(metrics)
+	b := NewRetryBucket(faults, testRetryConfig, nil)
+
+	// Successful reads don't check the version of the object.
+	testutil.Equals(t, content, readObject(t, b, "obj"))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(metrics.metrics.ops.WithLabelValues(OpAttributes)))
+
+	for _, tcase := range []struct {
+		name      string
+		get       func() (io.ReadCloser, error)
+		expected  string
+		truncates int
+	}{
+		{name: "get", get: func() (io.ReadCloser, error) { return b.Get(ctx, "obj") }, expected: content, truncates: 2},
+		{name: "get range", get: func() (io.ReadCloser, error) { return b.GetRange(ctx, "obj", 5, 20) }, expected: content[5:25], truncates: 2},
+		{name: "get range to end", get: func() (io.ReadCloser, error) { return b.GetRange(ctx, "obj", 30, -1) }, expected: content[30:], truncates: 1},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			// Every stream, including resumed ones, is cut after 5 bytes, as long as the rules trigger.
+			var rules []FaultRule
+			for i := 1; i <= tcase.truncates; i++ {
+				rules = append(rules,
+					FaultRule{Ops: []string{OpGet}, OnCall: i, Reader: &ReaderFault{Kind: ReaderTruncate, After: 5}},
+					FaultRule{Ops: []string{OpGetRange}, OnCall: i, Reader: &ReaderFault{Kind: ReaderTruncate, After: 5}},
+				)
+			}
+			faults.SetRules(rules...)
+
+			rc, err := tcase.get()
+			testutil.Ok(t, err)
+			got, err := io.ReadAll(rc)
+			testutil.Ok(t, err)
+			testutil.Ok(t, rc.Close())
+			testutil.Equals(t, tcase.expected, string(got))
+		})
+	}
+	// Get is resumed with GetRange, whose first two streams are also cut.
+	testutil.Equals(t, 3.0, promtest.ToFloat64(b.retries.WithLabelValues(OpGet)))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(b.retries.WithLabelValues(OpGetRange)))
+
+	// Reads give up once the budget is exhausted.
+	faults.SetRules(FaultRule{Ops: []string{OpGet, OpGetRange}, Probability: 1, Reader: &ReaderFault{Kind: ReaderTruncate}})
+	rc, err := b.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	_, err = io.ReadAll(rc)
+	testutil.Assert(t, errors.Is(err, io.ErrUnexpectedEOF), "expected unexpected EOF, got %v", err)
+	testutil.Ok(t, rc.Close())
+}
+
+func TestRetryBucket_ObjectChangedWhileReading(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("0123456789")))
+	testutil.Ok(t, inmem.ChangeLastModified("obj", time.Now().Add(-time.Minute)))
+
+	faults := WithFaults(inmem, FaultRule{Ops: []string{OpGet}, OnCall: 1, Reader: &ReaderFault{Kind: ReaderTruncate, After: 5}})
+	b := NewRetryBucket(faults, testRetryConfig, nil)
+	rc, err := b.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(rc, buf)
+	testutil.Ok(t, err)
+
+	// The rest of the new version is not appended to the bytes of the previous one.
+	testutil.Ok(t, inmem.Upload(ctx, "obj", strings.NewReader("abcdefghijklmnop")))
+	_, err = io.ReadAll(rc)
+	testutil.Assert(t, errors.Is(err, errObjectChanged), "expected object changed error, got %v", err)
+	testutil.Ok(t, rc.Close())
+}
+
+func TestRetryBucket_Upload(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	faults := WithFaults(inmem)
+	b := NewRetryBucket(faults, testRetryConfig, nil)
+
+	// Seekable readers are rewound.
+	faults.SetRules(FaultRule{Ops: []string{OpUpload}, OnCall: 1, Reader: &ReaderFault{Kind: ReaderTruncate, After: 3}})
+	testutil.Ok(t, b.Upload(ctx, "seekable", strings.NewReader("content")))
+	rc, err := inmem.Get(ctx, "seekable")
+	testutil.Ok(t, err)
+	got, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "content", string(got))
+
+	// Other readers are retried only if they were not read.
+	faults.SetRules(FaultRule{Ops: []string{OpUpload}, OnCall: 1, Err: ErrFaultTransient})
+	testutil.Ok(t, b.Upload(ctx, "unread", io.MultiReader(strings.NewReader("content"))))
+
+	faults.SetRules(FaultRule{Ops: []string{OpUpload}, OnCall: 1, Reader: &ReaderFault{Kind: ReaderTruncate, After: 3}})
+	err = b.Upload(ctx, "partially-read", io.MultiReader(strings.NewReader("content")))
+	testutil.Assert(t, errors.Is(err, io.ErrUnexpectedEOF), "expected unexpected EOF, got %v", err)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(b.retries.WithLabelValues(OpUpload)))
+}
+
+func TestRetryBucket_Backoff(t *testing.T) {
+	b := NewRetryBucket(NewInMemBucket(), RetryConfig{MinBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond}, nil)
+	for retry, expected := range []time.Duration{10, 20, 40, 40} {
+		testutil.Equals(t, expected*time.Millisecond, b.backoff(retry))
+	}
+
+	b = NewRetryBucket(NewInMemBucket(), RetryConfig{MinBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond, Jitter: 0.5}, nil)
+	for i := 0; i < 100; i++ {
+		d := b.backoff(1)
+		testutil.Assert(t, d > 10*time.Millisecond && d <= 20*time.Millisecond, "unexpected backoff %v", d)
+	}
+}
+
+func TestRetryBucket_OnRetry(t *testing.T) {
+	faults := WithFaults(NewInMemBucket(), FaultRule{Ops: []string{OpExists}, OnCall: 1, Err: ErrFaultTransient})
+	cfg := testRetryConfig
+	var events []RetryEvent
+	cfg.OnRetry = func(_ context.Context, e RetryEvent) { events = append(events, e) }
+	b := NewRetryBucket(faults, cfg, nil)
+	_, err := b.Exists(context.Background(), "obj")
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, 1, len(events))
+	testutil.Equals(t, RetryEvent{Op: OpExists, Name: "obj", Retry: 1, Backoff: time.Millisecond, Err: events[0].Err}, events[0])
+	testutil.Assert(t, errors.Is(events[0].Err, ErrFaultTransient), "expected transient error, got %v", events[0].Err)
+}
+
+func TestIsTransientNetworkErr(t *testing.T) {
+	for _, tcase := range []struct {
+		err       error
+		transient bool
+	}{
+		{err: nil},
+		{err: errors.New("some error")},
+		{err: context.Canceled},
+		{err: errors.Wrap(context.DeadlineExceeded, "get")},
+		{err: errors.Wrap(io.ErrUnexpectedEOF, "read"), transient: true},
+		{err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}, transient: true},
+		{err: &net.DNSError{IsTimeout: true}, transient: true},
+		{err: &net.DNSError{IsNotFound: true}},
+	} {
+		testutil.Equals(t, tcase.transient, IsTransientNetworkErr(tcase.err), "%v", tcase.err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// ShardingConfig configures ShardedBucket.
+type ShardingConfig struct {
+	// KeySegments is the number of leading path segments of object names hashed to pick their shard, e.g. 1 keeps all
+	// the objects under the same top level directory in the same shard. 0 hashes the whole name.
+	KeySegments int
+}
+
+// ShardedBucket is a Bucket spreading objects across shards by rendezvous hashing of a part of their name, so that
+// the request rate limits of each shard bucket apply to a part of the objects only.
+//
+// Shards are identified by their position: adding a shard at the end only moves the objects now assigned to it, which
+// Rebalance does. While rebalancing, a FallbackBucket over the new and the previous ShardedBucket keeps the objects
+// readable.
+type ShardedBucket struct {
+	logger log.Logger
+	shards []Bucket
+	cfg    ShardingConfig
+}
+
+// NewShardedBucket returns a ShardedBucket over shards.
+func NewShardedBucket(logger log.Logger, shards []Bucket, cfg ShardingConfig) (*ShardedBucket, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("at least one shard is required")
+	}
+	if cfg.KeySegments < 0 {
+		return nil, errors.Errorf("invalid number of key segments %d", cfg.KeySegments)
+	}
+	return &ShardedBucket{logger: logger, shards: shards, cfg: cfg}, nil
+}
+
+// ShardKey returns the part of name hashed to pick its shard.
+func (b *ShardedBucket) ShardKey(name string) string {
+	if b.cfg.KeySegments == 0 {
+		return name
+	}
+	segments := strings.SplitN(name, DirDelim, b.cfg.KeySegments+1)
+	if len(segments) <= b.cfg.KeySegments {
+		return name
+	}
+	return strings.Join(segments[:b.cfg.KeySegments], DirDelim)
+}
+
+// Shard returns the position of the shard of name.
+func (b *ShardedBucket) Shard(name string) int {
+	return shardOf(b.ShardKey(name), len(b.shards))
+}
+
+// shardOf returns the shard with the highest score for key, so that adding a shard only moves the keys which get it
+// as their highest scoring shard.
+func shardOf(key string, shards int) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	keyHash := h.Sum64()
+
+	best, bestScore := 0, uint64(0)
+	for i := 0; i < shards; i++ {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(i))
+		h.Reset()
+		_, _ = h.Write(buf[:])
+		if score := mix64(keyHash ^ h.Sum64()); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finalizer, spreading the FNV hashes of similar inputs.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// iterShards returns the shards to list for dir: a single one if dir has all the key segments, all of them otherwise.
+func (b *ShardedBucket) iterShards(dir string) []Bucket {
+	dir = strings.TrimSuffix(dir, DirDelim)
+	if b.cfg.KeySegments == 0 || dir == "" || strings.Count(dir, DirDelim)+1 < b.cfg.KeySegments {
+		return b.shards
+	}
+	return []Bucket{b.shards[b.Shard(dir+DirDelim)]}
+}
+
+func (b *ShardedBucket) Provider() ObjProvider { return b.shards[0].Provider() }
+
+// Iter calls f with the entries of all the shards, deduplicated and sorted.
+func (b *ShardedBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return mergedIter(ctx, b.iterShards(dir), dir, f, options...)
+}
+
+// IterWithAttributes calls f with the entries of all the shards, deduplicated and sorted.
+func (b *ShardedBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return mergedIterWithAttributes(ctx, b.iterShards(dir), dir, f, options...)
+}
+
+// SupportedIterOptions returns the options supported by all the shards.
+func (b *ShardedBucket) SupportedIterOptions() []IterOptionType {
+	return commonIterOptions(b.shards)
+}
+
+func (b *ShardedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.shards[b.Shard(name)].Get(ctx, name)
+}
+
+func (b *ShardedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.shards[b.Shard(name)].GetRange(ctx, name, off, length)
+}
+
+func (b *ShardedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.shards[b.Shard(name)].Exists(ctx, name)
+}
+
+func (b *ShardedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	return b.shards[b.Shard(name)].Attributes(ctx, name)
+}
+
+func (b *ShardedBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	return b.shards[b.Shard(name)].Upload(ctx, name, r, opts...)
+}
+
+func (b *ShardedBucket) Delete(ctx context.Context, name string) error {
+	return b.shards[b.Shard(name)].Delete(ctx, name)
+}
+
+// IsObjNotFoundErr returns true if any shard classifies err as not found.
+func (b *ShardedBucket) IsObjNotFoundErr(err error) bool {
+	return slices.ContainsFunc(b.shards, func(bkt Bucket) bool { return bkt.IsObjNotFoundErr(err) })
+}
+
+// IsAccessDeniedErr returns true if any shard classifies err as access denied.
+func (b *ShardedBucket) IsAccessDeniedErr(err error) bool {
+	return slices.ContainsFunc(b.shards, func(bkt Bucket) bool { return bkt.IsAccessDeniedErr(err) })
+}
+
+// IsRetryableErr returns true if any shard classifies err as retryable.
+func (b *ShardedBucket) IsRetryableErr(err error) bool {
+	return slices.ContainsFunc(b.shards, func(bkt Bucket) bool { return IsRetryableErr(bkt, err) })
+}
+
+// Close closes all the shards.
+func (b *ShardedBucket) Close() error { return closeAll(b.shards) }
+
+func (b *ShardedBucket) Name() string { return b.shards[0].Name() }
+
+// Rebalance moves the objects stored in another shard than their own, e.g. after shards were added, and returns the
+// number of objects moved. Objects are copied before being deleted from their previous shard, and objects already in
+// their own shard are kept, as they were written after the shards changed. It is safe to run again after a failure.
+func (b *ShardedBucket) Rebalance(ctx context.Context) (moved int, err error) {
+	for i, shard := range b.shards {
+		var misplaced []string
+		if err := shard.Iter(ctx, "", func(name string) error {
+			if b.Shard(name) != i {
+				misplaced = append(misplaced, name)
+			}
+			return nil
+		}, WithRecursiveIter()); err != nil {
+			return moved, errors.Wrapf(err, "list shard %d", i)
+		}
+
+		for _, name := range misplaced {
+			if err := b.move(ctx, shard, b.shards[b.Shard(name)], name); err != nil {
+				return moved, errors.Wrapf(err, "move %s from shard %d", name, i)
+			}
+			moved++
+		}
+		if len(misplaced) > 0 {
+			level.Info(b.logger).Log("msg", "moved objects to their shard", "shard", i, "objects", len(misplaced))
+		}
+	}
+	return moved, nil
+}
+
+func (b *ShardedBucket) move(ctx context.Context, src, dst Bucket, name string) error {
+	exists, err := dst.Exists(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "check existence in destination shard")
+	}
+	if !exists {
+		if err := copyObject(ctx, src, dst, name); err != nil {
+			if src.IsObjNotFoundErr(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := src.Delete(ctx, name); err != nil && !src.IsObjNotFoundErr(err) {
+		return errors.Wrap(err, "delete from source shard")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+)
+
+func TestShardedBucket_AcceptanceTest(t *testing.T) {
+	for _, segments := range []int{0, 1} {
+		t.Run(fmt.Sprintf("segments=%d", segments), func(t *testing.T) {
+			b, err := NewShardedBucket(log.NewNopLogger(), []Bucket{NewInMemBucket(), NewInMemBucket(), NewInMemBucket()}, ShardingConfig{KeySegments: segments})
+			testutil.Ok(t, err)
+			AcceptanceTest(t, b)
+		})
+	}
+}
+
+func TestShardedBucket_ShardKey(t *testing.T) {
+	b, err := NewShardedBucket(log.NewNopLogger(), []Bucket{NewInMemBucket()}, ShardingConfig{KeySegments: 2})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "a/b", b.ShardKey("a/b/c/d"))
+	testutil.Equals(t, "a/b", b.ShardKey("a/b"))
+	testutil.Equals(t, "a", b.ShardKey("a"))
+
+	_, err = NewShardedBucket(log.NewNopLogger(), nil, ShardingConfig{})
+	testutil.NotOk(t, err)
+}
+
+func TestShardedBucket_Spread(t *testing.T) {
+	ctx := context.Background()
+	shards := []*InMemBucket{NewInMemBucket(), NewInMemBucket(), NewInMemBucket()}
+	b, err := NewShardedBucket(log.NewNopLogger(), []Bucket{shards[0], shards[1], shards[2]}, ShardingConfig{KeySegments: 1})
+	testutil.Ok(t, err)
+
+	for i := 0; i < 30; i++ {
+		for _, obj := range []string{"a", "b"} {
+			testutil.Ok(t, b.Upload(ctx, fmt.Sprintf("tenant-%d/%s", i, obj), strings.NewReader("content")))
+		}
+	}
+	for i, shard := range shards {
+		testutil.Assert(t, len(shard.Objects()) > 0, "expected shard %d to have objects", i)
+		for name := range shard.Objects() {
+			testutil.Equals(t, i, b.Shard(name))
+		}
+	}
+
+	var names []string
+	testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, 30, len(names))
+	testutil.Equals(t, "tenant-0/", names[0])
+	testutil.Equals(t, "tenant-9/", names[29])
+
+	// Directories within a shard key are listed from their shard only.
+	shard := b.Shard("tenant-7/a")
+	testutil.Equals(t, []Bucket{shards[shard]}, b.iterShards("tenant-7"))
+	names = nil
+	testutil.Ok(t, b.Iter(ctx, "tenant-7", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"tenant-7/a", "tenant-7/b"}, names)
+}
+
+func TestShardedBucket_Rebalance(t *testing.T) {
+	ctx := context.Background()
+	shards := []*InMemBucket{NewInMemBucket(), NewInMemBucket(), NewInMemBucket()}
+	before, err := NewShardedBucket(log.NewNopLogger(), []Bucket{shards[0], shards[1]}, ShardingConfig{})
+	testutil.Ok(t, err)
+	for i := 0; i < 100; i++ {
+		testutil.Ok(t, before.Upload(ctx, fmt.Sprintf("obj-%d", i), strings.NewReader(fmt.Sprintf("v%d", i))))
+	}
+
+	after, err := NewShardedBucket(log.NewNopLogger(), []Bucket{shards[0], shards[1], shards[2]}, ShardingConfig{})
+	testutil.Ok(t, err)
+
+	// Until rebalanced, objects are readable through the previous shards.
+	fallback, err := NewFallbackBucket(log.NewNopLogger(), []Bucket{after, before}, FallbackConfig{}, nil)
+	testutil.Ok(t, err)
+	for i := 0; i < 100; i++ {
+		testutil.Equals(t, fmt.Sprintf("v%d", i), readObject(t, fallback, fmt.Sprintf("obj-%d", i)))
+	}
+
+	moved, err := after.Rebalance(ctx)
+	testutil.Ok(t, err)
+	testutil.Assert(t, moved > 0 && moved < 100, "expected some objects to move, got %d", moved)
+	// Only the objects assigned to the new shard moved.
+	testutil.Equals(t, moved, len(shards[2].Objects()))
+	testutil.Equals(t, 100, len(shards[0].Objects())+len(shards[1].Objects())+len(shards[2].Objects()))
+	for i := 0; i < 100; i++ {
+		testutil.Equals(t, fmt.Sprintf("v%d", i), readObject(t, after, fmt.Sprintf("obj-%d", i)))
+	}
+
+	moved, err = after.Rebalance(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, moved)
+}
@@ -0,0 +1,249 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// TieringConfig configures TieredBucket.
+type TieringConfig struct {
+	// DemoteAfter is the age, since their last modification, after which objects are moved to the cold tier.
+	DemoteAfter time.Duration
+	// DemoteInterval is the interval between passes of the background mover. 0 disables it, Demote must then be
+	// called explicitly.
+	DemoteInterval time.Duration
+	// PinnedPrefixes are the prefixes of the objects never moved to the cold tier.
+	PinnedPrefixes []string
+}
+
+// TieredBucket is a Bucket writing to a hot tier and moving the objects older than a threshold to a cold tier, e.g. a
+// cheaper archive store. Reads are served by whichever tier holds the object, hot first, and listings merge both
+// tiers. Deletes go to both tiers.
+type TieredBucket struct {
+	logger log.Logger
+	hot    Bucket
+	cold   Bucket
+	cfg    TieringConfig
+	tiers  *FallbackBucket
+	now    func() time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	demoted           prometheus.Counter
+	demoteFailures    prometheus.Counter
+	lastSuccessfulRun prometheus.Gauge
+}
+
+// NewTieredBucket returns a TieredBucket over the hot and cold buckets, and starts the background mover if
+// cfg.DemoteInterval is set. The hot bucket must support listing with the last modification time.
+func NewTieredBucket(logger log.Logger, hot, cold Bucket, cfg TieringConfig, reg prometheus.Registerer) (*TieredBucket, error) {
+	if cfg.DemoteAfter <= 0 {
+		return nil, errors.New("the age of objects to demote must be positive")
+	}
+	if !slices.Contains(hot.SupportedIterOptions(), UpdatedAt) {
+		return nil, errors.Errorf("hot bucket %s doesn't support listing with the last modification time", hot.Name())
+	}
+	// The metrics of the tiers would collide with the ones of a FallbackBucket registered by the caller.
+	tiers, err := NewFallbackBucket(logger, []Bucket{hot, cold}, FallbackConfig{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &TieredBucket{
+		logger: logger,
+		hot:    hot,
+		cold:   cold,
+		cfg:    cfg,
+		tiers:  tiers,
+		now:    time.Now,
+		cancel: cancel,
+		done:   make(chan struct{}),
+
+		demoted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_tiered_demoted_objects_total",
+			Help: "Total number of objects moved from the hot tier to the cold tier.",
+		}),
+		demoteFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "objstore_bucket_tiered_demotion_failures_total",
+			Help: "Total number of objects which failed to be moved from the hot tier to the cold tier.",
+		}),
+		lastSuccessfulRun: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "objstore_bucket_tiered_last_successful_demotion_timestamp_seconds",
+			Help: "Timestamp of the last pass which moved all the objects due to the cold tier.",
+		}),
+	}
+	if cfg.DemoteInterval <= 0 {
+		close(b.done)
+		return b, nil
+	}
+	go b.run(ctx)
+	return b, nil
+}
+
+func (b *TieredBucket) run(ctx context.Context) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.cfg.DemoteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := b.Demote(ctx); err != nil && ctx.Err() == nil {
+			level.Warn(b.logger).Log("msg", "failed to move objects to the cold tier", "err", err)
+		}
+	}
+}
+
+func (b *TieredBucket) pinned(name string) bool {
+	return slices.ContainsFunc(b.cfg.PinnedPrefixes, func(prefix string) bool { return strings.HasPrefix(name, prefix) })
+}
+
+// Demote moves the objects of the hot tier older than cfg.DemoteAfter, and not pinned, to the cold tier, and returns
+// the number of objects moved. Objects failing to move are retried on the next call.
+func (b *TieredBucket) Demote(ctx context.Context) (demoted int, err error) {
+	threshold := b.now().Add(-b.cfg.DemoteAfter)
+	var candidates []IterObjectAttributes
+	if err := b.hot.IterWithAttributes(ctx, "", func(attrs IterObjectAttributes) error {
+		lastModified, ok := attrs.LastModified()
+		if ok && lastModified.Before(threshold) && !b.pinned(attrs.Name) {
+			candidates = append(candidates, attrs)
+		}
+		return nil
+	}, WithRecursiveIter(), WithUpdatedAt()); err != nil {
+		return 0, errors.Wrap(err, "list hot tier")
+	}
+
+	var failed int
+	for _, attrs := range candidates {
+		if ctx.Err() != nil {
+			return demoted, ctx.Err()
+		}
+		moved, err := b.demote(ctx, attrs.Name, threshold)
+		if err != nil {
+			failed++
+			b.demoteFailures.Inc()
+			level.Warn(b.logger).Log("msg", "failed to move object to the cold tier", "name", attrs.Name, "err", err)
+			continue
+		}
+		if moved {
+			demoted++
+			b.demoted.Inc()
+		}
+	}
+	if failed > 0 {
+		return demoted, errors.Errorf("failed to move %d objects to the cold tier", failed)
+	}
+	b.lastSuccessfulRun.SetToCurrentTime()
+	return demoted, nil
+}
+
+// demote copies the object to the cold tier and deletes it from the hot one, unless it was modified after threshold or
+// while copied. Copies of objects deleted or overwritten while copied are deleted from the cold tier, so that they
+// don't resurrect a deleted object.
+func (b *TieredBucket) demote(ctx context.Context, name string, threshold time.Time) (bool, error) {
+	before, err := b.hot.Attributes(ctx, name)
+	if err != nil {
+		if b.hot.IsObjNotFoundErr(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "get attributes from hot tier")
+	}
+	if !before.LastModified.Before(threshold) {
+		// Overwritten since listed.
+		return false, nil
+	}
+	if err := copyObject(ctx, b.hot, b.cold, name); err != nil {
+		if b.hot.IsObjNotFoundErr(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "copy to cold tier")
+	}
+	attrs, err := b.hot.Attributes(ctx, name)
+	if err != nil && !b.hot.IsObjNotFoundErr(err) {
+		return false, errors.Wrap(err, "get attributes from hot tier")
+	}
+	if err != nil || ObjectVersion(attrs) != ObjectVersion(before) {
+		// Deleted or overwritten while copied, the copy is stale.
+		if err := b.cold.Delete(ctx, name); err != nil && !b.cold.IsObjNotFoundErr(err) {
+			return false, errors.Wrap(err, "delete stale copy from cold tier")
+		}
+		return false, nil
+	}
+	if err := b.hot.Delete(ctx, name); err != nil && !b.hot.IsObjNotFoundErr(err) {
+		return false, errors.Wrap(err, "delete from hot tier")
+	}
+	return true, nil
+}
+
+func (b *TieredBucket) Provider() ObjProvider { return b.hot.Provider() }
+
+// Iter calls f with the entries of both tiers, deduplicated and sorted.
+func (b *TieredBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	return b.tiers.Iter(ctx, dir, f, options...)
+}
+
+// IterWithAttributes calls f with the entries of both tiers, deduplicated and sorted. The attributes of objects in
+// both tiers are the ones of the hot tier.
+func (b *TieredBucket) IterWithAttributes(ctx context.Context, dir string, f func(IterObjectAttributes) error, options ...IterOption) error {
+	return b.tiers.IterWithAttributes(ctx, dir, f, options...)
+}
+
+func (b *TieredBucket) SupportedIterOptions() []IterOptionType { return b.tiers.SupportedIterOptions() }
+
+func (b *TieredBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.tiers.Get(ctx, name)
+}
+
+func (b *TieredBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.tiers.GetRange(ctx, name, off, length)
+}
+
+func (b *TieredBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.tiers.Exists(ctx, name)
+}
+
+func (b *TieredBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	return b.tiers.Attributes(ctx, name)
+}
+
+// Upload writes the object to the hot tier.
+func (b *TieredBucket) Upload(ctx context.Context, name string, r io.Reader, opts ...ObjectUploadOption) error {
+	return b.hot.Upload(ctx, name, r, opts...)
+}
+
+// Delete deletes the object from both tiers.
+func (b *TieredBucket) Delete(ctx context.Context, name string) error {
+	return b.tiers.Delete(ctx, name)
+}
+
+func (b *TieredBucket) IsObjNotFoundErr(err error) bool { return b.tiers.IsObjNotFoundErr(err) }
+
+func (b *TieredBucket) IsAccessDeniedErr(err error) bool { return b.tiers.IsAccessDeniedErr(err) }
+
+func (b *TieredBucket) IsRetryableErr(err error) bool { return b.tiers.IsRetryableErr(err) }
+
+// Close stops the background mover and closes both tiers.
+func (b *TieredBucket) Close() error {
+	b.cancel()
+	<-b.done
+	return b.tiers.Close()
+}
+
+func (b *TieredBucket) Name() string { return b.hot.Name() }
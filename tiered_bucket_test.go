@@ -0,0 +1,148 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTieredBucket_AcceptanceTest(t *testing.T) {
+	b, err := NewTieredBucket(log.NewNopLogger(), NewInMemBucket(), NewInMemBucket(), TieringConfig{DemoteAfter: time.Hour}, nil)
+	testutil.Ok(t, err)
+	AcceptanceTest(t, b)
+}
+
+func TestTieredBucket_Demote(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := NewInMemBucket(), NewInMemBucket()
+	b, err := NewTieredBucket(log.NewNopLogger(), hot, cold, TieringConfig{
+		DemoteAfter:    24 * time.Hour,
+		PinnedPrefixes: []string{"index/"},
+	}, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	now := time.Now()
+	for _, name := range []string{"blocks/old", "blocks/new", "index/old"} {
+		testutil.Ok(t, b.Upload(ctx, name, strings.NewReader(name)))
+		testutil.Ok(t, hot.ChangeLastModified(name, now))
+	}
+	testutil.Ok(t, hot.ChangeLastModified("blocks/old", now.Add(-48*time.Hour)))
+	testutil.Ok(t, hot.ChangeLastModified("index/old", now.Add(-48*time.Hour)))
+	b.now = func() time.Time { return now }
+
+	demoted, err := b.Demote(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, demoted)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(b.demoted))
+	testutil.Equals(t, map[string][]byte{"blocks/old": []byte("blocks/old")}, cold.Objects())
+	testutil.Equals(t, 2, len(hot.Objects()))
+
+	// Demoted objects are still read and listed.
+	testutil.Equals(t, "blocks/old", readObject(t, b, "blocks/old"))
+	var names []string
+	testutil.Ok(t, b.Iter(ctx, "blocks", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{"blocks/new", "blocks/old"}, names)
+
+	demoted, err = b.Demote(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, demoted)
+
+	testutil.Ok(t, b.Delete(ctx, "blocks/old"))
+	testutil.Equals(t, 0, len(cold.Objects()))
+}
+
+func TestTieredBucket_OverwrittenWhileDemoted(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := NewInMemBucket(), NewInMemBucket()
+	old := time.Now().Add(-48 * time.Hour)
+	testutil.Ok(t, hot.Upload(ctx, "obj", strings.NewReader("old content")))
+	testutil.Ok(t, hot.ChangeLastModified("obj", old))
+
+	// The object is overwritten while copied, with the same last modification time.
+	overwriting := &mockBucket{
+		Bucket: hot,
+		get: func(ctx context.Context, name string) (io.ReadCloser, error) {
+			testutil.Ok(t, hot.Upload(ctx, name, strings.NewReader("new")))
+			testutil.Ok(t, hot.ChangeLastModified(name, old))
+			return hot.Get(ctx, name)
+		},
+	}
+	b, err := NewTieredBucket(log.NewNopLogger(), overwriting, cold, TieringConfig{DemoteAfter: 24 * time.Hour}, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	demoted, err := b.Demote(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, demoted)
+	testutil.Equals(t, "new", readObject(t, hot, "obj"))
+	testutil.Equals(t, 0, len(cold.Objects()))
+}
+
+func TestTieredBucket_DeletedWhileDemoted(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := NewInMemBucket(), NewInMemBucket()
+	testutil.Ok(t, hot.Upload(ctx, "obj", strings.NewReader("content")))
+	testutil.Ok(t, hot.ChangeLastModified("obj", time.Now().Add(-48*time.Hour)))
+
+	// The object is deleted from both tiers while copied.
+	deleting := &mockBucket{
+		Bucket: hot,
+		get: func(ctx context.Context, name string) (io.ReadCloser, error) {
+			rc, err := hot.Get(ctx, name)
+			testutil.Ok(t, hot.Delete(ctx, name))
+			return rc, err
+		},
+	}
+	b, err := NewTieredBucket(log.NewNopLogger(), deleting, cold, TieringConfig{DemoteAfter: 24 * time.Hour}, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	demoted, err := b.Demote(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, demoted)
+	testutil.Equals(t, 0, len(cold.Objects()))
+	ok, err := b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected deleted object not to exist")
+}
+
+func TestTieredBucket_Metrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	_, err := NewFallbackBucket(log.NewNopLogger(), []Bucket{NewInMemBucket()}, FallbackConfig{}, reg)
+	testutil.Ok(t, err)
+	b, err := NewTieredBucket(log.NewNopLogger(), NewInMemBucket(), NewInMemBucket(), TieringConfig{DemoteAfter: time.Hour}, reg)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Close())
+}
+
+func TestTieredBucket_BackgroundMover(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := NewInMemBucket(), NewInMemBucket()
+	testutil.Ok(t, hot.Upload(ctx, "obj", strings.NewReader("content")))
+	testutil.Ok(t, hot.ChangeLastModified("obj", time.Now().Add(-2*time.Hour)))
+
+	b, err := NewTieredBucket(log.NewNopLogger(), hot, cold, TieringConfig{DemoteAfter: time.Hour, DemoteInterval: 10 * time.Millisecond}, nil)
+	testutil.Ok(t, err)
+	for len(cold.Objects()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	testutil.Ok(t, b.Close())
+	testutil.Equals(t, 0, len(hot.Objects()))
+
+	_, err = NewTieredBucket(log.NewNopLogger(), hot, cold, TieringConfig{}, nil)
+	testutil.NotOk(t, err)
+}
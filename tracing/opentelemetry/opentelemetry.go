@@ -152,6 +152,10 @@ func (t TracingBucket) IsAccessDeniedErr(err error) bool {
 	return t.bkt.IsAccessDeniedErr(err)
 }
 
+func (t TracingBucket) IsRetryableErr(err error) bool {
+	return objstore.IsRetryableErr(t.bkt, err)
+}
+
 func (t TracingBucket) WithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.Bucket {
 	if ib, ok := t.bkt.(objstore.InstrumentedBucket); ok {
 		return TracingBucket{tracer: t.tracer, bkt: ib.WithExpectedErrs(expectedFunc)}
@@ -163,6 +167,18 @@ func (t TracingBucket) ReaderWithExpectedErrs(expectedFunc objstore.IsOpFailureE
 	return t.WithExpectedErrs(expectedFunc)
 }
 
+// TraceRetry adds the retries of objstore.RetryBucket as events of the span of the context. It is meant to be set as
+// objstore.RetryConfig.OnRetry.
+func TraceRetry(ctx context.Context, e objstore.RetryEvent) {
+	trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+		attribute.String("operation", e.Op),
+		attribute.String("name", e.Name),
+		attribute.Int("retry", e.Retry),
+		attribute.String("backoff", e.Backoff.String()),
+		attribute.String("err", e.Err.Error()),
+	))
+}
+
 type tracingReadCloser struct {
 	r io.ReadCloser
 	s trace.Span
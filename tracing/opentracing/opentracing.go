@@ -142,6 +142,10 @@ func (t TracingBucket) IsAccessDeniedErr(err error) bool {
 	return t.bkt.IsAccessDeniedErr(err)
 }
 
+func (t TracingBucket) IsRetryableErr(err error) bool {
+	return objstore.IsRetryableErr(t.bkt, err)
+}
+
 func (t TracingBucket) WithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.Bucket {
 	if ib, ok := t.bkt.(objstore.InstrumentedBucket); ok {
 		return TracingBucket{bkt: ib.WithExpectedErrs(expectedFunc)}
@@ -153,6 +157,14 @@ func (t TracingBucket) ReaderWithExpectedErrs(expectedFunc objstore.IsOpFailureE
 	return t.WithExpectedErrs(expectedFunc)
 }
 
+// TraceRetry logs the retries of objstore.RetryBucket in the span of the context. It is meant to be set as
+// objstore.RetryConfig.OnRetry.
+func TraceRetry(ctx context.Context, e objstore.RetryEvent) {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.LogKV("event", "retry", "operation", e.Op, "name", e.Name, "retry", e.Retry, "backoff", e.Backoff.String(), "err", e.Err.Error())
+	}
+}
+
 type tracingReadCloser struct {
 	r io.ReadCloser
 	s opentracing.Span
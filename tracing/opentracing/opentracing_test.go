@@ -5,10 +5,15 @@ package opentracing
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
 	"github.com/thanos-io/objstore"
 )
 
@@ -32,3 +37,19 @@ func TestTracingReader(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, int64(11), size)
 }
+
+func TestTraceRetry(t *testing.T) {
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("test")
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+
+	faults := objstore.WithFaults(objstore.NewInMemBucket(), objstore.FaultRule{Ops: []string{objstore.OpExists}, OnCall: 1, Err: objstore.ErrFaultTransient})
+	b := objstore.NewRetryBucket(faults, objstore.RetryConfig{MaxRetries: 1, MinBackoff: time.Millisecond, OnRetry: TraceRetry}, nil)
+	_, err := b.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	span.Finish()
+
+	logs := tracer.FinishedSpans()[0].Logs()
+	testutil.Equals(t, 1, len(logs))
+	testutil.Equals(t, "retry", logs[0].Fields[0].ValueString)
+}